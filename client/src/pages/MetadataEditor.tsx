@@ -18,6 +18,10 @@ interface PdfMetadata {
   creator: string;
   producer: string;
   pages: number;
+  creationDate?: string;
+  modDate?: string;
+  pdfVersion?: string;
+  encrypted?: boolean;
 }
 
 export default function MetadataEditor() {
@@ -18,6 +18,9 @@ interface PagePreview {
 export default function OrganizePdf() {
   const [file, setFile] = useState<File | null>(null);
   const [pages, setPages] = useState<PagePreview[]>([]);
+  // The backend's reference to the previewed upload, so organizing doesn't
+  // upload the file a second time.
+  const [fileId, setFileId] = useState<string | null>(null);
   const [loadingPages, setLoadingPages] = useState(false);
   const [isProcessing, setIsProcessing] = useState(false);
   const [isComplete, setIsComplete] = useState(false);
@@ -40,6 +43,7 @@ export default function OrganizePdf() {
   });
 
   useEffect(() => {
+    setFileId(null);
     if (!file) {
       setPages([]);
       return;
@@ -58,6 +62,7 @@ export default function OrganizePdf() {
 
         if (response.ok) {
           const data = await response.json();
+          setFileId(data.fileId || null);
           if (data.pages) {
             const pagesData = data.pages.map((p: { pageNumber: number; imageUrl: string }) => {
               let url = p.imageUrl;
@@ -122,7 +127,11 @@ export default function OrganizePdf() {
     try {
       const pageOrder = pages.map(p => p.originalPageNumber);
       const formData = new FormData();
-      formData.append("file", file);
+      if (fileId) {
+        formData.append("fileId", fileId);
+      } else {
+        formData.append("file", file);
+      }
       formData.append("order", pageOrder.join(","));
 
       const response = await pdfFetch("/api/pdf/organize", {
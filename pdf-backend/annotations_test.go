@@ -0,0 +1,155 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "math"
+        "os"
+        "path/filepath"
+        "testing"
+
+        "github.com/jung-kurt/gofpdf"
+)
+
+// testPDFFile writes a PDF of two A4 pages to dir as an upload named name.
+func testPDFFile(t *testing.T, dir, name string) OpFile {
+        t.Helper()
+        pdf := gofpdf.New("P", "pt", "A4", "")
+        pdf.SetFont("Helvetica", "", 12)
+        for i := 0; i < 2; i++ {
+                pdf.AddPage()
+                pdf.Text(72, 72, "Some text to annotate")
+        }
+        path := filepath.Join(dir, "input.pdf")
+        if err := pdf.OutputFileAndClose(path); err != nil {
+                t.Fatal(err)
+        }
+        sum, err := hashFile(path)
+        if err != nil {
+                t.Fatal(err)
+        }
+        return OpFile{Path: path, Name: name, SHA256: sum}
+}
+
+// editAnnotations runs edit in annotation mode on a new PDF named name and
+// returns the edited file.
+func editAnnotations(t *testing.T, name, author string, annotations []map[string]any) OpFile {
+        t.Helper()
+        dir := t.TempDir()
+        in := &OpInput{Dir: dir, Files: []OpFile{testPDFFile(t, dir, name)}, Params: map[string]string{
+                "mode":        "annotations",
+                "author":      author,
+                "annotations": mustJSON(t, annotations),
+        }}
+        res, err := runOperation(context.Background(), operations["edit"], in)
+        if err != nil {
+                t.Fatalf("edit: %v", err)
+        }
+        path := filepath.Join(dir, res.File)
+        sum, err := hashFile(path)
+        if err != nil {
+                t.Fatal(err)
+        }
+        return OpFile{Path: path, Name: name, SHA256: sum}
+}
+
+func listAnnotations(t *testing.T, f OpFile) []annotationInfo {
+        t.Helper()
+        res, err := runOperation(context.Background(), operations["annotations"],
+                &OpInput{Dir: filepath.Dir(f.Path), Files: []OpFile{f}, Params: map[string]string{}})
+        if err != nil {
+                t.Fatalf("annotations: %v", err)
+        }
+        // Decode the listing as clients get it, cached or not.
+        var resp annotationsResponse
+        if err := json.Unmarshal([]byte(mustJSON(t, res.Data)), &resp); err != nil {
+                t.Fatal(err)
+        }
+        return resp.Annotations
+}
+
+func mustJSON(t *testing.T, v any) string {
+        t.Helper()
+        b, err := json.Marshal(v)
+        if err != nil {
+                t.Fatal(err)
+        }
+        return string(b)
+}
+
+func TestEditAnnotationsRoundTrip(t *testing.T) {
+        edited := editAnnotations(t, "report.pdf", "Ann", []map[string]any{
+                {"id": "note-1", "type": "note", "page": 1, "x": 10, "y": 20, "content": "Check this", "color": "#ffcc00"},
+                {"id": "box-1", "type": "shape", "shapeType": "rectangle", "page": 1, "x": 10, "y": 30, "width": 40, "height": 10,
+                        "color": "#ff0000", "comment": "Boxed", "opacity": 0.5, "author": "Bo"},
+                {"id": "mark-1", "type": "highlight", "page": 2, "x": 5, "y": 5, "width": 50, "height": 2,
+                        "color": "#ffff00", "comment": "Important"},
+                {"id": "circle-1", "type": "shape", "shapeType": "circle", "page": 2, "x": 60, "y": 60, "width": 20, "height": 20,
+                        "color": "#0000ff"},
+        })
+
+        want := []annotationInfo{
+                {Page: 1, Type: "Text", ID: "note-1", Author: "Ann", Contents: "Check this", Color: "#ffcc00", Opacity: 1, X: 10, Y: 20},
+                {Page: 1, Type: "Square", ID: "box-1", Author: "Bo", Contents: "Boxed", Color: "#ff0000", Opacity: 0.5,
+                        X: 10, Y: 30, Width: 40, Height: 10},
+                {Page: 2, Type: "Highlight", ID: "mark-1", Author: "Ann", Contents: "Important", Color: "#ffff00", Opacity: 1,
+                        X: 5, Y: 5, Width: 50, Height: 2},
+                {Page: 2, Type: "Circle", ID: "circle-1", Author: "Ann", Color: "#0000ff", Opacity: 1,
+                        X: 60, Y: 60, Width: 20, Height: 20},
+        }
+        got := listAnnotations(t, edited)
+        if len(got) != len(want) {
+                t.Fatalf("listed %d annotations, want %d: %+v", len(got), len(want), got)
+        }
+        for i, w := range want {
+                g := got[i]
+                if g.Page != w.Page || g.Type != w.Type || g.ID != w.ID || g.Author != w.Author ||
+                        g.Contents != w.Contents || g.Color != w.Color || g.Opacity != w.Opacity {
+                        t.Errorf("annotation %d = %+v, want %+v", i, g, w)
+                }
+                if g.Created == "" || g.Modified == "" {
+                        t.Errorf("annotation %s has no dates", g.ID)
+                }
+                // Positions survive as percentages of the page, to within rounding.
+                // Notes have an icon of their own size.
+                near := func(a, b float64) bool { return math.Abs(a-b) < 0.02 }
+                if !near(g.X, w.X) || !near(g.Y, w.Y) ||
+                        w.Type != "Text" && (!near(g.Width, w.Width) || !near(g.Height, w.Height)) {
+                        t.Errorf("annotation %s at %v,%v %vx%v, want %v,%v %vx%v",
+                                g.ID, g.X, g.Y, g.Width, g.Height, w.X, w.Y, w.Width, w.Height)
+                }
+        }
+}
+
+func TestAnnotationListingsNotCached(t *testing.T) {
+        useResultCache(t, 1<<30)
+
+        // Two users' files with the same name, each listed twice.
+        mine := editAnnotations(t, "contract.pdf", "Ann", []map[string]any{
+                {"id": "a", "type": "note", "page": 1, "x": 10, "y": 10, "content": "Ann's private note"},
+        })
+        theirs := editAnnotations(t, "contract.pdf", "Bo", []map[string]any{
+                {"id": "b", "type": "note", "page": 1, "x": 10, "y": 10, "content": "Bo's private note"},
+        })
+        for _, f := range []OpFile{mine, theirs, mine, theirs} {
+                got := listAnnotations(t, f)
+                author, contents := "Ann", "Ann's private note"
+                if f == theirs {
+                        author, contents = "Bo", "Bo's private note"
+                }
+                if len(got) != 1 || got[0].Author != author || got[0].Contents != contents {
+                        t.Errorf("listing %s = %+v, want %s's note", f.Path, got, author)
+                }
+        }
+
+        if key := resultCacheKey(operations["annotations"], &OpInput{Files: []OpFile{mine}}); key != "" {
+                t.Errorf("annotations has cache key %s", key)
+        }
+        entries, err := os.ReadDir(resultCache.dir)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if len(entries) != 0 {
+                t.Errorf("%d cache entries hold listings", len(entries))
+        }
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+        "context"
+        "os"
+        "path/filepath"
+        "reflect"
+        "testing"
+
+        "github.com/jung-kurt/gofpdf"
+)
+
+func TestBatchAliasDefaults(t *testing.T) {
+        tests := []struct {
+                operation string
+                params    map[string]string
+                runs      string
+                want      map[string]string
+        }{
+                {operation: "to-jpg", runs: "pdf-to-jpg", want: map[string]string{"all": "true", "dpi": "300"}},
+                {operation: "to-png", runs: "pdf-to-png", want: map[string]string{"dpi": "200"}},
+                {operation: "encrypt", runs: "protect", want: map[string]string{"password": "password"}},
+                {operation: "encrypt", params: map[string]string{"password": "s3cret"}, runs: "protect",
+                        want: map[string]string{"password": "s3cret"}},
+                {operation: "encrypt", params: map[string]string{"password": " "}, runs: "protect",
+                        want: map[string]string{"password": "password"}},
+                {operation: "watermark", runs: "watermark", want: map[string]string{"text": "WATERMARK", "opacity": "0.25"}},
+                {operation: "watermark", params: map[string]string{"text": "DRAFT"}, runs: "watermark",
+                        want: map[string]string{"text": "DRAFT", "opacity": "0.25"}},
+                {operation: "rotate", params: map[string]string{"degrees": "180"}, runs: "rotate",
+                        want: map[string]string{"degrees": "180"}},
+        }
+        for _, tt := range tests {
+                t.Run(tt.operation, func(t *testing.T) {
+                        op := operations[tt.runs]
+                        var got map[string]string
+                        run := op.Run
+                        op.Run = func(ctx context.Context, in *OpInput) (*OpResult, error) {
+                                got = in.Params
+                                if err := os.WriteFile(filepath.Join(in.Dir, "out.pdf"), []byte("%PDF"), 0o644); err != nil {
+                                        return nil, err
+                                }
+                                return fileResult("out.pdf"), nil
+                        }
+                        defer func() { op.Run = run }()
+
+                        // Results must be zipped inside the work directory.
+                        dir := useWorkDir(t)
+                        params := map[string]string{"operation": tt.operation}
+                        for k, v := range tt.params {
+                                params[k] = v
+                        }
+                        pdf := gofpdf.New("P", "pt", "A4", "")
+                        pdf.AddPage()
+                        input := filepath.Join(dir, "input.pdf")
+                        if err := pdf.OutputFileAndClose(input); err != nil {
+                                t.Fatal(err)
+                        }
+                        in := &OpInput{Dir: dir, Files: []OpFile{{Path: input, Name: "a.pdf"}}, Params: params}
+                        res, err := opBatch(context.Background(), in)
+                        if err != nil {
+                                t.Fatalf("opBatch: %v", err)
+                        }
+                        if want := "batch_" + tt.operation + ".zip"; res.File != want {
+                                t.Errorf("File = %q, want %q", res.File, want)
+                        }
+                        delete(got, "operation")
+                        if !reflect.DeepEqual(got, tt.want) {
+                                t.Errorf("%s got params %v, want %v", tt.runs, got, tt.want)
+                        }
+                        if params["password"] == " " && in.Params["password"] != " " {
+                                t.Error("opBatch modified the request parameters")
+                        }
+                })
+        }
+}
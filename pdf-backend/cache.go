@@ -0,0 +1,376 @@
+package main
+
+import (
+        "container/list"
+        "context"
+        "crypto/sha256"
+        "encoding/hex"
+        "encoding/json"
+        "fmt"
+        "log/slog"
+        "os"
+        "path/filepath"
+        "sort"
+        "strings"
+        "sync"
+        "time"
+
+        "go.opentelemetry.io/otel/attribute"
+)
+
+// ==================================================================================
+// Result cache
+// ==================================================================================
+//
+// Operations marked Cacheable (compress, OCR, conversions, ...) are
+// deterministic: the same input files and parameters give the same result. Their
+// results are kept in a content-addressed cache in the work directory, keyed
+// by the SHA-256 of
+//
+//	operation name, the SHA-256 digests of the inputs (in order), and the
+//	normalized parameters (sorted, trimmed, empty ones and request options
+//	such as retention or fileId dropped)
+//
+// A request that hits the cache gets a copy of the stored result without any
+// tool being run. Results are named after the current request's file, as if
+// the operation had run.
+//
+// Configuration:
+//
+//	PDF_RESULT_CACHE_MAX_BYTES  total size of cached results (e.g. "2G",
+//	                            default 1G); the least recently used entries
+//	                            are evicted beyond it. 0 disables the cache.
+//
+// Entries live in <work dir>/.cache/<key>/, outside job retention. Hit, miss,
+// store and eviction counters are reported by /health and /metrics.
+
+const (
+        resultCacheDir       = ".cache"
+        resultCacheEntryFile = "entry.json"
+        // resultCacheVersion is part of every key; bump it when operation output
+        // changes so stale results are no longer served.
+        resultCacheVersion = "1"
+
+        defaultResultCacheMaxBytes = 1 << 30
+)
+
+// requestOptionParams are form values that control how a request is handled
+// rather than what the operation produces, and so are not part of cache keys.
+var requestOptionParams = map[string]bool{
+        "retention":   true,
+        "singleUse":   true,
+        "async":       true,
+        "autoConvert": true,
+        "uploadId":    true,
+        "fileId":      true,
+}
+
+// resultCacheEntry is the stored description of a cached result.
+type resultCacheEntry struct {
+        File      string          `json:"file,omitempty"`      // result file name in the entry directory
+        InputName string          `json:"inputName,omitempty"` // client name of the first input
+        Data      json.RawMessage `json:"data,omitempty"`      // data result
+        CreatedAt time.Time       `json:"createdAt"`
+}
+
+type cacheItem struct {
+        key  string
+        size int64
+}
+
+type resultCacheStore struct {
+        mu       sync.Mutex
+        dir      string
+        maxBytes int64
+        bytes    int64
+        lru      *list.List // of *cacheItem, most recently used first
+        items    map[string]*list.Element
+
+        hits, misses, stores, evictions int64
+}
+
+var resultCache = loadResultCacheConfig()
+
+func loadResultCacheConfig() *resultCacheStore {
+        c := &resultCacheStore{
+                maxBytes: int64(config.Cache.MaxBytes),
+                lru:      list.New(),
+                items:    make(map[string]*list.Element),
+        }
+        return c
+}
+
+// enabled reports whether results are cached: there is a size limit, and
+// load has set up the directory, so nothing is stored before the work
+// directory is known.
+func (c *resultCacheStore) enabled() bool {
+        return c.maxBytes > 0 && c.dir != ""
+}
+
+// load indexes the entries left by a previous run, using their modification
+// time as last use. It must be called once baseWorkDir is final.
+func (c *resultCacheStore) load() {
+        if c.maxBytes <= 0 {
+                slog.Info("result cache disabled", "component", "cache")
+                return
+        }
+        c.dir = filepath.Join(baseWorkDir, resultCacheDir)
+        if err := os.MkdirAll(c.dir, 0o755); err != nil {
+                slog.Error("result cache disabled, cannot create its directory", "component", "cache", "dir", c.dir, "error", err.Error())
+                c.maxBytes = 0
+                return
+        }
+        entries, err := os.ReadDir(c.dir)
+        if err != nil {
+                return
+        }
+        type found struct {
+                key     string
+                size    int64
+                modTime time.Time
+        }
+        var all []found
+        for _, e := range entries {
+                dir := filepath.Join(c.dir, e.Name())
+                info, err := e.Info()
+                if err != nil || !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+                        os.RemoveAll(dir) // partial store from a crash
+                        continue
+                }
+                all = append(all, found{key: e.Name(), size: dirSize(dir), modTime: info.ModTime()})
+        }
+        sort.Slice(all, func(i, j int) bool { return all[i].modTime.After(all[j].modTime) })
+
+        c.mu.Lock()
+        defer c.mu.Unlock()
+        for _, f := range all {
+                c.items[f.key] = c.lru.PushBack(&cacheItem{key: f.key, size: f.size})
+                c.bytes += f.size
+        }
+        c.evictLocked()
+        slog.Info("result cache loaded", "component", "cache", "entries", c.lru.Len(), "bytes", c.bytes, "max_bytes", c.maxBytes)
+}
+
+// resultCacheKey returns the cache key for running op on in, or "" if the
+// result can't be cached (an input without a digest, e.g. a converted file).
+func resultCacheKey(op *Operation, in *OpInput) string {
+        if !op.Cacheable || !resultCache.enabled() || len(in.Files) == 0 {
+                return ""
+        }
+        h := sha256.New()
+        fmt.Fprintf(h, "v%s\nop %s\n", resultCacheVersion, op.Name)
+        for _, f := range in.Files {
+                if f.SHA256 == "" {
+                        return ""
+                }
+                fmt.Fprintf(h, "file %s\n", f.SHA256)
+        }
+        keys := make([]string, 0, len(in.Params))
+        for k, v := range in.Params {
+                if requestOptionParams[k] || strings.HasSuffix(k, "UploadId") || strings.HasSuffix(k, "FileId") ||
+                        strings.TrimSpace(v) == "" {
+                        continue
+                }
+                keys = append(keys, k)
+        }
+        sort.Strings(keys)
+        for _, k := range keys {
+                fmt.Fprintf(h, "param %q %q\n", k, strings.TrimSpace(in.Params[k]))
+        }
+        return hex.EncodeToString(h.Sum(nil))
+}
+
+// runOperation runs op on in, serving and filling the result cache for
+// cacheable operations, and records the run's metrics.
+func runOperation(ctx context.Context, op *Operation, in *OpInput) (_ *OpResult, err error) {
+        ctx, span := startSpan(ctx, "operation "+op.Name, attribute.Int("operation.files", len(in.Files)))
+        defer func() { endSpan(span, err) }()
+        key := resultCacheKey(op, in)
+        span.SetAttributes(attribute.Bool("cache.eligible", key != ""))
+        if key != "" {
+                if res, ok := resultCache.get(key, in); ok {
+                        span.SetAttributes(attribute.Bool("cache.hit", true))
+                        logger(ctx).Info("result cache hit", "component", "cache", "key", key[:12])
+                        observeOperation(op, in, res)
+                        return res, nil
+                }
+        }
+        res, err := op.Run(ctx, in)
+        if err != nil {
+                return nil, err
+        }
+        if key != "" {
+                resultCache.put(key, in, res)
+        }
+        observeOperation(op, in, res)
+        return res, nil
+}
+
+// get materializes the cached result for key in in.Dir.
+func (c *resultCacheStore) get(key string, in *OpInput) (*OpResult, bool) {
+        if !c.enabled() {
+                return nil, false
+        }
+        c.mu.Lock()
+        el, ok := c.items[key]
+        if ok {
+                c.lru.MoveToFront(el)
+        } else {
+                c.misses++
+        }
+        c.mu.Unlock()
+        if !ok {
+                return nil, false
+        }
+
+        // The entry may be evicted meanwhile; that counts as a miss.
+        res, err := c.read(key, in)
+        c.mu.Lock()
+        if err == nil {
+                c.hits++
+        } else {
+                c.misses++
+        }
+        c.mu.Unlock()
+        if err != nil {
+                slog.Error("read cached result failed", "component", "cache", "key", key[:12], "error", err.Error())
+                return nil, false
+        }
+        return res, true
+}
+
+func (c *resultCacheStore) read(key string, in *OpInput) (*OpResult, error) {
+        dir := filepath.Join(c.dir, key)
+        b, err := os.ReadFile(filepath.Join(dir, resultCacheEntryFile))
+        if err != nil {
+                return nil, err
+        }
+        var e resultCacheEntry
+        if err := json.Unmarshal(b, &e); err != nil {
+                return nil, err
+        }
+        now := time.Now()
+        _ = os.Chtimes(dir, now, now)
+        if e.File == "" {
+                return dataResult(e.Data), nil
+        }
+        name := renameCachedResult(e.File, e.InputName, in.File().Name)
+        // Copy rather than link: the job's copy may be edited or handed to later
+        // requests, and must not alter the cached one.
+        if err := copyFileEdit(filepath.Join(dir, e.File), filepath.Join(in.Dir, name)); err != nil {
+                os.Remove(filepath.Join(in.Dir, name))
+                return nil, err
+        }
+        return fileResult(name), nil
+}
+
+// renameCachedResult names a cached result after the current input when it
+// was named after the input it was produced from: "<stem>_<suffix>" (see
+// buildOutputName) or "<stem>.<ext>" (conversions such as pdf-to-word), with
+// the stem from either outputBaseName or baseNameWithoutExt.
+func renameCachedResult(file, cachedInput, input string) string {
+        for _, stem := range []func(string) string{outputBaseName, baseNameWithoutExt} {
+                prefix := stem(cachedInput)
+                if prefix == "" {
+                        continue
+                }
+                rest, ok := strings.CutPrefix(file, prefix)
+                if ok && (strings.HasPrefix(rest, "_") || strings.HasPrefix(rest, ".")) {
+                        return stem(input) + rest
+                }
+        }
+        return file
+}
+
+// put stores res, the result of running in, under key.
+func (c *resultCacheStore) put(key string, in *OpInput, res *OpResult) {
+        if !c.enabled() {
+                return
+        }
+        e := resultCacheEntry{File: res.File, InputName: in.File().Name, CreatedAt: time.Now().UTC()}
+        if res.File == "" {
+                data, err := json.Marshal(res.Data)
+                if err != nil {
+                        return
+                }
+                e.Data = data
+        }
+
+        // Assemble the entry in a temporary directory so that readers never see
+        // a partial one.
+        tmp, err := os.MkdirTemp(c.dir, ".put-")
+        if err != nil {
+                slog.Error("store result failed", "component", "cache", "key", key[:12], "error", err.Error())
+                return
+        }
+        defer os.RemoveAll(tmp)
+        if res.File != "" {
+                if err := copyFileEdit(filepath.Join(in.Dir, res.File), filepath.Join(tmp, res.File)); err != nil {
+                        slog.Error("store result failed", "component", "cache", "key", key[:12], "error", err.Error())
+                        return
+                }
+        }
+        b, _ := json.Marshal(e)
+        if err := os.WriteFile(filepath.Join(tmp, resultCacheEntryFile), b, 0o644); err != nil {
+                slog.Error("store result failed", "component", "cache", "key", key[:12], "error", err.Error())
+                return
+        }
+        size := dirSize(tmp)
+        if size > c.maxBytes {
+                return
+        }
+
+        c.mu.Lock()
+        defer c.mu.Unlock()
+        if _, exists := c.items[key]; exists {
+                return // stored by a concurrent identical request
+        }
+        if err := os.Rename(tmp, filepath.Join(c.dir, key)); err != nil {
+                slog.Error("store result failed", "component", "cache", "key", key[:12], "error", err.Error())
+                return
+        }
+        c.items[key] = c.lru.PushFront(&cacheItem{key: key, size: size})
+        c.bytes += size
+        c.stores++
+        c.evictLocked()
+}
+
+// evictLocked removes least recently used entries until the cache fits its
+// limit.
+func (c *resultCacheStore) evictLocked() {
+        for c.bytes > c.maxBytes && c.lru.Len() > 0 {
+                it := c.lru.Remove(c.lru.Back()).(*cacheItem)
+                delete(c.items, it.key)
+                c.bytes -= it.size
+                c.evictions++
+                if err := os.RemoveAll(filepath.Join(c.dir, it.key)); err != nil {
+                        slog.Error("evict cached result failed", "component", "cache", "key", it.key[:12], "error", err.Error())
+                }
+        }
+}
+
+type resultCacheStats struct {
+        Enabled   bool  `json:"enabled"`
+        Entries   int   `json:"entries"`
+        Bytes     int64 `json:"bytes"`
+        MaxBytes  int64 `json:"maxBytes"`
+        Hits      int64 `json:"hits"`
+        Misses    int64 `json:"misses"`
+        Stores    int64 `json:"stores"`
+        Evictions int64 `json:"evictions"`
+}
+
+func (c *resultCacheStore) stats() resultCacheStats {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+        return resultCacheStats{
+                Enabled:   c.enabled(),
+                Entries:   c.lru.Len(),
+                Bytes:     c.bytes,
+                MaxBytes:  c.maxBytes,
+                Hits:      c.hits,
+                Misses:    c.misses,
+                Stores:    c.stores,
+                Evictions: c.evictions,
+        }
+}
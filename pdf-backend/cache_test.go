@@ -0,0 +1,201 @@
+package main
+
+import (
+        "container/list"
+        "fmt"
+        "os"
+        "path/filepath"
+        "strings"
+        "testing"
+)
+
+// useResultCache replaces the result cache with an empty one of maxBytes in a
+// temporary work directory for the rest of the test.
+func useResultCache(t *testing.T, maxBytes int64) *resultCacheStore {
+        t.Helper()
+        dir := filepath.Join(t.TempDir(), resultCacheDir)
+        if err := os.Mkdir(dir, 0o755); err != nil {
+                t.Fatal(err)
+        }
+        saved := resultCache
+        resultCache = &resultCacheStore{dir: dir, maxBytes: maxBytes, lru: list.New(), items: make(map[string]*list.Element)}
+        t.Cleanup(func() { resultCache = saved })
+        return resultCache
+}
+
+func TestResultCacheKey(t *testing.T) {
+        c := useResultCache(t, 1<<20)
+        op := &Operation{Name: "compress", Cacheable: true}
+        a := OpFile{Name: "a.pdf", SHA256: strings.Repeat("a", 64)}
+        b := OpFile{Name: "b.pdf", SHA256: strings.Repeat("b", 64)}
+        key := func(op *Operation, params map[string]string, files ...OpFile) string {
+                return resultCacheKey(op, &OpInput{Files: files, Params: params})
+        }
+        high := map[string]string{"level": "high"}
+        base := key(op, high, a)
+        if len(base) != 64 {
+                t.Fatalf("key %q", base)
+        }
+
+        tests := []struct {
+                name string
+                key  string
+                same bool // as base; otherwise different and non-empty
+        }{
+                {name: "same request", key: key(op, map[string]string{"level": "high"}, a), same: true},
+                {name: "other file name", key: key(op, high, OpFile{Name: "x.pdf", SHA256: a.SHA256}), same: true},
+                {name: "whitespace", key: key(op, map[string]string{"level": " high\n"}, a), same: true},
+                {name: "empty param", key: key(op, map[string]string{"level": "high", "password": " "}, a), same: true},
+                {name: "request options", key: key(op, map[string]string{"level": "high", "retention": "10m", "async": "true",
+                        "singleUse": "true", "autoConvert": "true", "fileId": "x", "file2FileId": "y", "uploadId": "z", "filesUploadId": "w"}, a), same: true},
+                {name: "other value", key: key(op, map[string]string{"level": "low"}, a)},
+                {name: "extra param", key: key(op, map[string]string{"level": "high", "grayscale": "true"}, a)},
+                {name: "other content", key: key(op, high, b)},
+                {name: "other operation", key: key(&Operation{Name: "ocr", Cacheable: true}, high, a)},
+                {name: "more files", key: key(op, high, a, b)},
+                {name: "file order", key: key(op, high, b, a)},
+        }
+        seen := map[string]string{}
+        for _, tt := range tests {
+                if tt.key == "" || tt.same != (tt.key == base) {
+                        t.Errorf("%s: key %q, base %q", tt.name, tt.key, base)
+                }
+                if !tt.same {
+                        if other, dup := seen[tt.key]; dup {
+                                t.Errorf("%s: same key as %s", tt.name, other)
+                        }
+                        seen[tt.key] = tt.name
+                }
+        }
+
+        for name, k := range map[string]string{
+                "not cacheable":    key(&Operation{Name: "compress"}, high, a),
+                "no input":         key(op, high),
+                "input not hashed": key(op, high, a, OpFile{Name: "converted.pdf"}),
+        } {
+                if k != "" {
+                        t.Errorf("%s: key %q, want none", name, k)
+                }
+        }
+        c.dir = ""
+        if k := key(op, high, a); k != "" {
+                t.Errorf("cache without a directory: key %q, want none", k)
+        }
+}
+
+func TestRenameCachedResult(t *testing.T) {
+        tests := []struct {
+                file, cachedInput, input string
+                want                     string
+        }{
+                {"report_compressed.pdf", "report.pdf", "invoice.pdf", "invoice_compressed.pdf"},
+                {"report.docx", "report.pdf", "invoice.pdf", "invoice.docx"},
+                {"output_compressed.pdf", "input.pdf", "scan.pdf", "scan_compressed.pdf"},
+                {"scan_ocr.pdf", "scan.pdf", "input.pdf", "output_ocr.pdf"},
+                {"images.zip", "report.pdf", "invoice.pdf", "images.zip"},
+                {"reported.pdf", "report.pdf", "invoice.pdf", "reported.pdf"},
+        }
+        for _, tt := range tests {
+                if got := renameCachedResult(tt.file, tt.cachedInput, tt.input); got != tt.want {
+                        t.Errorf("renameCachedResult(%q, %q, %q) = %q, want %q", tt.file, tt.cachedInput, tt.input, got, tt.want)
+                }
+        }
+}
+
+// cacheInput returns an input in a new job directory holding a result file
+// named result with content data.
+func cacheInput(t *testing.T, name, result, data string) *OpInput {
+        t.Helper()
+        in := &OpInput{Dir: t.TempDir(), Files: []OpFile{{Name: name}}}
+        if result != "" {
+                if err := os.WriteFile(filepath.Join(in.Dir, result), []byte(data), 0o644); err != nil {
+                        t.Fatal(err)
+                }
+        }
+        return in
+}
+
+func TestResultCacheStoreAndServe(t *testing.T) {
+        c := useResultCache(t, 1<<20)
+        keyA, keyB := strings.Repeat("a", 64), strings.Repeat("b", 64)
+
+        if _, ok := c.get(keyA, cacheInput(t, "x.pdf", "", "")); ok {
+                t.Fatal("hit in an empty cache")
+        }
+        c.put(keyA, cacheInput(t, "report.pdf", "report_compressed.pdf", "small"), fileResult("report_compressed.pdf"))
+        c.put(keyB, cacheInput(t, "report.pdf", "", ""), dataResult(map[string]int{"pages": 3}))
+
+        in := cacheInput(t, "invoice.pdf", "", "")
+        res, ok := c.get(keyA, in)
+        if !ok || res.File != "invoice_compressed.pdf" {
+                t.Fatalf("get file result = %+v, %v", res, ok)
+        }
+        if b, err := os.ReadFile(filepath.Join(in.Dir, res.File)); err != nil || string(b) != "small" {
+                t.Errorf("served %q, %v", b, err)
+        }
+        // The served copy is the job's own.
+        os.WriteFile(filepath.Join(in.Dir, res.File), []byte("edited"), 0o644)
+        in = cacheInput(t, "invoice.pdf", "", "")
+        if res, _ := c.get(keyA, in); res != nil {
+                if b, _ := os.ReadFile(filepath.Join(in.Dir, res.File)); string(b) != "small" {
+                        t.Errorf("cached result changed to %q", b)
+                }
+        }
+
+        res, ok = c.get(keyB, cacheInput(t, "other.pdf", "", ""))
+        if !ok || res.File != "" || fmt.Sprint(res.Data) != `{"pages":3}` {
+                t.Errorf("get data result = %+v, %v", res, ok)
+        }
+        if st := c.stats(); st.Entries != 2 || st.Hits != 3 || st.Misses != 1 || st.Stores != 2 {
+                t.Errorf("stats %+v", st)
+        }
+}
+
+func TestResultCacheEviction(t *testing.T) {
+        c := useResultCache(t, 1<<20)
+        keys := []string{strings.Repeat("1", 64), strings.Repeat("2", 64), strings.Repeat("3", 64)}
+        put := func(key string) {
+                c.put(key, cacheInput(t, "a.pdf", "a_out.pdf", strings.Repeat("x", 400)), fileResult("a_out.pdf"))
+        }
+        put(keys[0])
+        put(keys[1])
+        entrySize := c.stats().Bytes / 2
+        c.maxBytes = 2*entrySize + entrySize/2
+
+        // Using the first entry makes the second the least recently used.
+        if _, ok := c.get(keys[0], cacheInput(t, "a.pdf", "", "")); !ok {
+                t.Fatal("miss")
+        }
+        put(keys[2])
+        for i, want := range []bool{true, false, true} {
+                _, err := os.Stat(filepath.Join(c.dir, keys[i]))
+                if _, cached := c.items[keys[i]]; cached != want || (err == nil) != want {
+                        t.Errorf("entry %d: indexed %v, on disk %v; want %v", i+1, cached, err == nil, want)
+                }
+        }
+        if st := c.stats(); st.Entries != 2 || st.Evictions != 1 || st.Bytes > c.maxBytes {
+                t.Errorf("stats %+v", st)
+        }
+
+        // A restart indexes the stored entries and drops partial ones.
+        os.Mkdir(filepath.Join(c.dir, ".put-123"), 0o755)
+        reloaded := &resultCacheStore{maxBytes: c.maxBytes, lru: list.New(), items: make(map[string]*list.Element)}
+        defer func(d string) { baseWorkDir = d }(baseWorkDir)
+        baseWorkDir = filepath.Dir(c.dir)
+        reloaded.load()
+        if st := reloaded.stats(); st.Entries != 2 || st.Bytes != c.stats().Bytes {
+                t.Errorf("reloaded stats %+v, want %+v", st, c.stats())
+        }
+        if _, err := os.Stat(filepath.Join(reloaded.dir, ".put-123")); !os.IsNotExist(err) {
+                t.Errorf("partial entry kept: %v", err)
+        }
+}
+
+func TestResultCacheWithoutDirectory(t *testing.T) {
+        c := useResultCache(t, 1<<20)
+        c.dir = ""
+        c.put(strings.Repeat("a", 64), cacheInput(t, "a.pdf", "a_out.pdf", "x"), fileResult("a_out.pdf"))
+        if _, ok := c.get(strings.Repeat("a", 64), cacheInput(t, "a.pdf", "", "")); ok || c.stats().Entries != 0 {
+                t.Errorf("cache without a directory stored a result: %+v", c.stats())
+        }
+}
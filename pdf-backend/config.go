@@ -0,0 +1,576 @@
+package main
+
+import (
+        "errors"
+        "fmt"
+        "io"
+        "log/slog"
+        "os"
+        "runtime"
+        "sort"
+        "strconv"
+        "strings"
+        "time"
+
+        "gopkg.in/yaml.v3"
+)
+
+// ==================================================================================
+// Configuration
+// ==================================================================================
+//
+// Settings are layered, later layers winning:
+//
+//  1. the defaults below
+//  2. the YAML file named by PDF_CONFIG_FILE, if set
+//  3. environment variables
+//
+// The configuration is validated before anything else happens at startup;
+// an invalid value stops the server instead of being ignored. The effective
+// configuration (secrets redacted) is logged at boot.
+//
+// Durations are Go durations ("10m") or plain seconds; sizes are byte counts
+// with an optional K/M/G/T suffix. File keys and their variables:
+//
+//	addr                      PDF_ADDR                      ":8080"
+//	workDir                   PDF_WORK_DIR                  "./work"
+//	planLimitsFile            PDF_PLAN_LIMITS_FILE          shared/planLimits.json (limits.go)
+//	maxUploadBytes            PDF_MAX_UPLOAD_BYTES          0 (no cap)
+//	autoConvert               PDF_AUTO_CONVERT              false
+//	debugErrors               PDF_DEBUG_ERRORS              false
+//	log.level                 PDF_LOG_LEVEL                 info
+//	log.format                PDF_LOG_FORMAT                json (or text)
+//	retention.default         PDF_RETENTION_DEFAULT         2h
+//	retention.max             PDF_RETENTION_MAX             24h
+//	retention.cleanupInterval PDF_CLEANUP_INTERVAL          1m
+//	retention.workDirMaxBytes PDF_WORK_DIR_MAX_BYTES        0 (no limit)
+//	tools.timeout             PDF_TOOL_TIMEOUT              120s
+//	tools.timeouts.<binary>   PDF_TOOL_TIMEOUT_<BINARY>     chromium: 60s
+//	tools.defaultConcurrency  PDF_TOOL_DEFAULT_CONCURRENCY  number of CPUs
+//	tools.concurrency         PDF_TOOL_CONCURRENCY          see scheduler.go
+//	tools.queueMaxDepth       PDF_QUEUE_MAX_DEPTH           64
+//	tools.queueRetryAfter     PDF_QUEUE_RETRY_AFTER         10s
+//	render.previewDPI         PDF_PREVIEW_DPI               110
+//	render.annotateDPI        PDF_ANNOTATE_DPI              150
+//	render.fontFile           PDF_FONT_FILE                 DejaVu Sans, see overlay.go
+//	links.signingKey          PDF_URL_SIGNING_KEY           random per process
+//	links.ttl                 PDF_URL_TTL                   2h
+//	links.singleUse           PDF_URL_SINGLE_USE            false
+//	storage.backend           PDF_STORAGE                   local (or s3)
+//	storage.s3.*              PDF_S3_*                      see storage.go
+//	cache.maxBytes            PDF_RESULT_CACHE_MAX_BYTES    1G (0 disables)
+//	health.interval           PDF_HEALTH_INTERVAL           5m
+//	health.criticalTools      PDF_CRITICAL_TOOLS            see health.go
+//
+// For example:
+//
+//	addr: ":9000"
+//	tools:
+//	  timeouts:
+//	    ocrmypdf: 10m
+//	  concurrency:
+//	    libreoffice: 4
+//	render:
+//	  previewDPI: 96
+
+type Config struct {
+        Addr           string   `yaml:"addr"`
+        WorkDir        string   `yaml:"workDir"`
+        PlanLimitsFile string   `yaml:"planLimitsFile"`
+        MaxUploadBytes byteSize `yaml:"maxUploadBytes"`
+        AutoConvert    bool     `yaml:"autoConvert"`
+        DebugErrors    bool     `yaml:"debugErrors"`
+
+        Log struct {
+                Level  string `yaml:"level"`
+                Format string `yaml:"format"`
+        } `yaml:"log"`
+
+        Retention struct {
+                Default         duration `yaml:"default"`
+                Max             duration `yaml:"max"`
+                CleanupInterval duration `yaml:"cleanupInterval"`
+                WorkDirMaxBytes byteSize `yaml:"workDirMaxBytes"`
+        } `yaml:"retention"`
+
+        Tools struct {
+                Timeout            duration            `yaml:"timeout"`
+                Timeouts           map[string]duration `yaml:"timeouts"`
+                DefaultConcurrency int                 `yaml:"defaultConcurrency"`
+                Concurrency        map[string]int      `yaml:"concurrency"`
+                QueueMaxDepth      int                 `yaml:"queueMaxDepth"`
+                QueueRetryAfter    duration            `yaml:"queueRetryAfter"`
+        } `yaml:"tools"`
+
+        Render struct {
+                PreviewDPI  int    `yaml:"previewDPI"`
+                AnnotateDPI int    `yaml:"annotateDPI"`
+                FontFile    string `yaml:"fontFile"`
+        } `yaml:"render"`
+
+        Links struct {
+                SigningKey string   `yaml:"signingKey"`
+                TTL        duration `yaml:"ttl"`
+                SingleUse  bool     `yaml:"singleUse"`
+        } `yaml:"links"`
+
+        Storage struct {
+                Backend string `yaml:"backend"`
+                S3      struct {
+                        Endpoint       string   `yaml:"endpoint"`
+                        PublicEndpoint string   `yaml:"publicEndpoint"`
+                        Bucket         string   `yaml:"bucket"`
+                        Region         string   `yaml:"region"`
+                        Prefix         string   `yaml:"prefix"`
+                        AccessKey      string   `yaml:"accessKey"`
+                        SecretKey      string   `yaml:"secretKey"`
+                        UseSSL         bool     `yaml:"useSSL"`
+                        Presign        bool     `yaml:"presign"`
+                        PresignTTL     duration `yaml:"presignTTL"`
+                } `yaml:"s3"`
+        } `yaml:"storage"`
+
+        Cache struct {
+                MaxBytes byteSize `yaml:"maxBytes"`
+        } `yaml:"cache"`
+
+        Health struct {
+                Interval      duration `yaml:"interval"`
+                CriticalTools []string `yaml:"criticalTools"`
+        } `yaml:"health"`
+}
+
+const (
+        defaultAddr    = ":8080"
+        defaultWorkDir = "./work"
+
+        defaultPreviewDPI  = 110
+        defaultAnnotateDPI = 150
+
+        minRenderDPI = 36
+        maxRenderDPI = 1200
+
+        defaultToolTimeout     = 120 * time.Second
+        defaultQueueMaxDepth   = 64
+        defaultQueueRetryAfter = 10 * time.Second
+)
+
+var defaultToolTimeouts = map[string]time.Duration{
+        "chromium": 60 * time.Second,
+}
+
+var defaultToolLimits = map[string]int{
+        "libreoffice": 2,
+        "soffice":     2,
+        "gs":          4,
+        "chromium":    1,
+        "ocrmypdf":    2,
+        "pdftoppm":    4,
+        "convert":     4,
+}
+
+// config is loaded before any other package state, so the loaders of the
+// individual features can read it; main refuses to start if configErr is set.
+var config, configFile, configErr = loadConfig()
+
+func defaultConfig() Config {
+        var c Config
+        c.Addr = defaultAddr
+        c.WorkDir = defaultWorkDir
+        c.Log.Level = "info"
+        c.Log.Format = "json"
+
+        c.Retention.Default = duration(defaultRetention)
+        c.Retention.Max = duration(defaultMaxRetention)
+        c.Retention.CleanupInterval = duration(defaultCleanupInterval)
+
+        c.Tools.Timeout = duration(defaultToolTimeout)
+        c.Tools.Timeouts = make(map[string]duration)
+        for name, d := range defaultToolTimeouts {
+                c.Tools.Timeouts[name] = duration(d)
+        }
+        c.Tools.DefaultConcurrency = runtime.NumCPU()
+        c.Tools.Concurrency = make(map[string]int)
+        for name, n := range defaultToolLimits {
+                c.Tools.Concurrency[name] = n
+        }
+        c.Tools.QueueMaxDepth = defaultQueueMaxDepth
+        c.Tools.QueueRetryAfter = duration(defaultQueueRetryAfter)
+
+        c.Render.PreviewDPI = defaultPreviewDPI
+        c.Render.AnnotateDPI = defaultAnnotateDPI
+
+        c.Links.TTL = duration(defaultURLTTL)
+
+        c.Storage.Backend = "local"
+        c.Storage.S3.Region = "us-east-1"
+        c.Storage.S3.UseSSL = true
+        c.Storage.S3.Presign = true
+        c.Storage.S3.PresignTTL = duration(defaultPresignTTL)
+
+        c.Cache.MaxBytes = defaultResultCacheMaxBytes
+
+        c.Health.Interval = duration(defaultHealthInterval)
+        c.Health.CriticalTools = append([]string(nil), defaultCriticalTools...)
+        return c
+}
+
+// loadConfig layers the file and the environment over the defaults. It
+// returns the file it read ("" for none) and every problem found, joined.
+func loadConfig() (Config, string, error) {
+        c := defaultConfig()
+        var errs []error
+
+        path := strings.TrimSpace(os.Getenv("PDF_CONFIG_FILE"))
+        if path != "" {
+                if err := c.loadFile(path); err != nil {
+                        errs = append(errs, err)
+                }
+        }
+        errs = append(errs, c.applyEnv()...)
+        c.normalize()
+        errs = append(errs, c.validate()...)
+        return c, path, errors.Join(errs...)
+}
+
+func (c *Config) loadFile(path string) error {
+        f, err := os.Open(path)
+        if err != nil {
+                return fmt.Errorf("config file: %w", err)
+        }
+        defer f.Close()
+        dec := yaml.NewDecoder(f)
+        dec.KnownFields(true)
+        if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+                return fmt.Errorf("config file %s: %w", path, err)
+        }
+        return nil
+}
+
+// envBindings maps each plain environment variable to the setting it
+// overrides.
+func (c *Config) envBindings() []envBinding {
+        s3 := &c.Storage.S3
+        return []envBinding{
+                {"PDF_ADDR", &c.Addr},
+                {"PDF_WORK_DIR", &c.WorkDir},
+                {"PDF_PLAN_LIMITS_FILE", &c.PlanLimitsFile},
+                {"PDF_MAX_UPLOAD_BYTES", &c.MaxUploadBytes},
+                {"PDF_AUTO_CONVERT", &c.AutoConvert},
+                {"PDF_DEBUG_ERRORS", &c.DebugErrors},
+                {"PDF_LOG_LEVEL", &c.Log.Level},
+                {"PDF_LOG_FORMAT", &c.Log.Format},
+                {"PDF_RETENTION_DEFAULT", &c.Retention.Default},
+                {"PDF_RETENTION_MAX", &c.Retention.Max},
+                {"PDF_CLEANUP_INTERVAL", &c.Retention.CleanupInterval},
+                {"PDF_WORK_DIR_MAX_BYTES", &c.Retention.WorkDirMaxBytes},
+                {"PDF_TOOL_TIMEOUT", &c.Tools.Timeout},
+                {"PDF_TOOL_DEFAULT_CONCURRENCY", &c.Tools.DefaultConcurrency},
+                {"PDF_QUEUE_MAX_DEPTH", &c.Tools.QueueMaxDepth},
+                {"PDF_QUEUE_RETRY_AFTER", &c.Tools.QueueRetryAfter},
+                {"PDF_PREVIEW_DPI", &c.Render.PreviewDPI},
+                {"PDF_ANNOTATE_DPI", &c.Render.AnnotateDPI},
+                {"PDF_FONT_FILE", &c.Render.FontFile},
+                {"PDF_URL_SIGNING_KEY", &c.Links.SigningKey},
+                {"PDF_URL_TTL", &c.Links.TTL},
+                {"PDF_URL_SINGLE_USE", &c.Links.SingleUse},
+                {"PDF_STORAGE", &c.Storage.Backend},
+                {"PDF_S3_ENDPOINT", &s3.Endpoint},
+                {"PDF_S3_PUBLIC_ENDPOINT", &s3.PublicEndpoint},
+                {"PDF_S3_BUCKET", &s3.Bucket},
+                {"PDF_S3_REGION", &s3.Region},
+                {"PDF_S3_PREFIX", &s3.Prefix},
+                {"PDF_S3_ACCESS_KEY", &s3.AccessKey},
+                {"PDF_S3_SECRET_KEY", &s3.SecretKey},
+                {"PDF_S3_USE_SSL", &s3.UseSSL},
+                {"PDF_S3_PRESIGN", &s3.Presign},
+                {"PDF_S3_PRESIGN_TTL", &s3.PresignTTL},
+                {"PDF_RESULT_CACHE_MAX_BYTES", &c.Cache.MaxBytes},
+                {"PDF_HEALTH_INTERVAL", &c.Health.Interval},
+                {"PDF_CRITICAL_TOOLS", &c.Health.CriticalTools},
+        }
+}
+
+type envBinding struct {
+        env string
+        dst any
+}
+
+const toolTimeoutEnvPrefix = "PDF_TOOL_TIMEOUT_"
+
+func (c *Config) applyEnv() []error {
+        var errs []error
+        for _, b := range c.envBindings() {
+                v, ok := os.LookupEnv(b.env)
+                if !ok {
+                        continue
+                }
+                if err := setConfigValue(b.dst, v); err != nil {
+                        errs = append(errs, fmt.Errorf("%s=%q: %w", b.env, v, err))
+                }
+        }
+
+        for _, entry := range strings.Split(os.Getenv("PDF_TOOL_CONCURRENCY"), ",") {
+                entry = strings.TrimSpace(entry)
+                if entry == "" {
+                        continue
+                }
+                name, val, ok := strings.Cut(entry, "=")
+                n, err := strconv.Atoi(strings.TrimSpace(val))
+                if !ok || err != nil {
+                        errs = append(errs, fmt.Errorf("PDF_TOOL_CONCURRENCY entry %q: want binary=limit", entry))
+                        continue
+                }
+                c.Tools.Concurrency[strings.TrimSpace(name)] = n
+        }
+
+        for _, kv := range os.Environ() {
+                key, v, _ := strings.Cut(kv, "=")
+                if !strings.HasPrefix(key, toolTimeoutEnvPrefix) || strings.TrimSpace(v) == "" {
+                        continue
+                }
+                d, err := parseDuration(v)
+                if err != nil {
+                        errs = append(errs, fmt.Errorf("%s=%q: %w", key, v, err))
+                        continue
+                }
+                c.Tools.Timeouts[strings.TrimPrefix(key, toolTimeoutEnvPrefix)] = duration(d)
+        }
+        return errs
+}
+
+// setConfigValue parses an environment value into the setting dst points to.
+// Blank values leave the setting alone, except for lists, where an empty
+// value means "none".
+func setConfigValue(dst any, v string) error {
+        if list, ok := dst.(*[]string); ok {
+                *list = nil
+                for _, s := range strings.Split(v, ",") {
+                        if s = strings.TrimSpace(s); s != "" {
+                                *list = append(*list, s)
+                        }
+                }
+                return nil
+        }
+        v = strings.TrimSpace(v)
+        if v == "" {
+                return nil
+        }
+        switch p := dst.(type) {
+        case *string:
+                *p = v
+        case *bool:
+                b, err := strconv.ParseBool(v)
+                if err != nil {
+                        return errors.New("want true or false")
+                }
+                *p = b
+        case *int:
+                n, err := strconv.Atoi(v)
+                if err != nil {
+                        return errors.New("want an integer")
+                }
+                *p = n
+        case *duration:
+                d, err := parseDuration(v)
+                if err != nil {
+                        return err
+                }
+                *p = duration(d)
+        case *byteSize:
+                n, err := parseByteSize(v)
+                if err != nil {
+                        return errors.New("want a size such as 500M")
+                }
+                *p = byteSize(n)
+        default:
+                panic(fmt.Sprintf("config: unsupported setting type %T", dst))
+        }
+        return nil
+}
+
+// normalize keys the per-tool settings the way toolKey does, whichever layer
+// they came from.
+func (c *Config) normalize() {
+        timeouts := make(map[string]duration, len(c.Tools.Timeouts))
+        for name, d := range c.Tools.Timeouts {
+                timeouts[toolKey(name)] = d
+        }
+        c.Tools.Timeouts = timeouts
+        limits := make(map[string]int, len(c.Tools.Concurrency))
+        for name, n := range c.Tools.Concurrency {
+                limits[toolKey(name)] = n
+        }
+        c.Tools.Concurrency = limits
+        c.Log.Level = strings.ToLower(c.Log.Level)
+        c.Log.Format = strings.ToLower(c.Log.Format)
+        c.Storage.Backend = strings.ToLower(c.Storage.Backend)
+        c.Storage.S3.Prefix = strings.TrimPrefix(c.Storage.S3.Prefix, "/")
+}
+
+func (c *Config) validate() []error {
+        var errs []error
+        check := func(ok bool, format string, args ...any) {
+                if !ok {
+                        errs = append(errs, fmt.Errorf(format, args...))
+                }
+        }
+        check(c.Addr != "", "addr must not be empty")
+        check(c.WorkDir != "", "workDir must not be empty")
+        check(c.MaxUploadBytes >= 0, "maxUploadBytes must not be negative")
+
+        var level slog.Level
+        check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "log.level %q: want debug, info, warn or error", c.Log.Level)
+        check(c.Log.Format == "json" || c.Log.Format == "text", "log.format %q: want json or text", c.Log.Format)
+
+        check(c.Retention.Default > 0, "retention.default must be positive")
+        check(c.Retention.Max >= c.Retention.Default, "retention.max (%s) must not be below retention.default (%s)", c.Retention.Max, c.Retention.Default)
+        check(c.Retention.CleanupInterval > 0, "retention.cleanupInterval must be positive")
+        check(c.Retention.WorkDirMaxBytes >= 0, "retention.workDirMaxBytes must not be negative")
+
+        check(c.Tools.Timeout > 0, "tools.timeout must be positive")
+        for _, name := range sortedKeys(c.Tools.Timeouts) {
+                check(c.Tools.Timeouts[name] > 0, "tools.timeouts.%s must be positive", name)
+        }
+        check(c.Tools.DefaultConcurrency > 0, "tools.defaultConcurrency must be positive")
+        for _, name := range sortedKeys(c.Tools.Concurrency) {
+                check(c.Tools.Concurrency[name] > 0, "tools.concurrency.%s must be positive", name)
+        }
+        check(c.Tools.QueueMaxDepth >= 0, "tools.queueMaxDepth must not be negative")
+        check(c.Tools.QueueRetryAfter >= duration(time.Second), "tools.queueRetryAfter must be at least 1s")
+
+        for _, dpi := range []struct {
+                key string
+                v   int
+        }{
+                {"render.previewDPI", c.Render.PreviewDPI},
+                {"render.annotateDPI", c.Render.AnnotateDPI},
+        } {
+                check(dpi.v >= minRenderDPI && dpi.v <= maxRenderDPI, "%s must be between %d and %d", dpi.key, minRenderDPI, maxRenderDPI)
+        }
+
+        check(c.Links.TTL > 0, "links.ttl must be positive")
+
+        switch c.Storage.Backend {
+        case "local":
+        case "s3":
+                check(c.Storage.S3.Endpoint != "" && c.Storage.S3.Bucket != "", "storage.s3.endpoint and storage.s3.bucket are required for the s3 backend")
+                check(c.Storage.S3.PresignTTL > 0, "storage.s3.presignTTL must be positive")
+        default:
+                check(false, "storage.backend %q: want local or s3", c.Storage.Backend)
+        }
+
+        check(c.Cache.MaxBytes >= 0, "cache.maxBytes must not be negative")
+        check(c.Health.Interval > 0, "health.interval must be positive")
+        return errs
+}
+
+// logEffective logs the configuration in effect, secrets redacted.
+func (c Config) logEffective() {
+        if c.Links.SigningKey != "" {
+                c.Links.SigningKey = redacted
+        }
+        if c.Storage.S3.SecretKey != "" {
+                c.Storage.S3.SecretKey = redacted
+        }
+        var fields map[string]any
+        b, err := yaml.Marshal(c)
+        if err == nil {
+                err = yaml.Unmarshal(b, &fields)
+        }
+        if err != nil {
+                slog.Error("cannot print configuration", "component", "config", "error", err.Error())
+                return
+        }
+        source := configFile
+        if source == "" {
+                source = "defaults and environment"
+        }
+        slog.Info("effective configuration", "component", "config", "source", source, "config", fields)
+}
+
+// toolKey is how per-tool settings are keyed: the binary's base name,
+// lower-cased, with anything but letters and digits turned into "_", so
+// PDF_TOOL_TIMEOUT_OCRMYPDF and tools.timeouts.ocrmypdf name the same tool.
+func toolKey(name string) string {
+        if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+                name = name[i+1:]
+        }
+        return strings.Map(func(r rune) rune {
+                if r >= 'A' && r <= 'Z' {
+                        return r - 'A' + 'a'
+                }
+                if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+                        return r
+                }
+                return '_'
+        }, name)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+        keys := make([]string, 0, len(m))
+        for k := range m {
+                keys = append(keys, k)
+        }
+        sort.Strings(keys)
+        return keys
+}
+
+// ----------------------------------------------------------------------------------
+// Setting types
+// ----------------------------------------------------------------------------------
+
+// duration is a time.Duration written as a Go duration or plain seconds.
+type duration time.Duration
+
+func (d duration) String() string { return time.Duration(d).String() }
+
+func (d duration) MarshalYAML() (any, error) { return d.String(), nil }
+
+func (d *duration) UnmarshalYAML(n *yaml.Node) error {
+        v, err := parseDuration(n.Value)
+        if err != nil {
+                return fmt.Errorf("line %d: %w", n.Line, err)
+        }
+        *d = duration(v)
+        return nil
+}
+
+// parseDuration accepts plain seconds ("90") or a Go duration ("1m30s").
+func parseDuration(s string) (time.Duration, error) {
+        s = strings.TrimSpace(s)
+        if n, err := strconv.Atoi(s); err == nil {
+                return time.Duration(n) * time.Second, nil
+        }
+        d, err := time.ParseDuration(s)
+        if err != nil {
+                return 0, fmt.Errorf("invalid duration %q: use seconds or a duration such as 10m", s)
+        }
+        return d, nil
+}
+
+// byteSize is a size written as parseByteSize accepts it.
+type byteSize int64
+
+func (b byteSize) String() string {
+        for _, u := range []struct {
+                suffix string
+                shift  uint
+        }{{"T", 40}, {"G", 30}, {"M", 20}, {"K", 10}} {
+                if b != 0 && b%(1<<u.shift) == 0 {
+                        return strconv.FormatInt(int64(b>>u.shift), 10) + u.suffix
+                }
+        }
+        return strconv.FormatInt(int64(b), 10)
+}
+
+func (b byteSize) MarshalYAML() (any, error) { return b.String(), nil }
+
+func (b *byteSize) UnmarshalYAML(n *yaml.Node) error {
+        v, err := parseByteSize(n.Value)
+        if err != nil {
+                return fmt.Errorf("line %d: invalid size %q", n.Line, n.Value)
+        }
+        *b = byteSize(v)
+        return nil
+}
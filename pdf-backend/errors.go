@@ -0,0 +1,203 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "net/http"
+        "strings"
+        "sync"
+)
+
+// ==================================================================================
+// Error responses
+// ==================================================================================
+//
+// Every error response has the shape
+//
+//	{"error": "human readable message", "code": "CORRUPT_PDF",
+//	 "param": "pages", "debug": "<tool stderr>"}
+//
+// "code" is stable and meant for clients to branch on; "error" may change.
+// "param" names the offending form parameter when there is one. "debug"
+// carries the output of the external tool that failed and is only included
+// when PDF_DEBUG_ERRORS=true, since it can reveal server paths.
+//
+// Handlers mostly report generic failures ("failed to split PDF"). When such
+// a failure was caused by an external tool, the tool's output is inspected
+// (see classifyToolFailure) so that e.g. an encrypted or damaged input is
+// reported as ENCRYPTED_PDF/CORRUPT_PDF rather than as a server error.
+
+const (
+        codeBadRequest        = "BAD_REQUEST"
+        codeInvalidParam      = "INVALID_PARAM"
+        codeEncryptedPDF      = "ENCRYPTED_PDF"
+        codeCorruptPDF        = "CORRUPT_PDF"
+        codePageOutOfRange    = "PAGE_OUT_OF_RANGE"
+        codeUnsupportedFormat = "UNSUPPORTED_FORMAT"
+        codeLimitExceeded     = "LIMIT_EXCEEDED"
+        codeToolTimeout       = "TOOL_TIMEOUT"
+        codeNotFound          = "NOT_FOUND"
+        codeMethodNotAllowed  = "METHOD_NOT_ALLOWED"
+        codeServerBusy        = "SERVER_BUSY"
+        codeForbidden         = "FORBIDDEN"
+        codeLinkExpired       = "LINK_EXPIRED"
+        codeNoContent         = "NO_CONTENT"
+        codeInternal          = "INTERNAL_ERROR"
+)
+
+// maxDebugOutput caps how much tool output is returned in the debug field.
+const maxDebugOutput = 4000
+
+var debugErrors = config.DebugErrors
+
+// apiError is the JSON body of every error response.
+type apiError struct {
+        Error string `json:"error"`
+        Code  string `json:"code,omitempty"`
+        Param string `json:"param,omitempty"`
+        Debug string `json:"debug,omitempty"`
+}
+
+// defaultErrorCode is the code used when a handler only gives a status.
+func defaultErrorCode(status int) string {
+        switch {
+        case status == http.StatusUnauthorized, status == http.StatusRequestEntityTooLarge:
+                return codeLimitExceeded
+        case status == http.StatusForbidden:
+                return codeForbidden
+        case status == http.StatusNotFound:
+                return codeNotFound
+        case status == http.StatusMethodNotAllowed:
+                return codeMethodNotAllowed
+        case status == http.StatusServiceUnavailable:
+                return codeServerBusy
+        case status == http.StatusGatewayTimeout:
+                return codeToolTimeout
+        case status >= http.StatusInternalServerError:
+                return codeInternal
+        case status >= http.StatusBadRequest:
+                return codeBadRequest
+        }
+        return ""
+}
+
+func writeAPIError(w http.ResponseWriter, status int, e apiError) {
+        if e.Code == "" {
+                e.Code = defaultErrorCode(status)
+        }
+        if !debugErrors {
+                e.Debug = ""
+        }
+        writeJSON(w, status, e)
+}
+
+// paramErrorJSON reports a missing or invalid request parameter.
+func paramErrorJSON(w http.ResponseWriter, param, msg string) {
+        writeAPIError(w, http.StatusBadRequest, apiError{Error: msg, Code: codeInvalidParam, Param: param})
+}
+
+// ----------------------------------------------------------------------------------
+// External tool failures
+// ----------------------------------------------------------------------------------
+
+// toolError is returned by runCommand and friends when a tool fails. It keeps
+// the tool's combined output for classification and debugging.
+type toolError struct {
+        Tool   string
+        Output string
+        Err    error
+}
+
+func (e *toolError) Error() string {
+        return e.Err.Error()
+}
+
+func (e *toolError) Unwrap() error {
+        return e.Err
+}
+
+// toolFailures remembers the most recent tool failure of a request. Handlers
+// often log a tool error and return a generic message; the adapter looks the
+// failure up here to refine that message. A later successful tool run clears
+// it, so a failed attempt followed by a working fallback is not reported.
+type toolFailures struct {
+        mu   sync.Mutex
+        last *toolError
+}
+
+type toolFailuresKey struct{}
+
+func withToolFailures(ctx context.Context) context.Context {
+        return context.WithValue(ctx, toolFailuresKey{}, &toolFailures{})
+}
+
+// noteToolResult records the outcome of a tool run in ctx; te is nil when the
+// tool succeeded.
+func noteToolResult(ctx context.Context, te *toolError) {
+        tf, _ := ctx.Value(toolFailuresKey{}).(*toolFailures)
+        if tf == nil {
+                return
+        }
+        tf.mu.Lock()
+        tf.last = te
+        tf.mu.Unlock()
+}
+
+func lastToolFailure(ctx context.Context) *toolError {
+        tf, _ := ctx.Value(toolFailuresKey{}).(*toolFailures)
+        if tf == nil {
+                return nil
+        }
+        tf.mu.Lock()
+        defer tf.mu.Unlock()
+        return tf.last
+}
+
+var toolFailurePatterns = []struct {
+        code     string
+        msg      string
+        patterns []string
+}{
+        {codeEncryptedPDF, "the PDF is password-protected; unlock it first",
+                []string{"encrypted", "password", "decrypt"}},
+        {codePageOutOfRange, "a requested page does not exist in this PDF",
+                []string{"out of range", "invalid page", "page number", "exceeds page count", "no such page"}},
+        {codeCorruptPDF, "the PDF is damaged or not a valid PDF",
+                []string{"xref", "damaged", "corrupt", "trailer", "syntax error", "not a pdf", "may not be a pdf",
+                        "no pdf header", "eof marker", "unexpected eof", "couldn't read", "invalid pdf"}},
+        {codeUnsupportedFormat, "the file format is not supported",
+                []string{"no decode delegate", "improper image header", "unknown format", "unsupported file format",
+                        "not a supported", "source file could not be loaded"}},
+}
+
+// classifyToolFailure derives a client-facing error from a tool's failure. ok
+// is false for failures that don't point at the input (crashes, missing
+// binaries), which stay internal errors.
+func classifyToolFailure(te *toolError) (status int, e apiError, ok bool) {
+        e.Debug = toolDebugOutput(te)
+        if errors.Is(te.Err, context.DeadlineExceeded) {
+                e.Code, e.Error = codeToolTimeout, "processing took too long and was stopped"
+                return http.StatusGatewayTimeout, e, true
+        }
+        out := strings.ToLower(te.Output)
+        for _, p := range toolFailurePatterns {
+                for _, pat := range p.patterns {
+                        if strings.Contains(out, pat) {
+                                e.Code, e.Error = p.code, p.msg
+                                return http.StatusUnprocessableEntity, e, true
+                        }
+                }
+        }
+        return 0, e, false
+}
+
+func toolDebugOutput(te *toolError) string {
+        out := strings.TrimSpace(te.Output)
+        if len(out) > maxDebugOutput {
+                out = "..." + out[len(out)-maxDebugOutput:]
+        }
+        if out == "" {
+                return te.Tool + ": " + te.Err.Error()
+        }
+        return te.Tool + ": " + out
+}
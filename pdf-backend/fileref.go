@@ -0,0 +1,175 @@
+package main
+
+import (
+        "crypto/hmac"
+        "crypto/sha256"
+        "encoding/base64"
+        "encoding/hex"
+        "errors"
+        "fmt"
+        "io"
+        "net/http"
+        "os"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// ==================================================================================
+// File IDs: reuse a job's input or output in later requests
+// ==================================================================================
+//
+// Results carry a fileId next to their downloadUrl, and previews carry the
+// fileId of the previewed document. Any tool accepts it in place of a
+// multipart file, so a preview → organize → compress flow uploads the
+// document once and never downloads intermediate results:
+//
+//	fileId=<id>          fills the tool's first file field
+//	<field>FileId=<id>   fills a specific field (e.g. file2FileId); repeat it
+//	                     for tools taking several files (filesFileId for merge)
+//
+// A file ID is signed like download links (signing.go), so job IDs alone
+// can't be turned into references to other users' files, and it expires with
+// them (PDF_URL_TTL). The referenced file is linked into the new job; using
+// it restarts the source job's retention clock. Once the source job is gone
+// the reference answers 404.
+
+const urlKindFile = "file"
+
+// fileRef is a file of an earlier job a request refers to.
+type fileRef struct {
+        jobID string
+        file  string // name in the job directory
+        name  string // client-facing name, used to name results
+}
+
+// newFileID returns the ID referring to file in jobID. name is the name
+// later results are named after.
+func newFileID(jobID, file, name string) string {
+        payload := jobID + "/" + file + "\n" + name
+        exp := time.Now().Add(signer.ttl).Unix()
+        return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+                strconv.FormatInt(exp, 10) + "." + signer.mac(urlKindFile, payload, exp, "")
+}
+
+// parseFileID verifies id and returns the file it refers to.
+func parseFileID(id string) (fileRef, error) {
+        parts := strings.Split(id, ".")
+        if len(parts) != 3 {
+                return fileRef{}, errURLInvalid
+        }
+        raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+        if err != nil {
+                return fileRef{}, errURLInvalid
+        }
+        exp, err := strconv.ParseInt(parts[1], 10, 64)
+        if err != nil {
+                return fileRef{}, errURLInvalid
+        }
+        payload := string(raw)
+        if !hmac.Equal([]byte(parts[2]), []byte(signer.mac(urlKindFile, payload, exp, ""))) {
+                return fileRef{}, errURLInvalid
+        }
+        if time.Now().Unix() > exp {
+                return fileRef{}, errURLExpired
+        }
+        rel, name, _ := strings.Cut(payload, "\n")
+        jobID, file, _ := strings.Cut(rel, "/")
+        if _, ok := uploadDir(jobID); !ok || file == "" || file != filepath.Base(file) || strings.HasPrefix(file, ".") {
+                return fileRef{}, errURLInvalid
+        }
+        return fileRef{jobID: jobID, file: file, name: name}, nil
+}
+
+// referencedInputs returns the files r gives for field by reference instead
+// of as multipart parts: resumable uploads (resumable.go) followed by files
+// of earlier jobs. first marks the operation's first file field, which the
+// plain uploadId and fileId parameters fill.
+func referencedInputs(r *http.Request, field string, first, multi bool, dir string) ([]OpFile, error) {
+        files, err := referencedUploads(r, field, first, multi, dir)
+        if err != nil || (len(files) > 0 && !multi) {
+                return files, err
+        }
+
+        var ids []string
+        if first {
+                ids = append(ids, r.Form["fileId"]...)
+        }
+        ids = append(ids, r.Form[field+"FileId"]...)
+        if !multi && len(ids) > 1 {
+                ids = ids[:1]
+        }
+        param := field + "FileId"
+        if _, ok := r.Form[param]; !ok {
+                param = "fileId"
+        }
+        for k, id := range ids {
+                f, err := claimJobFile(r, strings.TrimSpace(id), field, param, filepath.Join(dir, fmt.Sprintf("ref-%s-%d", field, k)))
+                if err != nil {
+                        for _, f := range files {
+                                os.Remove(f.Path)
+                        }
+                        return nil, err
+                }
+                files = append(files, f)
+        }
+        return files, nil
+}
+
+// claimJobFile links the file id refers to into dst.
+func claimJobFile(r *http.Request, id, field, param, dst string) (OpFile, error) {
+        ref, err := parseFileID(id)
+        if err != nil {
+                code := codeInvalidParam
+                if errors.Is(err, errURLExpired) {
+                        code = codeLinkExpired
+                }
+                return OpFile{}, &opError{status: http.StatusBadRequest, code: code, param: param,
+                        msg: "invalid fileId: " + err.Error()}
+        }
+        notFound := &opError{status: http.StatusNotFound, code: codeNotFound, param: param,
+                msg: fmt.Sprintf("file %q not found or expired", ref.name)}
+
+        defer markJobActive(ref.jobID)()
+        src := filepath.Join(baseWorkDir, ref.jobID, ref.file)
+        if err := fetchFile(r.Context(), src); err != nil {
+                if errors.Is(err, errStorageNotFound) {
+                        return OpFile{}, notFound
+                }
+                return OpFile{}, err
+        }
+        fi, err := os.Stat(src)
+        if err != nil || fi.IsDir() {
+                return OpFile{}, notFound
+        }
+        if maxSize := getMaxFileSizeBytes(r); maxSize > 0 && fi.Size() > maxSize {
+                return OpFile{}, fileSizeError(r, ref.name, maxSize)
+        }
+        if err := os.Link(src, dst); err != nil {
+                if err := copyFileEdit(src, dst); err != nil {
+                        return OpFile{}, err
+                }
+        }
+        sum, err := hashFile(dst)
+        if err != nil {
+                return OpFile{}, err
+        }
+        now := time.Now()
+        _ = os.Chtimes(filepath.Dir(src), now, now) // keep the source job alive
+        return OpFile{Path: dst, Name: ref.name, Size: fi.Size(), Field: field, SHA256: sum}, nil
+}
+
+// hashFile returns the hex SHA-256 of the file at path.
+func hashFile(path string) (string, error) {
+        f, err := os.Open(path)
+        if err != nil {
+                return "", err
+        }
+        defer f.Close()
+        h := sha256.New()
+        if _, err := io.Copy(h, f); err != nil {
+                return "", err
+        }
+        return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+        "encoding/base64"
+        "errors"
+        "net/http"
+        "net/http/httptest"
+        "net/url"
+        "os"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "testing"
+        "time"
+
+        "github.com/google/uuid"
+)
+
+// writeJobFile creates file with data in a new job directory and returns the
+// job ID.
+func writeJobFile(t *testing.T, file, data string) string {
+        t.Helper()
+        jobID := uuid.NewString()
+        dir := filepath.Join(baseWorkDir, jobID)
+        if err := os.MkdirAll(dir, 0o755); err != nil {
+                t.Fatal(err)
+        }
+        if err := os.WriteFile(filepath.Join(dir, file), []byte(data), 0o644); err != nil {
+                t.Fatal(err)
+        }
+        return jobID
+}
+
+func TestParseFileID(t *testing.T) {
+        useSigner(t, time.Hour, false)
+        jobID := uuid.NewString()
+        id := newFileID(jobID, "out.pdf", "report.pdf")
+        ref, err := parseFileID(id)
+        if err != nil || ref != (fileRef{jobID: jobID, file: "out.pdf", name: "report.pdf"}) {
+                t.Fatalf("parseFileID = %+v, %v", ref, err)
+        }
+
+        // forge returns a validly signed ID for any payload.
+        forge := func(payload string, exp time.Time) string {
+                return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+                        strconv.FormatInt(exp.Unix(), 10) + "." + signer.mac(urlKindFile, payload, exp.Unix(), "")
+        }
+        later := time.Now().Add(time.Hour)
+        parts := strings.Split(id, ".")
+        tests := []struct {
+                name string
+                id   string
+                want error
+        }{
+                {name: "empty", id: "", want: errURLInvalid},
+                {name: "tampered payload", id: base64.RawURLEncoding.EncodeToString([]byte(uuid.NewString()+"/out.pdf\nreport.pdf")) + "." + parts[1] + "." + parts[2], want: errURLInvalid},
+                {name: "extended expiry", id: parts[0] + "." + strconv.FormatInt(time.Now().Add(48*time.Hour).Unix(), 10) + "." + parts[2], want: errURLInvalid},
+                {name: "download signature", id: parts[0] + "." + parts[1] + "." + signer.mac(urlKindDownload, jobID+"/out.pdf\nreport.pdf", 0, ""), want: errURLInvalid},
+                {name: "expired", id: forge(jobID+"/out.pdf\nreport.pdf", time.Now().Add(-time.Minute)), want: errURLExpired},
+                {name: "not a job", id: forge("../etc/passwd\nx", later), want: errURLInvalid},
+                {name: "nested path", id: forge(jobID+"/a/b.pdf\nb.pdf", later), want: errURLInvalid},
+                {name: "hidden file", id: forge(jobID+"/"+usedNoncesDir+"\nx", later), want: errURLInvalid},
+                {name: "no file", id: forge(jobID+"/\nx", later), want: errURLInvalid},
+        }
+        for _, tt := range tests {
+                if _, err := parseFileID(tt.id); !errors.Is(err, tt.want) {
+                        t.Errorf("%s: error %v, want %v", tt.name, err, tt.want)
+                }
+        }
+}
+
+func TestReferencedInputs(t *testing.T) {
+        useWorkDir(t)
+        useSigner(t, time.Hour, false)
+        first := writeJobFile(t, "out.pdf", "first result")
+        second := writeJobFile(t, "merged.pdf", "second result")
+        firstID := newFileID(first, "out.pdf", "report.pdf")
+        secondID := newFileID(second, "merged.pdf", "merged.pdf")
+        goneID := newFileID(uuid.NewString(), "out.pdf", "gone.pdf")
+
+        tests := []struct {
+                name   string
+                form   url.Values
+                field  string
+                first  bool
+                multi  bool
+                want   []string // names of the files returned
+                status int
+                code   string
+                param  string
+        }{
+                {name: "fileId fills the first field", form: url.Values{"fileId": {firstID}}, field: "file", first: true, want: []string{"report.pdf"}},
+                {name: "fileId leaves other fields", form: url.Values{"fileId": {firstID}}, field: "file2"},
+                {name: "field fileId", form: url.Values{"file2FileId": {secondID}}, field: "file2", want: []string{"merged.pdf"}},
+                {name: "single field keeps the first", form: url.Values{"fileId": {firstID, secondID}}, field: "file", first: true, want: []string{"report.pdf"}},
+                {name: "multi", form: url.Values{"filesFileId": {firstID, secondID}}, field: "files", multi: true, want: []string{"report.pdf", "merged.pdf"}},
+                {name: "source job gone", form: url.Values{"fileId": {goneID}}, field: "file", first: true,
+                        status: http.StatusNotFound, code: codeNotFound, param: "fileId"},
+                {name: "invalid", form: url.Values{"file2FileId": {"nope"}}, field: "file2",
+                        status: http.StatusBadRequest, code: codeInvalidParam, param: "file2FileId"},
+        }
+        contents := map[string]string{"report.pdf": "first result", "merged.pdf": "second result"}
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        r := httptest.NewRequest(http.MethodPost, "/api/pdf/compress", nil)
+                        r.Form = tt.form
+                        files, err := referencedInputs(r, tt.field, tt.first, tt.multi, t.TempDir())
+                        if tt.status != 0 {
+                                var oe *opError
+                                if !errors.As(err, &oe) || oe.status != tt.status || oe.code != tt.code || oe.param != tt.param {
+                                        t.Fatalf("error %#v, want %d %s on %s", err, tt.status, tt.code, tt.param)
+                                }
+                                return
+                        }
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        if len(files) != len(tt.want) {
+                                t.Fatalf("got %d files, want %v", len(files), tt.want)
+                        }
+                        for i, f := range files {
+                                b, _ := os.ReadFile(f.Path)
+                                if f.Name != tt.want[i] || f.Field != tt.field || string(b) != contents[f.Name] ||
+                                        f.SHA256 != sha256Hex(contents[f.Name]) || f.Size != int64(len(b)) {
+                                        t.Errorf("file %d = %+v with %q", i, f, b)
+                                }
+                        }
+                })
+        }
+
+        // Using a file keeps its job alive.
+        old := time.Now().Add(-time.Hour)
+        os.Chtimes(filepath.Join(baseWorkDir, first), old, old)
+        r := httptest.NewRequest(http.MethodPost, "/api/pdf/compress", nil)
+        r.Form = url.Values{"fileId": {firstID}}
+        if _, err := referencedInputs(r, "file", true, false, t.TempDir()); err != nil {
+                t.Fatal(err)
+        }
+        fi, err := os.Stat(filepath.Join(baseWorkDir, first))
+        if err != nil {
+                t.Fatal(err)
+        }
+        if fi.ModTime().Before(time.Now().Add(-time.Minute)) {
+                t.Errorf("source job last modified %v, want now", fi.ModTime())
+        }
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "log/slog"
+        "net/http"
+        "os/exec"
+        "sort"
+        "strings"
+        "sync"
+        "time"
+)
+
+// ==================================================================================
+// Readiness: external toolchain checks
+// ==================================================================================
+//
+// /health only says the process is up. GET /health/ready checks that the
+// tools the operations run (see Operation.Requires) are actually usable: each
+// binary is run with its version flag and each Python module is imported,
+// once at startup and then every PDF_HEALTH_INTERVAL (default 5m).
+//
+// The response lists every dependency with its version or error, and the
+// endpoints that are degraded because something they need is missing. It is
+// 503 until the first check has finished and whenever a critical dependency
+// is missing, so orchestrators stop routing to a broken container:
+//
+//	PDF_CRITICAL_TOOLS  comma-separated dependencies without which the
+//	                    backend is not ready (default
+//	                    "pdfcpu,qpdf,gs,pdftoppm")
+//
+// Missing non-critical dependencies only mark their endpoints degraded.
+
+const (
+        defaultHealthInterval = 5 * time.Minute
+        probeTimeout          = 20 * time.Second
+
+        pythonModulePrefix = "python:"
+)
+
+var defaultCriticalTools = []string{"pdfcpu", "qpdf", "gs", "pdftoppm"}
+
+// versionArgs are the arguments that make a binary print its version and
+// exit; binaries not listed get --version.
+var versionArgs = map[string][]string{
+        "pdfcpu":    {"version"},
+        "pdfinfo":   {"-v"},
+        "pdftoppm":  {"-v"},
+        "pdftotext": {"-v"},
+        "pdftohtml": {"-v"},
+        "pdfimages": {"-v"},
+        "convert":   {"-version"},
+        "identify":  {"-version"},
+}
+
+// endpointRequires lists the tools of endpoints that aren't operations.
+var endpointRequires = map[string][]string{
+        "preview": {"pdftoppm"},
+}
+
+type dependencyStatus struct {
+        OK        bool      `json:"ok"`
+        Critical  bool      `json:"critical,omitempty"`
+        Version   string    `json:"version,omitempty"`
+        Error     string    `json:"error,omitempty"`
+        CheckedAt time.Time `json:"checkedAt"`
+}
+
+type degradedEndpoint struct {
+        Endpoint string   `json:"endpoint"`
+        Missing  []string `json:"missing"`
+}
+
+type readinessResponse struct {
+        Status       string                      `json:"status"` // ready, degraded, unavailable or starting
+        CheckedAt    *time.Time                  `json:"checkedAt,omitempty"`
+        Dependencies map[string]dependencyStatus `json:"dependencies,omitempty"`
+        Degraded     []degradedEndpoint          `json:"degraded,omitempty"`
+        Unavailable  []string                    `json:"unavailable,omitempty"` // missing critical dependencies
+}
+
+type toolchainChecker struct {
+        interval time.Duration
+        critical map[string]bool
+
+        mu        sync.Mutex
+        deps      map[string]dependencyStatus
+        checkedAt time.Time
+}
+
+var toolchain = loadToolchainChecker()
+
+func loadToolchainChecker() *toolchainChecker {
+        c := &toolchainChecker{interval: time.Duration(config.Health.Interval), critical: make(map[string]bool)}
+        for _, n := range config.Health.CriticalTools {
+                if n = strings.TrimSpace(n); n != "" {
+                        c.critical[n] = true
+                }
+        }
+        return c
+}
+
+// dependencies returns every tool and module an endpoint or critical list
+// names.
+func (c *toolchainChecker) dependencies() []string {
+        set := make(map[string]bool)
+        for n := range c.critical {
+                set[n] = true
+        }
+        for _, op := range operations {
+                for _, n := range op.Requires {
+                        set[n] = true
+                }
+        }
+        for _, req := range endpointRequires {
+                for _, n := range req {
+                        set[n] = true
+                }
+        }
+        names := make([]string, 0, len(set))
+        for n := range set {
+                names = append(names, n)
+        }
+        sort.Strings(names)
+        return names
+}
+
+// run checks the toolchain now and then every interval.
+func (c *toolchainChecker) run() {
+        c.check()
+        ticker := time.NewTicker(c.interval)
+        defer ticker.Stop()
+        for range ticker.C {
+                c.check()
+        }
+}
+
+// check probes all dependencies concurrently and logs changes.
+func (c *toolchainChecker) check() {
+        names := c.dependencies()
+        results := make([]dependencyStatus, len(names))
+        var wg sync.WaitGroup
+        for i, name := range names {
+                wg.Add(1)
+                go func(i int, name string) {
+                        defer wg.Done()
+                        results[i] = probeDependency(name)
+                        results[i].Critical = c.critical[name]
+                }(i, name)
+        }
+        wg.Wait()
+
+        c.mu.Lock()
+        prev := c.deps
+        c.deps = make(map[string]dependencyStatus, len(names))
+        for i, name := range names {
+                c.deps[name] = results[i]
+                if old, seen := prev[name]; (!seen && !results[i].OK) || (seen && old.OK != results[i].OK) {
+                        if results[i].OK {
+                                slog.Info("dependency available again", "component", "health", "dependency", name, "version", results[i].Version)
+                        } else {
+                                slog.Error("dependency unavailable", "component", "health", "dependency", name, "error", results[i].Error)
+                        }
+                }
+        }
+        c.checkedAt = time.Now().UTC()
+        c.mu.Unlock()
+}
+
+// probeDependency runs a binary's version command or imports a Python module.
+func probeDependency(name string) dependencyStatus {
+        ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+        defer cancel()
+
+        var cmd *exec.Cmd
+        if mod, ok := strings.CutPrefix(name, pythonModulePrefix); ok {
+                cmd = commandContext(ctx, "python3", "-c",
+                        "import "+mod+"; print(getattr("+mod+", '__version__', 'installed'))")
+        } else {
+                args, ok := versionArgs[name]
+                if !ok {
+                        args = []string{"--version"}
+                }
+                cmd = commandContext(ctx, name, args...)
+        }
+        out, err := cmd.CombinedOutput()
+        st := dependencyStatus{CheckedAt: time.Now().UTC()}
+        if err != nil {
+                switch {
+                case errors.Is(err, exec.ErrNotFound):
+                        st.Error = "not installed"
+                case ctx.Err() != nil:
+                        st.Error = "version check timed out"
+                default:
+                        st.Error = lastLine(string(out)) // e.g. Python's ModuleNotFoundError
+                        if st.Error == "" {
+                                st.Error = err.Error()
+                        }
+                }
+                return st
+        }
+        st.OK = true
+        st.Version = firstLine(string(out))
+        return st
+}
+
+func firstLine(s string) string {
+        s = strings.TrimSpace(s)
+        if i := strings.IndexByte(s, '\n'); i >= 0 {
+                return strings.TrimSpace(s[:i])
+        }
+        return s
+}
+
+func lastLine(s string) string {
+        s = strings.TrimSpace(s)
+        return strings.TrimSpace(s[strings.LastIndexByte(s, '\n')+1:])
+}
+
+// readiness summarizes the last check.
+func (c *toolchainChecker) readiness() readinessResponse {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+        if c.checkedAt.IsZero() {
+                return readinessResponse{Status: "starting"}
+        }
+        checkedAt := c.checkedAt
+        resp := readinessResponse{Status: "ready", CheckedAt: &checkedAt, Dependencies: c.deps}
+
+        missing := func(req []string) []string {
+                var m []string
+                for _, n := range req {
+                        if st, ok := c.deps[n]; ok && !st.OK {
+                                m = append(m, n)
+                        }
+                }
+                return m
+        }
+        for _, name := range operationNames() {
+                if m := missing(operations[name].Requires); len(m) > 0 {
+                        resp.Degraded = append(resp.Degraded, degradedEndpoint{Endpoint: "/api/pdf/" + name, Missing: m})
+                }
+        }
+        for name, req := range endpointRequires {
+                if m := missing(req); len(m) > 0 {
+                        resp.Degraded = append(resp.Degraded, degradedEndpoint{Endpoint: "/api/pdf/" + name, Missing: m})
+                }
+        }
+        sort.Slice(resp.Degraded, func(i, j int) bool { return resp.Degraded[i].Endpoint < resp.Degraded[j].Endpoint })
+        for name, st := range c.deps {
+                if st.Critical && !st.OK {
+                        resp.Unavailable = append(resp.Unavailable, name)
+                }
+        }
+        sort.Strings(resp.Unavailable)
+
+        switch {
+        case len(resp.Unavailable) > 0:
+                resp.Status = "unavailable"
+        case len(resp.Degraded) > 0:
+                resp.Status = "degraded"
+        }
+        return resp
+}
+
+func handleReady(w http.ResponseWriter, r *http.Request) {
+        resp := toolchain.readiness()
+        status := http.StatusOK
+        if resp.Status == "starting" || resp.Status == "unavailable" {
+                status = http.StatusServiceUnavailable
+        }
+        w.Header().Set("Cache-Control", "no-store")
+        writeJSON(w, status, resp)
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "log/slog"
+        "net/http"
+        "os"
+        "path/filepath"
+        "strings"
+        "sync"
+        "time"
+
+        "github.com/google/uuid"
+        "go.opentelemetry.io/otel"
+        "go.opentelemetry.io/otel/attribute"
+        "go.opentelemetry.io/otel/propagation"
+)
+
+// =============================================================================
+// Asynchronous jobs
+// =============================================================================
+//
+// Any tool endpoint can be called with ?async=true. Instead of holding the HTTP
+// connection open until the work is done, the request body is spooled into a
+// fresh job directory, a job ID is returned immediately (202 Accepted) and the
+// original handler is replayed in the background against the spooled body.
+// Clients poll the returned statusUrl for state, progress and the final
+// downloadUrl. The status URL is signed like download links (signing.go), so
+// a job ID alone doesn't reveal another user's job, and it expires with them
+// (PDF_URL_TTL):
+//
+//	GET /api/pdf/jobs/<id>?exp=<unix>&sig=<mac>
+//
+// The downloadUrl is returned as it was issued when the job finished; once it
+// has expired the status endpoint answers 410 instead of renewing it.
+//
+// Job state is persisted as job.json inside the job directory so that it
+// survives a backend restart.
+
+type jobState string
+
+const (
+        jobQueued    jobState = "queued"
+        jobRunning   jobState = "running"
+        jobSucceeded jobState = "succeeded"
+        jobFailed    jobState = "failed"
+)
+
+const (
+        jobStateFile   = "job.json"
+        jobRequestBody = "request.body"
+
+        urlKindJob = "job"
+)
+
+// jobRequest is the part of the original HTTP request needed to replay it.
+type jobRequest struct {
+        Method   string              `json:"method"`
+        Path     string              `json:"path"`
+        RawQuery string              `json:"rawQuery,omitempty"`
+        Host     string              `json:"host,omitempty"`
+        Header   map[string][]string `json:"header,omitempty"`
+}
+
+// jobRecord is the persisted state of an async job.
+type jobRecord struct {
+        ID          string          `json:"id"`
+        Operation   string          `json:"operation"`
+        State       jobState        `json:"state"`
+        Progress    float64         `json:"progress"`
+        Error       string          `json:"error,omitempty"`
+        Code        string          `json:"code,omitempty"`
+        Param       string          `json:"param,omitempty"`
+        DownloadURL string          `json:"downloadUrl,omitempty"`
+        Result      json.RawMessage `json:"result,omitempty"`
+        CreatedAt   time.Time       `json:"createdAt"`
+        StartedAt   *time.Time      `json:"startedAt,omitempty"`
+        FinishedAt  *time.Time      `json:"finishedAt,omitempty"`
+        Request     *jobRequest     `json:"request,omitempty"`
+}
+
+// jobStatusResponse is what GET /api/pdf/jobs/{id} returns.
+type jobStatusResponse struct {
+        ID          string          `json:"id"`
+        Operation   string          `json:"operation"`
+        State       jobState        `json:"state"`
+        Progress    float64         `json:"progress"`
+        Error       string          `json:"error,omitempty"`
+        Code        string          `json:"code,omitempty"`
+        Param       string          `json:"param,omitempty"`
+        DownloadURL string          `json:"downloadUrl,omitempty"`
+        Result      json.RawMessage `json:"result,omitempty"`
+        CreatedAt   time.Time       `json:"createdAt"`
+        StartedAt   *time.Time      `json:"startedAt,omitempty"`
+        FinishedAt  *time.Time      `json:"finishedAt,omitempty"`
+}
+
+type jobSubmitResponse struct {
+        JobID     string   `json:"jobId"`
+        State     jobState `json:"state"`
+        StatusURL string   `json:"statusUrl"`
+}
+
+// asyncJob is the in-memory handle for a job; all mutations go through it so
+// the persisted job.json never sees a torn write.
+type asyncJob struct {
+        mu  sync.Mutex
+        dir string
+        rec jobRecord
+
+        cancel  context.CancelFunc // set while the job is queued or running
+        done    chan struct{}      // closed when runJob returns
+        deleted bool               // purged; state is no longer persisted
+}
+
+var jobRegistry = struct {
+        sync.Mutex
+        jobs map[string]*asyncJob
+}{jobs: make(map[string]*asyncJob)}
+
+// Request headers that are carried over when a job is replayed.
+var jobReplayHeaders = []string{
+        "Content-Type",
+        "X-PDF-User-Plan",
+        "X-PDF-Max-Pages",
+        "X-Forwarded-Proto",
+        requestIDHeader,
+        "Traceparent",
+        "Tracestate",
+}
+
+type jobContextKey struct{}
+
+func withJob(ctx context.Context, job *asyncJob) context.Context {
+        return context.WithValue(ctx, jobContextKey{}, job)
+}
+
+func jobFromContext(ctx context.Context) *asyncJob {
+        job, _ := ctx.Value(jobContextKey{}).(*asyncJob)
+        return job
+}
+
+// setJobProgress records progress (0..1) for the async job running in ctx, if
+// any. It is a no-op for ordinary synchronous requests.
+func setJobProgress(ctx context.Context, progress float64) {
+        job := jobFromContext(ctx)
+        if job == nil {
+                return
+        }
+        if progress < 0 {
+                progress = 0
+        }
+        if progress > 1 {
+                progress = 1
+        }
+        job.update(func(rec *jobRecord) {
+                if rec.State == jobRunning {
+                        rec.Progress = progress
+                }
+        })
+}
+
+func (j *asyncJob) snapshot() jobRecord {
+        j.mu.Lock()
+        defer j.mu.Unlock()
+        return j.rec
+}
+
+func (j *asyncJob) update(fn func(rec *jobRecord)) {
+        j.mu.Lock()
+        defer j.mu.Unlock()
+        fn(&j.rec)
+        if j.deleted {
+                return
+        }
+        if err := writeJobRecord(j.dir, &j.rec); err != nil {
+                slog.Error("persist job failed", "component", "jobs", "job_id", j.rec.ID, "error", err.Error())
+        }
+}
+
+// jobStopTimeout bounds how long deleting a job waits for it to wind down
+// after cancellation.
+const jobStopTimeout = 10 * time.Second
+
+// stop cancels a queued or running job and waits for runJob to return, so the
+// job directory can be removed without the job writing into it again.
+func (j *asyncJob) stop() {
+        j.mu.Lock()
+        j.deleted = true
+        cancel, done := j.cancel, j.done
+        j.mu.Unlock()
+        if cancel == nil {
+                return
+        }
+        cancel()
+        select {
+        case <-done:
+        case <-time.After(jobStopTimeout):
+                slog.Warn("job did not stop in time", "component", "jobs", "job_id", j.rec.ID, "timeout", jobStopTimeout.String())
+        }
+}
+
+// startJob runs job in the background with a context that removeJob can
+// cancel.
+func startJob(job *asyncJob, h http.Handler) {
+        ctx := withJob(context.Background(), job)
+        if req := job.rec.Request; req != nil {
+                // Continue the submitting request's trace and log correlation.
+                ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(req.Header))
+                if ids := req.Header[requestIDHeader]; len(ids) > 0 {
+                        ctx = withLogAttrs(ctx, "request_id", ids[0])
+                }
+        }
+        ctx, span := startSpan(ctx, "async job "+job.rec.Operation, attribute.String("job.id", job.rec.ID))
+        ctx, cancel := context.WithCancel(withLogAttrs(ctx, "async", true))
+        job.mu.Lock()
+        job.cancel = cancel
+        job.done = make(chan struct{})
+        job.mu.Unlock()
+        release := markJobActive(job.rec.ID)
+        go func() {
+                defer close(job.done)
+                defer release()
+                defer cancel()
+                defer span.End()
+                runJob(ctx, job, h)
+        }()
+}
+
+func (rec *jobRecord) status() jobStatusResponse {
+        return jobStatusResponse{
+                ID:          rec.ID,
+                Operation:   rec.Operation,
+                State:       rec.State,
+                Progress:    rec.Progress,
+                Error:       rec.Error,
+                Code:        rec.Code,
+                Param:       rec.Param,
+                DownloadURL: rec.DownloadURL,
+                Result:      rec.Result,
+                CreatedAt:   rec.CreatedAt,
+                StartedAt:   rec.StartedAt,
+                FinishedAt:  rec.FinishedAt,
+        }
+}
+
+func writeJobRecord(dir string, rec *jobRecord) error {
+        b, err := json.MarshalIndent(rec, "", "  ")
+        if err != nil {
+                return err
+        }
+        tmp := filepath.Join(dir, jobStateFile+".tmp")
+        if err := os.WriteFile(tmp, b, 0o644); err != nil {
+                return err
+        }
+        return os.Rename(tmp, filepath.Join(dir, jobStateFile))
+}
+
+func readJobRecord(dir string) (*jobRecord, error) {
+        b, err := os.ReadFile(filepath.Join(dir, jobStateFile))
+        if err != nil {
+                return nil, err
+        }
+        var rec jobRecord
+        if err := json.Unmarshal(b, &rec); err != nil {
+                return nil, err
+        }
+        return &rec, nil
+}
+
+// lookupJob returns the job with the given ID, loading it from its job
+// directory if it is not known in memory (e.g. after a restart).
+func lookupJob(id string) *asyncJob {
+        if _, err := uuid.Parse(id); err != nil {
+                return nil
+        }
+        jobRegistry.Lock()
+        defer jobRegistry.Unlock()
+        if job, ok := jobRegistry.jobs[id]; ok {
+                return job
+        }
+        dir := filepath.Join(baseWorkDir, id)
+        rec, err := readJobRecord(dir)
+        if err != nil {
+                return nil
+        }
+        job := &asyncJob{dir: dir, rec: *rec}
+        jobRegistry.jobs[id] = job
+        return job
+}
+
+// operationFromPath turns "/api/pdf/compress" into "compress".
+func operationFromPath(p string) string {
+        p = strings.TrimPrefix(p, "/api")
+        p = strings.TrimPrefix(p, "/pdf/")
+        return strings.Trim(p, "/")
+}
+
+// withAsyncJobs wraps the mux so that POST requests carrying ?async=true are
+// spooled to a job directory and executed in the background.
+func withAsyncJobs(mux *http.ServeMux) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if r.Method != http.MethodPost || r.URL.Query().Get("async") != "true" {
+                        mux.ServeHTTP(w, r)
+                        return
+                }
+                if _, pattern := mux.Handler(r); pattern == "" {
+                        mux.ServeHTTP(w, r)
+                        return
+                }
+
+                if maxUploadBytes > 0 {
+                        r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+                }
+                job, err := submitJob(r, mux)
+                if err != nil {
+                        var maxErr *http.MaxBytesError
+                        if errors.As(err, &maxErr) {
+                                writeRequestError(w, r, uploadReadError(err))
+                                return
+                        }
+                        logger(r.Context()).Error("submit job failed", "component", "jobs", "error", err.Error())
+                        errorJSON(w, http.StatusInternalServerError, "failed to queue job")
+                        return
+                }
+
+                rec := job.snapshot()
+                writeJSON(w, http.StatusAccepted, jobSubmitResponse{
+                        JobID:     rec.ID,
+                        State:     rec.State,
+                        StatusURL: "/api/pdf/jobs/" + rec.ID + "?" + signer.sign(urlKindJob, rec.ID, ""),
+                })
+        })
+}
+
+// submitJob spools the request body into a new job directory, persists the
+// job as queued and starts it.
+func submitJob(r *http.Request, h http.Handler) (*asyncJob, error) {
+        jobID, dir, err := newJobDir(context.Background())
+        if err != nil {
+                return nil, err
+        }
+
+        body, err := os.Create(filepath.Join(dir, jobRequestBody))
+        if err != nil {
+                return nil, err
+        }
+        _, err = io.Copy(body, r.Body)
+        body.Close()
+        if err != nil {
+                _ = os.RemoveAll(dir)
+                return nil, fmt.Errorf("spool request body: %w", err)
+        }
+
+        q := r.URL.Query()
+        q.Del("async")
+        req := &jobRequest{
+                Method:   r.Method,
+                Path:     r.URL.Path,
+                RawQuery: q.Encode(),
+                Host:     r.Host,
+                Header:   make(map[string][]string),
+        }
+        for _, k := range jobReplayHeaders {
+                if v := r.Header.Values(k); len(v) > 0 {
+                        req.Header[k] = v
+                }
+        }
+
+        job := &asyncJob{
+                dir: dir,
+                rec: jobRecord{
+                        ID:        jobID,
+                        Operation: operationFromPath(r.URL.Path),
+                        State:     jobQueued,
+                        CreatedAt: time.Now().UTC(),
+                        Request:   req,
+                },
+        }
+        if err := writeJobRecord(dir, &job.rec); err != nil {
+                _ = os.RemoveAll(dir)
+                return nil, err
+        }
+
+        jobRegistry.Lock()
+        jobRegistry.jobs[jobID] = job
+        jobRegistry.Unlock()
+
+        startJob(job, h)
+        return job, nil
+}
+
+// jobResponseRecorder captures the replayed handler's response.
+type jobResponseRecorder struct {
+        header http.Header
+        status int
+        body   bytes.Buffer
+}
+
+func (rr *jobResponseRecorder) Header() http.Header {
+        return rr.header
+}
+
+func (rr *jobResponseRecorder) WriteHeader(status int) {
+        if rr.status == 0 {
+                rr.status = status
+        }
+}
+
+func (rr *jobResponseRecorder) Write(b []byte) (int, error) {
+        if rr.status == 0 {
+                rr.status = http.StatusOK
+        }
+        return rr.body.Write(b)
+}
+
+// runJob replays the spooled request against h and records the outcome.
+func runJob(ctx context.Context, job *asyncJob, h http.Handler) {
+        now := time.Now().UTC()
+        job.update(func(rec *jobRecord) {
+                rec.State = jobRunning
+                rec.StartedAt = &now
+                rec.Progress = 0
+        })
+
+        rec := job.snapshot()
+        bodyPath := filepath.Join(job.dir, jobRequestBody)
+        defer os.Remove(bodyPath)
+
+        fail := func(e apiError) {
+                done := time.Now().UTC()
+                job.update(func(rec *jobRecord) {
+                        rec.State = jobFailed
+                        rec.Error = e.Error
+                        rec.Code = e.Code
+                        rec.Param = e.Param
+                        rec.FinishedAt = &done
+                        rec.Request = nil
+                })
+                logger(ctx).Info("job failed", "component", "jobs", "job_id", rec.ID, "operation", rec.Operation, "code", e.Code, "error", e.Error)
+        }
+
+        if rec.Request == nil {
+                fail(apiError{Error: "job request is missing", Code: codeInternal})
+                return
+        }
+        body, err := os.Open(bodyPath)
+        if err != nil {
+                fail(apiError{Error: "job request body is missing", Code: codeInternal})
+                return
+        }
+        defer body.Close()
+
+        target := rec.Request.Path
+        if rec.Request.RawQuery != "" {
+                target += "?" + rec.Request.RawQuery
+        }
+        req, err := http.NewRequestWithContext(ctx, rec.Request.Method, target, body)
+        if err != nil {
+                fail(apiError{Error: "invalid job request", Code: codeInternal})
+                return
+        }
+        req.Host = rec.Request.Host
+        for k, v := range rec.Request.Header {
+                req.Header[http.CanonicalHeaderKey(k)] = v
+        }
+
+        rr := &jobResponseRecorder{header: make(http.Header)}
+        func() {
+                defer func() {
+                        if p := recover(); p != nil {
+                                logger(ctx).Error("job panicked", "component", "jobs", "job_id", rec.ID, "panic", fmt.Sprint(p))
+                                rr.status = http.StatusInternalServerError
+                                rr.body.Reset()
+                        }
+                }()
+                h.ServeHTTP(rr, req)
+        }()
+        if rr.status == 0 {
+                rr.status = http.StatusOK
+        }
+
+        if rr.status < 200 || rr.status >= 300 {
+                var payload apiError
+                if json.Unmarshal(rr.body.Bytes(), &payload) != nil || payload.Error == "" {
+                        payload.Error = http.StatusText(rr.status)
+                }
+                if payload.Code == "" {
+                        payload.Code = defaultErrorCode(rr.status)
+                }
+                fail(payload)
+                return
+        }
+
+        var payload struct {
+                DownloadURL string `json:"downloadUrl"`
+        }
+        _ = json.Unmarshal(rr.body.Bytes(), &payload)
+
+        done := time.Now().UTC()
+        job.update(func(rec *jobRecord) {
+                rec.State = jobSucceeded
+                rec.Progress = 1
+                rec.FinishedAt = &done
+                rec.Request = nil
+                if payload.DownloadURL != "" {
+                        rec.DownloadURL = payload.DownloadURL
+                } else if json.Valid(rr.body.Bytes()) {
+                        rec.Result = json.RawMessage(bytes.TrimSpace(rr.body.Bytes()))
+                }
+        })
+        logger(ctx).Info("job succeeded", "component", "jobs", "job_id", rec.ID, "operation", rec.Operation, "duration_ms", done.Sub(now).Milliseconds())
+}
+
+// recoverJobs reloads persisted jobs after a restart. Jobs that were still
+// queued are started again from their spooled request; jobs that were running
+// when the process died are marked failed since their partial output cannot
+// be trusted.
+func recoverJobs(h http.Handler) {
+        entries, err := os.ReadDir(baseWorkDir)
+        if err != nil {
+                return
+        }
+        for _, e := range entries {
+                if _, err := uuid.Parse(e.Name()); err != nil || !e.IsDir() {
+                        continue
+                }
+                dir := filepath.Join(baseWorkDir, e.Name())
+                rec, err := readJobRecord(dir)
+                if err != nil {
+                        continue
+                }
+                job := &asyncJob{dir: dir, rec: *rec}
+                jobRegistry.Lock()
+                jobRegistry.jobs[rec.ID] = job
+                jobRegistry.Unlock()
+
+                switch rec.State {
+                case jobQueued:
+                        slog.Info("resuming queued job", "component", "jobs", "job_id", rec.ID, "operation", rec.Operation)
+                        startJob(job, h)
+                case jobRunning:
+                        done := time.Now().UTC()
+                        job.update(func(rec *jobRecord) {
+                                rec.State = jobFailed
+                                rec.Error = "job interrupted by backend restart"
+                                rec.Code = codeInternal
+                                rec.FinishedAt = &done
+                                rec.Request = nil
+                        })
+                        _ = os.Remove(filepath.Join(dir, jobRequestBody))
+                }
+        }
+}
+
+// handleJobStatus serves GET on a job's statusUrl and, for purging the job
+// immediately, DELETE on the same signed URL.
+func handleJobStatus(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
+                return
+        }
+        id := r.URL.Path
+        if strings.HasPrefix(id, "/api/pdf/jobs/") {
+                id = strings.TrimPrefix(id, "/api/pdf/jobs/")
+        } else {
+                id = strings.TrimPrefix(id, "/pdf/jobs/")
+        }
+        id = strings.Trim(id, "/")
+
+        if err := signer.verify(r, urlKindJob, id); err != nil {
+                writeURLError(w, r, err)
+                return
+        }
+
+        if r.Method == http.MethodDelete {
+                if _, err := uuid.Parse(id); err != nil || !removeJob(id) {
+                        errorJSON(w, http.StatusNotFound, "job not found")
+                        return
+                }
+                logger(r.Context()).Info("job deleted on request", "component", "jobs", "job_id", id)
+                writeJSON(w, http.StatusOK, map[string]any{"id": id, "deleted": true})
+                return
+        }
+
+        job := lookupJob(id)
+        if job == nil {
+                errorJSON(w, http.StatusNotFound, "job not found")
+                return
+        }
+        rec := job.snapshot()
+        if downloadURLExpired(rec.DownloadURL) {
+                writeURLError(w, r, errURLExpired)
+                return
+        }
+        writeJSON(w, http.StatusOK, rec.status())
+}
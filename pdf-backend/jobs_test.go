@@ -0,0 +1,192 @@
+package main
+
+import (
+        "encoding/json"
+        "io"
+        "net/http"
+        "net/http/httptest"
+        "os"
+        "path/filepath"
+        "strings"
+        "testing"
+        "time"
+
+        "github.com/google/uuid"
+)
+
+// useWorkDir points the work directory and local storage at a fresh temporary
+// directory for the rest of the test.
+func useWorkDir(t *testing.T) string {
+        t.Helper()
+        dir := t.TempDir()
+        oldDir, oldStore := baseWorkDir, store
+        baseWorkDir, store = dir, &localStorage{root: dir}
+        t.Cleanup(func() { baseWorkDir, store = oldDir, oldStore })
+        return dir
+}
+
+// submitAsync posts body to target with async=true through withAsyncJobs.
+func submitAsync(t *testing.T, mux *http.ServeMux, target, body string) jobSubmitResponse {
+        t.Helper()
+        req := httptest.NewRequest(http.MethodPost, target+"?async=true&level=high", strings.NewReader(body))
+        req.Header.Set("Content-Type", "text/plain")
+        req.Header.Set("X-PDF-User-Plan", "pro")
+        rec := httptest.NewRecorder()
+        withAsyncJobs(mux).ServeHTTP(rec, req)
+        if rec.Code != http.StatusAccepted {
+                t.Fatalf("submit: status %d: %s", rec.Code, rec.Body)
+        }
+        var resp jobSubmitResponse
+        if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+                t.Fatal(err)
+        }
+        if resp.State != jobQueued || resp.StatusURL == "" {
+                t.Fatalf("submit response %+v", resp)
+        }
+        return resp
+}
+
+// jobStatus requests statusURL with method.
+func jobStatus(method, statusURL string) *httptest.ResponseRecorder {
+        rec := httptest.NewRecorder()
+        handleJobStatus(rec, httptest.NewRequest(method, statusURL, nil))
+        return rec
+}
+
+// waitJob polls statusURL until the job has finished.
+func waitJob(t *testing.T, statusURL string) jobStatusResponse {
+        t.Helper()
+        deadline := time.Now().Add(5 * time.Second)
+        for {
+                rec := jobStatus(http.MethodGet, statusURL)
+                if rec.Code != http.StatusOK {
+                        t.Fatalf("status: %d: %s", rec.Code, rec.Body)
+                }
+                var st jobStatusResponse
+                if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+                        t.Fatal(err)
+                }
+                if st.State == jobSucceeded || st.State == jobFailed {
+                        return st
+                }
+                if time.Now().After(deadline) {
+                        t.Fatalf("job still %s", st.State)
+                }
+                time.Sleep(10 * time.Millisecond)
+        }
+}
+
+func TestAsyncJobs(t *testing.T) {
+        useWorkDir(t)
+        var gotBody, gotQuery, gotPlan string
+        mux := http.NewServeMux()
+        mux.HandleFunc("/api/pdf/compress", func(w http.ResponseWriter, r *http.Request) {
+                b, _ := io.ReadAll(r.Body)
+                gotBody, gotQuery, gotPlan = string(b), r.URL.RawQuery, r.Header.Get("X-PDF-User-Plan")
+                setJobProgress(r.Context(), 0.5)
+                writeJSON(w, http.StatusOK, map[string]string{"downloadUrl": "/downloads/x/out.pdf"})
+        })
+        mux.HandleFunc("/api/pdf/info", func(w http.ResponseWriter, r *http.Request) {
+                writeJSON(w, http.StatusOK, map[string]int{"pages": 3})
+        })
+        mux.HandleFunc("/api/pdf/merge", func(w http.ResponseWriter, r *http.Request) {
+                errorJSON(w, http.StatusBadRequest, "need two files")
+        })
+        mux.HandleFunc("/api/pdf/split", func(w http.ResponseWriter, r *http.Request) {
+                panic("boom")
+        })
+
+        tests := []struct {
+                target   string
+                state    jobState
+                download string
+                result   string
+                errText  string
+        }{
+                {target: "/api/pdf/compress", state: jobSucceeded, download: "/downloads/x/out.pdf"},
+                {target: "/api/pdf/info", state: jobSucceeded, result: `{"pages":3}`},
+                {target: "/api/pdf/merge", state: jobFailed, errText: "need two files"},
+                {target: "/api/pdf/split", state: jobFailed, errText: "Internal Server Error"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.target, func(t *testing.T) {
+                        sub := submitAsync(t, mux, tt.target, "payload")
+                        st := waitJob(t, sub.StatusURL)
+                        if st.ID != sub.JobID || st.Operation != strings.TrimPrefix(tt.target, "/api/pdf/") {
+                                t.Errorf("status %+v for job %s", st, sub.JobID)
+                        }
+                        if st.State != tt.state || st.DownloadURL != tt.download || string(st.Result) != tt.result || st.Error != tt.errText {
+                                t.Errorf("status = %+v", st)
+                        }
+                        if st.State == jobSucceeded && st.Progress != 1 {
+                                t.Errorf("progress = %v, want 1", st.Progress)
+                        }
+                        if st.StartedAt == nil || st.FinishedAt == nil {
+                                t.Errorf("missing timestamps: %+v", st)
+                        }
+                        if _, err := os.Stat(filepath.Join(baseWorkDir, sub.JobID, jobRequestBody)); !os.IsNotExist(err) {
+                                t.Errorf("spooled request body kept: %v", err)
+                        }
+                })
+        }
+        if gotBody != "payload" || gotQuery != "level=high" || gotPlan != "pro" {
+                t.Errorf("replayed request: body %q, query %q, plan %q", gotBody, gotQuery, gotPlan)
+        }
+}
+
+func TestRecoverJobs(t *testing.T) {
+        useWorkDir(t)
+        ran := make(chan string, 1)
+        mux := http.NewServeMux()
+        mux.HandleFunc("/api/pdf/compress", func(w http.ResponseWriter, r *http.Request) {
+                b, _ := io.ReadAll(r.Body)
+                ran <- string(b)
+                writeJSON(w, http.StatusOK, map[string]string{"downloadUrl": "/downloads/y/out.pdf"})
+        })
+
+        newJob := func(state jobState) string {
+                id := uuid.NewString()
+                dir := filepath.Join(baseWorkDir, id)
+                if err := os.MkdirAll(dir, 0o755); err != nil {
+                        t.Fatal(err)
+                }
+                if err := os.WriteFile(filepath.Join(dir, jobRequestBody), []byte("spooled"), 0o644); err != nil {
+                        t.Fatal(err)
+                }
+                rec := &jobRecord{ID: id, Operation: "compress", State: state, CreatedAt: time.Now().UTC(),
+                        Request: &jobRequest{Method: http.MethodPost, Path: "/api/pdf/compress"}}
+                if err := writeJobRecord(dir, rec); err != nil {
+                        t.Fatal(err)
+                }
+                return id
+        }
+        queued := newJob(jobQueued)
+        running := newJob(jobRunning)
+
+        recoverJobs(mux)
+        select {
+        case body := <-ran:
+                if body != "spooled" {
+                        t.Errorf("resumed job got body %q", body)
+                }
+        case <-time.After(5 * time.Second):
+                t.Fatal("queued job was not resumed")
+        }
+
+        for id, want := range map[string]jobState{queued: jobSucceeded, running: jobFailed} {
+                job := lookupJob(id)
+                if job == nil {
+                        t.Fatalf("job %s not registered", id)
+                }
+                deadline := time.Now().Add(5 * time.Second)
+                for job.snapshot().State != want && time.Now().Before(deadline) {
+                        time.Sleep(10 * time.Millisecond)
+                }
+                if rec := job.snapshot(); rec.State != want {
+                        t.Errorf("job %s: state %s, want %s", id, rec.State, want)
+                }
+        }
+        if _, err := os.Stat(filepath.Join(baseWorkDir, running, jobRequestBody)); !os.IsNotExist(err) {
+                t.Errorf("interrupted job kept its request body: %v", err)
+        }
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "net/http"
+        "os"
+        "strconv"
+        "strings"
+)
+
+// ==================================================================================
+// Plan limits
+// ==================================================================================
+//
+// The per-plan limits live in shared/planLimits.json, which the Node proxy
+// reads too, so both sides agree on them. A null limit means unlimited.
+// PDF_PLAN_LIMITS_FILE overrides the location; by default the file is looked
+// up relative to the working directory (../shared when started from
+// pdf-backend, as the proxy does, or shared/ from the repository root).
+//
+// The proxy names the caller's plan in X-PDF-User-Plan and its page limit in
+// X-PDF-Max-Pages. Requests without them (or with an unknown plan) get the
+// anonymous limits. Page counts are checked on every PDF input before the
+// operation runs; merges and other multi-file tools count all inputs
+// together.
+
+const planAnonymous = "anonymous"
+
+type planLimit struct {
+        MaxOpsPerDay  *int     `json:"maxOpsPerDay"`
+        MaxFileSizeMB *float64 `json:"maxFileSizeMB"`
+        MaxPages      *int     `json:"maxPages"`
+}
+
+// maxFileSizeBytes returns the per-file size limit, 0 for unlimited.
+func (l planLimit) maxFileSizeBytes() int64 {
+        if l.MaxFileSizeMB == nil {
+                return 0
+        }
+        return int64(*l.MaxFileSizeMB * 1024 * 1024)
+}
+
+// maxPages returns the page limit, 0 for unlimited.
+func (l planLimit) maxPages() int {
+        if l.MaxPages == nil {
+                return 0
+        }
+        return *l.MaxPages
+}
+
+// planLimits is keyed by plan name; main loads it at startup.
+var planLimits map[string]planLimit
+
+var planLimitsPaths = []string{"../shared/planLimits.json", "shared/planLimits.json"}
+
+func loadPlanLimits() (map[string]planLimit, string, error) {
+        paths := planLimitsPaths
+        if p := strings.TrimSpace(config.PlanLimitsFile); p != "" {
+                paths = []string{p}
+        }
+        for _, p := range paths {
+                b, err := os.ReadFile(p)
+                if errors.Is(err, os.ErrNotExist) && len(paths) > 1 {
+                        continue
+                }
+                if err != nil {
+                        return nil, p, err
+                }
+                var limits map[string]planLimit
+                if err := json.Unmarshal(b, &limits); err != nil {
+                        return nil, p, fmt.Errorf("parse %s: %w", p, err)
+                }
+                if _, ok := limits[planAnonymous]; !ok {
+                        return nil, p, fmt.Errorf("%s has no %q plan", p, planAnonymous)
+                }
+                return limits, p, nil
+        }
+        return nil, "", fmt.Errorf("plan limits not found in %s; set PDF_PLAN_LIMITS_FILE", strings.Join(paths, ", "))
+}
+
+// requestPlan returns the plan named by the proxy, falling back to anonymous.
+func requestPlan(r *http.Request) string {
+        plan := r.Header.Get("X-PDF-User-Plan")
+        if _, ok := planLimits[plan]; !ok {
+                return planAnonymous
+        }
+        return plan
+}
+
+// requestLimits are the limits that apply to one request.
+type requestLimits struct {
+        plan     string
+        maxPages int // 0 for unlimited
+}
+
+func limitsForRequest(r *http.Request) requestLimits {
+        l := requestLimits{plan: requestPlan(r)}
+        l.maxPages = planLimits[l.plan].maxPages()
+        if v := strings.TrimSpace(r.Header.Get("X-PDF-Max-Pages")); v != "" {
+                if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+                        l.maxPages = n
+                } else {
+                        logger(r.Context()).Warn("ignoring invalid X-PDF-Max-Pages", "component", "limits", "value", v)
+                }
+        }
+        return l
+}
+
+type requestLimitsKey struct{}
+
+// withRequestLimits attaches r's limits to ctx for prepareInputs.
+func withRequestLimits(ctx context.Context, r *http.Request) context.Context {
+        return context.WithValue(ctx, requestLimitsKey{}, limitsForRequest(r))
+}
+
+func limitsFromContext(ctx context.Context) requestLimits {
+        if l, ok := ctx.Value(requestLimitsKey{}).(requestLimits); ok {
+                return l
+        }
+        return requestLimits{plan: planAnonymous, maxPages: planLimits[planAnonymous].maxPages()}
+}
+
+// pageLimitError reports files totalling pages pages when that exceeds the
+// limit, or returns nil.
+func (l requestLimits) pageLimitError(files []OpFile, pages int) error {
+        if l.maxPages <= 0 || pages <= l.maxPages || len(files) == 0 {
+                return nil
+        }
+        what := fmt.Sprintf("%q has %d pages", files[0].Name, pages)
+        if len(files) > 1 {
+                what = fmt.Sprintf("The uploaded files have %d pages in total", pages)
+        }
+        if l.plan == planAnonymous {
+                msg := what + ". Please log in to process larger documents."
+                if free, ok := planLimits["free"]; ok && free.maxPages() > l.maxPages {
+                        msg = fmt.Sprintf("%s. Please log in to process documents up to %d pages.", what, free.maxPages())
+                }
+                return &opError{status: http.StatusUnauthorized, code: codeLimitExceeded, msg: msg, param: files[0].Field}
+        }
+        return &opError{status: http.StatusRequestEntityTooLarge, code: codeLimitExceeded, param: files[0].Field,
+                msg: fmt.Sprintf("%s, which exceeds the %d-page limit. Upgrade to Pro for unlimited pages.", what, l.maxPages)}
+}
+
+// checkPageLimit counts the pages of the PDF files and enforces the request's
+// page limit. Files whose pages can't be counted (encrypted, damaged) are
+// left to the operation.
+func checkPageLimit(ctx context.Context, files []OpFile) error {
+        limits := limitsFromContext(ctx)
+        if limits.maxPages <= 0 || len(files) == 0 {
+                return nil
+        }
+        total := 0
+        for _, f := range files {
+                n, err := countPages(ctx, f.Path)
+                if err != nil {
+                        logger(ctx).Warn("page count failed", "component", "limits", "file", f.Name, "error", err.Error())
+                        continue
+                }
+                total += n
+        }
+        return limits.pageLimitError(files, total)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+        "context"
+        "log"
+        "log/slog"
+        "net/http"
+        "os"
+        "path/filepath"
+        "regexp"
+        "strings"
+        "time"
+
+        "github.com/google/uuid"
+)
+
+// ==================================================================================
+// Structured logging
+// ==================================================================================
+//
+// Logs are written with log/slog, as JSON lines by default:
+//
+//	PDF_LOG_FORMAT  json (default) or text
+//	PDF_LOG_LEVEL   debug, info (default), warn or error
+//
+// Every request gets a request ID: the X-Request-ID header set by the Node
+// proxy when present and well-formed, a fresh one otherwise. It is echoed in
+// the response and carried, with the job ID, operation and user plan, by the
+// logger in the request context (logger(ctx)), so everything logged while
+// serving a request can be correlated. Async jobs keep the ID of the request
+// that submitted them.
+//
+// Code outside a request logs with slog directly, naming its subsystem in the
+// "component" field. Output of dependencies that use the standard log package
+// goes through the same handler. Attributes named like secrets (passwords,
+// signature images, tokens) are redacted by the handler; tool arguments are
+// passed through redactArgs before being logged.
+
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern bounds what is accepted from clients, so an ID can't
+// inject anything into logs.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// sensitiveLogKeys are attribute keys whose values are never logged.
+var sensitiveLogKeys = map[string]bool{
+        "password":      true,
+        "signature":     true,
+        "signatures":    true,
+        "image":         true,
+        "token":         true,
+        "authorization": true,
+}
+
+const redacted = "[REDACTED]"
+
+// setupLogging installs the slog handler as the default logger and routes the
+// standard log package through it.
+func setupLogging() {
+        level := new(slog.LevelVar)
+        if err := level.UnmarshalText([]byte(config.Log.Level)); err != nil {
+                // Reported by main along with any other configuration error.
+                level.Set(slog.LevelInfo)
+        }
+        opts := &slog.HandlerOptions{
+                Level: level,
+                ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+                        if sensitiveLogKeys[strings.ToLower(a.Key)] {
+                                return slog.String(a.Key, redacted)
+                        }
+                        return a
+                },
+        }
+        var h slog.Handler
+        if config.Log.Format == "text" {
+                h = slog.NewTextHandler(os.Stderr, opts)
+        } else {
+                h = slog.NewJSONHandler(os.Stderr, opts)
+        }
+        slog.SetDefault(slog.New(h))
+        log.SetFlags(0)
+        log.SetOutput(legacyLogWriter{})
+}
+
+// fatal logs err as the reason the server can't run and exits.
+func fatal(msg string, err error) {
+        slog.Error(msg, "error", err.Error())
+        os.Exit(1)
+}
+
+// legacyLogWriter turns output of the standard log package, which some
+// dependencies still write to, into slog records, moving a leading "[tag]"
+// into the component field. Lines reporting errors or failures are logged as
+// warnings.
+type legacyLogWriter struct{}
+
+func (legacyLogWriter) Write(p []byte) (int, error) {
+        msg := strings.TrimRight(string(p), "\n")
+        var attrs []any
+        if strings.HasPrefix(msg, "[") {
+                if end := strings.IndexByte(msg, ']'); end > 1 && end < 40 && !strings.ContainsAny(msg[1:end], " \n") {
+                        attrs = append(attrs, "component", msg[1:end])
+                        msg = strings.TrimSpace(msg[end+1:])
+                }
+        }
+        level := slog.LevelInfo
+        if lower := strings.ToLower(msg); strings.Contains(lower, "error") || strings.Contains(lower, "fail") {
+                level = slog.LevelWarn
+        }
+        slog.Log(context.Background(), level, msg, attrs...)
+        return len(p), nil
+}
+
+// ----------------------------------------------------------------------------------
+// Request-scoped loggers
+// ----------------------------------------------------------------------------------
+
+type loggerContextKey struct{}
+
+// withLogAttrs returns ctx carrying a logger with args added to the one ctx
+// already has.
+func withLogAttrs(ctx context.Context, args ...any) context.Context {
+        return context.WithValue(ctx, loggerContextKey{}, logger(ctx).With(args...))
+}
+
+// logger returns the logger of the request ctx belongs to.
+func logger(ctx context.Context) *slog.Logger {
+        if l, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+                return l
+        }
+        return slog.Default()
+}
+
+// requestID returns the request's X-Request-ID if it is acceptable, or a new
+// ID.
+func requestID(r *http.Request) string {
+        if id := r.Header.Get(requestIDHeader); requestIDPattern.MatchString(id) {
+                return id
+        }
+        return uuid.NewString()
+}
+
+// quietRoutes are logged at debug level only: they are polled constantly.
+var quietRoutes = map[string]bool{
+        "/health":       true,
+        "/health/ready": true,
+        "/metrics":      true,
+}
+
+// withRequestLogging assigns the request ID, puts the request logger in the
+// context and logs one line per request once it has been served.
+func withRequestLogging(mux *http.ServeMux, next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                id := requestID(r)
+                r.Header.Set(requestIDHeader, id) // carried into async job replays
+                w.Header().Set(requestIDHeader, id)
+                _, route := mux.Handler(r)
+                ctx := withLogAttrs(r.Context(), "request_id", id, "plan", requestPlan(r))
+                if tid := traceIDOf(ctx); tid != "" {
+                        ctx = withLogAttrs(ctx, "trace_id", tid)
+                }
+
+                start := time.Now()
+                rw := &metricsWriter{ResponseWriter: w}
+                next.ServeHTTP(rw, r.WithContext(ctx))
+                if rw.status == 0 {
+                        rw.status = http.StatusOK
+                }
+
+                level := slog.LevelInfo
+                switch {
+                case rw.status >= http.StatusInternalServerError:
+                        level = slog.LevelError
+                case quietRoutes[route]:
+                        level = slog.LevelDebug
+                }
+                logger(ctx).Log(ctx, level, "request",
+                        "method", r.Method,
+                        "path", r.URL.Path,
+                        "route", route,
+                        "status", rw.status,
+                        "duration_ms", time.Since(start).Milliseconds(),
+                        "bytes_in", max(r.ContentLength, 0),
+                        "bytes_out", rw.bytes,
+                )
+        })
+}
+
+// ----------------------------------------------------------------------------------
+// Redaction
+// ----------------------------------------------------------------------------------
+
+// redactArgs masks secrets in tool arguments: qpdf's --encrypt user and owner
+// passwords and --password=, and pdfcpu's -upw/-opw.
+func redactArgs(args []string) []string {
+        out := make([]string, len(args))
+        mask := 0
+        for i, a := range args {
+                switch {
+                case mask > 0:
+                        out[i] = redacted
+                        mask--
+                        continue
+                case a == "--encrypt":
+                        mask = 2
+                case a == "-upw", a == "-opw", a == "--password":
+                        mask = 1
+                case strings.HasPrefix(a, "--password="):
+                        out[i] = "--password=" + redacted
+                        continue
+                }
+                out[i] = a
+        }
+        return out
+}
+
+// logToolRun logs one external tool invocation with the request's fields.
+func logToolRun(ctx context.Context, name string, args []string, start time.Time, out []byte, err error) {
+        l := logger(ctx).With(
+                "tool", filepath.Base(name),
+                "args", redactArgs(args),
+                "duration_ms", time.Since(start).Milliseconds(),
+        )
+        if err != nil {
+                l.Warn("tool failed", "error", err.Error(), "output", truncateForLog(string(out), 4096))
+                return
+        }
+        l.Info("tool finished")
+}
+
+// truncateForLog shortens tool output kept in logs.
+func truncateForLog(s string, n int) string {
+        if len(s) <= n {
+                return s
+        }
+        return s[:n] + "...(truncated)"
+}
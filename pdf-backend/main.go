@@ -7,12 +7,12 @@ import (
         "encoding/base64"
         "encoding/binary"
         "encoding/json"
+        "errors"
         "fmt"
         "hash/crc32"
         "io"
-        "log"
+        "log/slog"
         "math"
-        "mime/multipart"
         "net/http"
         "os"
         "os/exec"
@@ -21,6 +21,8 @@ import (
         "strconv"
         "strings"
         "time"
+        "unicode"
+        "unicode/utf8"
 
         "image"
         "image/color"
@@ -31,14 +33,18 @@ import (
 
         "github.com/google/uuid"
         "github.com/jung-kurt/gofpdf"
+        "go.opentelemetry.io/otel/attribute"
+
+        "pdf-backend/pdfdoc"
 )
 
-var baseWorkDir = "./work"  // Will be converted to absolute path in main()
+var baseWorkDir = config.WorkDir // made absolute in main()
 
 const defaultFilename = "output.pdf"
 
 type downloadResponse struct {
         DownloadURL string `json:"downloadUrl"`
+        FileID      string `json:"fileId,omitempty"` // see fileref.go
 }
 
 type previewPage struct {
@@ -47,164 +53,93 @@ type previewPage struct {
 }
 
 type previewResponse struct {
-        Pages []previewPage `json:"pages"`
+        Pages  []previewPage `json:"pages"`
+        FileID string        `json:"fileId,omitempty"` // the previewed document
 }
 
 func main() {
+        setupLogging()
+        if configErr != nil {
+                fatal("configuration error", configErr)
+        }
+        config.logEffective()
+        setupTracing(context.Background())
+
         // Convert baseWorkDir to absolute path
         absWorkDir, err := filepath.Abs(baseWorkDir)
         if err != nil {
-                log.Fatalf("failed to get absolute path for work dir: %v", err)
+                fatal("failed to get absolute path for work dir", err)
         }
         baseWorkDir = absWorkDir
         
         if err := os.MkdirAll(baseWorkDir, 0o755); err != nil {
-                log.Fatalf("failed to create work dir: %v", err)
+                fatal("failed to create work dir", err)
+        }
+        if store, err = newStorageFromEnv(baseWorkDir); err != nil {
+                fatal("failed to configure storage", err)
         }
+        limitsPath := ""
+        if planLimits, limitsPath, err = loadPlanLimits(); err != nil {
+                fatal("failed to load plan limits", err)
+        }
+        slog.Info("loaded plan limits", "component", "limits", "path", limitsPath)
+        resultCache.load()
 
         mux := http.NewServeMux()
 
-        mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-                w.WriteHeader(http.StatusOK)
-                _, _ = w.Write([]byte("ok"))
-        })
+        mux.HandleFunc("/health", handleHealth)
+        mux.HandleFunc("/health/ready", handleReady)
+        mux.Handle("/metrics", metricsHandler())
 
-        // Backwards-compatible routes:
-        mux.HandleFunc("/pdf/merge", handleMerge)
-        mux.HandleFunc("/pdf/split", handleSplit)
-        mux.HandleFunc("/pdf/remove-pages", handleRemovePages)
-        mux.HandleFunc("/pdf/extract-pages", handleExtractPages)
-        mux.HandleFunc("/pdf/compress", handleCompress)
-        mux.HandleFunc("/pdf/repair", handleRepair)
-        mux.HandleFunc("/pdf/ocr", handleOCR)
-        mux.HandleFunc("/pdf/convert-to-pdfa", handleConvertToPDFA)
-        mux.HandleFunc("/pdf/image-to-pdf", handleImageToPDF)
-        mux.HandleFunc("/pdf/word-to-pdf", handleWordToPDF)
-        mux.HandleFunc("/pdf/preview", handlePreview)
-        mux.HandleFunc("/pdf/organize", handleOrganize)
-        mux.HandleFunc("/pdf/rotate", handleRotate)
-        mux.HandleFunc("/pdf/crop", handleCrop)
-        mux.HandleFunc("/pdf/page-numbers", handlePageNumbers)
-        mux.HandleFunc("/pdf/watermark", handleWatermark)
-
-        // Preferred API base for the frontend: VITE_PDF_API_BASE_URL="/api/pdf"
-        mux.HandleFunc("/api/pdf/merge", handleMerge)
-        mux.HandleFunc("/api/pdf/split", handleSplit)
-        mux.HandleFunc("/api/pdf/remove-pages", handleRemovePages)
-        mux.HandleFunc("/api/pdf/extract-pages", handleExtractPages)
-        mux.HandleFunc("/api/pdf/compress", handleCompress)
-        mux.HandleFunc("/api/pdf/repair", handleRepair)
-        mux.HandleFunc("/api/pdf/ocr", handleOCR)
-        mux.HandleFunc("/api/pdf/convert-to-pdfa", handleConvertToPDFA)
-        mux.HandleFunc("/api/pdf/image-to-pdf", handleImageToPDF)
-        mux.HandleFunc("/api/pdf/word-to-pdf", handleWordToPDF)
-        mux.HandleFunc("/api/pdf/preview", handlePreview)
-        mux.HandleFunc("/api/pdf/organize", handleOrganize)
-        mux.HandleFunc("/api/pdf/rotate", handleRotate)
-        mux.HandleFunc("/api/pdf/crop", handleCrop)
-        mux.HandleFunc("/api/pdf/page-numbers", handlePageNumbers)
-        mux.HandleFunc("/api/pdf/watermark", handleWatermark)
+        // Tool routes: every registered operation (see operations.go) is served
+        // under the preferred API base for the frontend
+        // (VITE_PDF_API_BASE_URL="/api/pdf") and the backwards-compatible /pdf prefix.
+        for _, name := range operationNames() {
+                h := serveOperation(operations[name])
+                mux.HandleFunc("/api/pdf/"+name, h)
+                mux.HandleFunc("/pdf/"+name, h)
+        }
 
-        // Perspective Warp (document scanner)
+        mux.HandleFunc("/api/pdf/preview", handlePreview)
+        mux.HandleFunc("/pdf/preview", handlePreview)
         mux.HandleFunc("/api/pdf/perspective-warp", handlePerspectiveWarp)
         mux.HandleFunc("/pdf/perspective-warp", handlePerspectiveWarp)
 
-        // PDF Security Tools
-        mux.HandleFunc("/api/pdf/protect", handleProtectPDF)
-        mux.HandleFunc("/pdf/protect", handleProtectPDF)
-        mux.HandleFunc("/api/pdf/unlock", handleUnlockPDF)
-        mux.HandleFunc("/pdf/unlock", handleUnlockPDF)
-        mux.HandleFunc("/api/pdf/redact", handleRedactPDF)
-        mux.HandleFunc("/pdf/redact", handleRedactPDF)
-        mux.HandleFunc("/api/pdf/flatten", handleFlattenPDF)
-        mux.HandleFunc("/pdf/flatten", handleFlattenPDF)
-
-        // PDF Conversion Tools
-        mux.HandleFunc("/api/pdf/pdf-to-word", handlePDFToWord)
-        mux.HandleFunc("/pdf/pdf-to-word", handlePDFToWord)
-        mux.HandleFunc("/api/pdf/pdf-to-excel", handlePDFToExcel)
-        mux.HandleFunc("/pdf/pdf-to-excel", handlePDFToExcel)
-        mux.HandleFunc("/api/pdf/pdf-to-powerpoint", handlePDFToPowerPoint)
-        mux.HandleFunc("/pdf/pdf-to-powerpoint", handlePDFToPowerPoint)
-        mux.HandleFunc("/api/pdf/pdf-to-jpg", handlePDFToJPG)
-        mux.HandleFunc("/pdf/pdf-to-jpg", handlePDFToJPG)
-        mux.HandleFunc("/api/pdf/extract-text", handleExtractText)
-        mux.HandleFunc("/pdf/extract-text", handleExtractText)
-        mux.HandleFunc("/api/pdf/extract-images", handleExtractImages)
-        mux.HandleFunc("/pdf/extract-images", handleExtractImages)
-        mux.HandleFunc("/api/pdf/html-to-pdf", handleHTMLToPDF)
-        mux.HandleFunc("/pdf/html-to-pdf", handleHTMLToPDF)
-        mux.HandleFunc("/api/pdf/excel-to-pdf", handleExcelToPDF)
-        mux.HandleFunc("/pdf/excel-to-pdf", handleExcelToPDF)
-        mux.HandleFunc("/api/pdf/powerpoint-to-pdf", handlePowerPointToPDF)
-        mux.HandleFunc("/pdf/powerpoint-to-pdf", handlePowerPointToPDF)
-
-        // Advanced PDF Tools
-        mux.HandleFunc("/api/pdf/compare", handleComparePDFs)
-        mux.HandleFunc("/pdf/compare", handleComparePDFs)
-        mux.HandleFunc("/api/pdf/digital-signature", handleDigitalSignature)
-        mux.HandleFunc("/pdf/digital-signature", handleDigitalSignature)
-        mux.HandleFunc("/api/pdf/sign", handleSignPDF)
-        mux.HandleFunc("/pdf/sign", handleSignPDF)
-        mux.HandleFunc("/api/pdf/add-text", handleAddTextAnnotation)
-        mux.HandleFunc("/pdf/add-text", handleAddTextAnnotation)
-        mux.HandleFunc("/api/pdf/edit", handleEditPDF)
-        mux.HandleFunc("/pdf/edit", handleEditPDF)
-        mux.HandleFunc("/api/pdf/validate-pdfa", handleValidatePDFA)
-        mux.HandleFunc("/pdf/validate-pdfa", handleValidatePDFA)
-        mux.HandleFunc("/api/pdf/pdf-to-html", handlePDFToHTML)
-        mux.HandleFunc("/pdf/pdf-to-html", handlePDFToHTML)
-        mux.HandleFunc("/api/pdf/add-header-footer", handleHeaderFooter)
-        mux.HandleFunc("/pdf/add-header-footer", handleHeaderFooter)
-
-        mux.HandleFunc("/api/pdf/png-to-pdf", handlePNGToPDF)
-        mux.HandleFunc("/pdf/png-to-pdf", handlePNGToPDF)
-        mux.HandleFunc("/api/pdf/pdf-to-png", handlePDFToPNG)
-        mux.HandleFunc("/pdf/pdf-to-png", handlePDFToPNG)
-        mux.HandleFunc("/api/pdf/pdf-to-tiff", handlePDFToTIFF)
-        mux.HandleFunc("/pdf/pdf-to-tiff", handlePDFToTIFF)
-        mux.HandleFunc("/api/pdf/bmp-to-pdf", handleBMPToPDF)
-        mux.HandleFunc("/pdf/bmp-to-pdf", handleBMPToPDF)
-
-        mux.HandleFunc("/api/pdf/encrypt-pdf", handleEncryptPDF)
-        mux.HandleFunc("/pdf/encrypt-pdf", handleEncryptPDF)
-
-        mux.HandleFunc("/api/pdf/metadata", handleMetadataEditor)
-        mux.HandleFunc("/pdf/metadata", handleMetadataEditor)
-        mux.HandleFunc("/api/pdf/bookmarks", handleBookmarksEditor)
-        mux.HandleFunc("/pdf/bookmarks", handleBookmarksEditor)
-        mux.HandleFunc("/api/pdf/batch", handleBatchProcess)
-        mux.HandleFunc("/pdf/batch", handleBatchProcess)
-        mux.HandleFunc("/api/pdf/form-fill", handleFormFill)
-        mux.HandleFunc("/pdf/form-fill", handleFormFill)
-
-        mux.HandleFunc("/api/pdf/markdown-to-pdf", handleMarkdownToPDF)
-        mux.HandleFunc("/pdf/markdown-to-pdf", handleMarkdownToPDF)
-        mux.HandleFunc("/api/pdf/document-crop", handleDocumentCrop)
-        mux.HandleFunc("/pdf/document-crop", handleDocumentCrop)
-        mux.HandleFunc("/api/pdf/document-detect", handleDocumentDetect)
-        mux.HandleFunc("/pdf/document-detect", handleDocumentDetect)
-        mux.HandleFunc("/api/pdf/url-to-pdf", handleURLToPDF)
-        mux.HandleFunc("/pdf/url-to-pdf", handleURLToPDF)
-
         mux.HandleFunc("/downloads/", serveDownload)
         mux.HandleFunc("/api/pdf/downloads/", serveDownload)
         mux.HandleFunc("/previews/", servePreview)
         mux.HandleFunc("/api/pdf/previews/", servePreview)
 
-        // Simple background cleanup for old jobs.
-        go func() {
-                ticker := time.NewTicker(30 * time.Minute)
-                defer ticker.Stop()
-                for range ticker.C {
-                        cleanupOldJobs(2 * time.Hour) // adjust retention as needed
-                }
-        }()
-
-        addr := ":8080"
-        log.Printf("PDF backend listening on %s", addr)
-        if err := http.ListenAndServe(addr, mux); err != nil {
-                log.Fatalf("server error: %v", err)
+        // Resumable uploads (tus), usable by every tool via uploadId
+        mux.HandleFunc("/api/pdf/uploads", handleUploads)
+        mux.HandleFunc("/api/pdf/uploads/", handleUploads)
+        mux.HandleFunc("/pdf/uploads", handleUploads)
+        mux.HandleFunc("/pdf/uploads/", handleUploads)
+
+        // Multi-step pipeline (merge -> rotate -> ... in one request)
+        mux.HandleFunc("/api/pdf/pipeline", handlePipeline)
+        mux.HandleFunc("/pdf/pipeline", handlePipeline)
+
+        // Async job status (submit any tool with ?async=true)
+        mux.HandleFunc("/api/pdf/jobs/", handleJobStatus)
+        mux.HandleFunc("/pdf/jobs/", handleJobStatus)
+
+        handler := withAsyncJobs(mux)
+        recoverJobs(handler)
+        handler = withAdmission(handler)
+        handler = withMetrics(mux, handler)
+        handler = withRequestLogging(mux, handler)
+        handler = withTracing(mux, handler)
+
+        // Background cleanup of expired jobs (see retention.go).
+        go runJanitor()
+        // Toolchain checks behind /health/ready (see health.go).
+        go toolchain.run()
+
+        addr := config.Addr
+        slog.Info("PDF backend listening", "addr", addr)
+        if err := http.ListenAndServe(addr, handler); err != nil {
+                fatal("server error", err)
         }
 }
 
@@ -251,11 +186,16 @@ func baseNameWithoutExt(filename string) string {
 
 // buildOutputName creates a smart output filename based on original name and operation
 func buildOutputName(originalName, operation string) string {
+        return fmt.Sprintf("%s_%s.pdf", outputBaseName(originalName), operation)
+}
+
+// outputBaseName is the stem output files for originalName start with.
+func outputBaseName(originalName string) string {
         base := baseNameWithoutExt(originalName)
         if base == "" || base == "input" || base == "file" {
                 base = "output"
         }
-        return fmt.Sprintf("%s_%s.pdf", base, operation)
+        return base
 }
 
 // appendPNGTextChunk adds a tEXt chunk to a PNG to make it unique
@@ -301,93 +241,17 @@ func appendPNGTextChunk(pngData []byte, keyword, text string) []byte {
         return result
 }
 
-func pageCountPoppler(dir, inPath string) (int, error) {
-        // Uses poppler-utils (pdfinfo), which is already a required dependency for previews.
-        out, err := runCommandOutput(dir, "pdfinfo", inPath)
-        if err != nil {
-                return 0, fmt.Errorf("pdfinfo failed: %w", err)
-        }
-        for _, line := range strings.Split(out, "\n") {
-                trim := strings.TrimSpace(line)
-                if strings.HasPrefix(trim, "Pages:") {
-                        parts := strings.Fields(trim)
-                        if len(parts) >= 2 {
-                                n, err := strconv.Atoi(parts[len(parts)-1])
-                                if err == nil && n > 0 {
-                                        return n, nil
-                                }
-                        }
-                }
-        }
-        return 0, fmt.Errorf("could not parse page count")
-}
-
-func pageCountPDF(dir, inPath string) (int, error) {
-        out, err := runCommandOutput(dir, "pdfcpu", "info", inPath)
-        if err != nil {
-                return 0, fmt.Errorf("pdfcpu info failed: %w", err)
-        }
-        // Typical line: "Pages:             12"
-        for _, line := range strings.Split(out, "\n") {
-                if strings.HasPrefix(strings.TrimSpace(line), "Pages:") {
-                        parts := strings.Fields(line)
-                        // Fields: [Pages: 12]
-                        if len(parts) >= 2 {
-                                n, err := strconv.Atoi(parts[len(parts)-1])
-                                if err == nil {
-                                        return n, nil
-                                }
-                        }
-                }
-        }
-        return 0, fmt.Errorf("could not parse page count")
-}
-
-func handleDocumentCrop(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("image")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "image is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        ext := filepath.Ext(header.Filename)
-        if ext == "" {
-                ext = ".jpg"
-        }
-        inPath := filepath.Join(dir, "input"+ext)
-        if err := saveUploadedFile(header, inPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save image")
-                return
-        }
+func opDocumentCrop(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        f, err := os.Open(inPath)
+        f, err := os.Open(in.File().Path)
         if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to open image")
-                return
+                return nil, opFail(http.StatusInternalServerError, "failed to open image")
         }
         srcImg, _, err := image.Decode(f)
         f.Close()
         if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to decode image")
-                return
+                return nil, opFail(http.StatusInternalServerError, "failed to decode image")
         }
 
         cropped := detectAndCropDocument(srcImg)
@@ -395,50 +259,28 @@ func handleDocumentCrop(w http.ResponseWriter, r *http.Request) {
         outPath := filepath.Join(dir, "cropped.jpg")
         outFile, err := os.Create(outPath)
         if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create output")
-                return
+                return nil, opFail(http.StatusInternalServerError, "failed to create output")
         }
         if err := jpeg.Encode(outFile, cropped, &jpeg.Options{Quality: 95}); err != nil {
                 outFile.Close()
-                errorJSON(w, http.StatusInternalServerError, "failed to encode cropped image")
-                return
+                return nil, opFail(http.StatusInternalServerError, "failed to encode cropped image")
         }
         outFile.Close()
 
         outName := "cropped.jpg"
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handleDocumentDetect(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(10 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("image")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "image is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        file, err := header.Open()
+func opDocumentDetect(ctx context.Context, in *OpInput) (*OpResult, error) {
+        file, err := os.Open(in.File().Path)
         if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to open image")
-                return
+                return nil, opFail(http.StatusInternalServerError, "failed to open image")
         }
         defer file.Close()
 
         srcImg, _, err := image.Decode(file)
         if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to decode image")
-                return
+                return nil, opFail(http.StatusInternalServerError, "failed to decode image")
         }
 
         detected, corners := detectDocumentQuad(srcImg)
@@ -460,8 +302,7 @@ func handleDocumentDetect(w http.ResponseWriter, r *http.Request) {
         }
 
         if !detected {
-                writeJSON(w, http.StatusOK, detectResult{Detected: false})
-                return
+                return dataResult(detectResult{Detected: false}), nil
         }
 
         minX := math.Min(math.Min(corners[0].x, corners[3].x), math.Min(corners[1].x, corners[2].x))
@@ -469,7 +310,7 @@ func handleDocumentDetect(w http.ResponseWriter, r *http.Request) {
         minY := math.Min(math.Min(corners[0].y, corners[1].y), math.Min(corners[2].y, corners[3].y))
         maxY := math.Max(math.Max(corners[0].y, corners[1].y), math.Max(corners[2].y, corners[3].y))
 
-        writeJSON(w, http.StatusOK, detectResult{
+        return dataResult(detectResult{
                 Detected:    true,
                 X:           minX,
                 Y:           minY,
@@ -479,7 +320,7 @@ func handleDocumentDetect(w http.ResponseWriter, r *http.Request) {
                 TopRight:    cornerPoint{X: corners[1].x, Y: corners[1].y},
                 BottomRight: cornerPoint{X: corners[2].x, Y: corners[2].y},
                 BottomLeft:  cornerPoint{X: corners[3].x, Y: corners[3].y},
-        })
+        }), nil
 }
 
 func handlePerspectiveWarp(w http.ResponseWriter, r *http.Request) {
@@ -487,21 +328,25 @@ func handlePerspectiveWarp(w http.ResponseWriter, r *http.Request) {
                 errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
                 return
         }
-        if err := r.ParseMultipartForm(50 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
+        // The result is returned directly, so the upload only needs a scratch
+        // directory rather than a job.
+        tmpDir, err := os.MkdirTemp(baseWorkDir, ".warp-")
+        if err != nil {
+                errorJSON(w, http.StatusInternalServerError, "failed to open image")
                 return
         }
-
-        _, header, err := r.FormFile("image")
+        defer os.RemoveAll(tmpDir)
+        uploads, err := readUploads(w, r, tmpDir, uploadSpec{fields: []string{"image"}})
         if err != nil {
-                errorJSON(w, http.StatusBadRequest, "image is required")
+                writeRequestError(w, r, err)
                 return
         }
-        if !checkFileSize(w, r, header) {
+        if len(uploads) == 0 {
+                paramErrorJSON(w, "image", "image is required")
                 return
         }
 
-        file, err := header.Open()
+        file, err := os.Open(uploads[0].Path)
         if err != nil {
                 errorJSON(w, http.StatusInternalServerError, "failed to open image")
                 return
@@ -1530,99 +1375,43 @@ func docFindByEdgeProjection(edgeMag [][]float64, w, h int) (int, int, int, int)
         return left, top, right - left + 1, bottom - top + 1
 }
 
-func handleRotate(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        degrees := parseIntDefault(r.FormValue("degrees"), 90)
+func opRotate(ctx context.Context, in *OpInput) (*OpResult, error) {
+        degrees := parseIntDefault(in.Param("degrees"), 90)
         if degrees != 90 && degrees != 180 && degrees != 270 {
-                errorJSON(w, http.StatusBadRequest, "degrees must be 90, 180, or 270")
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
+                return nil, opParamFail("degrees", "degrees must be 90, 180, or 270")
         }
 
-        inPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(header, inPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+        dir := in.Dir
 
-        outName := buildOutputName(header.Filename, "rotated")
+        inPath := in.File().Path
+        outName := buildOutputName(in.File().Name, "rotated")
         outPath := filepath.Join(dir, outName)
 
-        if err := runCommand(dir, "pdfcpu", "rotate", inPath, strconv.Itoa(degrees), outPath); err != nil {
-                log.Printf("rotate error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to rotate PDF")
-                return
+        if err := runCommand(ctx, dir, "pdfcpu", "rotate", inPath, strconv.Itoa(degrees), outPath); err != nil {
+                logger(ctx).Error("rotate failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to rotate PDF")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handleCrop(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        desc := strings.TrimSpace(r.FormValue("description"))
-        unit := strings.TrimSpace(r.FormValue("unit"))
+func opCrop(ctx context.Context, in *OpInput) (*OpResult, error) {
+        desc := strings.TrimSpace(in.Param("description"))
+        unit := strings.TrimSpace(in.Param("unit"))
         if unit == "" {
                 unit = "po"
         }
         
         // Parse margin values from form
-        marginLeft := parseIntDefault(r.FormValue("marginLeft"), 0)
-        marginRight := parseIntDefault(r.FormValue("marginRight"), 0)
-        marginTop := parseIntDefault(r.FormValue("marginTop"), 0)
-        marginBottom := parseIntDefault(r.FormValue("marginBottom"), 0)
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
+        marginLeft := parseIntDefault(in.Param("marginLeft"), 0)
+        marginRight := parseIntDefault(in.Param("marginRight"), 0)
+        marginTop := parseIntDefault(in.Param("marginTop"), 0)
+        marginBottom := parseIntDefault(in.Param("marginBottom"), 0)
 
-        inPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(header, inPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+        dir := in.Dir
 
-        outName := buildOutputName(header.Filename, "cropped")
+        inPath := in.File().Path
+        outName := buildOutputName(in.File().Name, "cropped")
         outPath := filepath.Join(dir, outName)
 
         // Use margin-based cropping if margins are specified
@@ -1638,69 +1427,41 @@ func handleCrop(w http.ResponseWriter, r *http.Request) {
         }
 
         args := []string{"crop", "-u", unit, "--", cropDesc, inPath, outPath}
-        if err := runCommand(dir, "pdfcpu", args...); err != nil {
-                log.Printf("crop error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to crop PDF")
-                return
+        if err := runCommand(ctx, dir, "pdfcpu", args...); err != nil {
+                logger(ctx).Error("crop failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to crop PDF")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handlePageNumbers(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        pos := strings.TrimSpace(r.FormValue("position"))
+func opPageNumbers(ctx context.Context, in *OpInput) (*OpResult, error) {
+        pos := strings.TrimSpace(in.Param("position"))
         if pos == "" {
                 pos = "bc"
         }
-        fontSize := parseIntDefault(r.FormValue("fontSize"), 10)
+        fontSize := parseIntDefault(in.Param("fontSize"), 10)
         if fontSize < 6 {
                 fontSize = 6
         }
         if fontSize > 72 {
                 fontSize = 72
         }
-        opacity := parseFloatDefault(r.FormValue("opacity"), 0.95)
+        opacity := parseFloatDefault(in.Param("opacity"), 0.95)
         if opacity < 0 {
                 opacity = 0
         }
         if opacity > 1 {
                 opacity = 1
         }
-        startAt := parseIntDefault(r.FormValue("startAt"), 1)
+        startAt := parseIntDefault(in.Param("startAt"), 1)
         if startAt < 1 {
                 startAt = 1
         }
 
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        inPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(header, inPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+        dir := in.Dir
 
+        inPath := in.File().Path
         // iLovePDF-style robustness:
         // Avoid repeatedly stamping the same PDF in-place (pdfcpu may stack stamp resources).
         // Instead:
@@ -1708,31 +1469,24 @@ func handlePageNumbers(w http.ResponseWriter, r *http.Request) {
         // 2) stamp each single-page PDF once
         // 3) merge back into a clean output PDF
 
-        total, err := pageCountPDF(dir, inPath)
+        total, err := countPages(ctx, inPath)
         if err != nil {
-                // Try poppler-based page count as fallback
-                total, err = pageCountPoppler(dir, inPath)
-                if err != nil {
-                        log.Printf("page numbers: page count error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to read page count")
-                        return
-                }
+                logger(ctx).Error("page count failed", "error", err.Error())
+                return nil, pdfReadError(err)
         }
 
         pagesDir := filepath.Join(dir, "pages")
         if err := os.MkdirAll(pagesDir, 0o755); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create pages dir")
-                return
+                return nil, opFail(http.StatusInternalServerError, "failed to create pages dir")
         }
 
-        if err := runCommand(dir, "pdfcpu", "extract", "-mode", "page", inPath, pagesDir); err != nil {
-                log.Printf("page numbers: extract pages error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to prepare pages")
-                return
+        if err := runCommand(ctx, dir, "pdfcpu", "extract", "-mode", "page", inPath, pagesDir); err != nil {
+                logger(ctx).Error("extract pages failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to prepare pages")
         }
 
         // Parse margin parameter for better positioning
-        marginStr := strings.TrimSpace(r.FormValue("margin"))
+        marginStr := strings.TrimSpace(in.Param("margin"))
         marginOffset := 20 // default recommended margin in points
         if marginStr == "small" {
                 marginOffset = 10
@@ -1776,82 +1530,53 @@ func handlePageNumbers(w http.ResponseWriter, r *http.Request) {
 
                 label := fmt.Sprintf("%d", startAt+(i-1))
                 outPage := filepath.Join(dir, fmt.Sprintf("stamped-%04d.pdf", i))
-                if err := runCommand(dir, "pdfcpu", "stamp", "add", "-mode", "text", "--", label, desc, pagePath, outPage); err != nil {
-                        log.Printf("page numbers: stamp error (page=%d): %v", i, err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to add page numbers")
-                        return
+                if err := runCommand(ctx, dir, "pdfcpu", "stamp", "add", "-mode", "text", "--", label, desc, pagePath, outPage); err != nil {
+                        logger(ctx).Error("stamp failed", "page", i, "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to add page numbers")
                 }
                 stamped = append(stamped, outPage)
+                setJobProgress(ctx, float64(i)/float64(total+1))
         }
 
-        outName := buildOutputName(header.Filename, "numbered")
+        outName := buildOutputName(in.File().Name, "numbered")
         outPath := filepath.Join(dir, outName)
         args := append([]string{"merge", outPath}, stamped...)
-        if err := runCommand(dir, "pdfcpu", args...); err != nil {
-                log.Printf("page numbers: merge error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to write output")
-                return
+        if err := runCommand(ctx, dir, "pdfcpu", args...); err != nil {
+                logger(ctx).Error("merge failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to write output")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handleWatermark(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        text := strings.TrimSpace(r.FormValue("text"))
+func opWatermark(ctx context.Context, in *OpInput) (*OpResult, error) {
+        text := strings.TrimSpace(in.Param("text"))
         if text == "" {
-                errorJSON(w, http.StatusBadRequest, "text is required")
-                return
+                return nil, opParamFail("text", "text is required")
         }
 
-        rot := parseIntDefault(r.FormValue("rotation"), 45)
-        opacity := parseFloatDefault(r.FormValue("opacity"), 0.5)
+        rot := parseIntDefault(in.Param("rotation"), 45)
+        opacity := parseFloatDefault(in.Param("opacity"), 0.5)
         if opacity < 0 {
                 opacity = 0
         }
         if opacity > 1 {
                 opacity = 1
         }
-        layer := strings.TrimSpace(r.FormValue("layer"))
-        fromPage := parseIntDefault(r.FormValue("fromPage"), 1)
-        toPage := parseIntDefault(r.FormValue("toPage"), 0)
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
+        layer := strings.TrimSpace(in.Param("layer"))
+        fromPage := parseIntDefault(in.Param("fromPage"), 1)
+        toPage := parseIntDefault(in.Param("toPage"), 0)
 
-        inPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(header, inPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+        dir := in.Dir
 
-        outName := buildOutputName(header.Filename, "watermarked")
+        inPath := in.File().Path
+        outName := buildOutputName(in.File().Name, "watermarked")
         outPath := filepath.Join(dir, outName)
 
         // Build page selection string if specified
         pageSelection := ""
         if fromPage > 0 || toPage > 0 {
-                total, _ := pageCountPoppler(dir, inPath)
+                total, _ := countPages(ctx, inPath)
                 if toPage <= 0 || toPage > total {
                         toPage = total
                 }
@@ -1869,7 +1594,7 @@ func handleWatermark(w http.ResponseWriter, r *http.Request) {
         actualRot := -rot
         
         // Parse color parameter - format: "r,g,b" values from 0-255 or hex
-        color := strings.TrimSpace(r.FormValue("color"))
+        color := strings.TrimSpace(in.Param("color"))
         colorDesc := "fillc:.5 .5 .5" // Default gray
         if color != "" {
                 // Convert hex color like "#ff0000" or "ff0000" to RGB fractions
@@ -1897,47 +1622,27 @@ func handleWatermark(w http.ResponseWriter, r *http.Request) {
         }
         args = append(args, "--", text, desc, inPath, outPath)
 
-        if err := runCommand(dir, "pdfcpu", args...); err != nil {
-                log.Printf("watermark error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to add watermark")
-                return
+        if err := runCommand(ctx, dir, "pdfcpu", args...); err != nil {
+                logger(ctx).Error("watermark failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to add watermark")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handleHeaderFooter(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        headerText := strings.TrimSpace(r.FormValue("headerText"))
-        footerText := strings.TrimSpace(r.FormValue("footerText"))
+func opHeaderFooter(ctx context.Context, in *OpInput) (*OpResult, error) {
+        headerText := strings.TrimSpace(in.Param("headerText"))
+        footerText := strings.TrimSpace(in.Param("footerText"))
         if headerText == "" && footerText == "" {
-                errorJSON(w, http.StatusBadRequest, "header or footer text is required")
-                return
+                return nil, opParamFail("headerText", "header or footer text is required")
         }
 
-        headerAlign := strings.TrimSpace(r.FormValue("headerAlign"))
-        footerAlign := strings.TrimSpace(r.FormValue("footerAlign"))
-        fontSize := parseIntDefault(r.FormValue("fontSize"), 12)
-        marginStr := strings.TrimSpace(r.FormValue("margin"))
-        fromPage := parseIntDefault(r.FormValue("fromPage"), 1)
-        toPage := parseIntDefault(r.FormValue("toPage"), 0)
+        headerAlign := strings.TrimSpace(in.Param("headerAlign"))
+        footerAlign := strings.TrimSpace(in.Param("footerAlign"))
+        fontSize := parseIntDefault(in.Param("fontSize"), 12)
+        marginStr := strings.TrimSpace(in.Param("margin"))
+        fromPage := parseIntDefault(in.Param("fromPage"), 1)
+        toPage := parseIntDefault(in.Param("toPage"), 0)
 
         // Map alignments to pdfcpu positions
         headerPos := "tc"
@@ -1963,26 +1668,13 @@ func handleHeaderFooter(w http.ResponseWriter, r *http.Request) {
                 marginOffset = 45
         }
 
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        inPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(header, inPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+        dir := in.Dir
 
-        total, err := pageCountPDF(dir, inPath)
+        inPath := in.File().Path
+        total, err := countPages(ctx, inPath)
         if err != nil {
-                total, err = pageCountPoppler(dir, inPath)
-                if err != nil {
-                        log.Printf("header-footer: page count error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to read page count")
-                        return
-                }
+                logger(ctx).Error("page count failed", "error", err.Error())
+                return nil, pdfReadError(err)
         }
 
         if toPage <= 0 || toPage > total {
@@ -1997,7 +1689,7 @@ func handleHeaderFooter(w http.ResponseWriter, r *http.Request) {
                 pageSelection = fmt.Sprintf("%d-%d", fromPage, toPage)
         }
 
-        outName := buildOutputName(header.Filename, "headerfooter")
+        outName := buildOutputName(in.File().Name, "headerfooter")
         workPath := inPath
 
         // Add header if specified
@@ -2009,10 +1701,9 @@ func handleHeaderFooter(w http.ResponseWriter, r *http.Request) {
                         args = append(args, "-pages", pageSelection)
                 }
                 args = append(args, "--", headerText, headerDesc, workPath, headerOutPath)
-                if err := runCommand(dir, "pdfcpu", args...); err != nil {
-                        log.Printf("header-footer: header error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to add header")
-                        return
+                if err := runCommand(ctx, dir, "pdfcpu", args...); err != nil {
+                        logger(ctx).Error("header failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to add header")
                 }
                 workPath = headerOutPath
         }
@@ -2026,21 +1717,19 @@ func handleHeaderFooter(w http.ResponseWriter, r *http.Request) {
                         args = append(args, "-pages", pageSelection)
                 }
                 args = append(args, "--", footerText, footerDesc, workPath, footerOutPath)
-                if err := runCommand(dir, "pdfcpu", args...); err != nil {
-                        log.Printf("header-footer: footer error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to add footer")
-                        return
+                if err := runCommand(ctx, dir, "pdfcpu", args...); err != nil {
+                        logger(ctx).Error("footer failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to add footer")
                 }
         } else {
                 // Only header was added, rename output
                 if err := os.Rename(workPath, filepath.Join(dir, outName)); err != nil {
-                        log.Printf("header-footer: rename error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to finalize output")
-                        return
+                        logger(ctx).Error("rename failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to finalize output")
                 }
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
 type organizeRotation struct {
@@ -2048,58 +1737,28 @@ type organizeRotation struct {
         Degrees    int `json:"degrees"`
 }
 
-func handleOrganize(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        order := strings.TrimSpace(r.FormValue("order"))
+func opOrganize(ctx context.Context, in *OpInput) (*OpResult, error) {
+        order := strings.TrimSpace(in.Param("order"))
         if order == "" {
-                errorJSON(w, http.StatusBadRequest, "order is required")
-                return
+                return nil, opParamFail("order", "order is required")
         }
 
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        inPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(header, inPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+        dir := in.Dir
 
+        inPath := in.File().Path
         workPath := filepath.Join(dir, "work.pdf")
         if b, err := os.ReadFile(inPath); err == nil {
                 _ = os.WriteFile(workPath, b, 0o644)
         } else {
-                errorJSON(w, http.StatusInternalServerError, "failed to prepare work file")
-                return
+                return nil, opFail(http.StatusInternalServerError, "failed to prepare work file")
         }
 
         // Optional per-page rotations.
-        rotationsRaw := strings.TrimSpace(r.FormValue("rotations"))
+        rotationsRaw := strings.TrimSpace(in.Param("rotations"))
         if rotationsRaw != "" {
                 var rotations []organizeRotation
                 if err := json.Unmarshal([]byte(rotationsRaw), &rotations); err != nil {
-                        errorJSON(w, http.StatusBadRequest, "invalid rotations")
-                        return
+                        return nil, opParamFail("rotations", "invalid rotations")
                 }
 
                 // Group pages by degrees.
@@ -2131,38 +1790,49 @@ func handleOrganize(w http.ResponseWriter, r *http.Request) {
 
                         // pdfcpu rotate rotates in-place.
                         // Example: pdfcpu rotate -pages 1-2 test.pdf -90
-                        if err := runCommand(dir, "pdfcpu", "rotate", "-pages", pagesSpec, workPath, fmt.Sprintf("-%d", deg)); err != nil {
-                                log.Printf("organize rotate error: %v", err)
-                                errorJSON(w, http.StatusInternalServerError, "failed to rotate pages")
-                                return
+                        if err := runCommand(ctx, dir, "pdfcpu", "rotate", "-pages", pagesSpec, workPath, fmt.Sprintf("-%d", deg)); err != nil {
+                                logger(ctx).Error("organize rotate failed", "error", err.Error())
+                                return nil, opFail(http.StatusInternalServerError, "failed to rotate pages")
                         }
                 }
         }
 
-        outName := buildOutputName(header.Filename, "organized")
+        outName := buildOutputName(in.File().Name, "organized")
         outPath := filepath.Join(dir, outName)
 
         // Reorder + delete by collecting pages in the specified order.
-        if err := runCommand(dir, "pdfcpu", "collect", "-pages", order, workPath, outPath); err != nil {
-                log.Printf("organize collect error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to organize PDF")
-                return
+        if err := runCommand(ctx, dir, "pdfcpu", "collect", "-pages", order, workPath, outPath); err != nil {
+                logger(ctx).Error("organize collect failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to organize PDF")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
 func buildPreviewURL(r *http.Request, jobID, filename string) string {
         base := inferBaseURL(r)
-        return fmt.Sprintf("%s/previews/%s/%s", base, jobID, filename)
+        rel := jobID + "/" + filepath.ToSlash(filename)
+        return fmt.Sprintf("%s/previews/%s?%s", base, rel, signer.sign(urlKindPreview, rel, ""))
 }
 
-func newJobDir() (string, string, error) {
+// newJobDir allocates a job ID and its working directory. When ctx belongs to
+// an async job, the job's own directory is reused so that the download URL
+// produced by the handler points at the job the client is polling.
+//
+// The directory is always local scratch space; its layout doubles as the
+// job's key space in the storage backend (see storageKey), so files saved
+// here by receiveOperationInput or zipDirectory are persisted under
+// "<jobId>/<name>".
+func newJobDir(ctx context.Context) (string, string, error) {
+        if job := jobFromContext(ctx); job != nil {
+                return job.rec.ID, job.dir, nil
+        }
         jobID := uuid.NewString()
         dir := filepath.Join(baseWorkDir, jobID)
         if err := os.MkdirAll(dir, 0o755); err != nil {
                 return "", "", err
         }
+        requestSweep()
         return jobID, dir, nil
 }
 
@@ -2172,8 +1842,10 @@ func writeJSON(w http.ResponseWriter, status int, v any) {
         _ = json.NewEncoder(w).Encode(v)
 }
 
+// errorJSON writes an error response with the default code for status; see
+// errors.go for responses with a specific code or parameter.
 func errorJSON(w http.ResponseWriter, status int, msg string) {
-        writeJSON(w, status, map[string]string{"error": msg})
+        writeAPIError(w, status, apiError{Error: msg})
 }
 
 func inferBaseURL(r *http.Request) string {
@@ -2185,91 +1857,97 @@ func inferBaseURL(r *http.Request) string {
 }
 
 func buildDownloadURL(r *http.Request, jobID, filename string) string {
+        // With an object store, hand out a presigned URL so that the download
+        // doesn't pass through this server at all, unless the job must be
+        // purged once downloaded, which only serveDownload can notice.
+        if !deleteAfterDownload(jobID) {
+                if u, err := store.PresignURL(r.Context(), jobID+"/"+filename, filename); err != nil {
+                        logger(r.Context()).Error("presign failed", "component", "storage", "job_id", jobID, "file", filename, "error", err.Error())
+                } else if u != "" {
+                        return u
+                }
+        }
         // Use /downloads/ path to bypass rate limiting middleware on /api/pdf
-        return fmt.Sprintf("/downloads/%s/%s", jobID, filename)
+        rel := jobID + "/" + filename
+        nonce := ""
+        if wantsSingleUse(r) {
+                nonce = newNonce()
+        }
+        return fmt.Sprintf("/downloads/%s?%s", rel, signer.sign(urlKindDownload, rel, nonce))
 }
 
+// getMaxFileSizeBytes returns the per-file size limit of the request's plan
+// (see limits.go), 0 for unlimited.
 func getMaxFileSizeBytes(r *http.Request) int64 {
-        plan := r.Header.Get("X-PDF-User-Plan")
-        switch plan {
-        case "pro":
-                return 0 // no limit
-        case "free":
-                return 11 * 1024 * 1024 // 11MB
-        default:
-                return 7 * 1024 * 1024 // 7MB anonymous
-        }
+        return planLimits[requestPlan(r)].maxFileSizeBytes()
 }
 
-func checkFileSize(w http.ResponseWriter, r *http.Request, header *multipart.FileHeader) bool {
-        maxSize := getMaxFileSizeBytes(r)
-        if maxSize <= 0 {
-                return true // no limit (pro)
-        }
-        if header.Size > maxSize {
-                plan := r.Header.Get("X-PDF-User-Plan")
-                sizeMB := float64(header.Size) / 1024 / 1024
-                limitMB := float64(maxSize) / 1024 / 1024
-                if plan == "anonymous" || plan == "" {
-                        errorJSON(w, http.StatusUnauthorized, fmt.Sprintf(
-                                "File \"%s\" is %.1fMB. Please log in to upload files up to 11MB.",
-                                header.Filename, sizeMB))
-                } else {
-                        errorJSON(w, http.StatusRequestEntityTooLarge, fmt.Sprintf(
-                                "File \"%s\" is %.1fMB which exceeds the %.0fMB per-file limit. Upgrade to Pro for unlimited file sizes.",
-                                header.Filename, sizeMB, limitMB))
-                }
-                return false
+// runCommand runs an external tool in dir once the scheduler grants it a slot.
+// The process group is killed when ctx is cancelled (client disconnect) or when
+// the tool's timeout (see toolTimeout) expires.
+func runCommand(ctx context.Context, dir string, name string, args ...string) (err error) {
+        ctx, span := startToolSpan(ctx, name, args)
+        defer func() { endToolSpan(span, err) }()
+        queued := time.Now()
+        release, err := scheduler.acquire(ctx, name)
+        if err != nil {
+                return err
         }
-        return true
-}
-
-func checkMultipleFileSizes(w http.ResponseWriter, r *http.Request, headers []*multipart.FileHeader) bool {
-        for _, h := range headers {
-                if !checkFileSize(w, r, h) {
-                        return false
+        defer release()
+        span.SetAttributes(attribute.Int64("scheduler.wait_ms", time.Since(queued).Milliseconds()))
+        ctx, cancel := context.WithTimeout(ctx, toolTimeout(name))
+        defer cancel()
+        cmd := commandContext(ctx, name, args...)
+        cmd.Dir = dir
+        start := time.Now()
+        out, err := cmd.CombinedOutput()
+        observeTool(ctx, filepath.Base(name), start, err)
+        logToolRun(ctx, name, args, start, out, err)
+        if err != nil {
+                if ctxErr := ctx.Err(); ctxErr != nil {
+                        err = fmt.Errorf("%s: %w", name, ctxErr)
                 }
+                te := &toolError{Tool: filepath.Base(name), Output: string(out), Err: err}
+                noteToolResult(ctx, te)
+                return te
         }
-        return true
+        noteToolResult(ctx, nil)
+        return nil
 }
 
-func saveUploadedFile(fileHeader *multipart.FileHeader, dst string) error {
-        src, err := fileHeader.Open()
+func runCommandOutput(ctx context.Context, dir string, name string, args ...string) (_ string, err error) {
+        ctx, span := startToolSpan(ctx, name, args)
+        defer func() { endToolSpan(span, err) }()
+        queued := time.Now()
+        release, err := scheduler.acquire(ctx, name)
         if err != nil {
-                return err
+                return "", err
         }
-        defer src.Close()
-
-        out, err := os.Create(dst)
+        defer release()
+        span.SetAttributes(attribute.Int64("scheduler.wait_ms", time.Since(queued).Milliseconds()))
+        ctx, cancel := context.WithTimeout(ctx, toolTimeout(name))
+        defer cancel()
+        cmd := commandContext(ctx, name, args...)
+        cmd.Dir = dir
+        start := time.Now()
+        out, err := cmd.CombinedOutput()
+        observeTool(ctx, filepath.Base(name), start, err)
+        logToolRun(ctx, name, args, start, out, err)
         if err != nil {
-                return err
+                if ctxErr := ctx.Err(); ctxErr != nil {
+                        err = fmt.Errorf("%s: %w", name, ctxErr)
+                }
+                te := &toolError{Tool: filepath.Base(name), Output: string(out), Err: err}
+                noteToolResult(ctx, te)
+                return string(out), te
         }
-        defer out.Close()
+        noteToolResult(ctx, nil)
+        return string(out), nil
+}
 
-        _, err = io.Copy(out, src)
-        return err
-}
-
-func runCommand(dir string, name string, args ...string) error {
-        ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
-        defer cancel()
-        cmd := exec.CommandContext(ctx, name, args...)
-        cmd.Dir = dir
-        out, err := cmd.CombinedOutput()
-        if err != nil {
-                log.Printf("[runCommand] %s %v failed: %v\nOutput: %s", name, args, err, string(out))
-        }
-        return err
-}
-
-func runCommandOutput(dir string, name string, args ...string) (string, error) {
-        cmd := exec.Command(name, args...)
-        cmd.Dir = dir
-        out, err := cmd.CombinedOutput()
-        return string(out), err
-}
-
-func runChromiumPDF(dir, outputPath, inputSource string) error {
+func runChromiumPDF(ctx context.Context, dir, outputPath, inputSource string) (err error) {
+        ctx, span := startToolSpan(ctx, "chromium", []string{"--print-to-pdf", inputSource})
+        defer func() { endToolSpan(span, err) }()
         scriptContent := fmt.Sprintf(`#!/bin/sh
 exec chromium --headless --disable-gpu --no-sandbox --disable-dev-shm-usage --print-to-pdf="%s" --no-pdf-header-footer "%s" 2>/dev/null
 `, outputPath, inputSource)
@@ -2277,30 +1955,57 @@ exec chromium --headless --disable-gpu --no-sandbox --disable-dev-shm-usage --pr
         if err := os.WriteFile(scriptPath, []byte(scriptContent), 0o755); err != nil {
                 return fmt.Errorf("failed to write chrome script: %v", err)
         }
-        log.Printf("[chromium] starting: input=%s output=%s", inputSource, outputPath)
-        ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+        queued := time.Now()
+        release, err := scheduler.acquire(ctx, "chromium")
+        if err != nil {
+                return fmt.Errorf("chromium failed: %w", err)
+        }
+        defer release()
+        span.SetAttributes(attribute.Int64("scheduler.wait_ms", time.Since(queued).Milliseconds()))
+        ctx, cancel := context.WithTimeout(ctx, toolTimeout("chromium"))
         defer cancel()
-        cmd := exec.CommandContext(ctx, "/bin/sh", scriptPath)
+        cmd := commandContext(ctx, "/bin/sh", scriptPath)
         cmd.Dir = dir
+        start := time.Now()
         out, err := cmd.CombinedOutput()
+        observeTool(ctx, "chromium", start, err)
+        logToolRun(ctx, "chromium", []string{inputSource}, start, out, err)
         if err != nil {
-                log.Printf("[chromium] failed: %v output: %s", err, string(out))
-                return fmt.Errorf("chromium failed: %v", err)
+                if ctxErr := ctx.Err(); ctxErr != nil {
+                        err = ctxErr
+                }
+                te := &toolError{Tool: "chromium", Output: string(out), Err: fmt.Errorf("chromium failed: %w", err)}
+                noteToolResult(ctx, te)
+                return te
         }
-        log.Printf("[chromium] success")
+        noteToolResult(ctx, nil)
         return nil
 }
 
-func zipDirectory(srcDir, zipPath string) error {
+// zipDirectory zips srcDir into zipPath and persists the archive in the
+// storage backend.
+func zipDirectory(ctx context.Context, srcDir, zipPath string) (err error) {
+        ctx, span := startSpan(ctx, "zip", attribute.String("file.name", filepath.Base(zipPath)))
+        defer func() { endSpan(span, err) }()
         f, err := os.Create(zipPath)
         if err != nil {
                 return err
         }
-        defer f.Close()
-
         zw := zip.NewWriter(f)
-        defer zw.Close()
+        werr := writeZipEntries(zw, srcDir)
+        if err := zw.Close(); werr == nil {
+                werr = err
+        }
+        if err := f.Close(); werr == nil {
+                werr = err
+        }
+        if werr != nil {
+                return werr
+        }
+        return persistFile(ctx, zipPath)
+}
 
+func writeZipEntries(zw *zip.Writer, srcDir string) error {
         return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
                 if err != nil {
                         return err
@@ -2329,99 +2034,38 @@ func zipDirectory(srcDir, zipPath string) error {
 
 // === Handlers ===
 
-func handleMerge(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-
-        if err := r.ParseMultipartForm(256 << 20); err != nil { // 256MB
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        files := r.MultipartForm.File["files"]
-        if len(files) == 0 {
-                errorJSON(w, http.StatusBadRequest, "no files provided")
-                return
-        }
-        if !checkMultipleFileSizes(w, r, files) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
+func opMerge(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
         var inputPaths []string
-        for i, fh := range files {
-                inPath := filepath.Join(dir, fmt.Sprintf("input_%d.pdf", i))
-                if err := saveUploadedFile(fh, inPath); err != nil {
-                        errorJSON(w, http.StatusInternalServerError, "failed to save input file")
-                        return
-                }
-                inputPaths = append(inputPaths, inPath)
+        for _, f := range in.Files {
+                inputPaths = append(inputPaths, f.Path)
         }
 
         // Use first file's name as base for merged output
-        firstFileName := ""
-        if len(files) > 0 {
-                firstFileName = files[0].Filename
-        }
-        outName := buildOutputName(firstFileName, "merged")
+        outName := buildOutputName(in.File().Name, "merged")
         outPath := filepath.Join(dir, outName)
 
         args := append([]string{"merge", outPath}, inputPaths...)
-        if err := runCommand(dir, "pdfcpu", args...); err != nil {
-                log.Printf("merge error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to merge PDFs")
-                return
+        if err := runCommand(ctx, dir, "pdfcpu", args...); err != nil {
+                logger(ctx).Error("merge failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to merge PDFs")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handleSplit(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        file, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-        file.Close()
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        origBase := baseNameWithoutExt(header.Filename)
-        inPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(header, inPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+func opSplit(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        mode := r.FormValue("mode")
-        ranges := r.FormValue("ranges")
-        merge := r.FormValue("merge") == "true"
+        origBase := baseNameWithoutExt(in.File().Name)
+        inPath := in.File().Path
+        mode := in.Param("mode")
+        ranges := in.Param("ranges")
+        merge := in.Param("merge") == "true"
 
         // Handle mobile app "pages" field - treat as extract_merge
-        pages := r.FormValue("pages")
+        pages := in.Param("pages")
         if pages != "" && mode == "" {
                 mode = "extract_merge"
                 ranges = pages
@@ -2432,30 +2076,27 @@ func handleSplit(w http.ResponseWriter, r *http.Request) {
                 rangeList := strings.Split(ranges, ",")
                 partsDir := filepath.Join(dir, "parts")
                 if err := os.MkdirAll(partsDir, 0o755); err != nil {
-                        errorJSON(w, http.StatusInternalServerError, "failed to create parts dir")
-                        return
+                        return nil, opFail(http.StatusInternalServerError, "failed to create parts dir")
                 }
 
                 for i, rng := range rangeList {
                         outName := fmt.Sprintf("%s_part_%d.pdf", origBase, i+1)
                         outPath := filepath.Join(partsDir, outName)
                         args := []string{inPath, "--pages", inPath, rng, "--", outPath}
-                        if err := runCommand(dir, "qpdf", args...); err != nil {
-                                log.Printf("fixed_parts split error: %v", err)
-                                errorJSON(w, http.StatusInternalServerError, "failed to split PDF into parts")
-                                return
+                        if err := runCommand(ctx, dir, "qpdf", args...); err != nil {
+                                logger(ctx).Error("fixed_parts split failed", "error", err.Error())
+                                return nil, opFail(http.StatusInternalServerError, "failed to split PDF into parts")
                         }
+                        setJobProgress(ctx, float64(i+1)/float64(len(rangeList)+1))
                 }
 
                 zipName := fmt.Sprintf("%s_split_parts.zip", origBase)
                 zipPath := filepath.Join(dir, zipName)
-                if err := zipDirectory(partsDir, zipPath); err != nil {
-                        errorJSON(w, http.StatusInternalServerError, "failed to zip parts")
-                        return
+                if err := zipDirectory(ctx, partsDir, zipPath); err != nil {
+                        return nil, opFail(http.StatusInternalServerError, "failed to zip parts")
                 }
 
-                writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, zipName)})
-                return
+                return fileResult(zipName), nil
         }
 
         // Mode: extract_merge - extract specific pages and merge into one PDF
@@ -2463,44 +2104,40 @@ func handleSplit(w http.ResponseWriter, r *http.Request) {
                 outName := fmt.Sprintf("%s_extracted.pdf", origBase)
                 outPath := filepath.Join(dir, outName)
                 args := []string{inPath, "--pages", inPath, ranges, "--", outPath}
-                if err := runCommand(dir, "qpdf", args...); err != nil {
-                        log.Printf("extract_merge error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to extract and merge pages")
-                        return
+                if err := runCommand(ctx, dir, "qpdf", args...); err != nil {
+                        logger(ctx).Error("extract_merge failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to extract and merge pages")
                 }
-                writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
-                return
+                return fileResult(outName), nil
         }
 
         // Mode: extract - extract pages into separate PDFs
         if mode == "extract" && ranges != "" {
                 pagesDir := filepath.Join(dir, "extracted")
                 if err := os.MkdirAll(pagesDir, 0o755); err != nil {
-                        errorJSON(w, http.StatusInternalServerError, "failed to create extracted dir")
-                        return
+                        return nil, opFail(http.StatusInternalServerError, "failed to create extracted dir")
                 }
 
                 // Parse ranges like "1,5-8" into individual pages
                 pageNums := parsePageRanges(ranges)
-                for _, pageNum := range pageNums {
+                for i, pageNum := range pageNums {
+                        setJobProgress(ctx, float64(i)/float64(len(pageNums)+1))
                         outName := fmt.Sprintf("%s_page_%d.pdf", origBase, pageNum)
                         outPath := filepath.Join(pagesDir, outName)
                         args := []string{inPath, "--pages", inPath, fmt.Sprintf("%d", pageNum), "--", outPath}
-                        if err := runCommand(dir, "qpdf", args...); err != nil {
-                                log.Printf("extract page %d error: %v", pageNum, err)
+                        if err := runCommand(ctx, dir, "qpdf", args...); err != nil {
+                                logger(ctx).Error("extract page failed", "page", pageNum, "error", err.Error())
                                 continue
                         }
                 }
 
                 zipName := fmt.Sprintf("%s_extracted_pages.zip", origBase)
                 zipPath := filepath.Join(dir, zipName)
-                if err := zipDirectory(pagesDir, zipPath); err != nil {
-                        errorJSON(w, http.StatusInternalServerError, "failed to zip extracted pages")
-                        return
+                if err := zipDirectory(ctx, pagesDir, zipPath); err != nil {
+                        return nil, opFail(http.StatusInternalServerError, "failed to zip extracted pages")
                 }
 
-                writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, zipName)})
-                return
+                return fileResult(zipName), nil
         }
 
         // Mode: ranges with merge option
@@ -2509,67 +2146,59 @@ func handleSplit(w http.ResponseWriter, r *http.Request) {
                         outName := fmt.Sprintf("%s_merged.pdf", origBase)
                         outPath := filepath.Join(dir, outName)
                         args := []string{inPath, "--pages", inPath, ranges, "--", outPath}
-                        if err := runCommand(dir, "qpdf", args...); err != nil {
-                                log.Printf("merge ranges error: %v", err)
-                                errorJSON(w, http.StatusInternalServerError, "failed to merge ranges")
-                                return
+                        if err := runCommand(ctx, dir, "qpdf", args...); err != nil {
+                                logger(ctx).Error("merge ranges failed", "error", err.Error())
+                                return nil, opFail(http.StatusInternalServerError, "failed to merge ranges")
                         }
-                        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
-                        return
+                        return fileResult(outName), nil
                 }
 
                 // Split into separate files for each range
                 rangeList := strings.Split(ranges, ",")
                 partsDir := filepath.Join(dir, "ranges")
                 if err := os.MkdirAll(partsDir, 0o755); err != nil {
-                        errorJSON(w, http.StatusInternalServerError, "failed to create ranges dir")
-                        return
+                        return nil, opFail(http.StatusInternalServerError, "failed to create ranges dir")
                 }
 
                 for i, rng := range rangeList {
                         outName := fmt.Sprintf("%s_range_%d.pdf", origBase, i+1)
                         outPath := filepath.Join(partsDir, outName)
                         args := []string{inPath, "--pages", inPath, rng, "--", outPath}
-                        if err := runCommand(dir, "qpdf", args...); err != nil {
-                                log.Printf("range split error: %v", err)
+                        if err := runCommand(ctx, dir, "qpdf", args...); err != nil {
+                                logger(ctx).Error("range split failed", "error", err.Error())
                                 continue
                         }
                 }
 
                 zipName := fmt.Sprintf("%s_split_ranges.zip", origBase)
                 zipPath := filepath.Join(dir, zipName)
-                if err := zipDirectory(partsDir, zipPath); err != nil {
-                        errorJSON(w, http.StatusInternalServerError, "failed to zip ranges")
-                        return
+                if err := zipDirectory(ctx, partsDir, zipPath); err != nil {
+                        return nil, opFail(http.StatusInternalServerError, "failed to zip ranges")
                 }
 
-                writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, zipName)})
-                return
+                return fileResult(zipName), nil
         }
 
         // Default: split into individual pages and zip them
         pagesDir := filepath.Join(dir, "pages")
         if err := os.MkdirAll(pagesDir, 0o755); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create pages dir")
-                return
+                return nil, opFail(http.StatusInternalServerError, "failed to create pages dir")
         }
 
         args := []string{"extract", "-mode", "page", inPath, pagesDir}
 
-        if err := runCommand(dir, "pdfcpu", args...); err != nil {
-                log.Printf("split error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to split PDF")
-                return
+        if err := runCommand(ctx, dir, "pdfcpu", args...); err != nil {
+                logger(ctx).Error("split failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to split PDF")
         }
 
         zipName := fmt.Sprintf("%s_split_pages.zip", origBase)
         zipPath := filepath.Join(dir, zipName)
-        if err := zipDirectory(pagesDir, zipPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to zip pages")
-                return
+        if err := zipDirectory(ctx, pagesDir, zipPath); err != nil {
+                return nil, opFail(http.StatusInternalServerError, "failed to zip pages")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, zipName)})
+        return fileResult(zipName), nil
 }
 
 // parsePageRanges parses a string like "1,5-8" into individual page numbers
@@ -2596,165 +2225,77 @@ func parsePageRanges(ranges string) []int {
         return pages
 }
 
-func handleRemovePages(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        inPath := filepath.Join(dir, header.Filename)
-        if err := saveUploadedFile(header, inPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+func opRemovePages(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        pages := r.FormValue("pages")
+        inPath := in.File().Path
+        pages := in.Param("pages")
         if pages == "" {
-                errorJSON(w, http.StatusBadRequest, "pages is required")
-                return
+                return nil, opParamFail("pages", "pages is required")
         }
 
-        outName := buildOutputName(header.Filename, "removedpages")
+        outName := buildOutputName(in.File().Name, "removedpages")
         outPath := filepath.Join(dir, outName)
 
         args := []string{"pages", "remove", "-pages", pages, inPath, outPath}
-        if err := runCommand(dir, "pdfcpu", args...); err != nil {
-                log.Printf("remove pages error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to remove pages")
-                return
+        if err := runCommand(ctx, dir, "pdfcpu", args...); err != nil {
+                logger(ctx).Error("remove pages failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to remove pages")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handleExtractPages(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        inPath := filepath.Join(dir, header.Filename)
-        if err := saveUploadedFile(header, inPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+func opExtractPages(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        mode := r.FormValue("mode")
-        ranges := r.FormValue("ranges")
+        inPath := in.File().Path
+        mode := in.Param("mode")
+        ranges := in.Param("ranges")
 
         if mode == "ranges" && ranges != "" {
-                outName := buildOutputName(header.Filename, "extracted")
+                outName := buildOutputName(in.File().Name, "extracted")
                 outPath := filepath.Join(dir, outName)
                 args := []string{"collect", "-pages", ranges, inPath, outPath}
-                if err := runCommand(dir, "pdfcpu", args...); err != nil {
-                        log.Printf("extract ranges error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to extract pages")
-                        return
+                if err := runCommand(ctx, dir, "pdfcpu", args...); err != nil {
+                        logger(ctx).Error("extract ranges failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to extract pages")
                 }
-                writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
-                return
+                return fileResult(outName), nil
         }
 
         // mode == all -> ZIP with each page
         pagesDir := filepath.Join(dir, "pages")
         if err := os.MkdirAll(pagesDir, 0o755); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create pages dir")
-                return
+                return nil, opFail(http.StatusInternalServerError, "failed to create pages dir")
         }
 
         args := []string{"extract", "-mode", "page", inPath, pagesDir}
-        if err := runCommand(dir, "pdfcpu", args...); err != nil {
-                log.Printf("extract all pages error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to extract pages")
-                return
+        if err := runCommand(ctx, dir, "pdfcpu", args...); err != nil {
+                logger(ctx).Error("extract all pages failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to extract pages")
         }
 
         zipPath := filepath.Join(dir, "extracted_pages.zip")
-        if err := zipDirectory(pagesDir, zipPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to zip pages")
-                return
+        if err := zipDirectory(ctx, pagesDir, zipPath); err != nil {
+                return nil, opFail(http.StatusInternalServerError, "failed to zip pages")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, "extracted_pages.zip")})
+        return fileResult("extracted_pages.zip"), nil
 }
 
 
-func handleCompress(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        inPath := filepath.Join(dir, header.Filename)
-        if err := saveUploadedFile(header, inPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+func opCompress(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        level := strings.ToLower(r.FormValue("level"))
+        inPath := in.File().Path
+        level := strings.ToLower(in.Param("level"))
         if level == "" {
                 level = "medium"
         }
-        targetSizeKB := parseIntDefault(r.FormValue("targetSize"), 0)
+        targetSizeKB := parseIntDefault(in.Param("targetSize"), 0)
 
-        outName := buildOutputName(header.Filename, "compressed")
+        outName := buildOutputName(in.File().Name, "compressed")
         outPath := filepath.Join(dir, outName)
 
         // For custom target size, use iterative compression
@@ -2773,7 +2314,7 @@ func handleCompress(w http.ResponseWriter, r *http.Request) {
                                 "-sOutputFile=" + outPath,
                                 inPath,
                         }
-                        if err := runCommand(dir, "gs", args...); err != nil {
+                        if err := runCommand(ctx, dir, "gs", args...); err != nil {
                                 continue
                         }
                         fi, err := os.Stat(outPath)
@@ -2797,7 +2338,7 @@ func handleCompress(w http.ResponseWriter, r *http.Request) {
                                 "-sOutputFile=" + outPath,
                                 inPath,
                         }
-                        if err := runCommand(dir, "gs", args...); err != nil {
+                        if err := runCommand(ctx, dir, "gs", args...); err != nil {
                                 continue
                         }
                         fi, err = os.Stat(outPath)
@@ -2828,131 +2369,73 @@ func handleCompress(w http.ResponseWriter, r *http.Request) {
                         inPath,
                 }
 
-                if err := runCommand(dir, "gs", args...); err != nil {
-                        log.Printf("compress error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to compress PDF")
-                        return
+                if err := runCommand(ctx, dir, "gs", args...); err != nil {
+                        logger(ctx).Error("compress failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to compress PDF")
                 }
         }
 
         // Verify output exists
         if _, err := os.Stat(outPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "compression failed")
-                return
+                return nil, opFail(http.StatusInternalServerError, "compression failed")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handleRepair(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        inPath := filepath.Join(dir, header.Filename)
-        if err := saveUploadedFile(header, inPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+func opRepair(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        outName := buildOutputName(header.Filename, "repaired")
+        inPath := in.File().Path
+        outName := buildOutputName(in.File().Name, "repaired")
         outPath := filepath.Join(dir, outName)
 
         // pdfcpu optimize also repairs many structural issues.
         args := []string{"optimize", inPath, outPath}
-        if err := runCommand(dir, "pdfcpu", args...); err != nil {
-                log.Printf("repair error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to repair PDF")
-                return
+        if err := runCommand(ctx, dir, "pdfcpu", args...); err != nil {
+                logger(ctx).Error("repair failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to repair PDF")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handleOCR(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        inPath := filepath.Join(dir, header.Filename)
-        if err := saveUploadedFile(header, inPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+func opOCR(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        outName := buildOutputName(header.Filename, "ocr")
+        inPath := in.File().Path
+        outName := buildOutputName(in.File().Name, "ocr")
         outPath := filepath.Join(dir, outName)
 
-        lang := r.FormValue("lang")
+        lang := in.Param("lang")
         args := []string{"--force-ocr", "--optimize", "1", "--output-type", "pdf"}
         if lang != "" {
                 args = append(args, "-l", lang)
         }
         args = append(args, inPath, outPath)
 
-        if err := runCommand(dir, "ocrmypdf", args...); err != nil {
-                log.Printf("ocr error with --force-ocr: %v, trying --skip-text", err)
+        if err := runCommand(ctx, dir, "ocrmypdf", args...); err != nil {
+                logger(ctx).Warn("ocr with --force-ocr failed, trying --skip-text", "error", err.Error())
                 args2 := []string{"--skip-text", "--optimize", "1", "--output-type", "pdf"}
                 if lang != "" {
                         args2 = append(args2, "-l", lang)
                 }
                 args2 = append(args2, inPath, outPath)
-                if err2 := runCommand(dir, "ocrmypdf", args2...); err2 != nil {
-                        log.Printf("ocr error with --skip-text: %v", err2)
-                        errorJSON(w, http.StatusInternalServerError, "failed to OCR PDF")
-                        return
+                if err2 := runCommand(ctx, dir, "ocrmypdf", args2...); err2 != nil {
+                        logger(ctx).Error("ocr with --skip-text failed", "error", err2.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to OCR PDF")
                 }
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func convertToJPEG(dir string, imgPath string, index int) (string, error) {
+func convertToJPEG(ctx context.Context, dir string, imgPath string, index int) (string, error) {
         ext := strings.ToLower(filepath.Ext(imgPath))
         if ext == ".heic" || ext == ".heif" || ext == ".webp" || ext == ".bmp" || ext == ".tiff" || ext == ".tif" {
                 jpgPath := filepath.Join(dir, fmt.Sprintf("converted_%d.jpg", index))
                 args := []string{imgPath, "-quality", "95", jpgPath}
-                if err := runCommand(dir, "convert", args...); err != nil {
+                if err := runCommand(ctx, dir, "convert", args...); err != nil {
                         return "", fmt.Errorf("failed to convert %s: %v", ext, err)
                 }
                 return jpgPath, nil
@@ -2967,18 +2450,18 @@ func convertToJPEG(dir string, imgPath string, index int) (string, error) {
                 if err == nil {
                         return imgPath, nil
                 }
-                log.Printf("image decode failed for %s, attempting ImageMagick convert", imgPath)
+                logger(ctx).Warn("image decode failed, attempting ImageMagick convert", "image", imgPath)
                 jpgPath := filepath.Join(dir, fmt.Sprintf("converted_%d.jpg", index))
                 args := []string{imgPath, "-quality", "95", jpgPath}
-                if cerr := runCommand(dir, "convert", args...); cerr != nil {
+                if cerr := runCommand(ctx, dir, "convert", args...); cerr != nil {
                         return imgPath, nil
                 }
                 return jpgPath, nil
         }
         jpgPath := filepath.Join(dir, fmt.Sprintf("converted_%d.jpg", index))
         args := []string{imgPath, "-quality", "95", jpgPath}
-        if err := runCommand(dir, "convert", args...); err != nil {
-                log.Printf("fallback convert failed for %s: %v", imgPath, err)
+        if err := runCommand(ctx, dir, "convert", args...); err != nil {
+                logger(ctx).Error("fallback convert failed", "image", imgPath, "error", err.Error())
                 return imgPath, nil
         }
         return jpgPath, nil
@@ -2997,34 +2480,12 @@ func getPageDimensions(pageSize string) (float64, float64) {
         }
 }
 
-func handleImageToPDF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(256 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        files := r.MultipartForm.File["files"]
-        if len(files) == 0 {
-                errorJSON(w, http.StatusBadRequest, "no files provided")
-                return
-        }
-        if !checkMultipleFileSizes(w, r, files) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
+func opImageToPDF(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        layout := r.FormValue("layout")
-        pageSize := r.FormValue("pageSize")
-        marginStr := r.FormValue("margin")
+        layout := in.Param("layout")
+        pageSize := in.Param("pageSize")
+        marginStr := in.Param("margin")
         margin := 10.0
         if marginStr != "" {
                 if m, err := strconv.ParseFloat(marginStr, 64); err == nil {
@@ -3033,21 +2494,17 @@ func handleImageToPDF(w http.ResponseWriter, r *http.Request) {
         }
 
         var imagePaths []string
-        for i, fh := range files {
-                inPath := filepath.Join(dir, fmt.Sprintf("image_%d%s", i, filepath.Ext(fh.Filename)))
-                if err := saveUploadedFile(fh, inPath); err != nil {
-                        errorJSON(w, http.StatusInternalServerError, "failed to save image")
-                        return
-                }
-                converted, cerr := convertToJPEG(dir, inPath, i)
+        for i, f := range in.Files {
+                inPath := f.Path
+                converted, cerr := convertToJPEG(ctx, dir, inPath, i)
                 if cerr != nil {
-                        log.Printf("image convert warning: %v, using original", cerr)
+                        logger(ctx).Warn("image convert failed, using original", "error", cerr.Error())
                         converted = inPath
                 }
                 imagePaths = append(imagePaths, converted)
         }
 
-        outName := r.FormValue("outputFilename")
+        outName := in.Param("outputFilename")
         if outName == "" {
                 outName = defaultFilename
         }
@@ -3112,13 +2569,13 @@ func handleImageToPDF(w http.ResponseWriter, r *http.Request) {
                                 imgPath := imagePaths[j]
                                 f, ferr := os.Open(imgPath)
                                 if ferr != nil {
-                                        log.Printf("image collage: failed to open %s: %v", imgPath, ferr)
+                                        logger(ctx).Error("open image failed", "image", imgPath, "error", ferr.Error())
                                         continue
                                 }
                                 imgConfig, _, derr := image.DecodeConfig(f)
                                 f.Close()
                                 if derr != nil {
-                                        log.Printf("image collage: failed to decode %s: %v", imgPath, derr)
+                                        logger(ctx).Error("decode image failed", "image", imgPath, "error", derr.Error())
                                         continue
                                 }
 
@@ -3150,16 +2607,14 @@ func handleImageToPDF(w http.ResponseWriter, r *http.Request) {
                 for _, imgPath := range imagePaths {
                         f, ferr := os.Open(imgPath)
                         if ferr != nil {
-                                log.Printf("image to pdf: failed to open %s: %v", imgPath, ferr)
-                                errorJSON(w, http.StatusInternalServerError, "failed to convert images")
-                                return
+                                logger(ctx).Error("open image failed", "image", imgPath, "error", ferr.Error())
+                                return nil, opFail(http.StatusInternalServerError, "failed to convert images")
                         }
                         imgConfig, _, derr := image.DecodeConfig(f)
                         f.Close()
                         if derr != nil {
-                                log.Printf("image to pdf: failed to decode config %s: %v", imgPath, derr)
-                                errorJSON(w, http.StatusInternalServerError, "failed to convert images")
-                                return
+                                logger(ctx).Error("decode image config failed", "image", imgPath, "error", derr.Error())
+                                return nil, opFail(http.StatusInternalServerError, "failed to convert images")
                         }
 
                         imgW := float64(imgConfig.Width)
@@ -3196,63 +2651,35 @@ func handleImageToPDF(w http.ResponseWriter, r *http.Request) {
         }
 
         if err := pdf.OutputFileAndClose(outPath); err != nil {
-                log.Printf("image to pdf error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to convert images")
-                return
+                logger(ctx).Error("image to pdf failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to convert images")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handleWordToPDF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(128 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        inPath := filepath.Join(dir, header.Filename)
-        if err := saveUploadedFile(header, inPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+func opWordToPDF(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
+        inPath := in.File().Path
         // LibreOffice will write the PDF into the same directory.
-        if err := runCommand(dir, "libreoffice", "--headless", "--nologo", "--convert-to", "pdf", inPath); err != nil {
-                log.Printf("libreoffice error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to convert document")
-                return
+        if err := runCommand(ctx, dir, "libreoffice", "--headless", "--nologo", "--convert-to", "pdf", inPath); err != nil {
+                logger(ctx).Error("libreoffice failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to convert document")
         }
 
-        // LibreOffice names the output based on the input file with .pdf extension.
-        base := strings.TrimSuffix(header.Filename, filepath.Ext(header.Filename)) + ".pdf"
-        outName := base
-        outPath := filepath.Join(dir, outName)
-
-        if _, err := os.Stat(outPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "converted PDF not found")
-                return
+        // LibreOffice names the output based on the input file with .pdf extension;
+        // rename it after the client's document.
+        converted := strings.TrimSuffix(inPath, filepath.Ext(inPath)) + ".pdf"
+        if _, err := os.Stat(converted); err != nil {
+                return nil, opFail(http.StatusInternalServerError, "converted PDF not found")
+        }
+        outName := baseNameWithoutExt(in.File().Name) + ".pdf"
+        if err := os.Rename(converted, filepath.Join(dir, outName)); err != nil {
+                return nil, opFail(http.StatusInternalServerError, "converted PDF not found")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
 func handlePreview(w http.ResponseWriter, r *http.Request) {
@@ -3260,32 +2687,25 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
                 errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
                 return
         }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
 
-        jobID, dir, err := newJobDir()
+        jobID, dir, err := newJobDir(r.Context())
         if err != nil {
                 errorJSON(w, http.StatusInternalServerError, "failed to create job")
                 return
         }
+        defer markJobActive(jobID)()
 
-        // Use a stable filename so the previews handler can reliably locate the source PDF.
-        inPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(header, inPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
+        // previewOp describes the upload like an operation taking one PDF, so
+        // it is received the same way, under the stable name input.pdf the
+        // previews handler looks for.
+        previewOp := &Operation{Name: "preview", Inputs: []string{"file"}}
+        in, err := receiveOperationInput(w, r, previewOp, jobID, dir)
+        if err != nil {
+                discardJob(r.Context(), jobID)
+                writeRequestError(w, r, err)
                 return
         }
+        inPath := in.File().Path
 
         // Progressive preview (iLovePDF-style):
         // Instead of rendering ALL pages up-front (slow for large PDFs), we:
@@ -3298,16 +2718,15 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
-        // Count pages using poppler (more tolerant + matches preview toolchain).
-        // Fallback to pdfcpu info if pdfinfo fails.
-        total, err := pageCountPoppler(dir, inPath)
+        total, err := countPages(r.Context(), inPath)
         if err != nil {
-                total, err = pageCountPDF(dir, inPath)
-                if err != nil {
-                        log.Printf("preview: page count error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to read page count")
-                        return
-                }
+                logger(r.Context()).Error("page count failed", "error", err.Error())
+                writeRequestError(w, r, pdfReadError(err))
+                return
+        }
+        if err := limitsForRequest(r).pageLimitError(in.Files, total); err != nil {
+                writeRequestError(w, r, err)
+                return
         }
 
         pages := make([]previewPage, 0, total)
@@ -3319,9 +2738,10 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
         // Render ALL pages synchronously so images are fully written before the
         // frontend starts requesting them. This avoids the race condition where
         // the browser fetches a partially-written PNG (shows half page / blank).
+        // -cropbox renders the visible area, which editors place overlays on.
         prefix := filepath.Join(previewsDir, "page")
-        if out, renderErr := runCommandOutput(dir, "pdftoppm", "-png", "-r", "110", inPath, prefix); renderErr != nil {
-                log.Printf("preview render error: %v output=%s", renderErr, out)
+        if out, renderErr := runCommandOutput(r.Context(), dir, "pdftoppm", "-png", "-cropbox", "-r", strconv.Itoa(config.Render.PreviewDPI), inPath, prefix); renderErr != nil {
+                logger(r.Context()).Error("preview render failed", "error", renderErr.Error(), "output", truncateForLog(out, 4096))
         }
 
         // pdftoppm may produce zero-padded filenames (page-01.png vs page-1.png).
@@ -3344,7 +2764,10 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
                 }
         }
 
-        writeJSON(w, http.StatusOK, previewResponse{Pages: pages})
+        writeJSON(w, http.StatusOK, previewResponse{
+                Pages:  pages,
+                FileID: newFileID(jobID, filepath.Base(inPath), in.File().Name),
+        })
 }
 
 func serveDownload(w http.ResponseWriter, r *http.Request) {
@@ -3357,19 +2780,50 @@ func serveDownload(w http.ResponseWriter, r *http.Request) {
         }
         clean := filepath.Clean(rel)
         if strings.Contains(clean, "..") {
-                http.Error(w, "forbidden", http.StatusForbidden)
+                errorJSON(w, http.StatusForbidden, "forbidden")
+                return
+        }
+        if err := signer.verify(r, urlKindDownload, filepath.ToSlash(clean)); err != nil {
+                writeURLError(w, r, err)
                 return
         }
         full := filepath.Join(baseWorkDir, clean)
 
+        // Jobs submitted with retention=delete-after-download are purged once
+        // their result has been fetched in full.
+        jobID, _, _ := strings.Cut(filepath.ToSlash(clean), "/")
+        purge := r.Method == http.MethodGet && r.Header.Get("Range") == "" && deleteAfterDownload(jobID)
+
         fi, err := os.Stat(full)
-        if err != nil || fi.IsDir() {
-                http.Error(w, "file not found", http.StatusNotFound)
+        if err == nil && !fi.IsDir() {
+                w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(fi.Name()))
+                http.ServeFile(w, r, full)
+                if purge {
+                        removeJob(jobID)
+                }
                 return
         }
 
-        w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(fi.Name()))
-        http.ServeFile(w, r, full)
+        // Not in local scratch space (another replica ran the job, or the
+        // directory was cleaned up): stream it from the storage backend.
+        obj, info, err := store.Open(r.Context(), filepath.ToSlash(clean))
+        if err != nil {
+                if !errors.Is(err, errStorageNotFound) {
+                        logger(r.Context()).Error("open failed", "component", "storage", "path", clean, "error", err.Error())
+                }
+                errorJSON(w, http.StatusNotFound, "file not found")
+                return
+        }
+        defer obj.Close()
+        name := filepath.Base(clean)
+        w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(name))
+        if w.Header().Get("Content-Type") == "" {
+                w.Header().Set("Content-Type", contentTypeForName(name))
+        }
+        http.ServeContent(w, r, name, info.ModTime, obj)
+        if purge {
+                removeJob(jobID)
+        }
 }
 
 func servePreview(w http.ResponseWriter, r *http.Request) {
@@ -3382,7 +2836,11 @@ func servePreview(w http.ResponseWriter, r *http.Request) {
         }
         clean := filepath.Clean(rel)
         if strings.Contains(clean, "..") {
-                http.Error(w, "forbidden", http.StatusForbidden)
+                errorJSON(w, http.StatusForbidden, "forbidden")
+                return
+        }
+        if err := signer.verify(r, urlKindPreview, filepath.ToSlash(clean)); err != nil {
+                writeURLError(w, r, err)
                 return
         }
         full := filepath.Join(baseWorkDir, clean)
@@ -3399,16 +2857,21 @@ func servePreview(w http.ResponseWriter, r *http.Request) {
                                 numStr := strings.TrimSuffix(strings.TrimPrefix(filename, "page-"), ".png")
                                 n, convErr := strconv.Atoi(numStr)
                                 if convErr == nil && n > 0 {
+                                        defer markJobActive(jobID)()
                                         jobDir := filepath.Join(baseWorkDir, jobID)
                                         srcPDF := filepath.Join(jobDir, "input.pdf")
+                                        if fetchErr := fetchFile(r.Context(), srcPDF); fetchErr != nil {
+                                                errorJSON(w, http.StatusNotFound, "file not found")
+                                                return
+                                        }
                                         previewsDir := filepath.Join(jobDir, "previews")
                                         _ = os.MkdirAll(previewsDir, 0o755)
 
                                         prefix := filepath.Join(previewsDir, "page")
                                         // Render just this page.
-                                        if out, genErr := runCommandOutput(jobDir, "pdftoppm", "-png", "-r", "110", "-f", strconv.Itoa(n), "-l", strconv.Itoa(n), srcPDF, prefix); genErr != nil {
-                                                log.Printf("lazy preview error (job=%s page=%d): %v output=%s", jobID, n, genErr, out)
-                                                http.Error(w, "failed to render preview", http.StatusInternalServerError)
+                                        if out, genErr := runCommandOutput(r.Context(), jobDir, "pdftoppm", "-png", "-cropbox", "-r", strconv.Itoa(config.Render.PreviewDPI), "-f", strconv.Itoa(n), "-l", strconv.Itoa(n), srcPDF, prefix); genErr != nil {
+                                                logger(r.Context()).Error("lazy preview failed", "job_id", jobID, "page", n, "error", genErr.Error(), "output", truncateForLog(out, 4096))
+                                                errorJSON(w, http.StatusInternalServerError, "failed to render preview")
                                                 return
                                         }
 
@@ -3430,7 +2893,7 @@ func servePreview(w http.ResponseWriter, r *http.Request) {
                                         // Retry stat after generation.
                                         fi, err = os.Stat(full)
                                         if err != nil || fi.IsDir() {
-                                                http.Error(w, "file not found", http.StatusNotFound)
+                                                errorJSON(w, http.StatusNotFound, "file not found")
                                                 return
                                         }
                                 }
@@ -3438,7 +2901,7 @@ func servePreview(w http.ResponseWriter, r *http.Request) {
                 }
 
                 if err != nil || fi.IsDir() {
-                        http.Error(w, "file not found", http.StatusNotFound)
+                        errorJSON(w, http.StatusNotFound, "file not found")
                         return
                 }
         }
@@ -3447,134 +2910,47 @@ func servePreview(w http.ResponseWriter, r *http.Request) {
         http.ServeFile(w, r, full)
 }
 
-func cleanupOldJobs(maxAge time.Duration) {
-        entries, err := os.ReadDir(baseWorkDir)
-        if err != nil {
-                return
-        }
-        cutoff := time.Now().Add(-maxAge)
-        for _, e := range entries {
-                if !e.IsDir() {
-                        continue
-                }
-                p := filepath.Join(baseWorkDir, e.Name())
-                info, err := os.Stat(p)
-                if err != nil {
-                        continue
-                }
-                if info.ModTime().Before(cutoff) {
-                        _ = os.RemoveAll(p)
-                }
-        }
-}
-
 // =============================================================================
 // PDF Security Tools: Protect, Unlock, Redact, Flatten
 // =============================================================================
 
-// handleProtectPDF encrypts a PDF with a password using 256-bit AES encryption.
-func handleProtectPDF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                log.Printf("[protect] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "parse form failed")
-                return
-        }
-
-        password := strings.TrimSpace(r.FormValue("password"))
+// opProtectPDF encrypts a PDF with a password using 256-bit AES encryption.
+func opProtectPDF(ctx context.Context, in *OpInput) (*OpResult, error) {
+        password := strings.TrimSpace(in.Param("password"))
         if password == "" {
-                errorJSON(w, http.StatusBadRequest, "password is required")
-                return
-        }
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                log.Printf("[protect] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "file required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[protect] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
+                return nil, opParamFail("password", "password is required")
         }
 
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[protect] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
+        dir := in.Dir
 
-        baseName := baseNameWithoutExt(hdr.Filename)
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
         outputName := baseName + "_protected.pdf"
         outputPath := filepath.Join(dir, outputName)
 
         // qpdf --encrypt <user-pw> <owner-pw> 256 -- input.pdf output.pdf
-        if err := runCommand(dir, "qpdf",
+        if err := runCommand(ctx, dir, "qpdf",
                 "--warning-exit-0",
                 "--encrypt", password, password, "256",
                 "--",
                 inputPath,
                 outputPath,
         ); err != nil {
-                log.Printf("[protect] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "qpdf encrypt failed: "+err.Error())
-                return
+                logger(ctx).Error("protect failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "qpdf encrypt failed: "+err.Error())
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
-// handleUnlockPDF removes password protection from a PDF.
-func handleUnlockPDF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                log.Printf("[unlock] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "parse form failed")
-                return
-        }
-
-        password := strings.TrimSpace(r.FormValue("password"))
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                log.Printf("[unlock] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "file required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[unlock] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
+// opUnlockPDF removes password protection from a PDF.
+func opUnlockPDF(ctx context.Context, in *OpInput) (*OpResult, error) {
+        password := strings.TrimSpace(in.Param("password"))
 
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[unlock] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
+        dir := in.Dir
 
-        baseName := baseNameWithoutExt(hdr.Filename)
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
         outputName := baseName + "_unlocked.pdf"
         outputPath := filepath.Join(dir, outputName)
 
@@ -3585,47 +2961,42 @@ func handleUnlockPDF(w http.ResponseWriter, r *http.Request) {
         } else {
                 args = []string{"--warning-exit-0", "--decrypt", inputPath, outputPath}
         }
-        if err := runCommand(dir, "qpdf", args...); err != nil {
-                log.Printf("[unlock] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "qpdf decrypt failed: "+err.Error())
-                return
+        if err := runCommand(ctx, dir, "qpdf", args...); err != nil {
+                logger(ctx).Error("unlock failed", "error", err.Error())
+                var te *toolError
+                if errors.As(err, &te) && strings.Contains(strings.ToLower(te.Output), "invalid password") {
+                        return nil, &opError{status: http.StatusUnprocessableEntity, code: codeEncryptedPDF,
+                                msg: "the password is incorrect", param: "password"}
+                }
+                return nil, opFail(http.StatusInternalServerError, "qpdf decrypt failed: "+err.Error())
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
-// handleRedactPDF permanently redacts specified areas from a PDF.
+// opRedactPDF permanently redacts specified areas from a PDF.
 //
-// SECURITY NOTE: This implementation performs TRUE PERMANENT REDACTION.
-// The PDF is rasterized to images, black rectangles are drawn over the
-// sensitive areas, and then converted back to PDF. The original text/vector
-// content beneath redacted areas is completely destroyed and cannot be
-// recovered. Additionally, metadata is stripped using qpdf to ensure no
-// residual information remains.
+// SECURITY NOTE: This implementation performs TRUE PERMANENT REDACTION, in
+// the pages' content rather than by rasterizing them. Text glyphs, vector
+// paths, inline images and annotations under the areas are removed, image
+// pixels under them are blanked, and the areas are filled. The document is
+// then rewritten with only the objects still in use, so the removed content
+// is gone from the file. Pages without redactions keep their content
+// streams byte for byte, and all text outside the areas stays selectable.
+// The removed text is also scrubbed from the document information, XMP
+// metadata, bookmarks and annotation text.
 //
 // Request format:
 //   - file: PDF file (multipart)
 //   - redactions: JSON array of redaction areas
 //     [{"page":1,"x":0.1,"y":0.2,"width":0.3,"height":0.1}, ...]
-//     Coordinates are percentages (0.0-1.0) relative to page dimensions.
-func handleRedactPDF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                log.Printf("[redact] parse form: %v", err)
-                errorJSON(w, http.StatusBadRequest, "parse form failed")
-                return
-        }
-
+//     Coordinates are fractions (0.0-1.0) of the page as displayed.
+//   - color: fill color of the areas (default #000000)
+func opRedactPDF(ctx context.Context, in *OpInput) (*OpResult, error) {
         // Parse redactions JSON
-        redactionsJSON := strings.TrimSpace(r.FormValue("redactions"))
+        redactionsJSON := strings.TrimSpace(in.Param("redactions"))
         if redactionsJSON == "" {
-                errorJSON(w, http.StatusBadRequest, "redactions JSON required")
-                return
+                return nil, opParamFail("redactions", "redactions JSON required")
         }
 
         type redactionArea struct {
@@ -3637,274 +3008,149 @@ func handleRedactPDF(w http.ResponseWriter, r *http.Request) {
         }
         var redactions []redactionArea
         if err := json.Unmarshal([]byte(redactionsJSON), &redactions); err != nil {
-                log.Printf("[redact] parse redactions: %v", err)
-                errorJSON(w, http.StatusBadRequest, "invalid redactions JSON: "+err.Error())
-                return
+                logger(ctx).Error("parse redactions failed", "error", err.Error())
+                return nil, opParamFail("redactions", "invalid redactions JSON: "+err.Error())
         }
         if len(redactions) == 0 {
-                errorJSON(w, http.StatusBadRequest, "at least one redaction area required")
-                return
-        }
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                log.Printf("[redact] file: %v", err)
-                errorJSON(w, http.StatusBadRequest, "file required")
-                return
+                return nil, opParamFail("redactions", "at least one redaction area required")
         }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[redact] newJobDir: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
+        var fill color.Color = color.Black
+        if c := optionalColor(in.Param("color")); c != nil {
+                fill = c
         }
 
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[redact] save: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
+        outputName := baseName + "_redacted.pdf"
+        outputPath := filepath.Join(in.Dir, outputName)
 
-        // Step 1: Render all pages to PNG at 300 DPI using pdftoppm
-        pngPrefix := filepath.Join(dir, "page")
-        if err := runCommand(dir, "pdftoppm", "-png", "-r", "300", inputPath, pngPrefix); err != nil {
-                log.Printf("[redact] pdftoppm: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "pdftoppm failed: "+err.Error())
-                return
+        doc, u, err := startOverlays(ctx, inputPath)
+        if err != nil {
+                logger(ctx).Error("parse failed", "error", err.Error())
+                return nil, err
         }
+        defer doc.Close()
 
-        // Group redactions by page number
-        pageRedactions := make(map[int][]redactionArea)
+        // Group redactions by page number, in points of the displayed page
+        pageRedactions := make(map[int][]pdfdoc.Box)
         for _, rd := range redactions {
-                pageRedactions[rd.Page] = append(pageRedactions[rd.Page], rd)
-        }
-
-        // Find all generated PNG files
-        pngFiles, err := filepath.Glob(filepath.Join(dir, "page-*.png"))
-        if err != nil || len(pngFiles) == 0 {
-                log.Printf("[redact] no pages: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "no pages generated")
-                return
-        }
-        sort.Strings(pngFiles)
-
-        // Step 2: For each page with redactions, draw black rectangles
-        for pageNum, areas := range pageRedactions {
-                // pdftoppm names files as page-1.png, page-2.png, etc. (or page-01.png for >9 pages)
-                var pngPath string
-                for _, p := range pngFiles {
-                        base := filepath.Base(p)
-                        // Extract page number from filename (page-1.png or page-01.png)
-                        var pn int
-                        if _, err := fmt.Sscanf(base, "page-%d.png", &pn); err == nil && pn == pageNum {
-                                pngPath = p
-                                break
-                        }
-                }
-                if pngPath == "" {
-                        log.Printf("[redact] page %d not found, skipping", pageNum)
-                        continue
-                }
-
-                // Get image dimensions using ImageMagick identify
-                dimOutput, err := runCommandOutput(dir, "identify", "-format", "%w %h", pngPath)
+                page, ok := doc.Page(rd.Page)
+                if !ok {
+                        return nil, &opError{status: http.StatusUnprocessableEntity, code: codePageOutOfRange, param: "redactions",
+                                msg: fmt.Sprintf("a redaction is placed on page %d, but the PDF has %d pages", rd.Page, doc.NumPages())}
+                }
+                w, h := page.Size()
+                pageRedactions[rd.Page] = append(pageRedactions[rd.Page], pdfdoc.Box{X: rd.X * w, Y: rd.Y * h, Width: rd.Width * w, Height: rd.Height * h})
+        }
+        pageNums := make([]int, 0, len(pageRedactions))
+        for n := range pageRedactions {
+                pageNums = append(pageNums, n)
+        }
+        sort.Ints(pageNums)
+
+        var removed pdfdoc.Redaction
+        var texts []string
+        for _, n := range pageNums {
+                _, span := startSpan(ctx, "redact page", attribute.Int("pdf.page", n))
+                r, err := u.Redact(n, pageRedactions[n], fill)
+                endSpan(span, err)
                 if err != nil {
-                        log.Printf("[redact] identify: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "identify failed: "+err.Error())
-                        return
-                }
-                var imgWidth, imgHeight int
-                if _, err := fmt.Sscanf(strings.TrimSpace(dimOutput), "%d %d", &imgWidth, &imgHeight); err != nil {
-                        log.Printf("[redact] parse dimensions: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "parse dimensions failed")
-                        return
-                }
-
-                // Build draw commands for all redaction areas on this page
-                var drawCmds []string
-                for _, area := range areas {
-                        // Convert percentage coordinates to pixel coordinates
-                        x1 := int(area.X * float64(imgWidth))
-                        y1 := int(area.Y * float64(imgHeight))
-                        x2 := int((area.X + area.Width) * float64(imgWidth))
-                        y2 := int((area.Y + area.Height) * float64(imgHeight))
-                        drawCmds = append(drawCmds, fmt.Sprintf("rectangle %d,%d %d,%d", x1, y1, x2, y2))
-                }
-
-                // Draw black rectangles using ImageMagick convert
-                tempPath := pngPath + ".tmp.png"
-                convertArgs := []string{pngPath, "-fill", "black"}
-                for _, cmd := range drawCmds {
-                        convertArgs = append(convertArgs, "-draw", cmd)
-                }
-                convertArgs = append(convertArgs, tempPath)
-
-                if err := runCommand(dir, "convert", convertArgs...); err != nil {
-                        log.Printf("[redact] convert draw: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "convert failed: "+err.Error())
-                        return
-                }
-
-                // Atomically replace original with redacted version
-                if err := os.Rename(tempPath, pngPath); err != nil {
-                        log.Printf("[redact] rename: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "rename failed: "+err.Error())
-                        return
+                        logger(ctx).Error("redact page failed", "page", n, "error", err.Error())
+                        return nil, opFail(http.StatusUnprocessableEntity, fmt.Sprintf("cannot redact page %d: its content is unreadable", n))
                 }
+                removed.Glyphs += r.Glyphs
+                removed.Paths += r.Paths
+                removed.Images += r.Images
+                removed.Annotations += r.Annotations
+                texts = append(texts, r.Text...)
         }
 
-        // Step 3: Rebuild PDF from images
-        tempPdfPath := filepath.Join(dir, "temp_redacted.pdf")
-        convertPdfArgs := append(pngFiles, tempPdfPath)
-        if err := runCommand(dir, "convert", convertPdfArgs...); err != nil {
-                log.Printf("[redact] convert to pdf: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "convert to pdf failed: "+err.Error())
-                return
-        }
-
-        // Step 4: Strip metadata and optimize with qpdf
-        baseName := baseNameWithoutExt(hdr.Filename)
-        outputName := baseName + "_redacted.pdf"
-        outputPath := filepath.Join(dir, outputName)
-
-        if err := runCommand(dir, "qpdf",
-                "--warning-exit-0",
-                "--linearize",
-                "--compress-streams=y",
-                "--object-streams=disable",
-                tempPdfPath,
-                outputPath,
-        ); err != nil {
-                log.Printf("[redact] qpdf optimize: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "qpdf optimize failed: "+err.Error())
-                return
+        scrubbed, err := u.ScrubText(scrubTerms(texts))
+        if err != nil {
+                logger(ctx).Error("scrub metadata failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to scrub document metadata")
         }
+        logger(ctx).Info("redacted", "pages", len(pageNums), "glyphs", removed.Glyphs, "paths", removed.Paths,
+                "images", removed.Images, "annotations", removed.Annotations, "metadata_matches", scrubbed)
 
-        // Clean up temporary files
-        _ = os.Remove(tempPdfPath)
-        for _, p := range pngFiles {
-                _ = os.Remove(p)
+        if err := writeOverlays(ctx, u, outputPath); err != nil {
+                logger(ctx).Error("write failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to finalize PDF")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
-// handleFlattenPDF flattens all annotations and rotations in a PDF.
-func handleFlattenPDF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                log.Printf("[flatten] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "parse form failed")
-                return
-        }
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                log.Printf("[flatten] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "file required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
+// scrubTerms returns what to scrub from metadata for the text redaction
+// removed: each run of removed text, and the words in it that look like
+// names or numbers (capitalized, or with digits), which metadata may
+// mention on their own. Common words are left alone.
+func scrubTerms(texts []string) []string {
+        seen := make(map[string]bool)
+        var terms []string
+        add := func(s string) {
+                s = strings.TrimFunc(s, func(r rune) bool { return unicode.IsPunct(r) || unicode.IsSpace(r) })
+                if utf8.RuneCountInString(s) < 3 || seen[strings.ToLower(s)] {
+                        return
+                }
+                seen[strings.ToLower(s)] = true
+                terms = append(terms, s)
         }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[flatten] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
+        for _, t := range texts {
+                add(t)
+                for _, word := range strings.Fields(t) {
+                        first, _ := utf8.DecodeRuneInString(word)
+                        if unicode.IsUpper(first) || strings.ContainsAny(word, "0123456789") {
+                                add(word)
+                        }
+                }
         }
+        return terms
+}
 
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[flatten] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
+// opFlattenPDF flattens all annotations and rotations in a PDF.
+func opFlattenPDF(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        baseName := baseNameWithoutExt(hdr.Filename)
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
         outputName := baseName + "_flattened.pdf"
         outputPath := filepath.Join(dir, outputName)
 
         // qpdf --flatten-annotations=all --flatten-rotation input.pdf output.pdf
-        if err := runCommand(dir, "qpdf",
+        if err := runCommand(ctx, dir, "qpdf",
                 "--warning-exit-0",
                 "--flatten-annotations=all",
                 "--flatten-rotation",
                 inputPath,
                 outputPath,
         ); err != nil {
-                log.Printf("[flatten] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "qpdf flatten failed: "+err.Error())
-                return
+                logger(ctx).Error("flatten failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "qpdf flatten failed: "+err.Error())
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
 // =============================================================================
 // PDF Conversion Tools: PDF to Word, PDF to JPG, Extract Text, Extract Images, HTML to PDF
 // =============================================================================
 
-// handlePDFToWord converts a PDF to Word (.docx) using pdftotext + python-docx.
+// opPDFToWord converts a PDF to Word (.docx) using pdftotext + python-docx.
 // Extracts text from PDF and creates a formatted Word document.
-func handlePDFToWord(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                log.Printf("[pdf-to-word] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "parse form failed")
-                return
-        }
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                log.Printf("[pdf-to-word] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "file required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[pdf-to-word] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
+func opPDFToWord(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[pdf-to-word] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
-
-        baseName := baseNameWithoutExt(hdr.Filename)
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
         outputName := baseName + ".docx"
         outputPath := filepath.Join(dir, outputName)
         textPath := filepath.Join(dir, "extracted.txt")
 
         // Extract text using pdftotext with layout preservation
-        if err := runCommand(dir, "pdftotext", "-layout", inputPath, textPath); err != nil {
-                log.Printf("[pdf-to-word] pdftotext failed: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "text extraction failed")
-                return
+        if err := runCommand(ctx, dir, "pdftotext", "-layout", inputPath, textPath); err != nil {
+                logger(ctx).Error("pdftotext failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "text extraction failed")
         }
 
         // Create Python script to convert text to DOCX using python-docx
@@ -3949,76 +3195,39 @@ except Exception as e:
 `
         scriptPath := filepath.Join(dir, "convert.py")
         if err := os.WriteFile(scriptPath, []byte(pythonScript), 0o755); err != nil {
-                log.Printf("[pdf-to-word] error writing script: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create conversion script")
-                return
+                logger(ctx).Error("write script failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to create conversion script")
         }
 
-        if err := runCommand(dir, "python3", scriptPath, textPath, outputPath); err != nil {
-                log.Printf("[pdf-to-word] python script failed: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "document creation failed")
-                return
+        if err := runCommand(ctx, dir, "python3", scriptPath, textPath, outputPath); err != nil {
+                logger(ctx).Error("python script failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "document creation failed")
         }
 
         // Verify output file was created
         if _, err := os.Stat(outputPath); err != nil {
-                log.Printf("[pdf-to-word] output not found: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "converted file not found")
-                return
+                logger(ctx).Error("output not found", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "converted file not found")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
-// handlePDFToExcel converts a PDF to Excel (.xlsx) using pdftotext and openpyxl.
+// opPDFToExcel converts a PDF to Excel (.xlsx) using pdftotext and openpyxl.
 // Extracts text from PDF and creates an Excel spreadsheet.
-func handlePDFToExcel(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                log.Printf("[pdf-to-excel] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "parse form failed")
-                return
-        }
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                log.Printf("[pdf-to-excel] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "file required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[pdf-to-excel] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
+func opPDFToExcel(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[pdf-to-excel] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
-
-        baseName := baseNameWithoutExt(hdr.Filename)
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
         outputName := baseName + ".xlsx"
         outputPath := filepath.Join(dir, outputName)
         textPath := filepath.Join(dir, "extracted.txt")
 
         // Extract text using pdftotext with table layout
-        if err := runCommand(dir, "pdftotext", "-layout", "-fixed", "3", inputPath, textPath); err != nil {
-                log.Printf("[pdf-to-excel] pdftotext failed: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "text extraction failed")
-                return
+        if err := runCommand(ctx, dir, "pdftotext", "-layout", "-fixed", "3", inputPath, textPath); err != nil {
+                logger(ctx).Error("pdftotext failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "text extraction failed")
         }
 
         // Create Python conversion script using openpyxl
@@ -4074,67 +3283,31 @@ except Exception as e:
 `
         scriptPath := filepath.Join(dir, "convert_excel.py")
         if err := os.WriteFile(scriptPath, []byte(pythonScript), 0o755); err != nil {
-                log.Printf("[pdf-to-excel] error writing script: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create conversion script")
-                return
+                logger(ctx).Error("write script failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to create conversion script")
         }
 
         // Execute Python script
-        if err := runCommand(dir, "python3", scriptPath, textPath, outputPath); err != nil {
-                log.Printf("[pdf-to-excel] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "excel conversion failed: "+err.Error())
-                return
+        if err := runCommand(ctx, dir, "python3", scriptPath, textPath, outputPath); err != nil {
+                logger(ctx).Error("pdf-to-excel failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "excel conversion failed: "+err.Error())
         }
 
         // Verify output file was created
         if _, err := os.Stat(outputPath); err != nil {
-                log.Printf("[pdf-to-excel] output not found: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "converted file not found")
-                return
+                logger(ctx).Error("output not found", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "converted file not found")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
-// handlePDFToPowerPoint converts a PDF to PowerPoint (.pptx) by converting pages to images.
-func handlePDFToPowerPoint(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                log.Printf("[pdf-to-pptx] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "parse form failed")
-                return
-        }
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                log.Printf("[pdf-to-pptx] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "file required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[pdf-to-pptx] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[pdf-to-pptx] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
+// opPDFToPowerPoint converts a PDF to PowerPoint (.pptx) by converting pages to images.
+func opPDFToPowerPoint(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        baseName := baseNameWithoutExt(hdr.Filename)
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
         outputName := baseName + ".pptx"
         outputPath := filepath.Join(dir, outputName)
 
@@ -4170,79 +3343,67 @@ except Exception as e:
 `
         scriptPath := filepath.Join(dir, "convert_pptx.py")
         if err := os.WriteFile(scriptPath, []byte(pythonScript), 0o755); err != nil {
-                log.Printf("[pdf-to-pptx] error writing script: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create conversion script")
-                return
+                logger(ctx).Error("write script failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to create conversion script")
         }
 
         // Execute Python script with pdf2image and python-pptx
-        if err := runCommand(dir, "python3", scriptPath, inputPath, outputPath); err != nil {
-                log.Printf("[pdf-to-pptx] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "pptx convert failed: "+err.Error())
-                return
+        if err := runCommand(ctx, dir, "python3", scriptPath, inputPath, outputPath); err != nil {
+                logger(ctx).Error("pdf-to-pptx failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "pptx convert failed: "+err.Error())
         }
 
         // Verify output file was created
         if _, err := os.Stat(outputPath); err != nil {
-                log.Printf("[pdf-to-pptx] output not found: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "converted file not found")
-                return
+                logger(ctx).Error("output not found", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "converted file not found")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
-// handleExcelToPDF converts an Excel file (.xlsx, .xls) to PDF using LibreOffice.
-func handleExcelToPDF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                log.Printf("[excel-to-pdf] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "parse form failed")
-                return
-        }
+// opExcelToPDF converts an Excel file (.xlsx, .xls) to PDF using LibreOffice.
+func opExcelToPDF(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                log.Printf("[excel-to-pdf] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "file required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
+        inputPath := in.File().Path
+        // LibreOffice converts Excel to PDF
+        if err := runCommand(ctx, dir, "libreoffice", "--headless", "--nologo", "--convert-to", "pdf", "--outdir", dir, inputPath); err != nil {
+                logger(ctx).Error("excel-to-pdf failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "libreoffice convert failed: "+err.Error())
         }
 
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[excel-to-pdf] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
+        baseName := baseNameWithoutExt(in.File().Name)
+        outputName := baseName + ".pdf"
+        outputPath := filepath.Join(dir, outputName)
 
-        // Keep original extension for LibreOffice
-        ext := filepath.Ext(hdr.Filename)
-        if ext == "" {
-                ext = ".xlsx"
-        }
-        inputPath := filepath.Join(dir, "input"+ext)
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[excel-to-pdf] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
+        // LibreOffice names output based on input filename
+        expectedOutput := filepath.Join(dir, "input.pdf")
+        if _, err := os.Stat(expectedOutput); err == nil {
+                if err := os.Rename(expectedOutput, outputPath); err != nil {
+                        logger(ctx).Error("rename failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "rename failed")
+                }
+        } else if _, err := os.Stat(outputPath); err != nil {
+                logger(ctx).Error("output not found", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "converted file not found")
         }
 
-        // LibreOffice converts Excel to PDF
-        if err := runCommand(dir, "libreoffice", "--headless", "--nologo", "--convert-to", "pdf", "--outdir", dir, inputPath); err != nil {
-                log.Printf("[excel-to-pdf] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "libreoffice convert failed: "+err.Error())
-                return
+        return fileResult(outputName), nil
+}
+
+// opPowerPointToPDF converts a PowerPoint file (.pptx, .ppt) to PDF using LibreOffice.
+func opPowerPointToPDF(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
+
+        inputPath := in.File().Path
+        // LibreOffice converts PowerPoint to PDF
+        if err := runCommand(ctx, dir, "libreoffice", "--headless", "--nologo", "--convert-to", "pdf", "--outdir", dir, inputPath); err != nil {
+                logger(ctx).Error("pptx-to-pdf failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "libreoffice convert failed: "+err.Error())
         }
 
-        baseName := baseNameWithoutExt(hdr.Filename)
+        baseName := baseNameWithoutExt(in.File().Name)
         outputName := baseName + ".pdf"
         outputPath := filepath.Join(dir, outputName)
 
@@ -4250,118 +3411,23 @@ func handleExcelToPDF(w http.ResponseWriter, r *http.Request) {
         expectedOutput := filepath.Join(dir, "input.pdf")
         if _, err := os.Stat(expectedOutput); err == nil {
                 if err := os.Rename(expectedOutput, outputPath); err != nil {
-                        log.Printf("[excel-to-pdf] rename error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "rename failed")
-                        return
+                        logger(ctx).Error("rename failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "rename failed")
                 }
         } else if _, err := os.Stat(outputPath); err != nil {
-                log.Printf("[excel-to-pdf] output not found: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "converted file not found")
-                return
+                logger(ctx).Error("output not found", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "converted file not found")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
-// handlePowerPointToPDF converts a PowerPoint file (.pptx, .ppt) to PDF using LibreOffice.
-func handlePowerPointToPDF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-        if err := r.ParseMultipartForm(128 << 20); err != nil {
-                log.Printf("[pptx-to-pdf] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "parse form failed")
-                return
-        }
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                log.Printf("[pptx-to-pdf] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "file required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[pptx-to-pdf] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        // Keep original extension for LibreOffice
-        ext := filepath.Ext(hdr.Filename)
-        if ext == "" {
-                ext = ".pptx"
-        }
-        inputPath := filepath.Join(dir, "input"+ext)
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[pptx-to-pdf] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
-
-        // LibreOffice converts PowerPoint to PDF
-        if err := runCommand(dir, "libreoffice", "--headless", "--nologo", "--convert-to", "pdf", "--outdir", dir, inputPath); err != nil {
-                log.Printf("[pptx-to-pdf] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "libreoffice convert failed: "+err.Error())
-                return
-        }
-
-        baseName := baseNameWithoutExt(hdr.Filename)
-        outputName := baseName + ".pdf"
-        outputPath := filepath.Join(dir, outputName)
-
-        // LibreOffice names output based on input filename
-        expectedOutput := filepath.Join(dir, "input.pdf")
-        if _, err := os.Stat(expectedOutput); err == nil {
-                if err := os.Rename(expectedOutput, outputPath); err != nil {
-                        log.Printf("[pptx-to-pdf] rename error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "rename failed")
-                        return
-                }
-        } else if _, err := os.Stat(outputPath); err != nil {
-                log.Printf("[pptx-to-pdf] output not found: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "converted file not found")
-                return
-        }
-
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
-}
-
-// handlePDFToJPG converts PDF pages to JPG images.
+// opPDFToJPG converts PDF pages to JPG images.
 // For single-page PDFs, returns a single JPG file.
 // For multi-page PDFs, returns a ZIP containing all JPG files.
-func handlePDFToJPG(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                log.Printf("[pdf-to-jpg] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "parse form failed")
-                return
-        }
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                log.Printf("[pdf-to-jpg] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "file required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
+func opPDFToJPG(ctx context.Context, in *OpInput) (*OpResult, error) {
         // Optional DPI parameter (default 300)
-        dpi := parseIntDefault(r.FormValue("dpi"), 300)
+        dpi := parseIntDefault(in.Param("dpi"), 300)
         if dpi < 72 {
                 dpi = 72
         }
@@ -4369,56 +3435,40 @@ func handlePDFToJPG(w http.ResponseWriter, r *http.Request) {
                 dpi = 600
         }
 
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[pdf-to-jpg] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[pdf-to-jpg] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
+        dir := in.Dir
 
-        // Get page count using pdfinfo
-        pageCount, err := pageCountPoppler(dir, inputPath)
+        inputPath := in.File().Path
+        pageCount, err := countPages(ctx, inputPath)
         if err != nil {
-                log.Printf("[pdf-to-jpg] pdfinfo error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to get page count: "+err.Error())
-                return
+                logger(ctx).Error("page count failed", "error", err.Error())
+                return nil, pdfReadError(err)
         }
 
         // Create images directory
         imagesDir := filepath.Join(dir, "images")
         if err := os.MkdirAll(imagesDir, 0o755); err != nil {
-                log.Printf("[pdf-to-jpg] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create images dir")
-                return
+                logger(ctx).Error("pdf-to-jpg failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to create images dir")
         }
 
         // Convert PDF to JPG using pdftoppm
         prefix := filepath.Join(imagesDir, "page")
-        if err := runCommand(dir, "pdftoppm", "-jpeg", "-r", strconv.Itoa(dpi), inputPath, prefix); err != nil {
-                log.Printf("[pdf-to-jpg] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "pdftoppm failed: "+err.Error())
-                return
+        if err := runCommand(ctx, dir, "pdftoppm", "-jpeg", "-r", strconv.Itoa(dpi), inputPath, prefix); err != nil {
+                logger(ctx).Error("pdf-to-jpg failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "pdftoppm failed: "+err.Error())
         }
 
-        baseName := baseNameWithoutExt(hdr.Filename)
+        baseName := baseNameWithoutExt(in.File().Name)
 
         // Check if user wants a specific page or all pages
-        pageStr := r.FormValue("page")
-        wantAllPages := r.FormValue("all") == "true"
+        pageStr := in.Param("page")
+        wantAllPages := in.Param("all") == "true"
 
         // Find all generated JPG files
         jpgFiles, err := filepath.Glob(filepath.Join(imagesDir, "page-*.jpg"))
         if err != nil || len(jpgFiles) == 0 {
-                log.Printf("[pdf-to-jpg] error: no JPG files generated")
-                errorJSON(w, http.StatusInternalServerError, "no JPG files generated")
-                return
+                logger(ctx).Error("no JPG files generated")
+                return nil, opFail(http.StatusInternalServerError, "no JPG files generated")
         }
 
         // Sort files to ensure correct order
@@ -4429,16 +3479,12 @@ func handlePDFToJPG(w http.ResponseWriter, r *http.Request) {
                 zipName := baseName + "_images.zip"
                 zipPath := filepath.Join(dir, zipName)
 
-                if err := zipDirectory(imagesDir, zipPath); err != nil {
-                        log.Printf("[pdf-to-jpg] error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "zip failed: "+err.Error())
-                        return
+                if err := zipDirectory(ctx, imagesDir, zipPath); err != nil {
+                        logger(ctx).Error("zip failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "zip failed: "+err.Error())
                 }
 
-                writeJSON(w, http.StatusOK, downloadResponse{
-                        DownloadURL: buildDownloadURL(r, jobID, zipName),
-                })
-                return
+                return fileResult(zipName), nil
         }
 
         // Determine which page to return (default: first page, or specified page)
@@ -4457,165 +3503,76 @@ func handlePDFToJPG(w http.ResponseWriter, r *http.Request) {
         }
         outputPath := filepath.Join(dir, outputName)
         if err := os.Rename(jpgFiles[pageIndex], outputPath); err != nil {
-                log.Printf("[pdf-to-jpg] rename error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "rename failed: "+err.Error())
-                return
+                logger(ctx).Error("rename failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "rename failed: "+err.Error())
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
-// handleExtractText extracts plain text from a PDF using pdftotext.
-func handleExtractText(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                log.Printf("[extract-text] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "parse form failed")
-                return
-        }
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                log.Printf("[extract-text] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "file required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[extract-text] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[extract-text] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
+// opExtractText extracts plain text from a PDF using pdftotext.
+func opExtractText(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        baseName := baseNameWithoutExt(hdr.Filename)
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
         outputName := baseName + ".txt"
         outputPath := filepath.Join(dir, outputName)
 
         // pdftotext extracts text from PDF
         // -layout preserves the original layout
-        if err := runCommand(dir, "pdftotext", "-layout", inputPath, outputPath); err != nil {
-                log.Printf("[extract-text] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "pdftotext failed: "+err.Error())
-                return
+        if err := runCommand(ctx, dir, "pdftotext", "-layout", inputPath, outputPath); err != nil {
+                logger(ctx).Error("extract-text failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "pdftotext failed: "+err.Error())
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
-// handleExtractImages extracts embedded images from a PDF using pdfimages.
-func handleExtractImages(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                log.Printf("[extract-images] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "parse form failed")
-                return
-        }
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                log.Printf("[extract-images] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "file required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[extract-images] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[extract-images] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
+// opExtractImages extracts embedded images from a PDF using pdfimages.
+func opExtractImages(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
+        inputPath := in.File().Path
         // Create images directory
         imagesDir := filepath.Join(dir, "images")
         if err := os.MkdirAll(imagesDir, 0o755); err != nil {
-                log.Printf("[extract-images] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create images dir")
-                return
+                logger(ctx).Error("extract-images failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to create images dir")
         }
 
         // pdfimages extracts embedded images
         // -all extracts all images in their native format
         prefix := filepath.Join(imagesDir, "image")
-        if err := runCommand(dir, "pdfimages", "-all", inputPath, prefix); err != nil {
-                log.Printf("[extract-images] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "pdfimages failed: "+err.Error())
-                return
+        if err := runCommand(ctx, dir, "pdfimages", "-all", inputPath, prefix); err != nil {
+                logger(ctx).Error("extract-images failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "pdfimages failed: "+err.Error())
         }
 
         // Check if any images were extracted
         entries, err := os.ReadDir(imagesDir)
         if err != nil || len(entries) == 0 {
-                errorJSON(w, http.StatusOK, "no images found in PDF")
-                return
+                return nil, &opError{status: http.StatusUnprocessableEntity, code: codeNoContent, msg: "no images found in PDF"}
         }
 
-        baseName := baseNameWithoutExt(hdr.Filename)
+        baseName := baseNameWithoutExt(in.File().Name)
         zipName := baseName + "_extracted_images.zip"
         zipPath := filepath.Join(dir, zipName)
 
-        if err := zipDirectory(imagesDir, zipPath); err != nil {
-                log.Printf("[extract-images] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "zip failed: "+err.Error())
-                return
+        if err := zipDirectory(ctx, imagesDir, zipPath); err != nil {
+                logger(ctx).Error("extract-images failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "zip failed: "+err.Error())
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, zipName),
-        })
+        return fileResult(zipName), nil
 }
 
-// handleHTMLToPDF converts an HTML file or URL to PDF using wkhtmltopdf.
-func handleHTMLToPDF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                log.Printf("[html-to-pdf] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "parse form failed")
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[html-to-pdf] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
+// opHTMLToPDF converts an HTML file or URL to PDF using wkhtmltopdf.
+func opHTMLToPDF(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        url := strings.TrimSpace(r.FormValue("url"))
-        htmlContent := r.FormValue("html")
+        url := strings.TrimSpace(in.Param("url"))
+        htmlContent := in.Param("html")
         var inputSource string
         var baseName string
 
@@ -4625,196 +3582,95 @@ func handleHTMLToPDF(w http.ResponseWriter, r *http.Request) {
         } else if htmlContent != "" {
                 inputPath := filepath.Join(dir, "input.html")
                 if err := os.WriteFile(inputPath, []byte(htmlContent), 0o644); err != nil {
-                        log.Printf("[html-to-pdf] error writing html: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "save failed")
-                        return
+                        logger(ctx).Error("write html failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "save failed")
                 }
                 inputSource = "file://" + inputPath
                 baseName = "document"
         } else {
-                _, hdr, err := r.FormFile("file")
-                if err != nil {
-                        errorJSON(w, http.StatusBadRequest, "file, html content, or url required")
-                        return
+                if len(in.Files) == 0 {
+                        return nil, opParamFail("file", "file, html content, or url required")
                 }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
-                inputPath := filepath.Join(dir, "input.html")
-                if err := saveUploadedFile(hdr, inputPath); err != nil {
-                        log.Printf("[html-to-pdf] error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "save failed")
-                        return
-                }
-                inputSource = "file://" + inputPath
-                baseName = baseNameWithoutExt(hdr.Filename)
+                inputSource = "file://" + in.File().Path
+                baseName = baseNameWithoutExt(in.File().Name)
         }
 
         outputName := baseName + ".pdf"
         outputPath := filepath.Join(dir, outputName)
 
-        if err := runChromiumPDF(dir, outputPath, inputSource); err != nil {
-                log.Printf("[html-to-pdf] chromium error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "HTML to PDF conversion failed")
-                return
+        if err := runChromiumPDF(ctx, dir, outputPath, inputSource); err != nil {
+                logger(ctx).Error("chromium failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "HTML to PDF conversion failed")
         }
 
         if _, err := os.Stat(outputPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "PDF generation failed")
-                return
+                return nil, opFail(http.StatusInternalServerError, "PDF generation failed")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
 // ─────────────────────────────────────────────────────────────────────────────
 // Advanced PDF Tools
 // ─────────────────────────────────────────────────────────────────────────────
 
-// handleComparePDFs compares two PDF files and returns a text diff
+// opComparePDFs compares two PDF files and returns a text diff
 // Expects two files: "file1" and "file2"
-func handleComparePDFs(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
+func opComparePDFs(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, err.Error())
-                return
-        }
-
-        // Parse multipart form
-        if err := r.ParseMultipartForm(100 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "failed to parse form: "+err.Error())
-                return
-        }
-
-        // Get file1
-        file1, _, err := r.FormFile("file1")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file1 is required: "+err.Error())
-                return
-        }
-        defer file1.Close()
-
-        // Get file2
-        file2, _, err := r.FormFile("file2")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file2 is required: "+err.Error())
-                return
-        }
-        defer file2.Close()
-
-        // Save both files
-        inputPath1 := filepath.Join(dir, "file1.pdf")
-        outFile1, err := os.Create(inputPath1)
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create file1: "+err.Error())
-                return
-        }
-        if _, err := io.Copy(outFile1, file1); err != nil {
-                outFile1.Close()
-                errorJSON(w, http.StatusInternalServerError, "failed to save file1: "+err.Error())
-                return
-        }
-        outFile1.Close()
-
-        inputPath2 := filepath.Join(dir, "file2.pdf")
-        outFile2, err := os.Create(inputPath2)
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create file2: "+err.Error())
-                return
-        }
-        if _, err := io.Copy(outFile2, file2); err != nil {
-                outFile2.Close()
-                errorJSON(w, http.StatusInternalServerError, "failed to save file2: "+err.Error())
-                return
-        }
-        outFile2.Close()
+        inputPath1 := in.Files[0].Path
+        inputPath2 := in.Files[1].Path
 
         // Extract text from both PDFs
         text1Path := filepath.Join(dir, "file1.txt")
         text2Path := filepath.Join(dir, "file2.txt")
 
-        if err := runCommand(dir, "pdftotext", inputPath1, text1Path); err != nil {
-                log.Printf("[compare] pdftotext file1 error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to extract text from file1: "+err.Error())
-                return
+        if err := runCommand(ctx, dir, "pdftotext", inputPath1, text1Path); err != nil {
+                logger(ctx).Error("pdftotext file1 failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to extract text from file1: "+err.Error())
         }
 
-        if err := runCommand(dir, "pdftotext", inputPath2, text2Path); err != nil {
-                log.Printf("[compare] pdftotext file2 error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to extract text from file2: "+err.Error())
-                return
+        if err := runCommand(ctx, dir, "pdftotext", inputPath2, text2Path); err != nil {
+                logger(ctx).Error("pdftotext file2 failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to extract text from file2: "+err.Error())
         }
 
         // Compare using diff (diff returns exit code 1 if files differ, which is normal)
         outputName := "differences.txt"
         outputPath := filepath.Join(dir, outputName)
 
-        // Run diff and capture output (ignore exit code since diff returns 1 when files differ)
-        cmd := exec.Command("diff", "-u", text1Path, text2Path)
-        cmd.Dir = dir
-        diffOutput, _ := cmd.Output() // Ignore error - diff exits 1 when files differ
+        // Run diff and capture output (diff exits 1 when the files differ, which is
+        // not a failure)
+        diffOutput, err := runCommandOutput(ctx, dir, "diff", "-u", text1Path, text2Path)
+        var exitErr *exec.ExitError
+        if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+                logger(ctx).Error("diff failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "diff failed: "+err.Error())
+        }
 
         // Write diff output to file
         if len(diffOutput) == 0 {
-                diffOutput = []byte("No differences found between the two PDF files.\n")
+                diffOutput = "No differences found between the two PDF files.\n"
         }
-        if err := os.WriteFile(outputPath, diffOutput, 0644); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to write diff output: "+err.Error())
-                return
+        if err := os.WriteFile(outputPath, []byte(diffOutput), 0644); err != nil {
+                return nil, opFail(http.StatusInternalServerError, "failed to write diff output: "+err.Error())
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
-// handleDigitalSignature processes PDF and adds signature overlay
-func handleDigitalSignature(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
+// opDigitalSignature processes PDF and adds signature overlay
+func opDigitalSignature(ctx context.Context, in *OpInput) (*OpResult, error) {
+        signature := in.Param("signature")
+        page := parseIntDefault(in.Param("page"), 1)
+        xOff := parseIntDefault(in.Param("x"), 20)
+        yOff := parseIntDefault(in.Param("y"), 20)
 
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        signature := r.FormValue("signature")
-        page := parseIntDefault(r.FormValue("page"), 1)
-        xOff := parseIntDefault(r.FormValue("x"), 20)
-        yOff := parseIntDefault(r.FormValue("y"), 20)
+        dir := in.Dir
 
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, err.Error())
-                return
-        }
-
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(header, inputPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
-
-        baseName := baseNameWithoutExt(header.Filename)
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
         outputName := baseName + "_signed.pdf"
         outputPath := filepath.Join(dir, outputName)
 
@@ -4823,23 +3679,20 @@ func handleDigitalSignature(w http.ResponseWriter, r *http.Request) {
                 // Extract base64 part
                 parts := strings.SplitN(signature, ",", 2)
                 if len(parts) != 2 {
-                        log.Printf("[digital-signature] invalid signature format")
-                        errorJSON(w, http.StatusBadRequest, "invalid signature format")
-                        return
+                        logger(ctx).Error("invalid signature format")
+                        return nil, opParamFail("signature", "invalid signature format")
                 }
                 
                 decoded, err := base64.StdEncoding.DecodeString(parts[1])
                 if err != nil {
-                        log.Printf("[digital-signature] base64 decode error: %v", err)
-                        errorJSON(w, http.StatusBadRequest, "invalid signature encoding")
-                        return
+                        logger(ctx).Error("base64 decode failed", "error", err.Error())
+                        return nil, opParamFail("signature", "invalid signature encoding")
                 }
                 
                 sigPath := filepath.Join(dir, "signature.png")
                 if err := os.WriteFile(sigPath, decoded, 0644); err != nil {
-                        log.Printf("[digital-signature] write signature error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to save signature")
-                        return
+                        logger(ctx).Error("write signature failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to save signature")
                 }
                 
                 // Use pdfcpu stamp to overlay signature
@@ -4847,70 +3700,39 @@ func handleDigitalSignature(w http.ResponseWriter, r *http.Request) {
                 desc := fmt.Sprintf("pos:br, off:%d %d, scale:0.3", xOff, yOff)
                 args := []string{"stamp", "add", "-mode", "image", "-pages", fmt.Sprintf("%d", page), "--", sigPath, desc, inputPath, outputPath}
                 
-                if err := runCommand(dir, "pdfcpu", args...); err != nil {
-                        log.Printf("[digital-signature] pdfcpu stamp error: %v", err)
+                if err := runCommand(ctx, dir, "pdfcpu", args...); err != nil {
+                        logger(ctx).Error("pdfcpu stamp failed", "error", err.Error())
                         // Fall back to simple qpdf processing
-                        if err2 := runCommand(dir, "qpdf", "--linearize", "--warning-exit-0", inputPath, outputPath); err2 != nil {
-                                errorJSON(w, http.StatusInternalServerError, "failed to add signature: "+err.Error())
-                                return
+                        if err2 := runCommand(ctx, dir, "qpdf", "--linearize", "--warning-exit-0", inputPath, outputPath); err2 != nil {
+                                return nil, opFail(http.StatusInternalServerError, "failed to add signature: "+err.Error())
                         }
                 }
         } else {
                 // Just linearize and process PDF
-                if err := runCommand(dir, "qpdf",
+                if err := runCommand(ctx, dir, "qpdf",
                         "--linearize",
                         "--warning-exit-0",
                         inputPath,
                         outputPath,
                 ); err != nil {
-                        log.Printf("[digital-signature] qpdf error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to process PDF: "+err.Error())
-                        return
+                        logger(ctx).Error("qpdf failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to process PDF: "+err.Error())
                 }
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
-// handleSignPDF processes PDF with multiple placed signatures
-func handleSignPDF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        signaturesJSON := r.FormValue("signatures")
-        log.Printf("[sign] Received signatures JSON (length %d): %s", len(signaturesJSON), signaturesJSON)
+// opSignPDF places signature images on the pages, drawn into the page
+// content at the boxes the signer chose.
+func opSignPDF(ctx context.Context, in *OpInput) (*OpResult, error) {
+        signaturesJSON := in.Param("signatures")
+        logger(ctx).Info("received signatures", "bytes", len(signaturesJSON))
 
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, err.Error())
-                return
-        }
+        dir := in.Dir
 
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(header, inputPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
-
-        baseName := baseNameWithoutExt(header.Filename)
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
         outputName := baseName + "_signed.pdf"
         outputPath := filepath.Join(dir, outputName)
 
@@ -4928,363 +3750,129 @@ func handleSignPDF(w http.ResponseWriter, r *http.Request) {
         var signatures []PlacedSignature
         if signaturesJSON != "" {
                 if err := json.Unmarshal([]byte(signaturesJSON), &signatures); err != nil {
-                        log.Printf("[sign] failed to parse signatures: %v", err)
-                        errorJSON(w, http.StatusBadRequest, "invalid signatures format")
-                        return
+                        logger(ctx).Error("failed to parse signatures", "error", err.Error())
+                        return nil, opParamFail("signatures", "invalid signatures format")
                 }
         }
 
         if len(signatures) == 0 {
-                errorJSON(w, http.StatusBadRequest, "no signatures provided")
-                return
+                return nil, opParamFail("signatures", "no signatures provided")
         }
 
-        // Group signatures by page
-        pageSignatures := make(map[int][]PlacedSignature)
+        doc, u, err := startOverlays(ctx, inputPath)
+        if err != nil {
+                logger(ctx).Error("parse failed", "error", err.Error())
+                return nil, err
+        }
+        defer doc.Close()
+
+        applied := 0
         for _, sig := range signatures {
                 if sig.ImageData == "" || !strings.HasPrefix(sig.ImageData, "data:image") {
                         continue
                 }
-                pageSignatures[sig.Page] = append(pageSignatures[sig.Page], sig)
-        }
-
-        // Get actual page dimensions using pdfinfo
-        pageWidthPx := 612  // Default Letter width in points
-        pageHeightPx := 792 // Default Letter height in points
-
-        cmd := exec.Command("pdfinfo", inputPath)
-        cmd.Dir = dir
-        infoOutput, err := cmd.Output()
-        if err == nil {
-                lines := strings.Split(string(infoOutput), "\n")
-                for _, line := range lines {
-                        if strings.HasPrefix(line, "Page size:") {
-                                // Format: "Page size:      612 x 792 pts (letter)"
-                                parts := strings.Fields(line)
-                                if len(parts) >= 5 {
-                                        if w, err := strconv.ParseFloat(parts[2], 64); err == nil {
-                                                pageWidthPx = int(w)
-                                        }
-                                        if h, err := strconv.ParseFloat(parts[4], 64); err == nil {
-                                                pageHeightPx = int(h)
-                                        }
-                                }
-                                break
-                        }
+                if sig.Page < 1 || sig.Page > doc.NumPages() {
+                        return nil, &opError{status: http.StatusUnprocessableEntity, code: codePageOutOfRange, param: "signatures",
+                                msg: fmt.Sprintf("a signature is placed on page %d, but the PDF has %d pages", sig.Page, doc.NumPages())}
                 }
-        }
-        log.Printf("[sign] PDF page dimensions: %dx%d", pageWidthPx, pageHeightPx)
-
-        currentInput := inputPath
-        tempCounter := 0
-
-        // Process each page's signatures by compositing them into a single overlay
-        for pageNum, sigs := range pageSignatures {
-                // Create a transparent overlay image for this page
-                overlayPath := filepath.Join(dir, fmt.Sprintf("overlay_%d.png", pageNum))
-                
-                // Start with a transparent canvas
-                compositeArgs := []string{"-size", fmt.Sprintf("%dx%d", pageWidthPx, pageHeightPx), "xc:none"}
-                
-                // Add each signature to the composite
-                for i, sig := range sigs {
-                        parts := strings.SplitN(sig.ImageData, ",", 2)
-                        if len(parts) != 2 {
-                                log.Printf("[sign] invalid signature format for %s", sig.ID)
-                                continue
-                        }
-
-                        decoded, err := base64.StdEncoding.DecodeString(parts[1])
-                        if err != nil {
-                                log.Printf("[sign] base64 decode error: %v", err)
-                                continue
-                        }
-
-                        sigPath := filepath.Join(dir, fmt.Sprintf("sig_p%d_%d.png", pageNum, i))
-                        if err := os.WriteFile(sigPath, decoded, 0644); err != nil {
-                                log.Printf("[sign] write signature error: %v", err)
-                                continue
-                        }
 
-                        // Calculate position in pixels (HTML coordinates, origin top-left)
-                        xPos := int(sig.X / 100.0 * float64(pageWidthPx))
-                        yPos := int(sig.Y / 100.0 * float64(pageHeightPx))
-                        
-                        // Calculate signature size in pixels
-                        sigWidth := int(sig.Width / 100.0 * float64(pageWidthPx))
-                        sigHeight := int(sig.Height / 100.0 * float64(pageHeightPx))
-                        
-                        // Add this signature to the composite command
-                        compositeArgs = append(compositeArgs,
-                                "(", sigPath, "-resize", fmt.Sprintf("%dx%d!", sigWidth, sigHeight), ")",
-                                "-geometry", fmt.Sprintf("+%d+%d", xPos, yPos),
-                                "-composite",
-                        )
-                }
-                
-                compositeArgs = append(compositeArgs, "PNG32:"+overlayPath)
-                
-                // Run ImageMagick to create the composite overlay
-                log.Printf("[sign] Creating overlay for page %d with args: convert %v", pageNum, compositeArgs)
-                if err := runCommand(dir, "convert", compositeArgs...); err != nil {
-                        log.Printf("[sign] ImageMagick composite error: %v", err)
+                data, err := decodeDataURL(sig.ImageData)
+                if err != nil {
+                        logger(ctx).Error("invalid signature data", "signature_id", sig.ID, "error", err.Error())
                         continue
                 }
-
-                // Now stamp this overlay onto the PDF page
-                tempOutput := filepath.Join(dir, fmt.Sprintf("temp_%d.pdf", tempCounter))
-                tempCounter++
-
-                // Use pdfcpu to stamp the overlay - position at top-left, full page
-                // The overlay is already positioned correctly, so we just need to place it at 0,0
-                desc := "pos:tl, off:0 0, scale:1.0 abs, rot:0"
-                args := []string{"stamp", "add", "-mode", "image", "-pages", fmt.Sprintf("%d", pageNum), "--", overlayPath, desc, currentInput, tempOutput}
-
-                log.Printf("[sign] Running pdfcpu with args: %v", args)
-                if err := runCommand(dir, "pdfcpu", args...); err != nil {
-                        log.Printf("[sign] pdfcpu stamp error: %v", err)
+                img, err := u.AddImage(data)
+                if err != nil {
+                        logger(ctx).Error("unusable signature image", "signature_id", sig.ID, "error", err.Error())
                         continue
                 }
-                currentInput = tempOutput
-        }
-
-        // Copy final result
-        if currentInput != inputPath {
-                if err := copyFileEdit(currentInput, outputPath); err != nil {
-                        log.Printf("[sign] copy error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to finalize PDF")
-                        return
-                }
-        } else {
-                errorJSON(w, http.StatusInternalServerError, "no signatures could be applied")
-                return
-        }
-
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
-}
-
-// handleAddTextAnnotation adds text overlay to a PDF
-func handleAddTextAnnotation(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        text := r.FormValue("text")
-        if text == "" {
-                errorJSON(w, http.StatusBadRequest, "text is required")
-                return
-        }
-
-        page := r.FormValue("page")
-        if page == "" {
-                page = "1"
-        }
-        pageNum, _ := strconv.Atoi(page)
-        if pageNum < 1 {
-                pageNum = 1
-        }
-
-        x := r.FormValue("x")
-        if x == "" {
-                x = "50"
-        }
-        y := r.FormValue("y")
-        if y == "" {
-                y = "50"
-        }
-
-        fontSize := r.FormValue("fontSize")
-        if fontSize == "" {
-                fontSize = "12"
-        }
-
-        color := r.FormValue("color")
-        if color == "" {
-                color = "#000000"
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, err.Error())
-                return
-        }
-
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(header, inputPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
-
-        baseName := baseNameWithoutExt(header.Filename)
-        outputName := baseName + "_annotated.pdf"
-        outputPath := filepath.Join(dir, outputName)
-
-        // Get total page count
-        pdfInfoCmd := exec.Command("pdfinfo", inputPath)
-        pdfInfoCmd.Dir = dir
-        pdfInfoOutput, err := pdfInfoCmd.Output()
-        if err != nil {
-                log.Printf("[add-text] pdfinfo error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to analyze PDF")
-                return
-        }
-
-        totalPages := 1
-        for _, line := range strings.Split(string(pdfInfoOutput), "\n") {
-                if strings.HasPrefix(line, "Pages:") {
-                        fmt.Sscanf(line, "Pages: %d", &totalPages)
-                        break
-                }
-        }
-
-        if pageNum > totalPages {
-                pageNum = totalPages
-        }
-
-        // Create annotation overlay using ImageMagick
-        // First convert specified page to image
-        pageImagePath := filepath.Join(dir, "page.png")
-        if err := runCommand(dir, "pdftoppm",
-                "-png",
-                "-singlefile",
-                "-f", strconv.Itoa(pageNum),
-                "-l", strconv.Itoa(pageNum),
-                "-r", "150",
-                inputPath,
-                filepath.Join(dir, "page"),
-        ); err != nil {
-                log.Printf("[add-text] pdftoppm error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to convert page")
-                return
-        }
-
-        // Add text to the image using ImageMagick
-        annotatedImagePath := filepath.Join(dir, "annotated.png")
-        fontSizeStr := fmt.Sprintf("%s", fontSize)
-        if err := runCommand(dir, "convert",
-                pageImagePath,
-                "-font", "DejaVu-Sans",
-                "-fill", color,
-                "-pointsize", fontSizeStr,
-                "-annotate", fmt.Sprintf("+%s+%s", x, y),
-                text,
-                annotatedImagePath,
-        ); err != nil {
-                log.Printf("[add-text] convert error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to add text")
-                return
-        }
-
-        // Convert annotated image back to PDF
-        annotatedPDFPath := filepath.Join(dir, "annotated_page.pdf")
-        if err := runCommand(dir, "convert",
-                annotatedImagePath,
-                annotatedPDFPath,
-        ); err != nil {
-                log.Printf("[add-text] convert to pdf error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create annotated PDF")
-                return
-        }
-
-        // If single page, use the annotated page directly
-        if totalPages == 1 {
-                if err := runCommand(dir, "cp", annotatedPDFPath, outputPath); err != nil {
-                        errorJSON(w, http.StatusInternalServerError, "failed to copy result")
-                        return
-                }
-        } else {
-                // Extract pages before and after the annotated page, then combine
-                beforePath := filepath.Join(dir, "before.pdf")
-                afterPath := filepath.Join(dir, "after.pdf")
-
-                // Pages before annotated page
-                if pageNum > 1 {
-                        runCommand(dir, "qpdf", inputPath,
-                                "--pages", inputPath, fmt.Sprintf("1-%d", pageNum-1), "--",
-                                beforePath)
-                }
-
-                // Pages after annotated page
-                if pageNum < totalPages {
-                        runCommand(dir, "qpdf", inputPath,
-                                "--pages", inputPath, fmt.Sprintf("%d-%d", pageNum+1, totalPages), "--",
-                                afterPath)
+                o, err := u.Overlay(sig.Page)
+                if err != nil {
+                        logger(ctx).Error("place signature failed", "page", sig.Page, "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to process PDF")
                 }
 
-                // Combine all parts
-                args := []string{inputPath, "--pages"}
-                if pageNum > 1 {
-                        args = append(args, beforePath, fmt.Sprintf("1-%d", pageNum-1))
-                }
-                args = append(args, annotatedPDFPath, "1")
-                if pageNum < totalPages {
-                        args = append(args, afterPath, fmt.Sprintf("1-%d", totalPages-pageNum))
-                }
-                args = append(args, "--", outputPath)
+                // Positions are percentages of the page as displayed; the image
+                // is stretched to the box, as the signer saw it.
+                w, h := o.Size()
+                o.Image(img, sig.X/100*w, sig.Y/100*h, sig.Width/100*w, sig.Height/100*h)
+                applied++
+        }
 
-                if err := runCommand(dir, "qpdf", args...); err != nil {
-                        log.Printf("[add-text] qpdf combine error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to combine pages")
-                        return
-                }
+        if applied == 0 {
+                return nil, opFail(http.StatusInternalServerError, "no signatures could be applied")
+        }
+        if err := writeOverlays(ctx, u, outputPath); err != nil {
+                logger(ctx).Error("write failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to finalize PDF")
         }
+        logger(ctx).Info("placed signatures", "count", applied)
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
-// handleValidatePDFA validates PDF/A compliance using verapdf
-func handleValidatePDFA(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
+// opAddTextAnnotation adds text to a page. x, y and fontSize are in pixels
+// of the page rendered at render.annotateDPI, with y the baseline, as the
+// client measures them on its preview.
+func opAddTextAnnotation(ctx context.Context, in *OpInput) (*OpResult, error) {
+        text := in.Param("text")
+        if text == "" {
+                return nil, opParamFail("text", "text is required")
         }
 
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
+        pageNum := parseIntDefault(in.Param("page"), 1)
+        if pageNum < 1 {
+                pageNum = 1
+        }
+        x := parseFloatDefault(in.Param("x"), 50)
+        y := parseFloatDefault(in.Param("y"), 50)
+        fontSize := parseFloatDefault(in.Param("fontSize"), 12)
+        if fontSize <= 0 {
+                fontSize = 12
         }
+        textColor := parseHexColor(in.Param("color"))
 
-        _, header, err := r.FormFile("file")
+        dir := in.Dir
+
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
+        outputName := baseName + "_annotated.pdf"
+        outputPath := filepath.Join(dir, outputName)
+
+        doc, u, err := startOverlays(ctx, inputPath)
         if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
+                logger(ctx).Error("parse failed", "error", err.Error())
+                return nil, err
         }
+        defer doc.Close()
 
-        jobID, dir, err := newJobDir()
+        if pageNum > doc.NumPages() {
+                pageNum = doc.NumPages()
+        }
+        o, err := u.Overlay(pageNum)
         if err != nil {
-                errorJSON(w, http.StatusInternalServerError, err.Error())
-                return
+                logger(ctx).Error("add text failed", "page", pageNum, "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to add text")
         }
 
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(header, inputPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
+        scale := 72 / float64(config.Render.AnnotateDPI)
+        o.SetFillColor(textColor)
+        o.Text(overlayFont(u), fontSize*scale, x*scale, y*scale, text)
+
+        if err := writeOverlays(ctx, u, outputPath); err != nil {
+                logger(ctx).Error("write failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to create annotated PDF")
         }
 
-        baseName := baseNameWithoutExt(header.Filename)
+        return fileResult(outputName), nil
+}
+
+// opValidatePDFA validates PDF/A compliance using verapdf
+func opValidatePDFA(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
+
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
         outputName := baseName + "_validation.txt"
         outputPath := filepath.Join(dir, outputName)
 
@@ -5293,90 +3881,54 @@ func handleValidatePDFA(w http.ResponseWriter, r *http.Request) {
 
         // Run qpdf --check to validate PDF structure
         reportBuilder.WriteString("=== PDF Structure Validation (qpdf --check) ===\n\n")
-        cmd := exec.Command("qpdf", "--check", "--warning-exit-0", inputPath)
-        cmd.Dir = dir
-        qpdfOutput, err := cmd.CombinedOutput()
+        qpdfOutput, err := runCommandOutput(ctx, dir, "qpdf", "--check", "--warning-exit-0", inputPath)
         if err != nil {
                 reportBuilder.WriteString(fmt.Sprintf("qpdf check failed: %v\n", err))
         }
         if len(qpdfOutput) > 0 {
-                reportBuilder.Write(qpdfOutput)
+                reportBuilder.WriteString(qpdfOutput)
         } else {
                 reportBuilder.WriteString("No issues found.\n")
         }
 
         // Run pdfinfo to get PDF version and metadata
         reportBuilder.WriteString("\n=== PDF Metadata (pdfinfo) ===\n\n")
-        cmd2 := exec.Command("pdfinfo", inputPath)
-        cmd2.Dir = dir
-        pdfinfoOutput, err := cmd2.CombinedOutput()
+        pdfinfoOutput, err := runCommandOutput(ctx, dir, "pdfinfo", inputPath)
         if err != nil {
                 reportBuilder.WriteString(fmt.Sprintf("pdfinfo failed: %v\n", err))
         }
         if len(pdfinfoOutput) > 0 {
-                reportBuilder.Write(pdfinfoOutput)
+                reportBuilder.WriteString(pdfinfoOutput)
         } else {
                 reportBuilder.WriteString("No metadata available.\n")
         }
 
         // Write combined validation output to file
         if err := os.WriteFile(outputPath, []byte(reportBuilder.String()), 0644); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to write validation report: "+err.Error())
-                return
+                return nil, opFail(http.StatusInternalServerError, "failed to write validation report: "+err.Error())
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
-// handlePDFToHTML converts PDF to HTML using pdftohtml
-func handlePDFToHTML(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, err.Error())
-                return
-        }
-
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(header, inputPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+// opPDFToHTML converts PDF to HTML using pdftohtml
+func opPDFToHTML(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        baseName := baseNameWithoutExt(header.Filename)
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
 
         // pdftohtml with -s creates a single HTML file
         // The output will be named baseName.html (pdftohtml adds suffix automatically)
-        if err := runCommand(dir, "pdftohtml",
+        if err := runCommand(ctx, dir, "pdftohtml",
                 "-s",            // single HTML file
                 "-noframes",     // no frame structure
                 "-enc", "UTF-8", // UTF-8 encoding
                 inputPath,
                 filepath.Join(dir, baseName),
         ); err != nil {
-                log.Printf("[pdf-to-html] pdftohtml error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "pdftohtml failed: "+err.Error())
-                return
+                logger(ctx).Error("pdftohtml failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "pdftohtml failed: "+err.Error())
         }
 
         // pdftohtml creates baseName-html.html or baseName.html
@@ -5416,86 +3968,37 @@ func handlePDFToHTML(w http.ResponseWriter, r *http.Request) {
         }
 
         if _, err := os.Stat(outputPath); os.IsNotExist(err) {
-                errorJSON(w, http.StatusInternalServerError, "HTML output not found")
-                return
+                return nil, opFail(http.StatusInternalServerError, "HTML output not found")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
-// handleAddHeaderFooter adds headers and footers to PDF using Ghostscript
-func handleAddHeaderFooter(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, err.Error())
-                return
-        }
-
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(header, inputPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+// opAddHeaderFooter adds headers and footers to PDF using Ghostscript
+func opAddHeaderFooter(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
+        inputPath := in.File().Path
         // Get header and footer text from form values
-        headerText := r.FormValue("headerText")
-        footerText := r.FormValue("footerText")
+        headerText := in.Param("headerText")
+        footerText := in.Param("footerText")
 
         if headerText == "" && footerText == "" {
-                errorJSON(w, http.StatusBadRequest, "at least one of headerText or footerText is required")
-                return
+                return nil, opParamFail("headerText", "at least one of headerText or footerText is required")
         }
 
-        baseName := baseNameWithoutExt(header.Filename)
+        baseName := baseNameWithoutExt(in.File().Name)
         outputName := baseName + "_headerfooter.pdf"
         outputPath := filepath.Join(dir, outputName)
 
-        // Get page dimensions using pdfinfo
+        // Get page dimensions
         pageWidth := 612.0  // Default Letter width in points
         pageHeight := 792.0 // Default Letter height in points
 
-        cmd := exec.Command("pdfinfo", inputPath)
-        cmd.Dir = dir
-        infoOutput, err := cmd.Output()
-        if err == nil {
-                // Parse page size from pdfinfo output
-                lines := strings.Split(string(infoOutput), "\n")
-                for _, line := range lines {
-                        if strings.HasPrefix(line, "Page size:") {
-                                // Format: "Page size:      612 x 792 pts (letter)"
-                                parts := strings.Fields(line)
-                                if len(parts) >= 4 {
-                                        if w, err := strconv.ParseFloat(parts[2], 64); err == nil {
-                                                pageWidth = w
-                                        }
-                                        if h, err := strconv.ParseFloat(parts[4], 64); err == nil {
-                                                pageHeight = h
-                                        }
-                                }
-                                break
-                        }
-                }
+        if w, h, err := firstPageSize(ctx, inputPath); err == nil {
+                pageWidth, pageHeight = w, h
+        } else {
+                logger(ctx).Error("page size failed", "error", err.Error())
         }
 
         // Calculate positions
@@ -5533,12 +4036,11 @@ func handleAddHeaderFooter(w http.ResponseWriter, r *http.Request) {
 `, psCommands.String())
 
         if err := os.WriteFile(psPath, []byte(psContent), 0644); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create overlay script")
-                return
+                return nil, opFail(http.StatusInternalServerError, "failed to create overlay script")
         }
 
         // Use Ghostscript to apply header/footer overlay to each page
-        if err := runCommand(dir, "gs",
+        if err := runCommand(ctx, dir, "gs",
                 "-dBATCH",
                 "-dNOPAUSE",
                 "-dQUIET",
@@ -5548,55 +4050,24 @@ func handleAddHeaderFooter(w http.ResponseWriter, r *http.Request) {
                 psPath,
                 inputPath,
         ); err != nil {
-                log.Printf("[add-header-footer] ghostscript error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to add header/footer: "+err.Error())
-                return
+                logger(ctx).Error("ghostscript failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to add header/footer: "+err.Error())
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
-// handleConvertToPDFA converts PDF to PDF/A-2b format using Ghostscript
-func handleConvertToPDFA(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, err.Error())
-                return
-        }
-
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(header, inputPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+// opConvertToPDFA converts PDF to PDF/A-2b format using Ghostscript
+func opConvertToPDFA(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        baseName := baseNameWithoutExt(header.Filename)
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
         outputName := baseName + "_pdfa.pdf"
         outputPath := filepath.Join(dir, outputName)
 
         // Convert to PDF/A-2b using Ghostscript
-        if err := runCommand(dir, "gs",
+        if err := runCommand(ctx, dir, "gs",
                 "-dBATCH",
                 "-dNOPAUSE",
                 "-dQUIET",
@@ -5606,289 +4077,350 @@ func handleConvertToPDFA(w http.ResponseWriter, r *http.Request) {
                 "-sOutputFile="+outputPath,
                 inputPath,
         ); err != nil {
-                log.Printf("[convert-to-pdfa] ghostscript error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to convert to PDF/A: "+err.Error())
-                return
+                logger(ctx).Error("ghostscript failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to convert to PDF/A: "+err.Error())
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
 }
 
-// handleEditPDF processes PDF with multiple annotations (text, images, drawings)
-func handleEditPDF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "POST required")
-                return
-        }
-
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, header, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, header) {
-                return
-        }
-
-        annotationsJSON := r.FormValue("annotations")
-        
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, err.Error())
-                return
+// opEditPDF applies the editor's annotations: text, images, freehand
+// drawings, shapes, lines, text markup and sticky notes. In the default
+// "content" mode they are drawn into the page content; with
+// mode=annotations they are added as PDF annotations, which viewers show
+// with their author and date and which reviewers can select, answer and
+// delete.
+func opEditPDF(ctx context.Context, in *OpInput) (*OpResult, error) {
+        annotationsJSON := in.Param("annotations")
+        author := strings.TrimSpace(in.Param("author"))
+
+        mode := strings.TrimSpace(in.Param("mode"))
+        switch mode {
+        case "":
+                mode = "content"
+        case "content", "annotations":
+        default:
+                return nil, opParamFail("mode", "mode must be content or annotations")
         }
 
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(header, inputPath); err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                return
-        }
+        dir := in.Dir
 
-        baseName := baseNameWithoutExt(header.Filename)
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
         outputName := baseName + "_edited.pdf"
         outputPath := filepath.Join(dir, outputName)
 
-        // Parse annotations
+        // Parse annotations. Positions and sizes are percentages of the page
+        // as displayed.
+        type Area struct {
+                X      float64 `json:"x"`
+                Y      float64 `json:"y"`
+                Width  float64 `json:"width"`
+                Height float64 `json:"height"`
+        }
         type Annotation struct {
-                ID          string                   `json:"id"`
-                Type        string                   `json:"type"`
-                Page        int                      `json:"page"`
-                X           float64                  `json:"x"`
-                Y           float64                  `json:"y"`
-                Width       float64                  `json:"width,omitempty"`
-                Height      float64                  `json:"height,omitempty"`
-                Content     string                   `json:"content,omitempty"`
-                FontSize    int                      `json:"fontSize,omitempty"`
-                Color       string                   `json:"color,omitempty"`
-                ImageData   string                   `json:"imageData,omitempty"`
-                DrawingPath []map[string]float64     `json:"drawingPath,omitempty"`
+                ID          string               `json:"id"`
+                Type        string               `json:"type"`
+                Page        int                  `json:"page"`
+                X           float64              `json:"x"`
+                Y           float64              `json:"y"`
+                Width       float64              `json:"width,omitempty"`
+                Height      float64              `json:"height,omitempty"`
+                Content     string               `json:"content,omitempty"`
+                FontSize    int                  `json:"fontSize,omitempty"`
+                Color       string               `json:"color,omitempty"`
+                ImageData   string               `json:"imageData,omitempty"`
+                DrawingPath []map[string]float64 `json:"drawingPath,omitempty"`
+                ShapeType   string               `json:"shapeType,omitempty"`
+
+                // Rects are the lines of text a highlight, underline or strikeout
+                // marks; without them it marks x, y, width, height.
+                Rects []Area `json:"rects,omitempty"`
+                // Comment is the note attached to any annotation but text and
+                // sticky notes, whose note is their content.
+                Comment     string  `json:"comment,omitempty"`
+                Author      string  `json:"author,omitempty"`
+                FillColor   string  `json:"fillColor,omitempty"`
+                Opacity     float64 `json:"opacity,omitempty"`
+                StrokeWidth float64 `json:"strokeWidth,omitempty"`
+                // StartArrow and EndArrow are the arrowheads of lines: "open" or
+                // "closed".
+                StartArrow string `json:"startArrow,omitempty"`
+                EndArrow   string `json:"endArrow,omitempty"`
         }
 
         var annotations []Annotation
         if annotationsJSON != "" {
                 if err := json.Unmarshal([]byte(annotationsJSON), &annotations); err != nil {
-                        log.Printf("[edit] failed to parse annotations: %v", err)
-                        errorJSON(w, http.StatusBadRequest, "invalid annotations format")
-                        return
+                        logger(ctx).Error("failed to parse annotations", "error", err.Error())
+                        return nil, opParamFail("annotations", "invalid annotations format")
                 }
         }
 
         if len(annotations) == 0 {
-                errorJSON(w, http.StatusBadRequest, "no annotations provided")
-                return
+                return nil, opParamFail("annotations", "no annotations provided")
         }
 
-        pageWidthPts := 612.0
-        pageHeightPts := 792.0
+        doc, u, err := startOverlays(ctx, inputPath)
+        if err != nil {
+                logger(ctx).Error("parse failed", "error", err.Error())
+                return nil, err
+        }
+        defer doc.Close()
 
-        cmd := exec.Command("pdfinfo", inputPath)
-        cmd.Dir = dir
-        infoOutput, err := cmd.Output()
-        if err == nil {
-                lines := strings.Split(string(infoOutput), "\n")
-                for _, line := range lines {
-                        if strings.HasPrefix(line, "Page size:") {
-                                parts := strings.Fields(line)
-                                if len(parts) >= 5 {
-                                        if w, err := strconv.ParseFloat(parts[2], 64); err == nil {
-                                                pageWidthPts = w
-                                        }
-                                        if h, err := strconv.ParseFloat(parts[4], 64); err == nil {
-                                                pageHeightPts = h
-                                        }
-                                }
-                                break
-                        }
+        for _, ann := range annotations {
+                if ann.Page < 1 || ann.Page > doc.NumPages() {
+                        return nil, &opError{status: http.StatusUnprocessableEntity, code: codePageOutOfRange, param: "annotations",
+                                msg: fmt.Sprintf("an annotation is placed on page %d, but the PDF has %d pages", ann.Page, doc.NumPages())}
                 }
         }
-        log.Printf("[edit] PDF page dimensions: %.0fx%.0f pts", pageWidthPts, pageHeightPts)
 
-        currentInput := inputPath
-        tempCounter := 0
+        var font *pdfdoc.Font
+        now := time.Now()
         appliedCount := 0
-
-        pageGroups := make(map[int][]Annotation)
         for _, ann := range annotations {
-                pageGroups[ann.Page] = append(pageGroups[ann.Page], ann)
-        }
-
-        for pageNum, pageAnns := range pageGroups {
-                overlayFile := filepath.Join(dir, fmt.Sprintf("edit_overlay_%d.png", pageNum))
-                overlayArgs := []string{"-size", fmt.Sprintf("%dx%d", int(pageWidthPts), int(pageHeightPts)), "xc:none"}
-
-                hasContent := false
-
-                for i, ann := range pageAnns {
-                        xPts := ann.X / 100.0 * pageWidthPts
-                        yPts := ann.Y / 100.0 * pageHeightPts
-
-                        if ann.Type == "text" && ann.Content != "" {
-                                fontSize := ann.FontSize
-                                if fontSize < 8 {
-                                        fontSize = 16
-                                }
-                                color := ann.Color
-                                if color == "" {
-                                        color = "#000000"
-                                }
+                o, err := u.Overlay(ann.Page)
+                if err != nil {
+                        logger(ctx).Error("edit page failed", "page", ann.Page, "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to process PDF")
+                }
 
-                                escapedContent := strings.ReplaceAll(ann.Content, "'", "\\'")
-                                escapedContent = strings.ReplaceAll(escapedContent, "\"", "\\\"")
+                pageWidth, pageHeight := o.Size()
+                box := func(x, y, w, h float64) pdfdoc.Box {
+                        return pdfdoc.Box{X: x / 100 * pageWidth, Y: y / 100 * pageHeight, Width: w / 100 * pageWidth, Height: h / 100 * pageHeight}
+                }
+                points := make([]pdfdoc.Point, len(ann.DrawingPath))
+                for j, p := range ann.DrawingPath {
+                        points[j] = pdfdoc.Point{X: p["x"] / 100 * pageWidth, Y: p["y"] / 100 * pageHeight}
+                }
+                area := box(ann.X, ann.Y, ann.Width, ann.Height)
 
-                                overlayArgs = append(overlayArgs,
-                                        "-font", "DejaVu-Sans",
-                                        "-fill", color,
-                                        "-pointsize", fmt.Sprintf("%d", fontSize),
-                                        "-draw", fmt.Sprintf("text %d,%d '%s'", int(xPts), int(yPts)+fontSize, escapedContent),
-                                )
-                                hasContent = true
+                a := &pdfdoc.Annotation{
+                        Contents:      ann.Comment,
+                        Color:         optionalColor(ann.Color),
+                        InteriorColor: optionalColor(ann.FillColor),
+                        Opacity:       ann.Opacity,
+                        BorderWidth:   ann.StrokeWidth,
+                }
+                switch ann.Type {
+                case "text":
+                        if ann.Content == "" {
+                                continue
                         }
+                        fontSize := ann.FontSize
+                        if fontSize < 8 {
+                                fontSize = 16
+                        }
+                        if font == nil {
+                                font = overlayFont(u)
+                        }
+                        // y is the top of the text box; the box fits the text,
+                        // whose lines are 1.2 em apart.
+                        size := float64(fontSize)
+                        lines := strings.Split(strings.ReplaceAll(ann.Content, "\r\n", "\n"), "\n")
+                        textWidth := 0.0
+                        for _, line := range lines {
+                                textWidth = max(textWidth, font.Width(line, size))
+                        }
+                        a.Subtype = "FreeText"
+                        a.Contents = ann.Content
+                        a.Font, a.FontSize = font, size
+                        a.Rect = pdfdoc.Box{X: area.X, Y: area.Y, Width: max(area.Width, textWidth+2), Height: (1.2*float64(len(lines)-1) + 1.3) * size}
 
-                        if ann.Type == "image" && ann.ImageData != "" && strings.HasPrefix(ann.ImageData, "data:image") {
-                                parts := strings.SplitN(ann.ImageData, ",", 2)
-                                if len(parts) == 2 {
-                                        decoded, decErr := base64.StdEncoding.DecodeString(parts[1])
-                                        if decErr != nil {
-                                                log.Printf("[edit] base64 decode error: %v", decErr)
-                                                continue
-                                        }
-
-                                        imgPath := filepath.Join(dir, fmt.Sprintf("img_%d_%d.png", pageNum, i))
-                                        if wErr := os.WriteFile(imgPath, decoded, 0644); wErr != nil {
-                                                log.Printf("[edit] write image error: %v", wErr)
-                                                continue
-                                        }
-
-                                        imgWidth := int(ann.Width / 100.0 * pageWidthPts)
-                                        imgHeight := int(ann.Height / 100.0 * pageHeightPts)
-                                        if imgWidth < 10 {
-                                                imgWidth = int(pageWidthPts * 0.3)
-                                        }
-                                        if imgHeight < 10 {
-                                                imgHeight = int(pageHeightPts * 0.3)
-                                        }
-
-                                        imgOverlayPath := filepath.Join(dir, fmt.Sprintf("img_overlay_%d_%d.png", pageNum, i))
-                                        imgOverlayArgs := []string{
-                                                "-size", fmt.Sprintf("%dx%d", int(pageWidthPts), int(pageHeightPts)),
-                                                "xc:none",
-                                                "(", imgPath, "-resize", fmt.Sprintf("%dx%d!", imgWidth, imgHeight), ")",
-                                                "-geometry", fmt.Sprintf("+%d+%d", int(xPts), int(yPts)),
-                                                "-composite",
-                                                "PNG32:" + imgOverlayPath,
-                                        }
-                                        if err := runCommand(dir, "convert", imgOverlayArgs...); err != nil {
-                                                log.Printf("[edit] image overlay error: %v", err)
-                                                continue
-                                        }
+                case "image":
+                        if !strings.HasPrefix(ann.ImageData, "data:image") {
+                                continue
+                        }
+                        data, err := decodeDataURL(ann.ImageData)
+                        if err != nil {
+                                logger(ctx).Error("invalid image data", "annotation_id", ann.ID, "error", err.Error())
+                                continue
+                        }
+                        img, err := u.AddImage(data)
+                        if err != nil {
+                                logger(ctx).Error("unusable image", "annotation_id", ann.ID, "error", err.Error())
+                                continue
+                        }
+                        if area.Width < 10 {
+                                area.Width = pageWidth * 0.3
+                        }
+                        if area.Height < 10 {
+                                area.Height = pageHeight * 0.3
+                        }
+                        a.Subtype, a.Rect, a.Image = "Stamp", area, img
 
-                                        overlayArgs = append(overlayArgs,
-                                                imgOverlayPath, "-composite",
-                                        )
-                                        hasContent = true
-                                }
+                case "drawing":
+                        if len(points) < 2 {
+                                continue
+                        }
+                        a.Subtype, a.Ink = "Ink", [][]pdfdoc.Point{points}
+                        if a.BorderWidth == 0 {
+                                a.BorderWidth = 3
+                        }
+                        if strings.EqualFold(ann.Color, "#FFFF00") {
+                                // The highlighter: a broad translucent stroke that tints,
+                                // rather than covers, the text under it.
+                                a.BorderWidth, a.Opacity, a.BlendMode = 12, 0.5, "Multiply"
                         }
 
-                        if ann.Type == "drawing" && len(ann.DrawingPath) > 1 {
-                                drawColor := ann.Color
-                                if drawColor == "" {
-                                        drawColor = "#000000"
+                case "shape":
+                        if a.BorderWidth == 0 {
+                                a.BorderWidth = 2
+                        }
+                        switch ann.ShapeType {
+                        case "line", "arrow":
+                                // A line along the drawn path, or across the box.
+                                a.Subtype = "Line"
+                                if len(points) >= 2 {
+                                        a.Line = [2]pdfdoc.Point{points[0], points[len(points)-1]}
+                                } else {
+                                        a.Line = [2]pdfdoc.Point{{X: area.X, Y: area.Y}, {X: area.X + area.Width, Y: area.Y + area.Height}}
                                 }
-
-                                strokeWidth := "3"
-                                isHighlight := drawColor == "#FFFF00"
-                                if isHighlight {
-                                        strokeWidth = "12"
+                                if a.Line[0] == a.Line[1] {
+                                        continue
                                 }
-
-                                var drawPoints strings.Builder
-                                for j, point := range ann.DrawingPath {
-                                        px := point["x"] / 100.0 * pageWidthPts
-                                        py := point["y"] / 100.0 * pageHeightPts
-                                        if j > 0 {
-                                                drawPoints.WriteString(" ")
-                                        }
-                                        drawPoints.WriteString(fmt.Sprintf("%.1f,%.1f", px, py))
+                                endArrow := ann.EndArrow
+                                if endArrow == "" && ann.ShapeType == "arrow" {
+                                        endArrow = "open"
                                 }
+                                a.LineEndings = [2]pdfdoc.Name{lineEnding(ann.StartArrow), lineEnding(endArrow)}
+                        case "circle":
+                                a.Subtype, a.Rect = "Circle", area
+                        default:
+                                a.Subtype, a.Rect = "Square", area
+                        }
+                        if a.Subtype != "Line" && (area.Width <= 0 || area.Height <= 0) {
+                                continue
+                        }
 
-                                strokeColor := drawColor
-                                if isHighlight {
-                                        strokeColor = "#FFFF0080"
+                case "highlight", "underline", "strikeout":
+                        a.Subtype = map[string]pdfdoc.Name{"highlight": "Highlight", "underline": "Underline", "strikeout": "StrikeOut"}[ann.Type]
+                        for _, r := range ann.Rects {
+                                if q := box(r.X, r.Y, r.Width, r.Height); q.Width > 0 && q.Height > 0 {
+                                        a.Quads = append(a.Quads, q)
                                 }
-                                overlayArgs = append(overlayArgs,
-                                        "-stroke", strokeColor,
-                                        "-strokewidth", strokeWidth,
-                                        "-fill", "none",
-                                        "-draw", fmt.Sprintf("polyline %s", drawPoints.String()),
-                                )
-                                hasContent = true
                         }
-                }
+                        if len(a.Quads) == 0 {
+                                if area.Width <= 0 || area.Height <= 0 {
+                                        continue
+                                }
+                                a.Quads = []pdfdoc.Box{area}
+                        }
+
+                case "note":
+                        a.Subtype = "Text"
+                        a.Contents = ann.Content
+                        a.Rect = pdfdoc.Box{X: area.X, Y: area.Y}
 
-                if !hasContent {
+                default:
                         continue
                 }
 
-                overlayArgs = append(overlayArgs, "PNG32:"+overlayFile)
-
-                log.Printf("[edit] Creating overlay for page %d", pageNum)
-                if err := runCommand(dir, "convert", overlayArgs...); err != nil {
-                        log.Printf("[edit] ImageMagick overlay error for page %d: %v", pageNum, err)
+                if mode == "content" {
+                        o.DrawAnnotation(a)
+                        appliedCount++
                         continue
                 }
 
-                tempOutput := filepath.Join(dir, fmt.Sprintf("temp_%d.pdf", tempCounter))
-                tempCounter++
-
-                desc := "pos:tl, off:0 0, scale:1.0 abs, rot:0"
-                args := []string{"stamp", "add", "-mode", "image", "-pages", fmt.Sprintf("%d", pageNum), "--", overlayFile, desc, currentInput, tempOutput}
-
-                log.Printf("[edit] Stamping overlay on page %d", pageNum)
-                if err := runCommand(dir, "pdfcpu", args...); err != nil {
-                        log.Printf("[edit] pdfcpu stamp error for page %d: %v", pageNum, err)
+                a.Author = author
+                if ann.Author != "" {
+                        a.Author = ann.Author
+                }
+                a.Name = ann.ID
+                if a.Name == "" {
+                        a.Name = uuid.NewString()
+                }
+                a.Created, a.Modified = now, now
+                if _, err := u.Annotate(ann.Page, a); err != nil {
+                        logger(ctx).Error("cannot add annotation", "annotation_id", ann.ID, "error", err.Error())
                         continue
                 }
-                currentInput = tempOutput
                 appliedCount++
         }
 
         if appliedCount == 0 {
-                log.Printf("[edit] No annotations could be applied")
-                errorJSON(w, http.StatusInternalServerError, "failed to apply annotations to PDF")
-                return
+                logger(ctx).Error("no annotations could be applied")
+                return nil, opFail(http.StatusInternalServerError, "failed to apply annotations to PDF")
         }
 
-        if err := copyFileEdit(currentInput, outputPath); err != nil {
-                log.Printf("[edit] copy error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to finalize PDF")
-                return
+        if err := writeOverlays(ctx, u, outputPath); err != nil {
+                logger(ctx).Error("write failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to finalize PDF")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{
-                DownloadURL: buildDownloadURL(r, jobID, outputName),
-        })
+        return fileResult(outputName), nil
+}
+
+type annotationsResponse struct {
+        Annotations []annotationInfo `json:"annotations"`
+}
+
+// annotationInfo describes an annotation. X, Y, Width and Height are
+// percentages of the page as displayed, as the editor places annotations;
+// Rect is the annotation's rectangle in PDF user space.
+type annotationInfo struct {
+        Page     int        `json:"page"`
+        Type     string     `json:"type"` // the PDF subtype: Highlight, Text, Ink...
+        ID       string     `json:"id,omitempty"`
+        Author   string     `json:"author,omitempty"`
+        Subject  string     `json:"subject,omitempty"`
+        Contents string     `json:"contents,omitempty"`
+        Color    string     `json:"color,omitempty"`
+        Opacity  float64    `json:"opacity"`
+        Created  string     `json:"created,omitempty"` // RFC 3339
+        Modified string     `json:"modified,omitempty"`
+        X        float64    `json:"x"`
+        Y        float64    `json:"y"`
+        Width    float64    `json:"width"`
+        Height   float64    `json:"height"`
+        Rect     [4]float64 `json:"rect"`
 }
 
-// hexToRGB converts hex color to pdfcpu RGB format (0-1 range)
-func hexToRGB(hex string) string {
-        if hex == "" || hex == "#000000" {
-                return "0 0 0"
+// opListAnnotations lists the annotations of a PDF, page by page.
+func opListAnnotations(ctx context.Context, in *OpInput) (*OpResult, error) {
+        doc, err := openPDF(ctx, in.File().Path)
+        if err != nil {
+                logger(ctx).Error("parse failed", "error", err.Error())
+                return nil, pdfReadError(err)
         }
-        hex = strings.TrimPrefix(hex, "#")
-        if len(hex) != 6 {
-                return "0 0 0"
+        defer doc.Close()
+
+        percent := func(v, of float64) float64 { return math.Round(v/of*10000) / 100 }
+        resp := annotationsResponse{Annotations: []annotationInfo{}}
+        for _, page := range doc.Pages() {
+                annots, err := doc.Annotations(page.Number)
+                if err != nil {
+                        logger(ctx).Error("list annotations failed", "page", page.Number, "error", err.Error())
+                        return nil, pdfReadError(err)
+                }
+                w, h := page.Size()
+                for _, a := range annots {
+                        info := annotationInfo{
+                                Page:     page.Number,
+                                Type:     string(a.Subtype),
+                                ID:       a.Name,
+                                Author:   a.Author,
+                                Subject:  a.Subject,
+                                Contents: a.Contents,
+                                Color:    hexColor(a.Color),
+                                Opacity:  a.Opacity,
+                                X:        percent(a.Rect.X, w),
+                                Y:        percent(a.Rect.Y, h),
+                                Width:    percent(a.Rect.Width, w),
+                                Height:   percent(a.Rect.Height, h),
+                        }
+                        r := a.PDFRect
+                        info.Rect = [4]float64{r.LLX, r.LLY, r.URX, r.URY}
+                        if !a.Created.IsZero() {
+                                info.Created = a.Created.Format(time.RFC3339)
+                        }
+                        if !a.Modified.IsZero() {
+                                info.Modified = a.Modified.Format(time.RFC3339)
+                        }
+                        resp.Annotations = append(resp.Annotations, info)
+                }
         }
-        rVal, _ := strconv.ParseInt(hex[0:2], 16, 64)
-        gVal, _ := strconv.ParseInt(hex[2:4], 16, 64)
-        bVal, _ := strconv.ParseInt(hex[4:6], 16, 64)
-        return fmt.Sprintf("%.2f %.2f %.2f", float64(rVal)/255, float64(gVal)/255, float64(bVal)/255)
+        return dataResult(resp), nil
 }
 
 // copyFileEdit copies a file from src to dst
@@ -5910,13 +4442,17 @@ func copyFileEdit(src, dst string) error {
 }
 
 type metadataResponse struct {
-        Title    string `json:"title"`
-        Author   string `json:"author"`
-        Subject  string `json:"subject"`
-        Keywords string `json:"keywords"`
-        Creator  string `json:"creator"`
-        Producer string `json:"producer"`
-        Pages    string `json:"pages"`
+        Title        string `json:"title"`
+        Author       string `json:"author"`
+        Subject      string `json:"subject"`
+        Keywords     string `json:"keywords"`
+        Creator      string `json:"creator"`
+        Producer     string `json:"producer"`
+        CreationDate string `json:"creationDate,omitempty"` // RFC 3339
+        ModDate      string `json:"modDate,omitempty"`
+        Pages        int    `json:"pages"`
+        PDFVersion   string `json:"pdfVersion"`
+        Encrypted    bool   `json:"encrypted"`
 }
 
 type formFieldsResponse struct {
@@ -5934,74 +4470,28 @@ type bookmarkEntry struct {
         Page  int    `json:"page"`
 }
 
-func handlePNGToPDF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(256 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        files := r.MultipartForm.File["files"]
-        if len(files) == 0 {
-                errorJSON(w, http.StatusBadRequest, "no files provided")
-                return
-        }
-        if !checkMultipleFileSizes(w, r, files) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
+func opPNGToPDF(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
         var imagePaths []string
-        for i, fh := range files {
-                inPath := filepath.Join(dir, fmt.Sprintf("image_%d.png", i))
-                if err := saveUploadedFile(fh, inPath); err != nil {
-                        errorJSON(w, http.StatusInternalServerError, "failed to save image")
-                        return
-                }
-                imagePaths = append(imagePaths, inPath)
+        for _, f := range in.Files {
+                imagePaths = append(imagePaths, f.Path)
         }
 
         outName := "output.pdf"
         outPath := filepath.Join(dir, outName)
 
         args := append(imagePaths, outPath)
-        if err := runCommand(dir, "convert", args...); err != nil {
-                log.Printf("[png-to-pdf] convert error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to convert PNG to PDF")
-                return
+        if err := runCommand(ctx, dir, "convert", args...); err != nil {
+                logger(ctx).Error("convert failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to convert PNG to PDF")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handlePDFToPNG(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
-        dpi := parseIntDefault(r.FormValue("dpi"), 300)
+func opPDFToPNG(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dpi := parseIntDefault(in.Param("dpi"), 300)
         if dpi < 72 {
                 dpi = 72
         }
@@ -6009,203 +4499,99 @@ func handlePDFToPNG(w http.ResponseWriter, r *http.Request) {
                 dpi = 600
         }
 
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[pdf-to-png] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[pdf-to-png] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
+        dir := in.Dir
 
+        inputPath := in.File().Path
         imagesDir := filepath.Join(dir, "images")
         if err := os.MkdirAll(imagesDir, 0o755); err != nil {
-                log.Printf("[pdf-to-png] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create images dir")
-                return
+                logger(ctx).Error("pdf-to-png failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to create images dir")
         }
 
         prefix := filepath.Join(imagesDir, "page")
-        if err := runCommand(dir, "pdftoppm", "-png", "-r", strconv.Itoa(dpi), inputPath, prefix); err != nil {
-                log.Printf("[pdf-to-png] pdftoppm error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to convert PDF to PNG")
-                return
+        if err := runCommand(ctx, dir, "pdftoppm", "-png", "-r", strconv.Itoa(dpi), inputPath, prefix); err != nil {
+                logger(ctx).Error("pdftoppm failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to convert PDF to PNG")
         }
 
         pngFiles, err := filepath.Glob(filepath.Join(imagesDir, "page-*.png"))
         if err != nil || len(pngFiles) == 0 {
-                log.Printf("[pdf-to-png] no PNG files generated")
-                errorJSON(w, http.StatusInternalServerError, "no PNG files generated")
-                return
+                logger(ctx).Error("no PNG files generated")
+                return nil, opFail(http.StatusInternalServerError, "no PNG files generated")
         }
         sort.Strings(pngFiles)
 
-        baseName := baseNameWithoutExt(hdr.Filename)
+        baseName := baseNameWithoutExt(in.File().Name)
         zipName := baseName + "_png.zip"
         zipPath := filepath.Join(dir, zipName)
 
-        if err := zipDirectory(imagesDir, zipPath); err != nil {
-                log.Printf("[pdf-to-png] zip error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create zip")
-                return
+        if err := zipDirectory(ctx, imagesDir, zipPath); err != nil {
+                logger(ctx).Error("zip failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to create zip")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, zipName)})
+        return fileResult(zipName), nil
 }
 
-func handlePDFToTIFF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[pdf-to-tiff] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
+func opPDFToTIFF(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[pdf-to-tiff] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
-
-        baseName := baseNameWithoutExt(hdr.Filename)
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
         outName := baseName + ".tiff"
         outPath := filepath.Join(dir, outName)
 
-        dpi := r.FormValue("dpi")
+        dpi := in.Param("dpi")
         if dpi == "" {
                 dpi = "300"
         }
 
-        if err := runCommand(dir, "gs",
+        if err := runCommand(ctx, dir, "gs",
                 "-dNOPAUSE", "-dBATCH", "-dQUIET",
                 "-sDEVICE=tiff24nc",
                 "-r"+dpi,
                 fmt.Sprintf("-sOutputFile=%s", outPath),
                 inputPath,
         ); err != nil {
-                log.Printf("[pdf-to-tiff] gs error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to convert PDF to TIFF")
-                return
+                logger(ctx).Error("gs failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to convert PDF to TIFF")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handleBMPToPDF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(256 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        files := r.MultipartForm.File["files"]
-        if len(files) == 0 {
-                errorJSON(w, http.StatusBadRequest, "no files provided")
-                return
-        }
-        if !checkMultipleFileSizes(w, r, files) {
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
+func opBMPToPDF(ctx context.Context, in *OpInput) (*OpResult, error) {
+        dir := in.Dir
 
         var imagePaths []string
-        for i, fh := range files {
-                inPath := filepath.Join(dir, fmt.Sprintf("image_%d.bmp", i))
-                if err := saveUploadedFile(fh, inPath); err != nil {
-                        errorJSON(w, http.StatusInternalServerError, "failed to save image")
-                        return
-                }
-                imagePaths = append(imagePaths, inPath)
+        for _, f := range in.Files {
+                imagePaths = append(imagePaths, f.Path)
         }
 
         outName := "output.pdf"
         outPath := filepath.Join(dir, outName)
 
         args := append(imagePaths, outPath)
-        if err := runCommand(dir, "convert", args...); err != nil {
-                log.Printf("[bmp-to-pdf] convert error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to convert BMP to PDF")
-                return
+        if err := runCommand(ctx, dir, "convert", args...); err != nil {
+                logger(ctx).Error("convert failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to convert BMP to PDF")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handleEncryptPDF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                log.Printf("[encrypt-pdf] error: %v", err)
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        password := strings.TrimSpace(r.FormValue("password"))
+func opEncryptPDF(ctx context.Context, in *OpInput) (*OpResult, error) {
+        password := strings.TrimSpace(in.Param("password"))
         if password == "" {
-                errorJSON(w, http.StatusBadRequest, "password is required")
-                return
-        }
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
+                return nil, opParamFail("password", "password is required")
         }
 
-        permissions := strings.TrimSpace(r.FormValue("permissions"))
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[encrypt-pdf] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
+        permissions := strings.TrimSpace(in.Param("permissions"))
 
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[encrypt-pdf] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
+        dir := in.Dir
 
-        baseName := baseNameWithoutExt(hdr.Filename)
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
         outName := baseName + "_encrypted.pdf"
         outPath := filepath.Join(dir, outName)
 
@@ -6230,94 +4616,61 @@ func handleEncryptPDF(w http.ResponseWriter, r *http.Request) {
 
         args = append(args, "--", inputPath, outPath)
 
-        if err := runCommand(dir, "qpdf", args...); err != nil {
-                log.Printf("[encrypt-pdf] qpdf error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to encrypt PDF")
-                return
+        if err := runCommand(ctx, dir, "qpdf", args...); err != nil {
+                logger(ctx).Error("qpdf failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to encrypt PDF")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handleMetadataEditor(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
-        action := strings.TrimSpace(r.FormValue("action"))
+func opMetadataEditor(ctx context.Context, in *OpInput) (*OpResult, error) {
+        action := strings.TrimSpace(in.Param("action"))
         if action == "" {
                 action = "read"
         }
 
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[metadata] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[metadata] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
+        dir := in.Dir
 
+        inputPath := in.File().Path
         if action == "read" {
-                out, err := runCommandOutput(dir, "pdfcpu", "info", inputPath)
+                doc, err := openPDF(ctx, inputPath)
                 if err != nil {
-                        log.Printf("[metadata] pdfcpu info error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to read metadata")
-                        return
+                        logger(ctx).Error("parse failed", "error", err.Error())
+                        return nil, pdfReadError(err)
+                }
+                defer doc.Close()
+                info, err := doc.Info()
+                if err != nil {
+                        logger(ctx).Error("info failed", "error", err.Error())
+                        return nil, pdfReadError(err)
                 }
 
-                meta := metadataResponse{}
-                for _, line := range strings.Split(out, "\n") {
-                        line = strings.TrimSpace(line)
-                        if idx := strings.Index(line, ":"); idx > 0 {
-                                key := strings.TrimSpace(line[:idx])
-                                val := strings.TrimSpace(line[idx+1:])
-                                switch strings.ToLower(key) {
-                                case "title":
-                                        meta.Title = val
-                                case "author":
-                                        meta.Author = val
-                                case "subject":
-                                        meta.Subject = val
-                                case "keywords":
-                                        meta.Keywords = val
-                                case "creator":
-                                        meta.Creator = val
-                                case "producer":
-                                        meta.Producer = val
-                                case "pages", "page count":
-                                        meta.Pages = val
-                                }
-                        }
+                meta := metadataResponse{
+                        Title:      info.Title,
+                        Author:     info.Author,
+                        Subject:    info.Subject,
+                        Keywords:   info.Keywords,
+                        Creator:    info.Creator,
+                        Producer:   info.Producer,
+                        Pages:      doc.NumPages(),
+                        PDFVersion: doc.Version(),
+                        Encrypted:  doc.Encrypted(),
+                }
+                if !info.CreationDate.IsZero() {
+                        meta.CreationDate = info.CreationDate.Format(time.RFC3339)
+                }
+                if !info.ModDate.IsZero() {
+                        meta.ModDate = info.ModDate.Format(time.RFC3339)
                 }
 
-                writeJSON(w, http.StatusOK, meta)
-                return
+                return dataResult(meta), nil
         }
 
-        title := strings.TrimSpace(r.FormValue("title"))
-        author := strings.TrimSpace(r.FormValue("author"))
-        subject := strings.TrimSpace(r.FormValue("subject"))
-        keywords := strings.TrimSpace(r.FormValue("keywords"))
+        title := strings.TrimSpace(in.Param("title"))
+        author := strings.TrimSpace(in.Param("author"))
+        subject := strings.TrimSpace(in.Param("subject"))
+        keywords := strings.TrimSpace(in.Param("keywords"))
 
         var propArgs []string
         if title != "" {
@@ -6334,95 +4687,58 @@ func handleMetadataEditor(w http.ResponseWriter, r *http.Request) {
         }
 
         if len(propArgs) == 0 {
-                errorJSON(w, http.StatusBadRequest, "no metadata fields provided")
-                return
+                return nil, opFailCode(http.StatusBadRequest, codeInvalidParam, "no metadata fields provided")
         }
 
-        baseName := baseNameWithoutExt(hdr.Filename)
+        baseName := baseNameWithoutExt(in.File().Name)
         outName := baseName + "_metadata.pdf"
         outPath := filepath.Join(dir, outName)
 
         if err := copyFileEdit(inputPath, outPath); err != nil {
-                log.Printf("[metadata] copy error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to prepare output")
-                return
+                logger(ctx).Error("copy failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to prepare output")
         }
 
         args := []string{"properties", "add", outPath}
         args = append(args, propArgs...)
-        if err := runCommand(dir, "pdfcpu", args...); err != nil {
-                log.Printf("[metadata] pdfcpu properties error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to update metadata")
-                return
+        if err := runCommand(ctx, dir, "pdfcpu", args...); err != nil {
+                logger(ctx).Error("pdfcpu properties failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to update metadata")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handleBookmarksEditor(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
-        bookmarksJSON := strings.TrimSpace(r.FormValue("bookmarks"))
+func opBookmarksEditor(ctx context.Context, in *OpInput) (*OpResult, error) {
+        bookmarksJSON := strings.TrimSpace(in.Param("bookmarks"))
         if bookmarksJSON == "" {
-                errorJSON(w, http.StatusBadRequest, "bookmarks JSON is required")
-                return
+                return nil, opParamFail("bookmarks", "bookmarks JSON is required")
         }
 
         var bookmarks []bookmarkEntry
         if err := json.Unmarshal([]byte(bookmarksJSON), &bookmarks); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid bookmarks JSON")
-                return
+                return nil, opParamFail("bookmarks", "invalid bookmarks JSON")
         }
 
         if len(bookmarks) == 0 {
-                errorJSON(w, http.StatusBadRequest, "at least one bookmark is required")
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[bookmarks] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
+                return nil, opParamFail("bookmarks", "at least one bookmark is required")
         }
 
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[bookmarks] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
+        dir := in.Dir
 
-        baseName := baseNameWithoutExt(hdr.Filename)
+        inputPath := in.File().Path
+        baseName := baseNameWithoutExt(in.File().Name)
         outName := baseName + "_bookmarked.pdf"
 
         bmJSON, err := json.Marshal(bookmarks)
         if err != nil {
-                log.Printf("[bookmarks] marshal error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to encode bookmarks")
-                return
+                logger(ctx).Error("marshal failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to encode bookmarks")
         }
         bmFile := filepath.Join(dir, "bookmarks.json")
         if err := os.WriteFile(bmFile, bmJSON, 0o644); err != nil {
-                log.Printf("[bookmarks] write json error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to write bookmarks file")
-                return
+                logger(ctx).Error("write json failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to write bookmarks file")
         }
         outPath := filepath.Join(dir, outName)
 
@@ -6456,212 +4772,136 @@ print("Bookmarks added successfully")
 `
         scriptPath := filepath.Join(dir, "add_bookmarks.py")
         if err := os.WriteFile(scriptPath, []byte(pythonScript), 0o755); err != nil {
-                log.Printf("[bookmarks] write script error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create script")
-                return
+                logger(ctx).Error("write script failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to create script")
         }
-        if err := runCommand(dir, "python3", scriptPath, inputPath, bmFile, outPath); err != nil {
-                log.Printf("[bookmarks] python script error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to add bookmarks")
-                return
+        if err := runCommand(ctx, dir, "python3", scriptPath, inputPath, bmFile, outPath); err != nil {
+                logger(ctx).Error("python script failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to add bookmarks")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handleBatchProcess(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(256 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
+// batchAlias names the registered operation behind one of the operation names
+// the batch tool accepted before it could run any registered operation, and
+// the parameters that name used to imply.
+type batchAlias struct {
+        op       string
+        defaults map[string]string
+}
 
-        files := r.MultipartForm.File["files"]
-        if len(files) == 0 {
-                errorJSON(w, http.StatusBadRequest, "no files provided")
-                return
+// batchAliases keeps the old batch operations producing what they did: every
+// page of each file as images, a fallback password and watermark text.
+var batchAliases = map[string]batchAlias{
+        "encrypt":   {op: "protect", defaults: map[string]string{"password": "password"}},
+        "to-jpg":    {op: "pdf-to-jpg", defaults: map[string]string{"all": "true", "dpi": "300"}},
+        "to-png":    {op: "pdf-to-png", defaults: map[string]string{"dpi": "200"}},
+        "watermark": {op: "watermark", defaults: map[string]string{"text": "WATERMARK", "opacity": "0.25"}},
+}
+
+// batchParams returns params with the alias defaults filled in wherever the
+// request left them empty.
+func batchParams(alias batchAlias, params map[string]string) map[string]string {
+        out := make(map[string]string, len(params)+len(alias.defaults))
+        for k, v := range params {
+                out[k] = v
         }
-        if !checkMultipleFileSizes(w, r, files) {
-                return
+        for k, v := range alias.defaults {
+                if strings.TrimSpace(out[k]) == "" {
+                        out[k] = v
+                }
         }
+        return out
+}
 
-        operation := strings.TrimSpace(r.FormValue("operation"))
+// opBatch applies one registered operation to every uploaded file and returns
+// the results as a ZIP. Parameters other than "operation" are passed through
+// to the operation, with the defaults of an old batch operation name added.
+func opBatch(ctx context.Context, in *OpInput) (*OpResult, error) {
+        operation := strings.TrimSpace(in.Param("operation"))
         if operation == "" {
-                errorJSON(w, http.StatusBadRequest, "operation is required")
-                return
+                return nil, opParamFail("operation", "operation is required")
         }
-
-        degrees := parseIntDefault(r.FormValue("degrees"), 90)
-        text := strings.TrimSpace(r.FormValue("text"))
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[batch] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
+        name, params := operation, in.Params
+        if alias, ok := batchAliases[operation]; ok {
+                name, params = alias.op, batchParams(alias, in.Params)
+        }
+        op, ok := lookupOperation(name)
+        if !ok || !acceptsSinglePDF(op) {
+                return nil, opParamFail("operation", "unsupported operation: "+operation)
         }
 
+        dir := in.Dir
         outputDir := filepath.Join(dir, "output")
         if err := os.MkdirAll(outputDir, 0o755); err != nil {
-                log.Printf("[batch] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create output dir")
-                return
+                logger(ctx).Error("batch failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to create output dir")
         }
 
-        for i, fh := range files {
-                inPath := filepath.Join(dir, fmt.Sprintf("input_%d.pdf", i))
-                if err := saveUploadedFile(fh, inPath); err != nil {
-                        log.Printf("[batch] save error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to save file")
-                        return
-                }
-
-                outName := buildOutputName(fh.Filename, operation)
-                outPath := filepath.Join(outputDir, outName)
+        for i, f := range in.Files {
+                setJobProgress(ctx, float64(i)/float64(len(in.Files)+1))
 
-                var cmdErr error
-                switch operation {
-                case "compress":
-                        cmdErr = runCommand(dir, "gs",
-                                "-sDEVICE=pdfwrite",
-                                "-dCompatibilityLevel=1.4",
-                                "-dPDFSETTINGS=/ebook",
-                                "-dNOPAUSE", "-dBATCH", "-dQUIET",
-                                fmt.Sprintf("-sOutputFile=%s", outPath),
-                                inPath,
-                        )
-                case "rotate":
-                        if degrees != 90 && degrees != 180 && degrees != 270 {
-                                degrees = 90
-                        }
-                        cmdErr = runCommand(dir, "pdfcpu", "rotate", inPath, strconv.Itoa(degrees), outPath)
-                case "flatten":
-                        if err := copyFileEdit(inPath, outPath); err != nil {
-                                log.Printf("[batch] copy error: %v", err)
-                                errorJSON(w, http.StatusInternalServerError, "failed to prepare file")
-                                return
-                        }
-                        cmdErr = runCommand(dir, "pdfcpu", "flatten", outPath)
-                case "watermark":
-                        if text == "" {
-                                text = "WATERMARK"
-                        }
-                        desc := "pos:c, rot:45, scale:0.9 rel, op:0.25, fillc:.5 .5 .5"
-                        cmdErr = runCommand(dir, "pdfcpu", "watermark", "add", "-mode", "text", "--", text, desc, inPath, outPath)
-                case "encrypt":
-                        password := strings.TrimSpace(r.FormValue("password"))
-                        if password == "" {
-                                password = "password"
-                        }
-                        cmdErr = runCommand(dir, "qpdf", "--warning-exit-0", "--encrypt", password, password, "256", "--", inPath, outPath)
-                case "page-numbers":
-                        if err := copyFileEdit(inPath, outPath); err != nil {
-                                log.Printf("[batch] copy error: %v", err)
-                                errorJSON(w, http.StatusInternalServerError, "failed to prepare file")
-                                return
-                        }
-                        desc := "pos:bc, rot:0, points:10, scale:1 abs, op:1, fillc:0 0 0"
-                        cmdErr = runCommand(dir, "pdfcpu", "stamp", "add", "-mode", "text", "--", "%p", desc, outPath)
-                case "to-jpg":
-                        pageOutDir := filepath.Join(dir, fmt.Sprintf("jpgout_%d", i))
-                        os.MkdirAll(pageOutDir, 0o755)
-                        cmdErr = runCommand(dir, "pdftoppm", "-jpeg", "-r", "300", inPath, filepath.Join(pageOutDir, "page"))
-                        if cmdErr == nil {
-                                jpgFiles, _ := filepath.Glob(filepath.Join(pageOutDir, "*.jpg"))
-                                if len(jpgFiles) == 0 {
-                                        jpgFiles, _ = filepath.Glob(filepath.Join(pageOutDir, "*.jpeg"))
-                                }
-                                if len(jpgFiles) > 0 {
-                                        baseName := strings.TrimSuffix(fh.Filename, filepath.Ext(fh.Filename))
-                                        jpgZip := filepath.Join(outputDir, baseName+"_images.zip")
-                                        zipDirectory(pageOutDir, jpgZip)
-                                }
-                        }
-                        continue
-                case "to-png":
-                        pageOutDir := filepath.Join(dir, fmt.Sprintf("pngout_%d", i))
-                        os.MkdirAll(pageOutDir, 0o755)
-                        cmdErr = runCommand(dir, "pdftoppm", "-png", "-r", "200", inPath, filepath.Join(pageOutDir, "page"))
-                        if cmdErr == nil {
-                                pngFiles, _ := filepath.Glob(filepath.Join(pageOutDir, "*.png"))
-                                if len(pngFiles) > 0 {
-                                        baseName := strings.TrimSuffix(fh.Filename, filepath.Ext(fh.Filename))
-                                        pngZip := filepath.Join(outputDir, baseName+"_images.zip")
-                                        zipDirectory(pageOutDir, pngZip)
-                                }
+                fileDir := filepath.Join(dir, fmt.Sprintf("file_%d", i))
+                fileIn, err := stageOperationInput(op, in.JobID, fileDir, []OpFile{f}, params)
+                if err != nil {
+                        logger(ctx).Error("stage failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to prepare file")
+                }
+                runOp, err := prepareInputs(ctx, op, fileIn)
+                var res *OpResult
+                if err == nil {
+                        res, err = runOperation(ctx, runOp, fileIn)
+                }
+                if err != nil {
+                        logger(ctx).Error("batch file failed", "batch_op", operation, "file", i, "error", err.Error())
+                        status, resp := opErrorResponse(ctx, op, err)
+                        if status < http.StatusInternalServerError {
+                                resp.Error = fmt.Sprintf("file %d: %s", i+1, resp.Error)
+                        } else {
+                                resp.Error = fmt.Sprintf("failed to %s file %d", operation, i+1)
                         }
-                        continue
-                default:
-                        errorJSON(w, http.StatusBadRequest, "unsupported operation: "+operation)
-                        return
+                        return nil, resp.asOpError(status)
+                }
+                if res.File == "" {
+                        return nil, opParamFail("operation", "unsupported operation: "+operation)
                 }
 
-                if cmdErr != nil {
-                        log.Printf("[batch] %s error for file %d: %v", operation, i, cmdErr)
-                        errorJSON(w, http.StatusInternalServerError, fmt.Sprintf("failed to %s file %d", operation, i+1))
-                        return
+                outName := res.File
+                if _, err := os.Stat(filepath.Join(outputDir, outName)); err == nil {
+                        outName = fmt.Sprintf("%d_%s", i+1, outName)
+                }
+                if err := os.Rename(filepath.Join(fileDir, res.File), filepath.Join(outputDir, outName)); err != nil {
+                        logger(ctx).Error("move failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to collect results")
                 }
         }
 
         zipName := fmt.Sprintf("batch_%s.zip", operation)
         zipPath := filepath.Join(dir, zipName)
-        if err := zipDirectory(outputDir, zipPath); err != nil {
-                log.Printf("[batch] zip error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create zip")
-                return
+        if err := zipDirectory(ctx, outputDir, zipPath); err != nil {
+                logger(ctx).Error("zip failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to create zip")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, zipName)})
+        return fileResult(zipName), nil
 }
 
-func handleFormFill(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        _, hdr, err := r.FormFile("file")
-        if err != nil {
-                errorJSON(w, http.StatusBadRequest, "file is required")
-                return
-        }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
-        action := strings.TrimSpace(r.FormValue("action"))
+func opFormFill(ctx context.Context, in *OpInput) (*OpResult, error) {
+        action := strings.TrimSpace(in.Param("action"))
         if action == "" {
                 action = "fill"
         }
 
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[form-fill] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
-
-        inputPath := filepath.Join(dir, "input.pdf")
-        if err := saveUploadedFile(hdr, inputPath); err != nil {
-                log.Printf("[form-fill] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "save failed")
-                return
-        }
+        dir := in.Dir
 
+        inputPath := in.File().Path
         if action == "read" {
-                out, err := runCommandOutput(dir, "pdfcpu", "form", "list", inputPath)
+                out, err := runCommandOutput(ctx, dir, "pdfcpu", "form", "list", inputPath)
                 if err != nil {
-                        out, err = runCommandOutput(dir, "pdftk", inputPath, "dump_data_fields")
+                        out, err = runCommandOutput(ctx, dir, "pdftk", inputPath, "dump_data_fields")
                         if err != nil {
-                                writeJSON(w, http.StatusOK, formFieldsResponse{Fields: []formField{}})
-                                return
+                                return dataResult(formFieldsResponse{Fields: []formField{}}), nil
                         }
 
                         var fields []formField
@@ -6687,8 +4927,7 @@ func handleFormFill(w http.ResponseWriter, r *http.Request) {
                                 fields = append(fields, current)
                         }
 
-                        writeJSON(w, http.StatusOK, formFieldsResponse{Fields: fields})
-                        return
+                        return dataResult(formFieldsResponse{Fields: fields}), nil
                 }
 
                 var fields []formField
@@ -6710,37 +4949,32 @@ func handleFormFill(w http.ResponseWriter, r *http.Request) {
                         }
                 }
 
-                writeJSON(w, http.StatusOK, formFieldsResponse{Fields: fields})
-                return
+                return dataResult(formFieldsResponse{Fields: fields}), nil
         }
 
-        fieldsJSON := strings.TrimSpace(r.FormValue("fields"))
+        fieldsJSON := strings.TrimSpace(in.Param("fields"))
         if fieldsJSON == "" {
-                errorJSON(w, http.StatusBadRequest, "fields JSON is required")
-                return
+                return nil, opParamFail("fields", "fields JSON is required")
         }
 
         var fieldsMap map[string]string
         if err := json.Unmarshal([]byte(fieldsJSON), &fieldsMap); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid fields JSON")
-                return
+                return nil, opParamFail("fields", "invalid fields JSON")
         }
 
-        baseName := baseNameWithoutExt(hdr.Filename)
+        baseName := baseNameWithoutExt(in.File().Name)
         outName := baseName + "_filled.pdf"
         outPath := filepath.Join(dir, outName)
 
         formDataPath := filepath.Join(dir, "formdata.json")
         formDataContent, _ := json.Marshal(fieldsMap)
         if err := os.WriteFile(formDataPath, formDataContent, 0o644); err != nil {
-                log.Printf("[form-fill] write formdata error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to prepare form data")
-                return
+                logger(ctx).Error("write formdata failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to prepare form data")
         }
 
-        err = runCommand(dir, "pdfcpu", "form", "fill", inputPath, formDataPath, outPath)
-        if err != nil {
-                log.Printf("[form-fill] pdfcpu form fill failed, trying pdftk: %v", err)
+        if err := runCommand(ctx, dir, "pdfcpu", "form", "fill", inputPath, formDataPath, outPath); err != nil {
+                logger(ctx).Warn("pdfcpu form fill failed, trying pdftk", "error", err.Error())
 
                 fdfContent := "%FDF-1.2\n1 0 obj\n<< /FDF << /Fields [\n"
                 for k, v := range fieldsMap {
@@ -6750,111 +4984,51 @@ func handleFormFill(w http.ResponseWriter, r *http.Request) {
 
                 fdfPath := filepath.Join(dir, "data.fdf")
                 if err := os.WriteFile(fdfPath, []byte(fdfContent), 0o644); err != nil {
-                        log.Printf("[form-fill] write fdf error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to prepare FDF")
-                        return
+                        logger(ctx).Error("write fdf failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to prepare FDF")
                 }
 
-                if err := runCommand(dir, "pdftk", inputPath, "fill_form", fdfPath, "output", outPath); err != nil {
-                        log.Printf("[form-fill] pdftk error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to fill form")
-                        return
+                if err := runCommand(ctx, dir, "pdftk", inputPath, "fill_form", fdfPath, "output", outPath); err != nil {
+                        logger(ctx).Error("pdftk failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to fill form")
                 }
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
-func handleMarkdownToPDF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(64 << 20); err != nil {
-                errorJSON(w, http.StatusBadRequest, "invalid multipart form")
-                return
-        }
-
-        markdown := strings.TrimSpace(r.FormValue("markdown"))
+func opMarkdownToPDF(ctx context.Context, in *OpInput) (*OpResult, error) {
+        markdown := strings.TrimSpace(in.Param("markdown"))
+        dir := in.Dir
 
         if markdown == "" {
-                _, hdr, err := r.FormFile("file")
-                if err != nil {
-                        errorJSON(w, http.StatusBadRequest, "markdown text or file is required")
-                        return
-                }
-        if !checkFileSize(w, r, hdr) {
-                return
-        }
-
-                jobID, dir, err := newJobDir()
-                if err != nil {
-                        log.Printf("[markdown-to-pdf] error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                        return
-                }
-
-                mdPath := filepath.Join(dir, "input.md")
-                if err := saveUploadedFile(hdr, mdPath); err != nil {
-                        log.Printf("[markdown-to-pdf] error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "save failed")
-                        return
+                if len(in.Files) == 0 {
+                        return nil, opParamFail("markdown", "markdown text or file is required")
                 }
-
-                mdBytes, err := os.ReadFile(mdPath)
+                mdBytes, err := os.ReadFile(in.File().Path)
                 if err != nil {
-                        log.Printf("[markdown-to-pdf] read error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to read markdown file")
-                        return
+                        logger(ctx).Error("read failed", "error", err.Error())
+                        return nil, opFail(http.StatusInternalServerError, "failed to read markdown file")
                 }
                 markdown = string(mdBytes)
-
-                html := convertMarkdownToHTML(markdown)
-                htmlPath := filepath.Join(dir, "input.html")
-                if err := os.WriteFile(htmlPath, []byte(html), 0o644); err != nil {
-                        log.Printf("[markdown-to-pdf] write html error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to create HTML")
-                        return
-                }
-
-                outName := "output.pdf"
-                outPath := filepath.Join(dir, outName)
-
-                if err := runChromiumPDF(dir, outPath, "file://"+htmlPath); err != nil {
-                        log.Printf("[markdown-to-pdf] chrome error: %v", err)
-                        errorJSON(w, http.StatusInternalServerError, "failed to convert to PDF")
-                        return
-                }
-
-                writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
-                return
-        }
-
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[markdown-to-pdf] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
         }
 
         html := convertMarkdownToHTML(markdown)
         htmlPath := filepath.Join(dir, "input.html")
         if err := os.WriteFile(htmlPath, []byte(html), 0o644); err != nil {
-                log.Printf("[markdown-to-pdf] write html error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create HTML")
-                return
+                logger(ctx).Error("write html failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to create HTML")
         }
 
         outName := "output.pdf"
         outPath := filepath.Join(dir, outName)
 
-        if err := runChromiumPDF(dir, outPath, "file://"+htmlPath); err != nil {
-                log.Printf("[markdown-to-pdf] chrome error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to convert to PDF")
-                return
+        if err := runChromiumPDF(ctx, dir, outPath, "file://"+htmlPath); err != nil {
+                logger(ctx).Error("chrome failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to convert to PDF")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
 
 func convertMarkdownToHTML(md string) string {
@@ -6999,44 +5173,25 @@ func applyInlineMarkdown(s string) string {
         return result
 }
 
-func handleURLToPDF(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-                return
-        }
-        if err := r.ParseMultipartForm(10 << 20); err != nil {
-                if err := r.ParseForm(); err != nil {
-                        errorJSON(w, http.StatusBadRequest, "invalid form data")
-                        return
-                }
-        }
-
-        url := strings.TrimSpace(r.FormValue("url"))
+func opURLToPDF(ctx context.Context, in *OpInput) (*OpResult, error) {
+        url := strings.TrimSpace(in.Param("url"))
         if url == "" {
-                errorJSON(w, http.StatusBadRequest, "url is required")
-                return
+                return nil, opParamFail("url", "url is required")
         }
 
         if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
-                errorJSON(w, http.StatusBadRequest, "url must start with http:// or https://")
-                return
+                return nil, opParamFail("url", "url must start with http:// or https://")
         }
 
-        jobID, dir, err := newJobDir()
-        if err != nil {
-                log.Printf("[url-to-pdf] error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to create job")
-                return
-        }
+        dir := in.Dir
 
         outName := "output.pdf"
         outPath := filepath.Join(dir, outName)
 
-        if err := runChromiumPDF(dir, outPath, url); err != nil {
-                log.Printf("[url-to-pdf] chrome error: %v", err)
-                errorJSON(w, http.StatusInternalServerError, "failed to convert URL to PDF")
-                return
+        if err := runChromiumPDF(ctx, dir, outPath, url); err != nil {
+                logger(ctx).Error("chrome failed", "error", err.Error())
+                return nil, opFail(http.StatusInternalServerError, "failed to convert URL to PDF")
         }
 
-        writeJSON(w, http.StatusOK, downloadResponse{DownloadURL: buildDownloadURL(r, jobID, outName)})
+        return fileResult(outName), nil
 }
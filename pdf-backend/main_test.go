@@ -0,0 +1,48 @@
+package main
+
+import (
+        "bytes"
+        "mime/multipart"
+        "net/http"
+        "net/http/httptest"
+        "os"
+        "testing"
+)
+
+// TestMain points the work directory at a temporary one, so tests never
+// write jobs or cache entries into the source tree.
+func TestMain(m *testing.M) {
+        dir, err := os.MkdirTemp("", "pdf-backend-test-")
+        if err != nil {
+                panic(err)
+        }
+        baseWorkDir = dir
+        store = &localStorage{root: dir}
+        code := m.Run()
+        os.RemoveAll(dir)
+        os.Exit(code)
+}
+
+// postFiles sends files (field name to content) and params to h as a
+// multipart form.
+func postFiles(t *testing.T, h http.Handler, target string, files map[string][]byte, params map[string]string) *httptest.ResponseRecorder {
+        t.Helper()
+        var body bytes.Buffer
+        mw := multipart.NewWriter(&body)
+        for k, v := range params {
+                mw.WriteField(k, v)
+        }
+        for name, data := range files {
+                fw, err := mw.CreateFormFile("file", name)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                fw.Write(data)
+        }
+        mw.Close()
+        req := httptest.NewRequest(http.MethodPost, target, &body)
+        req.Header.Set("Content-Type", mw.FormDataContentType())
+        rec := httptest.NewRecorder()
+        h.ServeHTTP(rec, req)
+        return rec
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "net/http"
+        "os"
+        "os/exec"
+        "path/filepath"
+        "strconv"
+        "time"
+
+        "github.com/prometheus/client_golang/prometheus"
+        "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ==================================================================================
+// Prometheus metrics
+// ==================================================================================
+//
+// GET /metrics serves, besides the Go runtime and process metrics:
+//
+//	pdf_http_requests_total{route,method,code}         requests served
+//	pdf_http_request_duration_seconds{route,method}    request latency
+//	pdf_http_request_size_bytes{route}                 request body sizes
+//	pdf_http_response_size_bytes{route}                response body sizes
+//	pdf_operation_input_bytes{operation}               input files per run
+//	pdf_operation_output_bytes{operation}              result file sizes
+//	pdf_tool_duration_seconds{tool}                    external tool run time
+//	pdf_tool_failures_total{tool,reason}               failed tool runs
+//	pdf_active_jobs                                    jobs with work in progress
+//	pdf_async_jobs{state}                              queued and running async jobs
+//	pdf_workdir_bytes                                  work dir usage, as of the
+//	                                                   last retention sweep
+//	pdf_jobs_removed_total{reason}                     jobs removed by the sweep
+//	pdf_scheduler_queue_depth                          callers waiting for a tool
+//	pdf_result_cache_*                                 result cache (cache.go)
+//
+// Routes are labelled with the mux pattern that served them (e.g.
+// /api/pdf/compress, /downloads/), never with the raw path, so job IDs don't
+// create new series. The endpoint is served on the backend port only; the Node
+// proxy doesn't forward it.
+
+var (
+        httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+                Name: "pdf_http_requests_total",
+                Help: "HTTP requests served, by route pattern, method and status code.",
+        }, []string{"route", "method", "code"})
+        httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+                Name:    "pdf_http_request_duration_seconds",
+                Help:    "HTTP request latency.",
+                Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+        }, []string{"route", "method"})
+        httpRequestSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+                Name:    "pdf_http_request_size_bytes",
+                Help:    "HTTP request body sizes.",
+                Buckets: byteBuckets,
+        }, []string{"route"})
+        httpResponseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+                Name:    "pdf_http_response_size_bytes",
+                Help:    "HTTP response body sizes.",
+                Buckets: byteBuckets,
+        }, []string{"route"})
+
+        opInputBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+                Name:    "pdf_operation_input_bytes",
+                Help:    "Total size of the input files of an operation run.",
+                Buckets: byteBuckets,
+        }, []string{"operation"})
+        opOutputBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+                Name:    "pdf_operation_output_bytes",
+                Help:    "Size of the result file of an operation run.",
+                Buckets: byteBuckets,
+        }, []string{"operation"})
+
+        toolDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+                Name:    "pdf_tool_duration_seconds",
+                Help:    "External tool execution time, excluding time queued for a slot.",
+                Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+        }, []string{"tool"})
+        toolFailureCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+                Name: "pdf_tool_failures_total",
+                Help: "Failed external tool runs, by reason (exit, timeout, canceled, start).",
+        }, []string{"tool", "reason"})
+
+        workDirBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+                Name: "pdf_workdir_bytes",
+                Help: "Bytes used by job directories, as of the last retention sweep.",
+        })
+        jobsRemoved = prometheus.NewCounterVec(prometheus.CounterOpts{
+                Name: "pdf_jobs_removed_total",
+                Help: "Jobs removed by the retention sweep, by reason (expired, disk_limit).",
+        }, []string{"reason"})
+)
+
+// byteBuckets span 1KB to 1GB.
+var byteBuckets = prometheus.ExponentialBuckets(1<<10, 4, 11)
+
+func init() {
+        prometheus.MustRegister(
+                httpRequests, httpDuration, httpRequestSize, httpResponseSize,
+                opInputBytes, opOutputBytes,
+                toolDuration, toolFailureCount,
+                workDirBytes, jobsRemoved,
+                prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+                        Name: "pdf_active_jobs",
+                        Help: "Job directories with a request or tool working in them.",
+                }, func() float64 {
+                        activeJobs.Lock()
+                        defer activeJobs.Unlock()
+                        return float64(len(activeJobs.n))
+                }),
+                newAsyncJobsCollector(),
+                prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+                        Name: "pdf_scheduler_queue_depth",
+                        Help: "Callers waiting for an external tool slot.",
+                }, func() float64 { return float64(scheduler.stats().Depth) }),
+                newResultCacheCollector(),
+        )
+}
+
+// ----------------------------------------------------------------------------------
+// HTTP instrumentation
+// ----------------------------------------------------------------------------------
+
+// metricsWriter records the status and size of a response.
+type metricsWriter struct {
+        http.ResponseWriter
+        status int
+        bytes  int64
+}
+
+func (w *metricsWriter) WriteHeader(status int) {
+        if w.status == 0 {
+                w.status = status
+        }
+        w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+        if w.status == 0 {
+                w.status = http.StatusOK
+        }
+        n, err := w.ResponseWriter.Write(b)
+        w.bytes += int64(n)
+        return n, err
+}
+
+func (w *metricsWriter) Unwrap() http.ResponseWriter {
+        return w.ResponseWriter
+}
+
+// withMetrics records request metrics for everything next serves; routes are
+// resolved against mux.
+func withMetrics(mux *http.ServeMux, next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                _, route := mux.Handler(r)
+                if route == "" {
+                        route = "other"
+                }
+                start := time.Now()
+                mw := &metricsWriter{ResponseWriter: w}
+                next.ServeHTTP(mw, r)
+                if mw.status == 0 {
+                        mw.status = http.StatusOK
+                }
+                httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(mw.status)).Inc()
+                httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+                if r.ContentLength > 0 {
+                        httpRequestSize.WithLabelValues(route).Observe(float64(r.ContentLength))
+                }
+                httpResponseSize.WithLabelValues(route).Observe(float64(mw.bytes))
+        })
+}
+
+func metricsHandler() http.Handler {
+        return promhttp.Handler()
+}
+
+// ----------------------------------------------------------------------------------
+// Operations and tools
+// ----------------------------------------------------------------------------------
+
+// observeOperation records the input and output sizes of a successful run.
+func observeOperation(op *Operation, in *OpInput, res *OpResult) {
+        var size int64
+        for _, f := range in.Files {
+                if fi, err := os.Stat(f.Path); err == nil {
+                        size += fi.Size()
+                }
+        }
+        if len(in.Files) > 0 {
+                opInputBytes.WithLabelValues(op.Name).Observe(float64(size))
+        }
+        if res.File != "" {
+                if fi, err := os.Stat(filepath.Join(in.Dir, res.File)); err == nil {
+                        opOutputBytes.WithLabelValues(op.Name).Observe(float64(fi.Size()))
+                }
+        }
+}
+
+// observeTool records one run of an external tool that started at start and
+// ended with err. ctx is the run's (timeout) context.
+func observeTool(ctx context.Context, tool string, start time.Time, err error) {
+        toolDuration.WithLabelValues(tool).Observe(time.Since(start).Seconds())
+        if err == nil {
+                return
+        }
+        reason := "exit"
+        switch {
+        case errors.Is(ctx.Err(), context.DeadlineExceeded):
+                reason = "timeout"
+        case errors.Is(ctx.Err(), context.Canceled):
+                reason = "canceled"
+        case errors.Is(err, exec.ErrNotFound), errors.Is(err, os.ErrNotExist):
+                reason = "start"
+        }
+        toolFailureCount.WithLabelValues(tool, reason).Inc()
+}
+
+// ----------------------------------------------------------------------------------
+// Collectors reading state at scrape time
+// ----------------------------------------------------------------------------------
+
+type asyncJobsCollector struct {
+        desc *prometheus.Desc
+}
+
+func newAsyncJobsCollector() *asyncJobsCollector {
+        return &asyncJobsCollector{desc: prometheus.NewDesc("pdf_async_jobs",
+                "Async jobs that have not finished, by state.", []string{"state"}, nil)}
+}
+
+func (c *asyncJobsCollector) Describe(ch chan<- *prometheus.Desc) {
+        ch <- c.desc
+}
+
+func (c *asyncJobsCollector) Collect(ch chan<- prometheus.Metric) {
+        counts := map[jobState]int{jobQueued: 0, jobRunning: 0}
+        jobRegistry.Lock()
+        for _, j := range jobRegistry.jobs {
+                j.mu.Lock()
+                if _, ok := counts[j.rec.State]; ok {
+                        counts[j.rec.State]++
+                }
+                j.mu.Unlock()
+        }
+        jobRegistry.Unlock()
+        for state, n := range counts {
+                ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), string(state))
+        }
+}
+
+type resultCacheCollector struct {
+        hits, misses, stores, evictions, entries, bytes *prometheus.Desc
+}
+
+func newResultCacheCollector() *resultCacheCollector {
+        d := func(name, help string) *prometheus.Desc {
+                return prometheus.NewDesc("pdf_result_cache_"+name, help, nil, nil)
+        }
+        return &resultCacheCollector{
+                hits:      d("hits_total", "Operation runs served from the result cache."),
+                misses:    d("misses_total", "Cacheable operation runs not found in the result cache."),
+                stores:    d("stores_total", "Results added to the result cache."),
+                evictions: d("evictions_total", "Results evicted from the result cache."),
+                entries:   d("entries", "Results in the result cache."),
+                bytes:     d("bytes", "Size of the result cache."),
+        }
+}
+
+func (c *resultCacheCollector) Describe(ch chan<- *prometheus.Desc) {
+        for _, d := range []*prometheus.Desc{c.hits, c.misses, c.stores, c.evictions, c.entries, c.bytes} {
+                ch <- d
+        }
+}
+
+func (c *resultCacheCollector) Collect(ch chan<- prometheus.Metric) {
+        st := resultCache.stats()
+        ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(st.Hits))
+        ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(st.Misses))
+        ch <- prometheus.MustNewConstMetric(c.stores, prometheus.CounterValue, float64(st.Stores))
+        ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(st.Evictions))
+        ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(st.Entries))
+        ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(st.Bytes))
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "mime/multipart"
+        "net/http"
+        "os"
+        "path/filepath"
+        "sort"
+        "strings"
+        "time"
+)
+
+// ==================================================================================
+// Operations
+// ==================================================================================
+//
+// Every tool is an Operation: a typed function that takes files already saved
+// in a job directory plus string parameters, and produces either a file in
+// that directory or a JSON-serialisable result. HTTP handlers are generated
+// from operations by serveOperation, and batch and pipeline runs call
+// Operation.Run directly.
+
+// Operation describes one registered tool.
+type Operation struct {
+        // Name is the route suffix, e.g. "rotate" for /api/pdf/rotate.
+        Name string
+        // Inputs lists the multipart fields uploads are read from, in order.
+        // Defaults to {"file"}.
+        Inputs []string
+        // Multi accepts any number of files in the (single) input field.
+        Multi bool
+        // InputOptional lets requests through without an upload, for tools such
+        // as html-to-pdf that can also work from a parameter.
+        InputOptional bool
+        // InputExt is the extension uploads are saved with; defaults to ".pdf".
+        InputExt string
+        // KeepExt saves uploads with the client's extension instead, falling
+        // back to InputExt when the file name has none.
+        KeepExt bool
+        // AllowEncrypted and AllowDamaged let password-protected or damaged
+        // PDFs through input validation, for the tools that deal with them.
+        AllowEncrypted bool
+        AllowDamaged   bool
+        // ChecksInputs skips input validation in the adapter because the
+        // operation validates its files itself (batch, per inner operation).
+        ChecksInputs bool
+        // Cacheable marks deterministic operations whose results are reused
+        // for identical inputs and parameters (see cache.go).
+        Cacheable bool
+        // Params documents the form parameters the operation reads.
+        Params []string
+        // Requires lists the external tools ("gs") and Python modules
+        // ("python:docx") the operation runs; see health.go.
+        Requires []string
+        // Run performs the operation.
+        Run func(ctx context.Context, in *OpInput) (*OpResult, error)
+}
+
+// OpFile is an uploaded file saved in the job directory.
+type OpFile struct {
+        Path  string // absolute path in the job directory
+        Name  string // original client file name
+        Size  int64
+        Field string // multipart field it was uploaded as
+        // SHA256 is the hex digest of the upload as received, or "" for files
+        // not read from the request (pipeline step outputs, conversions).
+        SHA256 string
+}
+
+// OpInput is what an operation runs against.
+type OpInput struct {
+        JobID  string
+        Dir    string
+        Files  []OpFile
+        Params map[string]string
+}
+
+// Param returns the named parameter, or "" if it wasn't given.
+func (in *OpInput) Param(name string) string {
+        return in.Params[name]
+}
+
+// File returns the first input file. Operations with a required input can
+// rely on it being present.
+func (in *OpInput) File() OpFile {
+        if len(in.Files) == 0 {
+                return OpFile{}
+        }
+        return in.Files[0]
+}
+
+// OpResult is the outcome of an operation: either a file in the job directory
+// or, for informational tools, a value to be returned as JSON.
+type OpResult struct {
+        File string // file name relative to OpInput.Dir
+        Data any
+}
+
+func fileResult(name string) *OpResult {
+        return &OpResult{File: name}
+}
+
+func dataResult(v any) *OpResult {
+        return &OpResult{Data: v}
+}
+
+// opError carries the HTTP status, error code and message an operation wants
+// the client to see (see errors.go). Any other error is reported as a generic
+// 500.
+type opError struct {
+        status int
+        code   string // defaults to defaultErrorCode(status)
+        msg    string
+        param  string // offending parameter, if any
+        debug  string // tool output, only shown with PDF_DEBUG_ERRORS
+}
+
+func (e *opError) Error() string {
+        return e.msg
+}
+
+func opFail(status int, msg string) error {
+        return &opError{status: status, msg: msg}
+}
+
+// opFailCode fails with an explicit error code.
+func opFailCode(status int, code, msg string) error {
+        return &opError{status: status, code: code, msg: msg}
+}
+
+// opParamFail reports a missing or invalid parameter.
+func opParamFail(param, msg string) error {
+        return &opError{status: http.StatusBadRequest, code: codeInvalidParam, msg: msg, param: param}
+}
+
+// pageParams are the parameters a PAGE_OUT_OF_RANGE error is attributed to.
+var pageParams = []string{"pages", "page", "order", "rotations"}
+
+// opErrorResponse maps an operation error to the status and body returned to
+// the client. Server errors caused by a failing tool are refined from the
+// tool's output when it points at the input (encrypted, damaged, ...).
+func opErrorResponse(ctx context.Context, op *Operation, err error) (status int, resp apiError) {
+        defer func() {
+                if resp.Code == "" {
+                        resp.Code = defaultErrorCode(status)
+                }
+        }()
+        var oe *opError
+        if !errors.As(err, &oe) {
+                oe = &opError{status: http.StatusInternalServerError, msg: fmt.Sprintf("%s failed", op.Name)}
+        }
+        status, resp = oe.status, apiError{Error: oe.msg, Code: oe.code, Param: oe.param, Debug: oe.debug}
+        if status < http.StatusInternalServerError {
+                return status, resp
+        }
+
+        var te *toolError
+        if !errors.As(err, &te) {
+                te = lastToolFailure(ctx)
+        }
+        if te == nil {
+                return status, resp
+        }
+        resp.Debug = toolDebugOutput(te)
+        if s, refined, ok := classifyToolFailure(te); ok {
+                status, resp = s, refined
+                if resp.Code == codePageOutOfRange {
+                        for _, p := range pageParams {
+                                if hasParam(op, p) {
+                                        resp.Param = p
+                                        break
+                                }
+                        }
+                }
+        }
+        return status, resp
+}
+
+// asOpError turns a client-facing error response back into an operation
+// error, for operations (batch) that report errors of the operations they run.
+func (e apiError) asOpError(status int) error {
+        return &opError{status: status, code: e.Code, msg: e.Error, param: e.Param, debug: e.Debug}
+}
+
+// hasParam reports whether op documents the parameter name.
+func hasParam(op *Operation, name string) bool {
+        for _, p := range op.Params {
+                if p == name {
+                        return true
+                }
+        }
+        return false
+}
+
+var operations = map[string]*Operation{}
+
+// registerOperation adds op to the registry. It panics on duplicates since
+// registration happens at init time.
+func registerOperation(op *Operation) {
+        if _, dup := operations[op.Name]; dup {
+                panic("duplicate operation " + op.Name)
+        }
+        if len(op.Inputs) == 0 {
+                op.Inputs = []string{"file"}
+        }
+        operations[op.Name] = op
+}
+
+func lookupOperation(name string) (*Operation, bool) {
+        op, ok := operations[name]
+        return op, ok
+}
+
+func operationNames() []string {
+        names := make([]string, 0, len(operations))
+        for name := range operations {
+                names = append(names, name)
+        }
+        sort.Strings(names)
+        return names
+}
+
+// serveOperation adapts an operation to an HTTP handler: it parses the form,
+// enforces the plan's size limit, saves the uploads into a new job directory,
+// runs the operation and writes the download URL or JSON result.
+func serveOperation(op *Operation) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+                if r.Method != http.MethodPost {
+                        errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
+                        return
+                }
+
+                jobID, dir, err := newJobDir(r.Context())
+                if err != nil {
+                        errorJSON(w, http.StatusInternalServerError, "failed to create job")
+                        return
+                }
+                defer markJobActive(jobID)()
+                r = r.WithContext(withLogAttrs(r.Context(), "job_id", jobID, "operation", op.Name))
+
+                in, err := receiveOperationInput(w, r, op, jobID, dir)
+                if err != nil {
+                        // Nothing ran; don't keep the upload around.
+                        discardJob(r.Context(), jobID)
+                        writeRequestError(w, r, err)
+                        return
+                }
+
+                ctx := withRequestLimits(withToolFailures(r.Context()), r)
+                start := time.Now()
+                runOp, err := prepareInputs(ctx, op, in)
+                var res *OpResult
+                if err == nil {
+                        res, err = runOperation(ctx, runOp, in)
+                }
+                l := logger(ctx).With("duration_ms", time.Since(start).Milliseconds(), "files", len(in.Files))
+                if err == nil && runOp != op {
+                        l = l.With("converted_to", runOp.Name)
+                }
+                if err != nil {
+                        status, resp := opErrorResponse(ctx, runOp, err)
+                        if status >= http.StatusInternalServerError {
+                                l.Error("operation failed", "status", status, "code", resp.Code, "error", err.Error())
+                        } else {
+                                l.Info("operation rejected", "status", status, "code", resp.Code, "error", resp.Error)
+                        }
+                        writeAPIError(w, status, resp)
+                        return
+                }
+                l.Info("operation completed", "result", res.File)
+                writeOpResult(w, r, in, res)
+        }
+}
+
+// writeOpResult persists a file result in the storage backend and returns its
+// download URL, or writes a data result as JSON.
+func writeOpResult(w http.ResponseWriter, r *http.Request, in *OpInput, res *OpResult) {
+        if res.File == "" {
+                writeJSON(w, http.StatusOK, res.Data)
+                return
+        }
+        if err := persistFile(r.Context(), filepath.Join(in.Dir, res.File)); err != nil {
+                logger(r.Context()).Error("store result failed", "component", "storage", "file", res.File, "error", err.Error())
+                errorJSON(w, http.StatusInternalServerError, "failed to store result")
+                return
+        }
+        writeJSON(w, http.StatusOK, downloadResponse{
+                DownloadURL: buildDownloadURL(r, in.JobID, res.File),
+                FileID:      newFileID(in.JobID, res.File, res.File),
+        })
+}
+
+// receiveOperationInput streams the request's uploads into dir (see
+// upload.go), takes inputs given by reference instead (upload or file IDs,
+// see fileref.go), checks that op's inputs are present, applies the retention
+// parameter and moves the files to the names op expects.
+func receiveOperationInput(w http.ResponseWriter, r *http.Request, op *Operation, jobID, dir string) (*OpInput, error) {
+        received, err := readUploads(w, r, dir, uploadSpec{fields: op.Inputs, multi: op.Multi})
+        if err != nil {
+                return nil, err
+        }
+
+        var files []OpFile
+        for i, field := range op.Inputs {
+                got := filesInField(received, field)
+                if len(got) == 0 {
+                        if got, err = referencedInputs(r, field, i == 0, op.Multi, dir); err != nil {
+                                return nil, err
+                        }
+                }
+                if len(got) == 0 {
+                        if op.InputOptional {
+                                continue
+                        }
+                        if op.Multi {
+                                return nil, opParamFail(field, "no files provided")
+                        }
+                        return nil, opParamFail(field, field+" is required")
+                }
+                files = append(files, got...)
+        }
+
+        ret, err := parseRetention(r)
+        if err != nil {
+                return nil, opParamFail("retention", err.Error())
+        }
+        if err := writeJobRetention(dir, ret); err != nil {
+                return nil, err
+        }
+
+        in := &OpInput{JobID: jobID, Dir: dir, Params: formParams(r.MultipartForm)}
+        for i, f := range files {
+                dst := filepath.Join(dir, operationInputName(op, f.Name, i, len(files)))
+                if err := os.Rename(f.Path, dst); err != nil {
+                        return nil, err
+                }
+                f.Path = dst
+                if err := persistFile(r.Context(), dst); err != nil {
+                        return nil, err
+                }
+                in.Files = append(in.Files, f)
+        }
+        return in, nil
+}
+
+// operationInputName is the name the i-th of n inputs is saved under in the
+// job directory: input<ext> or input_<i><ext>, where ext follows the
+// operation's InputExt/KeepExt.
+func operationInputName(op *Operation, clientName string, i, n int) string {
+        ext := op.InputExt
+        if ext == "" {
+                ext = ".pdf"
+        }
+        if e := strings.ToLower(filepath.Ext(clientName)); op.KeepExt && e != "" {
+                ext = e
+        }
+        if n > 1 {
+                return fmt.Sprintf("input_%d%s", i, ext)
+        }
+        return "input" + ext
+}
+
+// stageOperationInput prepares an OpInput in dir from files that already exist
+// elsewhere (a previous pipeline step, one file of a batch), hard-linking them
+// into place under the names serveOperation would have used.
+func stageOperationInput(op *Operation, jobID, dir string, files []OpFile, params map[string]string) (*OpInput, error) {
+        if err := os.MkdirAll(dir, 0o755); err != nil {
+                return nil, err
+        }
+        in := &OpInput{JobID: jobID, Dir: dir, Params: params}
+        for i, f := range files {
+                dst := filepath.Join(dir, operationInputName(op, f.Name, i, len(files)))
+                if err := os.Link(f.Path, dst); err != nil {
+                        if err := copyFileEdit(f.Path, dst); err != nil {
+                                return nil, err
+                        }
+                }
+                f.Path = dst
+                in.Files = append(in.Files, f)
+        }
+        return in, nil
+}
+
+// acceptsSinglePDF reports whether op works on exactly one uploaded PDF, which
+// is what batch and pipeline steps feed it.
+func acceptsSinglePDF(op *Operation) bool {
+        return len(op.Inputs) == 1 && !op.Multi && !op.InputOptional && !op.KeepExt &&
+                (op.InputExt == "" || op.InputExt == ".pdf")
+}
+
+func formParams(form *multipart.Form) map[string]string {
+        params := make(map[string]string)
+        if form == nil {
+                return params
+        }
+        for k, v := range form.Value {
+                if len(v) > 0 {
+                        params[k] = v[0]
+                }
+        }
+        return params
+}
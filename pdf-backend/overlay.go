@@ -0,0 +1,154 @@
+package main
+
+import (
+        "context"
+        "encoding/base64"
+        "errors"
+        "fmt"
+        "image/color"
+        "log/slog"
+        "os"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "sync"
+
+        "go.opentelemetry.io/otel/attribute"
+
+        "pdf-backend/pdfdoc"
+)
+
+// ==================================================================================
+// Overlays
+// ==================================================================================
+//
+// Edit, sign and add-text draw on pages as PDF content: the text, lines,
+// shapes and images go into a content stream appended to each page, written
+// as an incremental update after the original bytes. Page content is never
+// rasterized, text stays selectable and searchable, and the file grows by
+// a few kilobytes per page instead of a page-sized image. With
+// mode=annotations, edit adds the same marks as PDF annotations instead,
+// with appearances drawn the same way.
+//
+// Text is set in DejaVu Sans (or render.fontFile), embedded with only the
+// glyphs used, so most Latin, Greek and Cyrillic text prints as typed. If no
+// font can be loaded, the standard Helvetica is used, which covers Western
+// European languages only.
+
+// overlayFontPaths are where DejaVu Sans is installed on common
+// distributions; the Docker image gets it from fonts-dejavu-core.
+var overlayFontPaths = []string{
+        "/usr/share/fonts/truetype/dejavu/DejaVuSans.ttf",
+        "/usr/share/fonts/TTF/DejaVuSans.ttf",
+        "/usr/share/fonts/dejavu/DejaVuSans.ttf",
+}
+
+// overlayFontData returns the TrueType font overlay text is set in, or nil
+// to use Helvetica. It is read once, on first use.
+var overlayFontData = sync.OnceValue(func() []byte {
+        paths := overlayFontPaths
+        configured := strings.TrimSpace(config.Render.FontFile)
+        if configured != "" {
+                paths = []string{configured}
+        }
+        for _, p := range paths {
+                data, err := os.ReadFile(p)
+                if err == nil {
+                        slog.Info("using overlay font", "component", "overlay", "path", p)
+                        return data
+                }
+                if configured != "" || !errors.Is(err, os.ErrNotExist) {
+                        slog.Warn("cannot read overlay font", "component", "overlay", "path", p, "error", err.Error())
+                }
+        }
+        slog.Warn("no TrueType font found; overlay text will use Helvetica", "component", "overlay")
+        return nil
+})
+
+// overlayFont returns the font for overlay text in u.
+func overlayFont(u *pdfdoc.Update) *pdfdoc.Font {
+        if data := overlayFontData(); data != nil {
+                f, err := u.EmbedFont(data)
+                if err == nil {
+                        return f
+                }
+                slog.Warn("cannot embed overlay font, using Helvetica", "component", "overlay", "error", err.Error())
+        }
+        return u.StandardFont("Helvetica")
+}
+
+// startOverlays parses the PDF at path and starts an update of it. The
+// caller must Close the document.
+func startOverlays(ctx context.Context, path string) (*pdfdoc.Document, *pdfdoc.Update, error) {
+        doc, err := openPDF(ctx, path)
+        if err != nil {
+                return nil, nil, pdfReadError(err)
+        }
+        u, err := doc.NewUpdate()
+        if err != nil {
+                doc.Close()
+                return nil, nil, pdfReadError(err)
+        }
+        return doc, u, nil
+}
+
+// writeOverlays writes the updated PDF to path.
+func writeOverlays(ctx context.Context, u *pdfdoc.Update, path string) (err error) {
+        _, span := startSpan(ctx, "write pdf", attribute.String("file.name", filepath.Base(path)))
+        defer func() { endSpan(span, err) }()
+        return u.WriteFile(path)
+}
+
+// decodeDataURL returns the content of a base64 data: URL, as the editors
+// send images.
+func decodeDataURL(s string) ([]byte, error) {
+        header, data, ok := strings.Cut(s, ",")
+        if !ok || !strings.HasPrefix(header, "data:") || !strings.HasSuffix(header, ";base64") {
+                return nil, errors.New("not a base64 data URL")
+        }
+        return base64.StdEncoding.DecodeString(data)
+}
+
+// optionalColor parses a color like parseHexColor, or returns nil, for the
+// default color, if s is blank.
+func optionalColor(s string) color.Color {
+        if strings.TrimSpace(s) == "" {
+                return nil
+        }
+        return parseHexColor(s)
+}
+
+// lineEnding returns the PDF line ending style of an arrowhead: "open" or
+// "closed". Anything else is none.
+func lineEnding(arrow string) pdfdoc.Name {
+        switch arrow {
+        case "open":
+                return "OpenArrow"
+        case "closed":
+                return "ClosedArrow"
+        }
+        return "None"
+}
+
+// hexColor formats c as "#rrggbb", "" for nil.
+func hexColor(c color.Color) string {
+        if c == nil {
+                return ""
+        }
+        r, g, b, _ := c.RGBA()
+        return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
+
+// parseHexColor parses a color such as "#ff8800" or "#f80". Anything else
+// is black.
+func parseHexColor(s string) color.RGBA {
+        s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+        if len(s) == 3 {
+                s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+        }
+        v, err := strconv.ParseUint(s, 16, 32)
+        if len(s) != 6 || err != nil {
+                return color.RGBA{A: 0xff}
+        }
+        return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}
+}
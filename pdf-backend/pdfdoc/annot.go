@@ -0,0 +1,625 @@
+package pdfdoc
+
+import (
+        "errors"
+        "fmt"
+        "image/color"
+        "math"
+        "time"
+)
+
+// ----------------------------------------------------------------------------------
+// Annotations
+// ----------------------------------------------------------------------------------
+
+// Box is a rectangle in the coordinates of overlays: points from the
+// top-left corner of the page as displayed.
+type Box struct {
+        X, Y, Width, Height float64
+}
+
+func (b Box) empty() bool { return b.Width <= 0 || b.Height <= 0 }
+
+// boundingBox returns the smallest box holding the points, grown by pad on
+// every side.
+func boundingBox(pts []Point, pad float64) Box {
+        if len(pts) == 0 {
+                return Box{}
+        }
+        minX, minY, maxX, maxY := pts[0].X, pts[0].Y, pts[0].X, pts[0].Y
+        for _, p := range pts[1:] {
+                minX, minY = min(minX, p.X), min(minY, p.Y)
+                maxX, maxY = max(maxX, p.X), max(maxY, p.Y)
+        }
+        return Box{minX - pad, minY - pad, maxX - minX + 2*pad, maxY - minY + 2*pad}
+}
+
+func (b Box) corners() []Point {
+        return []Point{{b.X, b.Y}, {b.X + b.Width, b.Y}, {b.X, b.Y + b.Height}, {b.X + b.Width, b.Y + b.Height}}
+}
+
+// Annotation is a page annotation: a comment, highlight, drawing or shape
+// that viewers show above the page content, and that reviewers can select,
+// reply to and delete. Positions are in the coordinates of overlays.
+type Annotation struct {
+        // Subtype is the kind of annotation: Highlight, Underline, StrikeOut,
+        // Text (a sticky note), FreeText, Ink, Square, Circle, Line, Stamp...
+        Subtype Name
+        // Rect is the area of the annotation. When adding text markup, ink or
+        // a line it may be left empty, to be computed from their geometry; a
+        // sticky note's defaults to 20 by 20 points at Rect.X, Rect.Y.
+        Rect Box
+        // PDFRect is the rectangle in the default user space of the page, as
+        // read by Annotations; adding ignores it.
+        PDFRect Rect
+
+        Contents string
+        Author   string
+        Subject  string
+        // Name identifies the annotation among those of its page.
+        Name              string
+        Created, Modified time.Time
+
+        // Color is the color of the annotation, nil for none: the marker
+        // color of text markup, the stroke of ink, shapes and lines, the text
+        // of FreeText and the icon of notes. When adding, nil picks yellow
+        // for highlights and notes and black for the others.
+        Color color.Color
+        // InteriorColor fills squares, circles and closed arrowheads.
+        InteriorColor color.Color
+        // Opacity is between 0 and 1; when adding, 0 means opaque.
+        Opacity float64
+        // BorderWidth is the line width of ink, shapes and lines; when
+        // adding, 0 means 1.
+        BorderWidth float64
+
+        // Quads are the areas of text that Highlight, Underline and StrikeOut
+        // mark; when adding, none means Rect.
+        Quads []Box
+        // Ink holds the strokes of an Ink annotation.
+        Ink [][]Point
+        // Line holds the end points of a Line, and LineEndings their styles:
+        // None, OpenArrow, ClosedArrow...
+        Line        [2]Point
+        LineEndings [2]Name
+        // Icon is the icon of a sticky note: Comment, Note, Help...
+        Icon Name
+
+        // When adding: Font and FontSize set the text of FreeText, Image is
+        // the picture of a Stamp, and BlendMode (Multiply for highlighter
+        // strokes) is used to draw the appearance.
+        Font      *Font
+        FontSize  float64
+        Image     *Image
+        BlendMode Name
+}
+
+var (
+        yellow = color.RGBA{0xff, 0xff, 0x00, 0xff}
+        black  = color.RGBA{0x00, 0x00, 0x00, 0xff}
+)
+
+func (a *Annotation) color() color.Color {
+        switch {
+        case a.Color != nil:
+                return a.Color
+        case a.Subtype == "Highlight" || a.Subtype == "Text":
+                return yellow
+        }
+        return black
+}
+
+func (a *Annotation) opacity() float64 {
+        if a.Opacity <= 0 || a.Opacity > 1 {
+                return 1
+        }
+        return a.Opacity
+}
+
+func (a *Annotation) borderWidth() float64 {
+        if a.BorderWidth <= 0 {
+                return 1
+        }
+        return a.BorderWidth
+}
+
+func (a *Annotation) fontSize() float64 {
+        if a.FontSize <= 0 {
+                return 12
+        }
+        return a.FontSize
+}
+
+func (a *Annotation) quads() []Box {
+        if len(a.Quads) == 0 && !a.Rect.empty() {
+                return []Box{a.Rect}
+        }
+        return a.Quads
+}
+
+// arrowLength is the length of the arrowheads of lines drawn width wide.
+func arrowLength(width float64) float64 { return max(6, 3*width) }
+
+// bounds returns the area an added annotation covers.
+func (a *Annotation) bounds() Box {
+        if !a.Rect.empty() {
+                return a.Rect
+        }
+        pad := a.borderWidth() / 2
+        switch a.Subtype {
+        case "Text":
+                return Box{a.Rect.X, a.Rect.Y, 20, 20}
+        case "Highlight", "Underline", "StrikeOut", "Squiggly":
+                var pts []Point
+                for _, q := range a.Quads {
+                        pts = append(pts, q.corners()...)
+                }
+                return boundingBox(pts, 0)
+        case "Ink":
+                var pts []Point
+                for _, stroke := range a.Ink {
+                        pts = append(pts, stroke...)
+                }
+                return boundingBox(pts, pad)
+        case "Line":
+                return boundingBox(a.Line[:], pad+arrowLength(a.borderWidth()))
+        }
+        return a.Rect
+}
+
+// pageSpace converts between the coordinates of overlays and the default
+// user space of a page.
+type pageSpace struct {
+        m, inv [6]float64
+        h      float64
+}
+
+func newPageSpace(p Page) pageSpace {
+        m := displayMatrix(p)
+        _, h := p.Size()
+        // m turns by a multiple of 90°, so its inverse turns by the transpose.
+        inv := [6]float64{m[0], m[2], m[1], m[3], -(m[0]*m[4] + m[1]*m[5]), -(m[2]*m[4] + m[3]*m[5])}
+        return pageSpace{m: m, inv: inv, h: h}
+}
+
+func transform(m [6]float64, x, y float64) (float64, float64) {
+        return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+func (s pageSpace) user(p Point) (x, y float64) { return transform(s.m, p.X, s.h-p.Y) }
+
+func (s pageSpace) display(x, y float64) Point {
+        dx, dy := transform(s.inv, x, y)
+        return Point{dx, s.h - dy}
+}
+
+func (s pageSpace) rect(b Box) Rect {
+        var pts []Point
+        for _, p := range b.corners() {
+                x, y := s.user(p)
+                pts = append(pts, Point{x, y})
+        }
+        bb := boundingBox(pts, 0)
+        return Rect{bb.X, bb.Y, bb.X + bb.Width, bb.Y + bb.Height}
+}
+
+func (s pageSpace) box(r Rect) Box {
+        return boundingBox([]Point{s.display(r.LLX, r.LLY), s.display(r.URX, r.URY)}, 0)
+}
+
+// ----------------------------------------------------------------------------------
+// Reading annotations
+// ----------------------------------------------------------------------------------
+
+// Annotations returns the annotations of page n (counting from 1), except
+// the pop-up windows of others.
+func (d *Document) Annotations(n int) ([]Annotation, error) {
+        page, ok := d.Page(n)
+        if !ok {
+                return nil, fmt.Errorf("pdfdoc: no page %d", n)
+        }
+        annots, _ := d.get(page.Dict["Annots"]).(Array)
+        if len(annots) > 0 && d.needPassword() {
+                return nil, ErrPasswordRequired
+        }
+        s := newPageSpace(page)
+        var list []Annotation
+        for _, o := range annots {
+                dict := d.getDict(o)
+                subtype, _ := d.get(dict["Subtype"]).(Name)
+                if dict == nil || subtype == "Popup" {
+                        continue
+                }
+                rect := d.rect(dict["Rect"], Rect{})
+                a := Annotation{
+                        Subtype:       subtype,
+                        Rect:          s.box(rect),
+                        PDFRect:       rect,
+                        Contents:      d.text(dict["Contents"]),
+                        Author:        d.text(dict["T"]),
+                        Subject:       d.text(dict["Subj"]),
+                        Name:          d.text(dict["NM"]),
+                        Color:         d.color(dict["C"]),
+                        InteriorColor: d.color(dict["IC"]),
+                        Opacity:       1,
+                }
+                a.Created, _ = ParseDate(d.text(dict["CreationDate"]))
+                a.Modified, _ = ParseDate(d.text(dict["M"]))
+                if v, ok := asNumber(d.get(dict["CA"])); ok {
+                        a.Opacity = v
+                }
+                a.BorderWidth = 1
+                if bs := d.getDict(dict["BS"]); bs != nil {
+                        if w, ok := asNumber(d.get(bs["W"])); ok {
+                                a.BorderWidth = w
+                        }
+                } else if border := d.numbers(dict["Border"]); len(border) >= 3 {
+                        a.BorderWidth = border[2]
+                }
+
+                quads := d.numbers(dict["QuadPoints"])
+                for i := 0; i+8 <= len(quads); i += 8 {
+                        var pts []Point
+                        for j := i; j < i+8; j += 2 {
+                                pts = append(pts, s.display(quads[j], quads[j+1]))
+                        }
+                        a.Quads = append(a.Quads, boundingBox(pts, 0))
+                }
+                inkList, _ := d.get(dict["InkList"]).(Array)
+                for _, stroke := range inkList {
+                        v := d.numbers(stroke)
+                        pts := make([]Point, 0, len(v)/2)
+                        for j := 0; j+1 < len(v); j += 2 {
+                                pts = append(pts, s.display(v[j], v[j+1]))
+                        }
+                        a.Ink = append(a.Ink, pts)
+                }
+                if l := d.numbers(dict["L"]); len(l) == 4 {
+                        a.Line = [2]Point{s.display(l[0], l[1]), s.display(l[2], l[3])}
+                }
+                if le, ok := d.get(dict["LE"]).(Array); ok && len(le) == 2 {
+                        a.LineEndings[0], _ = d.get(le[0]).(Name)
+                        a.LineEndings[1], _ = d.get(le[1]).(Name)
+                }
+                if subtype == "Text" {
+                        a.Icon, _ = d.get(dict["Name"]).(Name)
+                }
+                list = append(list, a)
+        }
+        return list, nil
+}
+
+// text reads a text string, "" if o isn't one.
+func (d *Document) text(o Object) string {
+        s, ok := d.get(o).(String)
+        if !ok {
+                return ""
+        }
+        return Text(s)
+}
+
+// numbers reads an array of numbers, skipping anything else.
+func (d *Document) numbers(o Object) []float64 {
+        a, _ := d.get(o).(Array)
+        v := make([]float64, 0, len(a))
+        for _, e := range a {
+                if n, ok := asNumber(d.get(e)); ok {
+                        v = append(v, n)
+                }
+        }
+        return v
+}
+
+// color reads a color array: gray, RGB or CMYK components. An empty or
+// missing array is nil, no color.
+func (d *Document) color(o Object) color.Color {
+        v := d.numbers(o)
+        c := func(f float64) uint8 { return uint8(math.Round(min(max(f, 0), 1) * 255)) }
+        switch len(v) {
+        case 1:
+                return color.Gray{c(v[0])}
+        case 3:
+                return color.RGBA{c(v[0]), c(v[1]), c(v[2]), 0xff}
+        case 4:
+                return color.CMYK{c(v[0]), c(v[1]), c(v[2]), c(v[3])}
+        }
+        return nil
+}
+
+// ----------------------------------------------------------------------------------
+// Adding annotations
+// ----------------------------------------------------------------------------------
+
+// Annotate adds an annotation to page n (counting from 1). It gets an
+// appearance drawn like DrawAnnotation draws it, so it looks the same in
+// every viewer.
+func (u *Update) Annotate(n int, a *Annotation) (Ref, error) {
+        pageDict, err := u.PageDict(n)
+        if err != nil {
+                return Ref{}, err
+        }
+        page, _ := u.d.Page(n)
+        bounds := a.bounds()
+        if bounds.empty() {
+                return Ref{}, errors.New("pdfdoc: annotation has no area")
+        }
+        s := newPageSpace(page)
+        rect := s.rect(bounds)
+        rectArray := Array{rect.LLX, rect.LLY, rect.URX, rect.URY}
+
+        dict := Dict{
+                "Type":    Name("Annot"),
+                "Subtype": a.Subtype,
+                "Rect":    rectArray,
+                "P":       page.Ref,
+                "F":       4, // Print
+                "C":       colorArray(a.color()),
+        }
+        for key, v := range map[Name]string{"Contents": a.Contents, "T": a.Author, "Subj": a.Subject, "NM": a.Name} {
+                if v != "" {
+                        dict[key] = textString(v)
+                }
+        }
+        if !a.Created.IsZero() {
+                dict["CreationDate"] = String(formatDate(a.Created))
+        }
+        if !a.Modified.IsZero() {
+                dict["M"] = String(formatDate(a.Modified))
+        }
+        if a.opacity() < 1 {
+                dict["CA"] = a.opacity()
+        }
+        if a.InteriorColor != nil {
+                dict["IC"] = colorArray(a.InteriorColor)
+        }
+
+        switch a.Subtype {
+        case "Highlight", "Underline", "StrikeOut", "Squiggly":
+                var quads Array
+                for _, q := range a.quads() {
+                        // Each quadrilateral goes upper left, upper right, lower
+                        // left, lower right, as the text reads.
+                        for _, p := range q.corners() {
+                                x, y := s.user(p)
+                                quads = append(quads, x, y)
+                        }
+                }
+                dict["QuadPoints"] = quads
+        case "Ink":
+                var inkList Array
+                for _, stroke := range a.Ink {
+                        var pts Array
+                        for _, p := range stroke {
+                                x, y := s.user(p)
+                                pts = append(pts, x, y)
+                        }
+                        inkList = append(inkList, pts)
+                }
+                dict["InkList"] = inkList
+                dict["BS"] = Dict{"W": a.borderWidth()}
+        case "Line":
+                x1, y1 := s.user(a.Line[0])
+                x2, y2 := s.user(a.Line[1])
+                dict["L"] = Array{x1, y1, x2, y2}
+                if a.LineEndings != [2]Name{} {
+                        dict["LE"] = Array{orNone(a.LineEndings[0]), orNone(a.LineEndings[1])}
+                }
+                dict["BS"] = Dict{"W": a.borderWidth()}
+        case "Square", "Circle":
+                dict["BS"] = Dict{"W": a.borderWidth()}
+        case "FreeText":
+                r, g, b := colorComponents(a.color())
+                dict["DA"] = String(fmt.Sprintf("/Helv %s Tf %s %s %s rg",
+                        formatNumber(a.fontSize()), formatNumber(r), formatNumber(g), formatNumber(b)))
+                dict["BS"] = Dict{"W": 0}
+        case "Text":
+                icon := a.Icon
+                if icon == "" {
+                        icon = "Comment"
+                }
+                dict["Name"] = icon
+        }
+
+        c := newCanvas(page)
+        c.DrawAnnotation(a)
+        if c.content.Len() > 0 {
+                data, err := deflate(c.contentStream(s.m))
+                if err != nil {
+                        return Ref{}, err
+                }
+                appearance := u.Add(NewStream(Dict{
+                        "Type":      Name("XObject"),
+                        "Subtype":   Name("Form"),
+                        "BBox":      rectArray,
+                        "Resources": c.resourceDict(u.d, nil),
+                        "Filter":    Name("FlateDecode"),
+                }, data))
+                dict["AP"] = Dict{"N": appearance}
+        }
+
+        ref := u.Add(dict)
+        var annots Array
+        switch v := u.d.get(pageDict["Annots"]).(type) {
+        case Array:
+                annots = append(annots, v...)
+        }
+        pageDict["Annots"] = append(annots, ref)
+        return ref, nil
+}
+
+func orNone(n Name) Name {
+        if n == "" {
+                return "None"
+        }
+        return n
+}
+
+func colorArray(c color.Color) Array {
+        r, g, b := colorComponents(c)
+        return Array{r, g, b}
+}
+
+// textString encodes a text string: as it is if it is ASCII, else in
+// UTF-16BE with a byte order mark.
+func textString(s string) String {
+        ascii := true
+        for i := 0; i < len(s); i++ {
+                ascii = ascii && s[i] < 0x80
+        }
+        if ascii {
+                return String(s)
+        }
+        b := []byte{0xfe, 0xff}
+        for _, r := range s {
+                if r > 0xffff {
+                        r -= 0x10000
+                        b = append(b, byte(0xd8|r>>18), byte(r>>10), byte(0xdc|(r>>8)&3), byte(r))
+                        continue
+                }
+                b = append(b, byte(r>>8), byte(r))
+        }
+        return String(b)
+}
+
+// formatDate formats a date string such as "D:20240131120000+01'00'".
+func formatDate(t time.Time) string {
+        s := t.Format("D:20060102150405")
+        _, offset := t.Zone()
+        if offset == 0 {
+                return s + "Z"
+        }
+        sign := '+'
+        if offset < 0 {
+                sign, offset = '-', -offset
+        }
+        return fmt.Sprintf("%s%c%02d'%02d'", s, sign, offset/3600, offset/60%60)
+}
+
+// ----------------------------------------------------------------------------------
+// Appearances
+// ----------------------------------------------------------------------------------
+
+// DrawAnnotation draws the appearance of an annotation, as Annotate would
+// give it. On an overlay, that puts the annotation into the page content,
+// where it can no longer be edited as one.
+func (c *canvas) DrawAnnotation(a *Annotation) {
+        col := a.color()
+        width := a.borderWidth()
+        blend := a.BlendMode
+        if blend == "" && a.Subtype == "Highlight" {
+                // Highlights tint the text under them rather than cover it.
+                blend = "Multiply"
+        }
+        if a.opacity() < 1 || blend != "" {
+                if blend == "" {
+                        blend = "Normal"
+                }
+                c.SetTransparency(a.opacity(), blend)
+                defer c.SetTransparency(1, "Normal")
+        }
+
+        switch a.Subtype {
+        case "Highlight":
+                c.SetFillColor(col)
+                for _, q := range a.quads() {
+                        c.Rect(q.X, q.Y, q.Width, q.Height, Fill)
+                }
+
+        case "Underline", "StrikeOut":
+                c.SetStrokeColor(col)
+                for _, q := range a.quads() {
+                        lw := max(q.Height/14, 0.5)
+                        y := q.Y + q.Height - lw
+                        if a.Subtype == "StrikeOut" {
+                                y = q.Y + q.Height/2
+                        }
+                        c.SetLineWidth(lw)
+                        c.Polyline([]Point{{q.X, y}, {q.X + q.Width, y}})
+                }
+
+        case "Ink":
+                c.SetStrokeColor(col)
+                c.SetLineWidth(width)
+                for _, stroke := range a.Ink {
+                        c.Polyline(stroke)
+                }
+
+        case "Square", "Circle":
+                r := a.Rect
+                paint := Stroke
+                if a.InteriorColor != nil {
+                        c.SetFillColor(a.InteriorColor)
+                        paint = FillStroke
+                }
+                c.SetStrokeColor(col)
+                c.SetLineWidth(width)
+                // The border lies inside the rectangle.
+                x, y, w, h := r.X+width/2, r.Y+width/2, r.Width-width, r.Height-width
+                if a.Subtype == "Circle" {
+                        c.Ellipse(x, y, w, h, paint)
+                } else {
+                        c.Rect(x, y, w, h, paint)
+                }
+
+        case "Line":
+                c.SetStrokeColor(col)
+                c.SetLineWidth(width)
+                c.Polyline(a.Line[:])
+                fill := col
+                if a.InteriorColor != nil {
+                        fill = a.InteriorColor
+                }
+                c.lineEnding(a.LineEndings[0], a.Line[0], a.Line[1], width, fill)
+                c.lineEnding(a.LineEndings[1], a.Line[1], a.Line[0], width, fill)
+
+        case "FreeText":
+                if a.Font == nil || a.Contents == "" {
+                        return
+                }
+                size := a.fontSize()
+                c.SetFillColor(col)
+                c.Text(a.Font, size, a.Rect.X, a.Rect.Y+size, a.Contents)
+
+        case "Text":
+                // A note: a sheet in the annotation's color with lines of text.
+                r := a.bounds()
+                c.SetFillColor(col)
+                c.SetStrokeColor(black)
+                c.SetLineWidth(0.75)
+                c.Rect(r.X+0.5, r.Y+0.5, r.Width-1, r.Height-1, FillStroke)
+                for _, f := range []float64{0.3, 0.5, 0.7} {
+                        y := r.Y + f*r.Height
+                        c.Polyline([]Point{{r.X + 0.2*r.Width, y}, {r.X + 0.8*r.Width, y}})
+                }
+
+        case "Stamp":
+                if a.Image != nil {
+                        c.Image(a.Image, a.Rect.X, a.Rect.Y, a.Rect.Width, a.Rect.Height)
+                }
+        }
+}
+
+// lineEnding draws the end of a line at tip, coming from from.
+func (c *canvas) lineEnding(style Name, tip, from Point, width float64, fill color.Color) {
+        if style != "OpenArrow" && style != "ClosedArrow" {
+                return
+        }
+        dx, dy := tip.X-from.X, tip.Y-from.Y
+        length := math.Hypot(dx, dy)
+        if length == 0 {
+                return
+        }
+        size := arrowLength(width)
+        // Unit vectors along the line and across it.
+        ux, uy := dx/length, dy/length
+        nx, ny := -uy, ux
+        base := Point{tip.X - size*ux, tip.Y - size*uy}
+        left := Point{base.X + size/2*nx, base.Y + size/2*ny}
+        right := Point{base.X - size/2*nx, base.Y - size/2*ny}
+        if style == "OpenArrow" {
+                c.Polyline([]Point{left, tip, right})
+                return
+        }
+        c.SetFillColor(fill)
+        c.Polygon([]Point{left, tip, right}, FillStroke)
+}
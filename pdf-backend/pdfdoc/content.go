@@ -0,0 +1,225 @@
+package pdfdoc
+
+import (
+        "bytes"
+        "errors"
+        "math"
+)
+
+// ----------------------------------------------------------------------------------
+// Content streams
+// ----------------------------------------------------------------------------------
+
+// operation is one operator of a content stream with its operands.
+type operation struct {
+        op   string
+        args []Object
+        // raw is the operation as written, with the white space and comments
+        // before it, for copying it unchanged.
+        raw []byte
+}
+
+// maxContentOps bounds the operations parsed from one content stream.
+const maxContentOps = 5_000_000
+
+var errContentTooLarge = errors.New("pdfdoc: content stream has too many operations")
+
+// parseContent splits a content stream into operations. Inline images (BI
+// ... ID data EI) are one operation "BI", with the image dictionary as its
+// operand.
+func parseContent(b []byte) ([]operation, error) {
+        var ops []operation
+        l := newBytesLexer(b)
+        start := int64(0)
+        var args []Object
+        for {
+                tok := l.next()
+                if tok == nil {
+                        break
+                }
+                kw, isKeyword := tok.(keyword)
+                switch {
+                case !isKeyword, kw == "[", kw == "<<", kw == "true", kw == "false", kw == "null":
+                        l.pushBack(tok)
+                        args = append(args, l.readObject())
+                        if l.err != nil {
+                                return nil, l.err
+                        }
+                        continue
+                }
+                if kw == "BI" {
+                        dict, end, ok := inlineImage(l, b)
+                        if !ok {
+                                // Truncated image data: the rest of the stream is unusable.
+                                break
+                        }
+                        ops = append(ops, operation{op: "BI", args: []Object{dict}, raw: b[start:end]})
+                        l = newLexer(bytes.NewReader(b), end)
+                        start, args = end, nil
+                        continue
+                }
+                end := l.pos()
+                ops = append(ops, operation{op: string(kw), args: args, raw: b[start:end]})
+                if len(ops) > maxContentOps {
+                        return nil, errContentTooLarge
+                }
+                start, args = end, nil
+        }
+        return ops, nil
+}
+
+// inlineImage reads an inline image after BI: its dictionary up to ID, then
+// the data up to EI. It returns the dictionary and the offset after EI.
+func inlineImage(l *lexer, b []byte) (Dict, int64, bool) {
+        dict := make(Dict)
+        for {
+                tok := l.next()
+                if tok == nil {
+                        return nil, 0, false
+                }
+                if tok == keyword("ID") {
+                        break
+                }
+                key, ok := tok.(Name)
+                if !ok {
+                        continue
+                }
+                dict[key] = l.readObject()
+        }
+        // A single white-space character separates ID from the data.
+        data := int(l.pos()) + 1
+        if data > len(b) {
+                return nil, 0, false
+        }
+        isEnd := func(i int) bool {
+                return i+2 <= len(b) && b[i] == 'E' && b[i+1] == 'I' &&
+                        (i+2 == len(b) || isSpace(b[i+2]) || isDelim(b[i+2]))
+        }
+        // PDF 2.0 gives the length of the data; older files have to be
+        // scanned for an EI that stands alone.
+        for _, key := range []Name{"L", "Length"} {
+                if n, ok := asInt(dict[key]); ok && n >= 0 && int64(data)+n <= int64(len(b)) {
+                        i := data + int(n)
+                        for i < len(b) && isSpace(b[i]) {
+                                i++
+                        }
+                        if isEnd(i) {
+                                return dict, int64(i + 2), true
+                        }
+                }
+        }
+        for i := data; i+2 <= len(b); i++ {
+                if isEnd(i) && (i == data || isSpace(b[i-1])) {
+                        return dict, int64(i + 2), true
+                }
+        }
+        return nil, 0, false
+}
+
+// write appends the operation to b: as it was written if unchanged, else
+// serialized from op and args.
+func (o *operation) write(b *bytes.Buffer, changed bool) {
+        if !changed {
+                b.Write(o.raw)
+                return
+        }
+        b.WriteByte('\n')
+        for _, arg := range o.args {
+                b.Write(encodeObject(arg))
+                b.WriteByte(' ')
+        }
+        b.WriteString(o.op)
+}
+
+// arg returns operand i, nil if missing.
+func (o *operation) arg(i int) Object {
+        if i >= len(o.args) {
+                return nil
+        }
+        return o.args[i]
+}
+
+// number returns operand i as a number, 0 if it isn't one.
+func (o *operation) number(i int) float64 {
+        if i >= len(o.args) {
+                return 0
+        }
+        v, _ := asNumber(o.args[i])
+        return v
+}
+
+// matrix returns the six operands of cm or Tm.
+func (o *operation) matrix() matrix {
+        var m matrix
+        for i := range m {
+                m[i] = o.number(i)
+        }
+        return m
+}
+
+// ----------------------------------------------------------------------------------
+// Matrices
+// ----------------------------------------------------------------------------------
+
+// matrix is a transformation [a b c d e f], mapping x, y to
+// ax + cy + e, bx + dy + f.
+type matrix [6]float64
+
+var identity = matrix{1, 0, 0, 1, 0, 0}
+
+// mul returns the transformation m followed by n.
+func (m matrix) mul(n matrix) matrix {
+        return matrix{
+                m[0]*n[0] + m[1]*n[2],
+                m[0]*n[1] + m[1]*n[3],
+                m[2]*n[0] + m[3]*n[2],
+                m[2]*n[1] + m[3]*n[3],
+                m[4]*n[0] + m[5]*n[2] + n[4],
+                m[4]*n[1] + m[5]*n[3] + n[5],
+        }
+}
+
+func (m matrix) apply(x, y float64) (float64, float64) {
+        return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+// invert returns the inverse of m; false if m is singular.
+func (m matrix) invert() (matrix, bool) {
+        det := m[0]*m[3] - m[1]*m[2]
+        if math.Abs(det) < 1e-12 {
+                return matrix{}, false
+        }
+        a, b, c, d := m[3]/det, -m[1]/det, -m[2]/det, m[0]/det
+        return matrix{a, b, c, d, -(m[4]*a + m[5]*c), -(m[4]*b + m[5]*d)}, true
+}
+
+// bounds returns the bounding box of the rectangle r transformed by m.
+func (m matrix) bounds(r Rect) Rect {
+        b := emptyBounds()
+        for _, p := range [4][2]float64{{r.LLX, r.LLY}, {r.URX, r.LLY}, {r.LLX, r.URY}, {r.URX, r.URY}} {
+                b.add(m.apply(p[0], p[1]))
+        }
+        return b
+}
+
+// scale returns how much m magnifies lengths, at most.
+func (m matrix) scale() float64 {
+        return math.Max(math.Hypot(m[0], m[1]), math.Hypot(m[2], m[3]))
+}
+
+// emptyBounds returns a box that add grows to fit points.
+func emptyBounds() Rect {
+        return Rect{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+}
+
+func (r *Rect) add(x, y float64) {
+        r.LLX, r.LLY = min(r.LLX, x), min(r.LLY, y)
+        r.URX, r.URY = max(r.URX, x), max(r.URY, y)
+}
+
+// overlaps reports whether r and o share some area, or touch when one of
+// them is flat.
+func (r Rect) overlaps(o Rect) bool {
+        return r.LLX <= o.URX && o.LLX <= r.URX && r.LLY <= o.URY && o.LLY <= r.URY &&
+                !math.IsInf(r.LLX, 0) && !math.IsInf(o.LLX, 0)
+}
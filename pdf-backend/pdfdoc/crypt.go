@@ -0,0 +1,360 @@
+package pdfdoc
+
+import (
+        "bytes"
+        "crypto/aes"
+        "crypto/cipher"
+        "crypto/md5"
+        "crypto/rand"
+        "crypto/rc4"
+        "crypto/sha256"
+        "crypto/sha512"
+        "encoding/binary"
+        "errors"
+        "fmt"
+)
+
+// ErrPasswordRequired is returned when data can't be read because the
+// document is encrypted with a user password.
+var ErrPasswordRequired = errors.New("pdfdoc: document requires a password")
+
+// Encryption describes how a document is encrypted.
+type Encryption struct {
+        Filter    string // security handler, normally "Standard"
+        V, R      int    // algorithm version and revision
+        KeyLength int    // in bits
+        Method    string // RC4, AESV2 or AESV3
+        // Permissions is the /P value: bit positions as in the PDF
+        // specification (bit 3 printing, bit 4 modifying, bit 5 copying...).
+        Permissions int32
+        // PasswordRequired is set when the user password isn't empty, so
+        // strings and streams can't be decrypted.
+        PasswordRequired bool
+        EncryptMetadata  bool
+}
+
+// padding is the password padding of the standard security handler.
+var padding = []byte{
+        0x28, 0xbf, 0x4e, 0x5e, 0x4e, 0x75, 0x8a, 0x41, 0x64, 0x00, 0x4e, 0x56, 0xff, 0xfa, 0x01, 0x08,
+        0x2e, 0x2e, 0x00, 0xb6, 0xd0, 0x68, 0x3e, 0x80, 0x2f, 0x0c, 0xa9, 0xfe, 0x64, 0x53, 0x69, 0x7a,
+}
+
+type decrypter struct {
+        key     []byte // file key; nil when the password is unknown
+        aes     bool   // AES (V4 AESV2 or V5) rather than RC4
+        aes256  bool
+        stmNone bool // streams use the identity crypt filter
+        strNone bool // strings use the identity crypt filter
+        encMeta bool
+}
+
+// setupEncryption reads the trailer's /Encrypt dictionary and derives the
+// file key for the empty user password, which is what documents protected
+// only by an owner password use. Caches are reset, since anything read so
+// far was read without decryption.
+func (d *Document) setupEncryption() error {
+        d.crypt, d.encryption, d.encryptRef = nil, nil, Ref{Num: -1}
+        d.cache = make(map[Ref]Object)
+        d.objStms = make(map[int]*objStream)
+        enc, ok := d.trailer["Encrypt"]
+        if !ok || enc == nil {
+                return nil
+        }
+        if ref, ok := enc.(Ref); ok {
+                d.encryptRef = ref
+        }
+        dict := d.getDict(enc)
+        if dict == nil {
+                return errors.New("pdfdoc: unreadable /Encrypt dictionary")
+        }
+        // The dictionary was just cached unencrypted, which is right for it only.
+        d.cache = map[Ref]Object{d.encryptRef: dict}
+
+        e := &Encryption{EncryptMetadata: true, Method: "RC4", KeyLength: 40}
+        filter, _ := dict["Filter"].(Name)
+        e.Filter = string(filter)
+        v, _ := asInt(d.get(dict["V"]))
+        r, _ := asInt(d.get(dict["R"]))
+        p, _ := asInt(d.get(dict["P"]))
+        e.V, e.R, e.Permissions = int(v), int(r), int32(p)
+        if n, ok := asInt(d.get(dict["Length"])); ok && n >= 40 && n <= 256 {
+                e.KeyLength = int(n)
+        }
+        if b, ok := d.get(dict["EncryptMetadata"]).(bool); ok {
+                e.EncryptMetadata = b
+        }
+        d.encryption = e
+
+        c := &decrypter{encMeta: e.EncryptMetadata}
+        if e.V >= 4 {
+                cf := d.getDict(dict["CF"])
+                method := func(name Object) (string, bool) {
+                        n, _ := d.get(name).(Name)
+                        if n == "" || n == "Identity" {
+                                return "", true
+                        }
+                        m, _ := d.getDict(cf[n])["CFM"].(Name)
+                        return string(m), false
+                }
+                stm, stmNone := method(dict["StmF"])
+                str, strNone := method(dict["StrF"])
+                c.stmNone, c.strNone = stmNone, strNone
+                switch {
+                case stm == "AESV3" || str == "AESV3":
+                        c.aes, c.aes256, e.Method, e.KeyLength = true, true, "AESV3", 256
+                case stm == "AESV2" || str == "AESV2":
+                        c.aes, e.Method, e.KeyLength = true, "AESV2", 128
+                case !stmNone || !strNone:
+                        e.KeyLength = 128
+                }
+        }
+        d.crypt = c
+
+        if filter != "Standard" {
+                e.PasswordRequired = true
+                return nil
+        }
+        o, _ := d.get(dict["O"]).(String)
+        u, _ := d.get(dict["U"]).(String)
+        if e.R >= 5 {
+                ue, _ := d.get(dict["UE"]).(String)
+                c.key = fileKeyAES256(e.R, []byte(u), []byte(ue))
+        } else {
+                var id []byte
+                if ids, ok := d.get(d.trailer["ID"]).(Array); ok && len(ids) > 0 {
+                        s, _ := d.get(ids[0]).(String)
+                        id = []byte(s)
+                }
+                c.key = fileKeyRC4(e, []byte(o), []byte(u), id)
+        }
+        if c.key == nil {
+                e.PasswordRequired = true
+        }
+        return nil
+}
+
+// fileKeyRC4 derives the key of revisions 2-4 (algorithm 2) for the empty
+// user password and checks it against /U (algorithms 4 and 5).
+func fileKeyRC4(e *Encryption, o, u, id []byte) []byte {
+        if len(o) < 32 || len(u) < 32 {
+                return nil
+        }
+        n := min(max(e.KeyLength/8, 5), md5.Size)
+        if e.R == 2 {
+                n = 5
+        }
+        h := md5.New()
+        h.Write(padding)
+        h.Write(o[:32])
+        var p [4]byte
+        binary.LittleEndian.PutUint32(p[:], uint32(e.Permissions))
+        h.Write(p[:])
+        h.Write(id)
+        if e.R >= 4 && !e.EncryptMetadata {
+                h.Write([]byte{0xff, 0xff, 0xff, 0xff})
+        }
+        key := h.Sum(nil)
+        if e.R >= 3 {
+                for i := 0; i < 50; i++ {
+                        sum := md5.Sum(key[:n])
+                        key = sum[:]
+                }
+        }
+        key = key[:n]
+
+        if e.R == 2 {
+                out := make([]byte, 32)
+                rc4Crypt(key, out, padding)
+                if !bytes.Equal(out, u[:32]) {
+                        return nil
+                }
+                return key
+        }
+        h = md5.New()
+        h.Write(padding)
+        h.Write(id)
+        out := h.Sum(nil)
+        for i := 0; i < 20; i++ {
+                k := make([]byte, len(key))
+                for j := range key {
+                        k[j] = key[j] ^ byte(i)
+                }
+                rc4Crypt(k, out, out)
+        }
+        if !bytes.Equal(out[:16], u[:16]) {
+                return nil
+        }
+        return key
+}
+
+// fileKeyAES256 derives the key of revisions 5 and 6 for the empty user
+// password.
+func fileKeyAES256(r int, u, ue []byte) []byte {
+        if len(u) < 48 || len(ue) < 32 {
+                return nil
+        }
+        hash := func(salt []byte) []byte {
+                if r == 5 {
+                        sum := sha256.Sum256(salt)
+                        return sum[:]
+                }
+                return hashR6(nil, salt, nil)
+        }
+        if !bytes.Equal(hash(u[32:40]), u[:32]) {
+                return nil
+        }
+        block, err := aes.NewCipher(hash(u[40:48]))
+        if err != nil {
+                return nil
+        }
+        key := make([]byte, 32)
+        cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(key, ue[:32])
+        return key
+}
+
+// hashR6 is algorithm 2.B of ISO 32000-2.
+func hashR6(password, salt, udata []byte) []byte {
+        sum := sha256.Sum256(append(append(append([]byte{}, password...), salt...), udata...))
+        k := sum[:]
+        var e []byte
+        // At least 64 rounds, then until the last byte of E allows stopping.
+        for i := 0; i < 64 || int(e[len(e)-1]) > i-32; i++ {
+                k1 := bytes.Repeat(append(append(append([]byte{}, password...), k...), udata...), 64)
+                block, _ := aes.NewCipher(k[:16])
+                e = make([]byte, len(k1))
+                cipher.NewCBCEncrypter(block, k[16:32]).CryptBlocks(e, k1)
+                var mod int
+                for _, b := range e[:16] {
+                        mod += int(b)
+                }
+                switch mod % 3 {
+                case 0:
+                        s := sha256.Sum256(e)
+                        k = s[:]
+                case 1:
+                        s := sha512.Sum384(e)
+                        k = s[:]
+                case 2:
+                        s := sha512.Sum512(e)
+                        k = s[:]
+                }
+        }
+        return k[:32]
+}
+
+func rc4Crypt(key, dst, src []byte) {
+        c, err := rc4.NewCipher(key)
+        if err != nil {
+                return
+        }
+        c.XORKeyStream(dst, src)
+}
+
+// objectKey is the key for one object (algorithm 1).
+func (c *decrypter) objectKey(ref Ref) []byte {
+        if c.aes256 {
+                return c.key
+        }
+        h := md5.New()
+        h.Write(c.key)
+        h.Write([]byte{byte(ref.Num), byte(ref.Num >> 8), byte(ref.Num >> 16), byte(ref.Gen), byte(ref.Gen >> 8)})
+        if c.aes {
+                h.Write([]byte("sAlT"))
+        }
+        return h.Sum(nil)[:min(len(c.key)+5, 16)]
+}
+
+func (c *decrypter) decrypt(b []byte, ref Ref) ([]byte, error) {
+        if c.key == nil {
+                return nil, ErrPasswordRequired
+        }
+        key := c.objectKey(ref)
+        if !c.aes {
+                out := make([]byte, len(b))
+                rc4Crypt(key, out, b)
+                return out, nil
+        }
+        if len(b) < aes.BlockSize || len(b)%aes.BlockSize != 0 {
+                if len(b) == 0 {
+                        return b, nil
+                }
+                return nil, fmt.Errorf("pdfdoc: object %v: invalid AES data", ref)
+        }
+        block, err := aes.NewCipher(key)
+        if err != nil {
+                return nil, err
+        }
+        out := make([]byte, len(b)-aes.BlockSize)
+        cipher.NewCBCDecrypter(block, b[:aes.BlockSize]).CryptBlocks(out, b[aes.BlockSize:])
+        if n := len(out); n > 0 {
+                if pad := int(out[n-1]); pad >= 1 && pad <= aes.BlockSize && pad <= n {
+                        out = out[:n-pad]
+                }
+        }
+        return out, nil
+}
+
+// encrypt encrypts data written to object ref. The file key must be known.
+func (c *decrypter) encrypt(b []byte, ref Ref) ([]byte, error) {
+        if c.key == nil {
+                return nil, ErrPasswordRequired
+        }
+        key := c.objectKey(ref)
+        if !c.aes {
+                out := make([]byte, len(b))
+                rc4Crypt(key, out, b)
+                return out, nil
+        }
+        block, err := aes.NewCipher(key)
+        if err != nil {
+                return nil, err
+        }
+        pad := aes.BlockSize - len(b)%aes.BlockSize
+        out := make([]byte, aes.BlockSize+len(b)+pad)
+        if _, err := rand.Read(out[:aes.BlockSize]); err != nil {
+                return nil, err
+        }
+        plain := append(append([]byte{}, b...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+        cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).CryptBlocks(out[aes.BlockSize:], plain)
+        return out, nil
+}
+
+// encryptsStream reports whether s is stored encrypted. Cross-reference
+// streams never are, and metadata streams may be exempt.
+func (c *decrypter) encryptsStream(s *Stream) bool {
+        if c.stmNone {
+                return false
+        }
+        switch s.Dict.Type() {
+        case "XRef":
+                return false
+        case "Metadata":
+                return c.encMeta
+        }
+        return true
+}
+
+// decryptObject decrypts the strings of an object read from the file.
+// Strings that can't be decrypted are left as they are.
+func (c *decrypter) decryptObject(o Object, ref Ref) Object {
+        if c.strNone || c.key == nil {
+                return o
+        }
+        switch v := o.(type) {
+        case String:
+                if b, err := c.decrypt([]byte(v), ref); err == nil {
+                        return String(b)
+                }
+        case Array:
+                for i := range v {
+                        v[i] = c.decryptObject(v[i], ref)
+                }
+        case Dict:
+                for k := range v {
+                        v[k] = c.decryptObject(v[k], ref)
+                }
+        case *Stream:
+                c.decryptObject(v.Dict, ref)
+        }
+        return o
+}
@@ -0,0 +1,93 @@
+package pdfdoc
+
+import (
+        "bytes"
+        "errors"
+        "testing"
+)
+
+func TestDecrypt(t *testing.T) {
+        tests := []struct {
+                method    string
+                v, r, key int
+                objStm    bool
+        }{
+                {"RC4", 2, 3, 128, false},
+                {"RC4", 2, 3, 128, true},
+                {"AESV2", 4, 4, 128, false},
+                {"AESV2", 4, 4, 128, true},
+                {"AESV3", 5, 6, 256, false},
+                {"AESV3", 5, 6, 256, true},
+        }
+        for _, tt := range tests {
+                name := tt.method
+                if tt.objStm {
+                        name += " object streams"
+                }
+                t.Run(name, func(t *testing.T) {
+                        opt := fixtureOptions{crypt: newFixtureCrypt(tt.method, "")}
+                        if tt.objStm {
+                                opt.xrefStream, opt.objStm = true, sampleObjStm
+                        }
+                        d := openFixture(t, buildPDF(t, sampleObjects(), sampleTrailer, opt))
+
+                        e := d.Encryption()
+                        if e == nil {
+                                t.Fatal("Encryption() = nil")
+                        }
+                        if e.Method != tt.method || e.V != tt.v || e.R != tt.r || e.KeyLength != tt.key ||
+                                e.PasswordRequired || e.Permissions != -1028 {
+                                t.Errorf("Encryption() = %+v", *e)
+                        }
+                        if d.NumPages() != 3 {
+                                t.Errorf("NumPages() = %d, want 3", d.NumPages())
+                        }
+
+                        info, err := d.Info()
+                        if err != nil || info.Title != "Titítle" || info.Author != "Ann — Bo" {
+                                t.Errorf("Info() = %+v, %v", info, err)
+                        }
+                        outline, err := d.Outline()
+                        if err != nil || len(outline) != 2 || outline[1].Title != "Äb" || outline[1].Page != 3 {
+                                t.Errorf("Outline() = %+v, %v", outline, err)
+                        }
+                        xmp, err := d.Metadata()
+                        if err != nil || string(xmp) != "<x:xmpmeta>hi</x:xmpmeta>" {
+                                t.Errorf("Metadata() = %q, %v", xmp, err)
+                        }
+                        p, _ := d.Page(1)
+                        s, _ := d.Resolve(p.Dict["Contents"])
+                        stm, ok := s.(*Stream)
+                        if !ok {
+                                t.Fatalf("page 1 contents = %T", s)
+                        }
+                        data, err := d.StreamData(stm)
+                        if err != nil || string(data) != "BT /F1 24 Tf 72 700 Td (Hello) Tj ET" {
+                                t.Errorf("page 1 contents = %q, %v", data, err)
+                        }
+                })
+        }
+}
+
+func TestDecryptUserPassword(t *testing.T) {
+        t.Run("plain objects", func(t *testing.T) {
+                opt := fixtureOptions{crypt: newFixtureCrypt("AESV3", "secret")}
+                d := openFixture(t, buildPDF(t, sampleObjects(), sampleTrailer, opt))
+                if e := d.Encryption(); e == nil || !e.PasswordRequired {
+                        t.Fatalf("Encryption() = %+v, want PasswordRequired", e)
+                }
+                if d.NumPages() != 3 {
+                        t.Errorf("NumPages() = %d, want 3", d.NumPages())
+                }
+                if _, err := d.Info(); !errors.Is(err, ErrPasswordRequired) {
+                        t.Errorf("Info() error = %v, want ErrPasswordRequired", err)
+                }
+        })
+        t.Run("object streams", func(t *testing.T) {
+                opt := fixtureOptions{crypt: newFixtureCrypt("RC4", "secret"), xrefStream: true, objStm: sampleObjStm}
+                b := buildPDF(t, sampleObjects(), sampleTrailer, opt)
+                if _, err := New(bytes.NewReader(b), int64(len(b))); !errors.Is(err, ErrPasswordRequired) {
+                        t.Errorf("New() error = %v, want ErrPasswordRequired", err)
+                }
+        })
+}
@@ -0,0 +1,551 @@
+// Package pdfdoc reads the structure of PDF files in process: the page tree
+// with each page's boxes and rotation, the document information dictionary,
+// XMP metadata, encryption status, the outline and page annotations.
+//
+// It reads classic cross-reference tables, cross-reference and object
+// streams, incremental updates and hybrid files. Damaged files are opened
+// the way viewers do, by rebuilding the table from the objects in the file.
+// Encrypted documents are read when their user password is empty (documents
+// protected by an owner password only); otherwise the structure is still
+// read where possible and string data reports ErrPasswordRequired. Open
+// reports it too when the page tree itself is encrypted (in object streams).
+//
+// Documents are changed by an Update, written after the original bytes as
+// an incremental update. Overlays draw text, shapes and images on pages,
+// with TrueType fonts embedded as subsets; Annotate adds annotations.
+// Redact removes page content under given areas, and has the document
+// rewritten as a whole so that the removed content is gone from the file.
+//
+// A Document is not safe for concurrent use.
+package pdfdoc
+
+import (
+        "bytes"
+        "errors"
+        "fmt"
+        "io"
+        "os"
+        "time"
+)
+
+// ErrNotPDF is returned for input without a PDF header.
+var ErrNotPDF = errors.New("pdfdoc: not a PDF file")
+
+type Document struct {
+        r      io.ReaderAt
+        size   int64
+        closer io.Closer
+
+        version  string
+        xref     map[int]xrefEntry
+        trailer  Dict
+        repaired bool
+        // startxref is the offset of the newest cross-reference section, and
+        // xrefStream whether it is a stream; updates append the same kind.
+        startxref  int64
+        xrefStream bool
+
+        cache     map[Ref]Object
+        objStms   map[int]*objStream
+        resolving map[Ref]bool
+        lastErr   error
+
+        crypt      *decrypter
+        encryption *Encryption
+        encryptRef Ref
+
+        catalog     Dict
+        pages       []Page
+        pageNums    map[Ref]int
+        namedDests  map[string]Object
+        namesLoaded bool
+}
+
+// Open opens the PDF file at path. The caller must Close the document.
+func Open(path string) (*Document, error) {
+        f, err := os.Open(path)
+        if err != nil {
+                return nil, err
+        }
+        st, err := f.Stat()
+        if err != nil {
+                f.Close()
+                return nil, err
+        }
+        d, err := New(f, st.Size())
+        if err != nil {
+                f.Close()
+                return nil, err
+        }
+        d.closer = f
+        return d, nil
+}
+
+// New reads a document from r, which holds size bytes.
+func New(r io.ReaderAt, size int64) (*Document, error) {
+        d := &Document{
+                r:          r,
+                size:       size,
+                xref:       make(map[int]xrefEntry),
+                cache:      make(map[Ref]Object),
+                objStms:    make(map[int]*objStream),
+                resolving:  make(map[Ref]bool),
+                encryptRef: Ref{Num: -1},
+        }
+        if err := d.load(); err != nil {
+                return nil, err
+        }
+        return d, nil
+}
+
+// Close closes the file opened by Open.
+func (d *Document) Close() error {
+        if d.closer == nil {
+                return nil
+        }
+        return d.closer.Close()
+}
+
+func (d *Document) load() error {
+        head := d.readAt(0, 1024)
+        i := bytes.Index(head, []byte("%PDF-"))
+        if i < 0 {
+                return ErrNotPDF
+        }
+        d.version = newBytesLexer(head[i+5:]).readRegular()
+        if len(d.version) > 3 {
+                d.version = d.version[:3]
+        }
+
+        if err := d.readXref(); err != nil || d.trailer["Root"] == nil {
+                if err := d.repair(); err != nil {
+                        return err
+                }
+        } else if err := d.setupEncryption(); err != nil {
+                return err
+        }
+
+        wasRepaired := d.repaired
+        err := d.loadStructure()
+        switch {
+        case d.repaired && !wasRepaired:
+                // The table was rebuilt halfway through; start over with it.
+                err = d.loadStructure()
+        case err != nil && !d.repaired && !d.needPassword():
+                if d.repair() == nil {
+                        err = d.loadStructure()
+                }
+        }
+        if err != nil && d.needPassword() {
+                return ErrPasswordRequired
+        }
+        return err
+}
+
+// loadStructure reads the catalog and the page tree.
+func (d *Document) loadStructure() error {
+        d.lastErr = nil
+        d.catalog = d.getDict(d.trailer["Root"])
+        if d.catalog == nil {
+                if d.lastErr != nil {
+                        return d.lastErr
+                }
+                return errors.New("pdfdoc: document catalog not found")
+        }
+        if v, ok := d.catalog["Version"].(Name); ok && len(v) == 3 && string(v) > d.version {
+                d.version = string(v)
+        }
+        return d.loadPages()
+}
+
+// Version is the PDF version from the header, or the catalog's /Version
+// when that is later.
+func (d *Document) Version() string { return d.version }
+
+// Trailer returns the trailer dictionary.
+func (d *Document) Trailer() Dict { return d.trailer }
+
+// Catalog returns the document catalog.
+func (d *Document) Catalog() Dict { return d.catalog }
+
+// Repaired reports whether the cross-reference table was damaged and had to
+// be rebuilt.
+func (d *Document) Repaired() bool { return d.repaired }
+
+// Encryption returns how the document is encrypted, or nil.
+func (d *Document) Encryption() *Encryption { return d.encryption }
+
+// Encrypted reports whether the document is encrypted.
+func (d *Document) Encrypted() bool { return d.encryption != nil }
+
+func (d *Document) needPassword() bool {
+        return d.encryption != nil && d.encryption.PasswordRequired
+}
+
+// ----------------------------------------------------------------------------------
+// Pages
+// ----------------------------------------------------------------------------------
+
+// Rect is a rectangle in default user space units (1/72 inch), normalized
+// so that LLX <= URX and LLY <= URY.
+type Rect struct {
+        LLX, LLY, URX, URY float64
+}
+
+func (r Rect) Width() float64  { return r.URX - r.LLX }
+func (r Rect) Height() float64 { return r.URY - r.LLY }
+
+func (r Rect) intersect(o Rect) Rect {
+        x := Rect{max(r.LLX, o.LLX), max(r.LLY, o.LLY), min(r.URX, o.URX), min(r.URY, o.URY)}
+        if x.Width() <= 0 || x.Height() <= 0 {
+                return o
+        }
+        return x
+}
+
+// letter is the MediaBox of pages that lack one.
+var letter = Rect{0, 0, 612, 792}
+
+// Page is one page with its inheritable attributes resolved.
+type Page struct {
+        Number int // 1-based
+        Ref    Ref // zero for a page dictionary that isn't an indirect object
+        Dict   Dict
+
+        MediaBox Rect
+        // CropBox defaults to the MediaBox and is clipped to it.
+        CropBox Rect
+        // Rotate is the clockwise display rotation: 0, 90, 180 or 270.
+        Rotate    int
+        Resources Dict
+}
+
+// Size returns the page's width and height as displayed: the CropBox,
+// turned by Rotate.
+func (p Page) Size() (w, h float64) {
+        w, h = p.CropBox.Width(), p.CropBox.Height()
+        if p.Rotate == 90 || p.Rotate == 270 {
+                return h, w
+        }
+        return w, h
+}
+
+// maxPageTreeDepth bounds the nesting of the page tree.
+const maxPageTreeDepth = 64
+
+func (d *Document) loadPages() error {
+        d.pages = nil
+        d.pageNums = make(map[Ref]int)
+        type inherited struct {
+                mediaBox, cropBox, rotate, resources Object
+        }
+        visited := make(map[Ref]bool)
+        var walk func(o Object, inh inherited, depth int)
+        walk = func(o Object, inh inherited, depth int) {
+                if depth > maxPageTreeDepth {
+                        return
+                }
+                ref, isRef := o.(Ref)
+                if isRef {
+                        if visited[ref] {
+                                return
+                        }
+                        visited[ref] = true
+                }
+                node := d.getDict(o)
+                if node == nil {
+                        return
+                }
+                for key, dst := range map[Name]*Object{
+                        "MediaBox": &inh.mediaBox, "CropBox": &inh.cropBox, "Rotate": &inh.rotate, "Resources": &inh.resources,
+                } {
+                        if v, ok := node[key]; ok {
+                                *dst = v
+                        }
+                }
+                kids, hasKids := d.get(node["Kids"]).(Array)
+                if t := node.Type(); t == "Pages" || (t != "Page" && hasKids) {
+                        for _, kid := range kids {
+                                walk(kid, inh, depth+1)
+                        }
+                        return
+                }
+                p := Page{Number: len(d.pages) + 1, Dict: node}
+                if isRef {
+                        p.Ref = ref
+                        d.pageNums[ref] = p.Number
+                }
+                p.MediaBox = d.rect(inh.mediaBox, letter)
+                p.CropBox = d.rect(inh.cropBox, p.MediaBox).intersect(p.MediaBox)
+                if r, ok := asInt(d.get(inh.rotate)); ok && r%90 == 0 {
+                        p.Rotate = int((r%360 + 360) % 360)
+                }
+                p.Resources = d.getDict(inh.resources)
+                d.pages = append(d.pages, p)
+        }
+        walk(d.catalog["Pages"], inherited{}, 0)
+        if len(d.pages) == 0 {
+                if d.lastErr != nil {
+                        return d.lastErr
+                }
+                return errors.New("pdfdoc: document has no pages")
+        }
+        return nil
+}
+
+// rect reads a rectangle, falling back to def when o isn't a valid one.
+func (d *Document) rect(o Object, def Rect) Rect {
+        a, ok := d.get(o).(Array)
+        if !ok || len(a) != 4 {
+                return def
+        }
+        var v [4]float64
+        for i := range v {
+                if v[i], ok = asNumber(d.get(a[i])); !ok {
+                        return def
+                }
+        }
+        r := Rect{min(v[0], v[2]), min(v[1], v[3]), max(v[0], v[2]), max(v[1], v[3])}
+        if r.Width() <= 0 || r.Height() <= 0 {
+                return def
+        }
+        return r
+}
+
+// NumPages returns the number of pages found in the page tree.
+func (d *Document) NumPages() int { return len(d.pages) }
+
+// Pages returns every page in order.
+func (d *Document) Pages() []Page { return d.pages }
+
+// Page returns page n, counting from 1.
+func (d *Document) Page(n int) (Page, bool) {
+        if n < 1 || n > len(d.pages) {
+                return Page{}, false
+        }
+        return d.pages[n-1], true
+}
+
+// PageNumber returns the number of the page object ref, or 0.
+func (d *Document) PageNumber(ref Ref) int { return d.pageNums[ref] }
+
+// ----------------------------------------------------------------------------------
+// Metadata
+// ----------------------------------------------------------------------------------
+
+// Info holds the document information dictionary.
+type Info struct {
+        Title, Author, Subject, Keywords, Creator, Producer string
+        // CreationDate and ModDate are zero when absent or unreadable.
+        CreationDate, ModDate time.Time
+        Trapped               string
+        // Custom holds any other text entries.
+        Custom map[string]string
+}
+
+// Info reads the document information dictionary. A document without one
+// returns an empty Info.
+func (d *Document) Info() (Info, error) {
+        var info Info
+        o, ok := d.trailer["Info"]
+        if !ok {
+                return info, nil
+        }
+        o, err := d.Resolve(o)
+        if err != nil {
+                return info, err
+        }
+        dict, _ := o.(Dict)
+        if len(dict) > 0 && d.needPassword() {
+                return info, ErrPasswordRequired
+        }
+        for key, v := range dict {
+                v = d.get(v)
+                if key == "Trapped" {
+                        if n, ok := v.(Name); ok {
+                                info.Trapped = string(n)
+                        }
+                        continue
+                }
+                s, ok := v.(String)
+                if !ok {
+                        continue
+                }
+                text := Text(s)
+                switch key {
+                case "Title":
+                        info.Title = text
+                case "Author":
+                        info.Author = text
+                case "Subject":
+                        info.Subject = text
+                case "Keywords":
+                        info.Keywords = text
+                case "Creator":
+                        info.Creator = text
+                case "Producer":
+                        info.Producer = text
+                case "CreationDate":
+                        info.CreationDate, _ = ParseDate(text)
+                case "ModDate":
+                        info.ModDate, _ = ParseDate(text)
+                default:
+                        if info.Custom == nil {
+                                info.Custom = make(map[string]string)
+                        }
+                        info.Custom[string(key)] = text
+                }
+        }
+        return info, nil
+}
+
+// Metadata returns the document's XMP metadata packet, or nil if it has
+// none.
+func (d *Document) Metadata() ([]byte, error) {
+        o, err := d.Resolve(d.catalog["Metadata"])
+        if err != nil {
+                return nil, err
+        }
+        s, ok := o.(*Stream)
+        if !ok {
+                return nil, nil
+        }
+        return d.StreamData(s)
+}
+
+// ----------------------------------------------------------------------------------
+// Outline
+// ----------------------------------------------------------------------------------
+
+// OutlineItem is a bookmark.
+type OutlineItem struct {
+        Title string
+        // Page is the 1-based page the item leads to, or 0 when it has no
+        // destination in this document.
+        Page     int
+        Children []OutlineItem
+}
+
+const (
+        maxOutlineItems = 100_000
+        maxOutlineDepth = 64
+)
+
+// Outline returns the document outline (bookmarks), nil if there is none.
+func (d *Document) Outline() ([]OutlineItem, error) {
+        root := d.getDict(d.catalog["Outlines"])
+        if root == nil {
+                return nil, nil
+        }
+        if d.needPassword() {
+                return nil, ErrPasswordRequired
+        }
+        visited := make(map[Ref]bool)
+        count := 0
+        var walk func(o Object, depth int) []OutlineItem
+        walk = func(o Object, depth int) []OutlineItem {
+                var items []OutlineItem
+                for o != nil && depth < maxOutlineDepth && count < maxOutlineItems {
+                        ref, ok := o.(Ref)
+                        if !ok || visited[ref] {
+                                break
+                        }
+                        visited[ref] = true
+                        dict := d.getDict(ref)
+                        if dict == nil {
+                                break
+                        }
+                        count++
+                        title, _ := d.get(dict["Title"]).(String)
+                        item := OutlineItem{Title: Text(title), Page: d.destinationPage(dict)}
+                        item.Children = walk(dict["First"], depth+1)
+                        items = append(items, item)
+                        o = dict["Next"]
+                }
+                return items
+        }
+        return walk(root["First"], 0), nil
+}
+
+// destinationPage returns the page an outline item or link goes to.
+func (d *Document) destinationPage(item Dict) int {
+        dest, ok := item["Dest"]
+        if !ok {
+                action := d.getDict(item["A"])
+                if s, _ := d.get(action["S"]).(Name); s != "GoTo" {
+                        return 0
+                }
+                dest = action["D"]
+        }
+        for i := 0; i < 4; i++ {
+                switch v := d.get(dest).(type) {
+                case Array:
+                        if len(v) == 0 {
+                                return 0
+                        }
+                        switch p := v[0].(type) {
+                        case Ref:
+                                return d.pageNums[p]
+                        case int64:
+                                // A page index, as remote destinations use.
+                                if p >= 0 && int(p) < len(d.pages) {
+                                        return int(p) + 1
+                                }
+                        }
+                        return 0
+                case Dict:
+                        dest = v["D"]
+                case Name:
+                        dest = d.namedDestination(string(v))
+                case String:
+                        dest = d.namedDestination(string(v))
+                default:
+                        return 0
+                }
+        }
+        return 0
+}
+
+// namedDestination looks a name up in the catalog's /Dests dictionary and
+// the /Dests name tree.
+func (d *Document) namedDestination(name string) Object {
+        if !d.namesLoaded {
+                d.namesLoaded = true
+                d.namedDests = make(map[string]Object)
+                for k, v := range d.getDict(d.catalog["Dests"]) {
+                        d.namedDests[string(k)] = v
+                }
+                names := d.getDict(d.catalog["Names"])
+                d.walkNameTree(names["Dests"], d.namedDests, make(map[Ref]bool), 0)
+        }
+        return d.namedDests[name]
+}
+
+func (d *Document) walkNameTree(o Object, into map[string]Object, visited map[Ref]bool, depth int) {
+        if ref, ok := o.(Ref); ok {
+                if visited[ref] {
+                        return
+                }
+                visited[ref] = true
+        }
+        node := d.getDict(o)
+        if node == nil || depth > maxPageTreeDepth || len(into) > maxOutlineItems {
+                return
+        }
+        if names, ok := d.get(node["Names"]).(Array); ok {
+                for i := 0; i+1 < len(names); i += 2 {
+                        if key, ok := d.get(names[i]).(String); ok {
+                                into[string(key)] = names[i+1]
+                        }
+                }
+        }
+        if kids, ok := d.get(node["Kids"]).(Array); ok {
+                for _, kid := range kids {
+                        d.walkNameTree(kid, into, visited, depth+1)
+                }
+        }
+}
+
+func (r Rect) String() string {
+        return fmt.Sprintf("[%g %g %g %g]", r.LLX, r.LLY, r.URX, r.URY)
+}
@@ -0,0 +1,232 @@
+package pdfdoc
+
+import (
+        "bytes"
+        "compress/zlib"
+        "encoding/ascii85"
+        "errors"
+        "fmt"
+        "io"
+)
+
+// maxDecodedStream bounds the decoded size of one stream, so a small
+// compressed stream can't exhaust memory.
+const maxDecodedStream = 256 << 20
+
+// ErrUnsupportedFilter is returned for streams encoded with a filter this
+// package doesn't implement (image codecs such as DCTDecode among them).
+var ErrUnsupportedFilter = errors.New("pdfdoc: unsupported stream filter")
+
+// StreamData returns the decrypted and decoded data of s.
+func (d *Document) StreamData(s *Stream) ([]byte, error) {
+        raw, err := d.RawStreamData(s)
+        if err != nil {
+                return nil, err
+        }
+        filters, params := d.filtersOf(s.Dict)
+        for i, f := range filters {
+                if raw, err = decodeFilter(f, params[i], raw); err != nil {
+                        return nil, err
+                }
+        }
+        return raw, nil
+}
+
+// RawStreamData returns the decrypted but still encoded data of s.
+func (d *Document) RawStreamData(s *Stream) ([]byte, error) {
+        if s.mem {
+                return s.data, nil
+        }
+        if s.length < 0 || s.off+s.length > d.size {
+                return nil, fmt.Errorf("pdfdoc: stream of object %v is truncated", s.ref)
+        }
+        if s.length > maxDecodedStream {
+                return nil, fmt.Errorf("pdfdoc: stream of object %v is too large", s.ref)
+        }
+        raw := d.readAt(s.off, int(s.length))
+        if d.crypt != nil && d.crypt.encryptsStream(s) {
+                return d.crypt.decrypt(raw, s.ref)
+        }
+        return raw, nil
+}
+
+// filtersOf returns a stream's filters with their parameters, in the order
+// they are to be applied.
+func (d *Document) filtersOf(dict Dict) ([]Name, []Dict) {
+        var filters []Name
+        var params []Dict
+        switch f := d.get(dict["Filter"]).(type) {
+        case Name:
+                filters = []Name{f}
+                params = []Dict{d.getDict(dict["DecodeParms"])}
+        case Array:
+                parms, _ := d.get(dict["DecodeParms"]).(Array)
+                for i, o := range f {
+                        name, _ := d.get(o).(Name)
+                        filters = append(filters, name)
+                        var p Dict
+                        if i < len(parms) {
+                                p = d.getDict(parms[i])
+                        }
+                        params = append(params, p)
+                }
+        }
+        return filters, params
+}
+
+func decodeFilter(name Name, params Dict, b []byte) ([]byte, error) {
+        switch name {
+        case "FlateDecode", "Fl":
+                out, err := inflate(b)
+                if err != nil {
+                        return nil, err
+                }
+                return applyPredictor(out, params)
+        case "ASCIIHexDecode", "AHx":
+                return []byte(newBytesLexer(b).readHexString()), nil
+        case "ASCII85Decode", "A85":
+                return decodeASCII85(b)
+        case "RunLengthDecode", "RL":
+                return decodeRunLength(b), nil
+        case "Crypt":
+                // Only the identity crypt filter appears inside documents whose
+                // encryption is handled as a whole.
+                return b, nil
+        }
+        return nil, fmt.Errorf("%w %s", ErrUnsupportedFilter, name)
+}
+
+func readLimited(r io.Reader) ([]byte, error) {
+        out, err := io.ReadAll(io.LimitReader(r, maxDecodedStream+1))
+        if len(out) > maxDecodedStream {
+                return nil, errors.New("pdfdoc: decoded stream too large")
+        }
+        return out, err
+}
+
+// inflate decompresses zlib data. Data that ends early or has a bad checksum
+// is common in the wild; what could be decoded is returned.
+func inflate(b []byte) ([]byte, error) {
+        zr, err := zlib.NewReader(bytes.NewReader(b))
+        if err != nil {
+                return nil, fmt.Errorf("pdfdoc: flate: %w", err)
+        }
+        out, err := readLimited(zr)
+        if err != nil && len(out) == 0 {
+                return nil, fmt.Errorf("pdfdoc: flate: %w", err)
+        }
+        return out, nil
+}
+
+// applyPredictor undoes the PNG predictors used with FlateDecode, notably
+// by cross-reference streams.
+func applyPredictor(b []byte, params Dict) ([]byte, error) {
+        pred, _ := asInt(params["Predictor"])
+        if pred <= 1 {
+                return b, nil
+        }
+        if pred == 2 {
+                return nil, fmt.Errorf("%w: TIFF predictor", ErrUnsupportedFilter)
+        }
+        colors, bpc, columns := int64(1), int64(8), int64(1)
+        if v, ok := asInt(params["Colors"]); ok && v > 0 {
+                colors = v
+        }
+        if v, ok := asInt(params["BitsPerComponent"]); ok && v > 0 {
+                bpc = v
+        }
+        if v, ok := asInt(params["Columns"]); ok && v > 0 {
+                columns = v
+        }
+        if colors > 64 || bpc > 16 || columns > 1<<24 {
+                return nil, errors.New("pdfdoc: invalid predictor parameters")
+        }
+        bpp := int((colors*bpc + 7) / 8)
+        rowLen := int((colors*bpc*columns + 7) / 8)
+        out := make([]byte, 0, len(b))
+        prev := make([]byte, rowLen)
+        for len(b) > 0 {
+                typ := b[0]
+                b = b[1:]
+                n := min(rowLen, len(b))
+                row := make([]byte, rowLen)
+                copy(row, b[:n])
+                b = b[n:]
+                for i := 0; i < rowLen; i++ {
+                        var left, upLeft byte
+                        if i >= bpp {
+                                left, upLeft = row[i-bpp], prev[i-bpp]
+                        }
+                        up := prev[i]
+                        switch typ {
+                        case 1:
+                                row[i] += left
+                        case 2:
+                                row[i] += up
+                        case 3:
+                                row[i] += byte((int(left) + int(up)) / 2)
+                        case 4:
+                                row[i] += paeth(left, up, upLeft)
+                        }
+                }
+                out = append(out, row...)
+                prev = row
+        }
+        return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+        p := int(a) + int(b) - int(c)
+        pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+        switch {
+        case pa <= pb && pa <= pc:
+                return a
+        case pb <= pc:
+                return b
+        }
+        return c
+}
+
+func abs(n int) int {
+        if n < 0 {
+                return -n
+        }
+        return n
+}
+
+func decodeASCII85(b []byte) ([]byte, error) {
+        b = bytes.TrimSpace(b)
+        b = bytes.TrimPrefix(b, []byte("<~"))
+        if i := bytes.Index(b, []byte("~>")); i >= 0 {
+                b = b[:i]
+        }
+        out := make([]byte, 4*len(b)+4) // "z" stands for four bytes
+        n, _, err := ascii85.Decode(out, b, true)
+        if err != nil {
+                return nil, fmt.Errorf("pdfdoc: ascii85: %w", err)
+        }
+        return out[:n], nil
+}
+
+func decodeRunLength(b []byte) []byte {
+        var out []byte
+        for len(b) > 0 && len(out) <= maxDecodedStream {
+                n := int(b[0])
+                b = b[1:]
+                switch {
+                case n == 128:
+                        return out
+                case n < 128:
+                        k := min(n+1, len(b))
+                        out = append(out, b[:k]...)
+                        b = b[k:]
+                default:
+                        if len(b) == 0 {
+                                return out
+                        }
+                        out = append(out, bytes.Repeat(b[:1], 257-n)...)
+                        b = b[1:]
+                }
+        }
+        return out
+}
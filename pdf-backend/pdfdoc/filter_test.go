@@ -0,0 +1,92 @@
+package pdfdoc
+
+import (
+        "bytes"
+        "errors"
+        "testing"
+)
+
+func TestDecodeFilter(t *testing.T) {
+        // Two rows of three one-byte samples, 10 20 30 and 15 25 40, encoded
+        // with each PNG predictor; the first byte of a row names its predictor.
+        rows := []byte{10, 20, 30, 15, 25, 40}
+        png := Dict{"Predictor": int64(12), "Columns": int64(3)}
+        tests := []struct {
+                name    string
+                filter  Name
+                params  Dict
+                in      []byte
+                want    []byte
+                partial bool // want only a non-empty prefix of want
+                wantErr error
+        }{
+                {name: "flate", filter: "FlateDecode", in: zlibData([]byte("hello")), want: []byte("hello")},
+                {name: "flate abbreviated", filter: "Fl", in: zlibData([]byte("hello")), want: []byte("hello")},
+                {name: "flate truncated", filter: "FlateDecode", in: zlibData(bytes.Repeat([]byte("ab"), 100))[:20],
+                        want: bytes.Repeat([]byte("ab"), 100), partial: true},
+                {name: "png none", filter: "FlateDecode", params: png,
+                        in: zlibData([]byte{0, 10, 20, 30, 0, 15, 25, 40}), want: rows},
+                {name: "png sub", filter: "FlateDecode", params: png,
+                        in: zlibData([]byte{1, 10, 10, 10, 1, 15, 10, 15}), want: rows},
+                {name: "png up", filter: "FlateDecode", params: png,
+                        in: zlibData([]byte{2, 10, 20, 30, 2, 5, 5, 10}), want: rows},
+                {name: "png average", filter: "FlateDecode", params: png,
+                        in: zlibData([]byte{3, 10, 15, 20, 3, 10, 8, 13}), want: rows},
+                {name: "png paeth", filter: "FlateDecode", params: png,
+                        in: zlibData([]byte{4, 10, 10, 10, 4, 5, 5, 10}), want: rows},
+                {name: "png mixed", filter: "FlateDecode", params: png,
+                        in: zlibData([]byte{1, 10, 10, 10, 2, 5, 5, 10}), want: rows},
+                {name: "tiff predictor", filter: "FlateDecode", params: Dict{"Predictor": int64(2)},
+                        in: zlibData(rows), wantErr: ErrUnsupportedFilter},
+                {name: "ascii hex", filter: "ASCIIHexDecode", in: []byte("48 65 6C6c 6F7>"), want: []byte("Hellop")},
+                {name: "ascii hex abbreviated", filter: "AHx", in: []byte("4865>"), want: []byte("He")},
+                {name: "ascii85", filter: "ASCII85Decode", in: []byte("<~87cURDZ~>"), want: []byte("Hello")},
+                {name: "ascii85 z", filter: "A85", in: []byte("z~>"), want: []byte{0, 0, 0, 0}},
+                {name: "run length", filter: "RunLengthDecode", in: []byte{2, 'a', 'b', 'c', 253, 'x', 128, 'z'},
+                        want: []byte("abcxxxx")},
+                {name: "identity crypt", filter: "Crypt", in: []byte("as is"), want: []byte("as is")},
+                {name: "dct", filter: "DCTDecode", in: []byte{0xff, 0xd8}, wantErr: ErrUnsupportedFilter},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        got, err := decodeFilter(tt.filter, tt.params, tt.in)
+                        if tt.wantErr != nil {
+                                if !errors.Is(err, tt.wantErr) {
+                                        t.Fatalf("error = %v, want %v", err, tt.wantErr)
+                                }
+                                return
+                        }
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        if tt.partial {
+                                // Whatever was decoded before the data ended is kept.
+                                if len(got) == 0 || !bytes.HasPrefix(tt.want, got) {
+                                        t.Errorf("got %q, want a prefix of %q", got, tt.want)
+                                }
+                                return
+                        }
+                        if !bytes.Equal(got, tt.want) {
+                                t.Errorf("got %q, want %q", got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestStreamDataFilterChain(t *testing.T) {
+        text := []byte("BT /F1 12 Tf (chained) Tj ET")
+        objs := sampleObjects()
+        objs[4] = fixtureObject{
+                dict:   "<< /Length LEN /Filter [/ASCIIHexDecode /FlateDecode] /DecodeParms [null << /Predictor 1 >>] >>",
+                stream: []byte(pdfHex(zlibData(text))[1:]),
+        }
+        for _, crypt := range []*fixtureCrypt{nil, newFixtureCrypt("AESV2", "")} {
+                d := openFixture(t, buildPDF(t, objs, sampleTrailer, fixtureOptions{crypt: crypt}))
+                p, _ := d.Page(1)
+                s, _ := d.Resolve(p.Dict["Contents"])
+                got, err := d.StreamData(s.(*Stream))
+                if err != nil || !bytes.Equal(got, text) {
+                        t.Errorf("encrypted %v: StreamData() = %q, %v", crypt != nil, got, err)
+                }
+        }
+}
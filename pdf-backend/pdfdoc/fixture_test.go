@@ -0,0 +1,377 @@
+package pdfdoc
+
+import (
+        "bytes"
+        "compress/zlib"
+        "crypto/aes"
+        "crypto/cipher"
+        "crypto/md5"
+        "crypto/rc4"
+        "crypto/sha256"
+        "crypto/sha512"
+        "encoding/binary"
+        "encoding/hex"
+        "fmt"
+        "hash"
+        "regexp"
+        "sort"
+        "strings"
+        "testing"
+)
+
+// ----------------------------------------------------------------------------------
+// Test documents
+// ----------------------------------------------------------------------------------
+//
+// Test documents are assembled from object bodies instead of being kept as
+// binary files, so each test shows the structure it exercises. Encryption
+// follows the standard security handler independently of crypt.go.
+
+// fixtureObject is one indirect object. In dict, "LEN" stands for the stream
+// length and ((text)) for a string that is encrypted with its object;
+// ((HEX:feff00c4)) gives the string's bytes in hex.
+type fixtureObject struct {
+        dict   string
+        stream []byte // nil for objects without a stream
+}
+
+type fixtureOptions struct {
+        xrefStream bool  // a cross-reference stream instead of a table
+        objStm     []int // objects stored in an object stream (needs xrefStream)
+        crypt      *fixtureCrypt
+}
+
+var (
+        fixtureID      = []byte("0123456789abcdef")
+        fixtureStrings = regexp.MustCompile(`\(\((.*?)\)\)`)
+)
+
+func pdfHex(b []byte) string { return "<" + hex.EncodeToString(b) + ">" }
+
+// buildPDF writes objs as a PDF whose trailer holds the given entries (plus
+// /Size, /ID and /Encrypt).
+func buildPDF(t testing.TB, objs map[int]fixtureObject, trailer string, opt fixtureOptions) []byte {
+        t.Helper()
+        nums := make([]int, 0, len(objs))
+        for n := range objs {
+                nums = append(nums, n)
+        }
+        sort.Ints(nums)
+        next := nums[len(nums)-1] + 1
+        inStm := make(map[int]int) // object number -> index in the object stream
+        stmNum, encNum, xrefNum := 0, 0, 0
+        if len(opt.objStm) > 0 {
+                stmNum = next
+                next++
+                for i, n := range opt.objStm {
+                        inStm[n] = i
+                }
+        }
+        if opt.crypt != nil {
+                encNum = next
+                next++
+        }
+        if opt.xrefStream {
+                xrefNum = next
+                next++
+        }
+        size := next
+
+        render := func(num int, body string) string {
+                return fixtureStrings.ReplaceAllStringFunc(body, func(m string) string {
+                        s := []byte(fixtureStrings.FindStringSubmatch(m)[1])
+                        if h, ok := bytes.CutPrefix(s, []byte("HEX:")); ok {
+                                var err error
+                                if s, err = hex.DecodeString(string(h)); err != nil {
+                                        t.Fatalf("object %d: %v", num, err)
+                                }
+                        }
+                        if _, packed := inStm[num]; opt.crypt != nil && !packed {
+                                s = opt.crypt.encrypt(num, s)
+                        }
+                        return pdfHex(s)
+                })
+        }
+
+        var out bytes.Buffer
+        out.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+        offsets := make(map[int]int)
+        for _, n := range nums {
+                o := objs[n]
+                body := render(n, o.dict)
+                if _, ok := inStm[n]; ok {
+                        if o.stream != nil {
+                                t.Fatalf("object %d: streams can't go in object streams", n)
+                        }
+                        continue
+                }
+                offsets[n] = out.Len()
+                if o.stream == nil {
+                        fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", n, body)
+                        continue
+                }
+                data := o.stream
+                if opt.crypt != nil {
+                        data = opt.crypt.encrypt(n, data)
+                }
+                body = strings.Replace(body, "LEN", fmt.Sprint(len(data)), 1)
+                fmt.Fprintf(&out, "%d 0 obj\n%s\nstream\n%s\nendstream\nendobj\n", n, body, data)
+        }
+        if stmNum > 0 {
+                var head, body bytes.Buffer
+                for _, n := range opt.objStm {
+                        fmt.Fprintf(&head, "%d %d ", n, body.Len())
+                        body.WriteString(render(n, objs[n].dict) + "\n")
+                }
+                data := zlibData(append(head.Bytes(), body.Bytes()...))
+                if opt.crypt != nil {
+                        data = opt.crypt.encrypt(stmNum, data)
+                }
+                offsets[stmNum] = out.Len()
+                fmt.Fprintf(&out, "%d 0 obj\n<< /Type /ObjStm /N %d /First %d /Filter /FlateDecode /Length %d >>\nstream\n%s\nendstream\nendobj\n",
+                        stmNum, len(opt.objStm), head.Len(), len(data), data)
+        }
+        if opt.crypt != nil {
+                offsets[encNum] = out.Len()
+                fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", encNum, opt.crypt.dict)
+                trailer += fmt.Sprintf(" /Encrypt %d 0 R", encNum)
+        }
+        trailer += fmt.Sprintf(" /ID [%s %s]", pdfHex(fixtureID), pdfHex(fixtureID))
+
+        xref := out.Len()
+        if !opt.xrefStream {
+                fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", size)
+                for n := 1; n < size; n++ {
+                        if off, ok := offsets[n]; ok {
+                                fmt.Fprintf(&out, "%010d 00000 n \n", off)
+                        } else {
+                                out.WriteString("0000000000 00000 f \n")
+                        }
+                }
+                fmt.Fprintf(&out, "trailer\n<< /Size %d %s >>\nstartxref\n%d\n%%%%EOF\n", size, trailer, xref)
+                return out.Bytes()
+        }
+
+        offsets[xrefNum] = xref
+        // Rows of [type, 4-byte offset or object stream, index], encoded with the
+        // PNG Up predictor.
+        var rows []byte
+        prev := make([]byte, 6)
+        for n := 0; n < size; n++ {
+                row := make([]byte, 6)
+                if off, ok := offsets[n]; ok {
+                        row[0] = 1
+                        binary.BigEndian.PutUint32(row[1:], uint32(off))
+                } else if i, ok := inStm[n]; ok {
+                        row[0] = 2
+                        binary.BigEndian.PutUint32(row[1:], uint32(stmNum))
+                        row[5] = byte(i)
+                }
+                rows = append(rows, 2)
+                for i := range row {
+                        rows = append(rows, row[i]-prev[i])
+                }
+                prev = row
+        }
+        data := zlibData(rows)
+        fmt.Fprintf(&out, "%d 0 obj\n<< /Type /XRef /Size %d /W [1 4 1] /Filter /FlateDecode /DecodeParms << /Predictor 12 /Columns 6 >> /Length %d %s >>\nstream\n%s\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n",
+                xrefNum, size, len(data), trailer, data, xref)
+        return out.Bytes()
+}
+
+func zlibData(b []byte) []byte {
+        var buf bytes.Buffer
+        zw := zlib.NewWriter(&buf)
+        zw.Write(b)
+        zw.Close()
+        return buf.Bytes()
+}
+
+// openFixture opens a test document held in memory.
+func openFixture(t testing.TB, b []byte) *Document {
+        t.Helper()
+        d, err := New(bytes.NewReader(b), int64(len(b)))
+        if err != nil {
+                t.Fatalf("open: %v", err)
+        }
+        return d
+}
+
+// sampleObjects is a three-page document with a nested page tree whose
+// boxes and rotation are inherited, an outline, named destinations, XMP
+// metadata and an information dictionary with UTF-16 and PDFDocEncoding
+// strings.
+func sampleObjects() map[int]fixtureObject {
+        return map[int]fixtureObject{
+                1:  {dict: "<< /Type /Catalog /Pages 2 0 R /Outlines 8 0 R /Names << /Dests 12 0 R >> /Metadata 13 0 R >>"},
+                2:  {dict: "<< /Type /Pages /Kids [3 0 R 5 0 R] /Count 3 /MediaBox [0 0 595 842] /Rotate 90 >>"},
+                3:  {dict: "<< /Type /Page /Parent 2 0 R /Contents 4 0 R /CropBox [10 10 585 832] >>"},
+                4:  {dict: "<< /Length LEN >>", stream: []byte("BT /F1 24 Tf 72 700 Td (Hello) Tj ET")},
+                5:  {dict: "<< /Type /Pages /Parent 2 0 R /Kids [6 0 R 7 0 R] /Count 2 /Rotate -90 >>"},
+                6:  {dict: "<< /Type /Page /Parent 5 0 R /MediaBox [0 0 300 400] >>"},
+                7:  {dict: "<< /Type /Page /Parent 5 0 R /Rotate 180 /MediaBox [612 792 0 0] /CropBox [-50 -50 100 100] >>"},
+                8:  {dict: "<< /Type /Outlines /First 9 0 R /Last 10 0 R /Count 2 >>"},
+                9:  {dict: "<< /Title ((Chapter 1)) /Parent 8 0 R /Next 10 0 R /Dest [3 0 R /Fit] /First 11 0 R /Last 11 0 R >>"},
+                10: {dict: "<< /Title ((HEX:feff00c40062)) /Parent 8 0 R /Prev 9 0 R /A << /S /GoTo /D ((third)) >> >>"},
+                11: {dict: "<< /Title ((Sub)) /Parent 9 0 R /Dest [6 0 R /XYZ 0 0 0] >>"},
+                12: {dict: "<< /Names [((third)) [7 0 R /Fit]] >>"},
+                13: {dict: "<< /Type /Metadata /Subtype /XML /Length LEN >>", stream: []byte("<x:xmpmeta>hi</x:xmpmeta>")},
+                14: {dict: "<< /Title ((HEX:feff00540069007400ed0074006c0065)) /Author ((Ann \x84 Bo)) /CreationDate ((D:20240131120000+01'00')) /Trapped /False /Custom1 ((v)) >>"},
+        }
+}
+
+const sampleTrailer = "/Root 1 0 R /Info 14 0 R"
+
+// sampleObjStm lists the sample objects that can go in an object stream.
+var sampleObjStm = []int{1, 2, 3, 5, 6, 7, 8, 9, 10, 11, 12, 14}
+
+// ----------------------------------------------------------------------------------
+// Standard security handler
+// ----------------------------------------------------------------------------------
+
+// fixtureCrypt encrypts a test document with the standard security handler.
+type fixtureCrypt struct {
+        method string // RC4, AESV2 or AESV3
+        key    []byte
+        dict   string
+}
+
+const fixturePermissions = -1028
+
+var fixturePad = []byte{
+        0x28, 0xbf, 0x4e, 0x5e, 0x4e, 0x75, 0x8a, 0x41, 0x64, 0x00, 0x4e, 0x56, 0xff, 0xfa, 0x01, 0x08,
+        0x2e, 0x2e, 0x00, 0xb6, 0xd0, 0x68, 0x3e, 0x80, 0x2f, 0x0c, 0xa9, 0xfe, 0x64, 0x53, 0x69, 0x7a,
+}
+
+func padPassword(pw string) []byte {
+        return append([]byte(pw), fixturePad...)[:32]
+}
+
+func rc4Bytes(key, b []byte) []byte {
+        c, _ := rc4.NewCipher(key)
+        out := make([]byte, len(b))
+        c.XORKeyStream(out, b)
+        return out
+}
+
+// rc4Rounds applies the 20 rounds of RC4 of algorithms 3 and 5, each with
+// the key XORed with the round number.
+func rc4Rounds(key, b []byte) []byte {
+        for i := 0; i < 20; i++ {
+                k := make([]byte, len(key))
+                for j := range key {
+                        k[j] = key[j] ^ byte(i)
+                }
+                b = rc4Bytes(k, b)
+        }
+        return b
+}
+
+func aesCBC(key, iv, b []byte) []byte {
+        block, _ := aes.NewCipher(key)
+        out := make([]byte, len(b))
+        cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, b)
+        return out
+}
+
+// newFixtureCrypt sets up encryption with the given method and user
+// password; the owner password is "owner". RC4 and AESV2 use revisions 3
+// and 4 with 128-bit keys, AESV3 revision 6.
+func newFixtureCrypt(method, userPassword string) *fixtureCrypt {
+        c := &fixtureCrypt{method: method}
+        if method == "AESV3" {
+                sum := sha256.Sum256([]byte("file key"))
+                c.key = sum[:]
+                vs, ks := []byte("validsal"), []byte("key salt")
+                u := append(append(hashR6Fixture([]byte(userPassword), vs), vs...), ks...)
+                ue := aesCBC(hashR6Fixture([]byte(userPassword), ks), make([]byte, 16), c.key)
+                c.dict = fmt.Sprintf("<< /Filter /Standard /V 5 /R 6 /Length 256 /CF << /StdCF << /CFM /AESV3 /Length 32 /AuthEvent /DocOpen >> >> /StmF /StdCF /StrF /StdCF /P %d /O %s /OE %s /U %s /UE %s /Perms %s >>",
+                        fixturePermissions, pdfHex(bytes.Repeat([]byte{1}, 48)), pdfHex(bytes.Repeat([]byte{2}, 32)),
+                        pdfHex(u), pdfHex(ue), pdfHex(bytes.Repeat([]byte{3}, 16)))
+                return c
+        }
+
+        // Algorithm 3: the O entry.
+        ok := md5.Sum(padPassword("owner"))
+        for i := 0; i < 50; i++ {
+                ok = md5.Sum(ok[:])
+        }
+        o := rc4Rounds(ok[:], padPassword(userPassword))
+        // Algorithm 2: the file key.
+        h := md5.New()
+        h.Write(padPassword(userPassword))
+        h.Write(o)
+        binary.Write(h, binary.LittleEndian, int32(fixturePermissions))
+        h.Write(fixtureID)
+        key := h.Sum(nil)
+        for i := 0; i < 50; i++ {
+                k := md5.Sum(key)
+                key = k[:]
+        }
+        c.key = key
+        // Algorithm 5: the U entry.
+        h = md5.New()
+        h.Write(fixturePad)
+        h.Write(fixtureID)
+        u := append(rc4Rounds(key, h.Sum(nil)), make([]byte, 16)...)
+
+        if method == "RC4" {
+                c.dict = fmt.Sprintf("<< /Filter /Standard /V 2 /R 3 /Length 128 /P %d /O %s /U %s >>",
+                        fixturePermissions, pdfHex(o), pdfHex(u))
+        } else {
+                c.dict = fmt.Sprintf("<< /Filter /Standard /V 4 /R 4 /Length 128 /CF << /StdCF << /CFM /AESV2 /Length 16 /AuthEvent /DocOpen >> >> /StmF /StdCF /StrF /StdCF /P %d /O %s /U %s >>",
+                        fixturePermissions, pdfHex(o), pdfHex(u))
+        }
+        return c
+}
+
+// hashR6Fixture is the revision 6 password hash (algorithm 2.B) with no
+// user key data.
+func hashR6Fixture(pw, salt []byte) []byte {
+        sum := sha256.Sum256(append(append([]byte{}, pw...), salt...))
+        k := sum[:]
+        for i := 1; ; i++ {
+                k1 := bytes.Repeat(append(append([]byte{}, pw...), k...), 64)
+                e := aesCBC(k[:16], k[16:32], k1)
+                n := 0
+                for _, b := range e[:16] {
+                        n += int(b)
+                }
+                var h hash.Hash
+                switch n % 3 {
+                case 0:
+                        h = sha256.New()
+                case 1:
+                        h = sha512.New384()
+                default:
+                        h = sha512.New()
+                }
+                h.Write(e)
+                k = h.Sum(nil)
+                if i >= 64 && int(e[len(e)-1]) <= i-32 {
+                        break
+                }
+        }
+        return k[:32]
+}
+
+// encrypt encrypts a string or stream of object num.
+func (c *fixtureCrypt) encrypt(num int, b []byte) []byte {
+        key := c.key
+        if c.method != "AESV3" {
+                h := md5.New()
+                h.Write(c.key)
+                h.Write([]byte{byte(num), byte(num >> 8), byte(num >> 16), 0, 0})
+                if c.method == "AESV2" {
+                        h.Write([]byte("sAlT"))
+                }
+                key = h.Sum(nil)[:min(len(c.key)+5, 16)]
+        }
+        if c.method == "RC4" {
+                return rc4Bytes(key, b)
+        }
+        iv := md5.Sum(b)
+        pad := aes.BlockSize - len(b)%aes.BlockSize
+        b = append(append([]byte{}, b...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+        return append(iv[:], aesCBC(key, iv[:], b)...)
+}
@@ -0,0 +1,239 @@
+package pdfdoc
+
+import (
+        "bytes"
+        "errors"
+        "fmt"
+        "math"
+        "sort"
+        "unicode/utf16"
+        "unicode/utf8"
+)
+
+// ----------------------------------------------------------------------------------
+// Fonts
+// ----------------------------------------------------------------------------------
+
+// ErrFontNotEmbeddable is returned for a font whose license (the OS/2 fsType
+// field) forbids embedding it.
+var ErrFontNotEmbeddable = errors.New("pdfdoc: font license does not allow embedding")
+
+// Font is a font overlay text is set in. Text stays text in the output:
+// viewers can select, search and copy it.
+type Font struct {
+        ref  Ref
+        name string
+        used bool
+
+        // tt is the embedded TrueType font, nil for a standard font.
+        tt     *trueType
+        glyphs map[uint16]rune // glyphs used, with the character each stands for
+}
+
+// StandardFont returns one of the 14 standard fonts (Helvetica,
+// Times-Roman, Courier...), which every viewer supplies, so nothing is
+// embedded. Text is limited to the Windows Latin character set; other
+// characters print as '?'.
+func (u *Update) StandardFont(name string) *Font {
+        f := &Font{ref: u.alloc(), name: name}
+        u.fonts = append(u.fonts, f)
+        return f
+}
+
+// EmbedFont embeds a TrueType font (.ttf). Only the glyphs the overlays use
+// are kept, so the cost is a few kilobytes whatever the size of the font.
+func (u *Update) EmbedFont(data []byte) (*Font, error) {
+        tt, err := parseTrueType(data)
+        if err != nil {
+                return nil, err
+        }
+        if !tt.embeddable {
+                return nil, ErrFontNotEmbeddable
+        }
+        f := &Font{ref: u.alloc(), name: tt.name, tt: tt, glyphs: make(map[uint16]rune)}
+        u.fonts = append(u.fonts, f)
+        return f, nil
+}
+
+// Width returns the advance width of s set in f at size points. Standard
+// fonts have no metrics here; their width is estimated.
+func (f *Font) Width(s string, size float64) float64 {
+        if f.tt == nil {
+                return 0.55 * size * float64(utf8.RuneCountInString(s))
+        }
+        units := 0
+        for _, r := range s {
+                units += f.tt.advance(f.tt.glyph(r))
+        }
+        return float64(units) * size / float64(f.tt.unitsPerEm)
+}
+
+// encode returns the string that shows s in f.
+func (f *Font) encode(s string) []byte {
+        f.used = true
+        if f.tt == nil {
+                b := make([]byte, 0, len(s))
+                for _, r := range s {
+                        b = append(b, winAnsi(r))
+                }
+                return b
+        }
+        // Identity-H: two-byte glyph IDs.
+        b := make([]byte, 0, 2*len(s))
+        for _, r := range s {
+                gid := f.tt.glyph(r)
+                if _, ok := f.glyphs[gid]; !ok {
+                        f.glyphs[gid] = r
+                }
+                b = append(b, byte(gid>>8), byte(gid))
+        }
+        return b
+}
+
+// finish writes the font's objects, once the text using it is known.
+func (f *Font) finish(u *Update) error {
+        if !f.used {
+                return nil
+        }
+        if f.tt == nil {
+                u.Set(f.ref, Dict{
+                        "Type":     Name("Font"),
+                        "Subtype":  Name("Type1"),
+                        "BaseFont": Name(f.name),
+                        "Encoding": Name("WinAnsiEncoding"),
+                })
+                return nil
+        }
+
+        tt := f.tt
+        gids := make([]uint16, 0, len(f.glyphs))
+        for gid := range f.glyphs {
+                gids = append(gids, gid)
+        }
+        sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+
+        program, err := tt.subset(gids)
+        if err != nil {
+                return err
+        }
+        packed, err := deflate(program)
+        if err != nil {
+                return err
+        }
+        fontFile := u.Add(NewStream(Dict{
+                "Filter":  Name("FlateDecode"),
+                "Length1": len(program),
+        }, packed))
+
+        // Subsets are named with a tag made of six capital letters, derived here
+        // from the glyphs so that the same subset gets the same name.
+        var tag [6]byte
+        h := uint32(2166136261)
+        for _, gid := range gids {
+                h = (h ^ uint32(gid)) * 16777619
+        }
+        for i := range tag {
+                tag[i] = 'A' + byte(h%26)
+                h /= 26
+        }
+        baseFont := Name(string(tag[:]) + "+" + tt.name)
+
+        scale := func(v int) int { return int(math.Round(float64(v) * 1000 / float64(tt.unitsPerEm))) }
+        descriptor := u.Add(Dict{
+                "Type":        Name("FontDescriptor"),
+                "FontName":    baseFont,
+                "Flags":       tt.flags(),
+                "FontBBox":    Array{scale(tt.bbox[0]), scale(tt.bbox[1]), scale(tt.bbox[2]), scale(tt.bbox[3])},
+                "ItalicAngle": tt.italicAngle,
+                "Ascent":      scale(tt.ascent),
+                "Descent":     scale(tt.descent),
+                "CapHeight":   scale(tt.capHeight),
+                "StemV":       80,
+                "FontFile2":   fontFile,
+        })
+
+        var widths Array
+        for _, gid := range gids {
+                widths = append(widths, int(gid), Array{scale(tt.advance(gid))})
+        }
+        descendant := u.Add(Dict{
+                "Type":     Name("Font"),
+                "Subtype":  Name("CIDFontType2"),
+                "BaseFont": baseFont,
+                "CIDSystemInfo": Dict{
+                        "Registry":   String("Adobe"),
+                        "Ordering":   String("Identity"),
+                        "Supplement": 0,
+                },
+                "FontDescriptor": descriptor,
+                "DW":             scale(tt.advance(0)),
+                "W":              widths,
+                "CIDToGIDMap":    Name("Identity"),
+        })
+
+        toUnicode, err := deflate(toUnicodeCMap(f.glyphs, gids))
+        if err != nil {
+                return err
+        }
+        u.Set(f.ref, Dict{
+                "Type":            Name("Font"),
+                "Subtype":         Name("Type0"),
+                "BaseFont":        baseFont,
+                "Encoding":        Name("Identity-H"),
+                "DescendantFonts": Array{descendant},
+                "ToUnicode":       u.Add(NewStream(Dict{"Filter": Name("FlateDecode")}, toUnicode)),
+        })
+        return nil
+}
+
+// toUnicodeCMap maps the glyphs back to characters, for copying and
+// searching text.
+func toUnicodeCMap(glyphs map[uint16]rune, gids []uint16) []byte {
+        var b bytes.Buffer
+        b.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n" +
+                "/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n" +
+                "/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n" +
+                "1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+        var mapped []uint16
+        for _, gid := range gids {
+                if gid != 0 {
+                        mapped = append(mapped, gid)
+                }
+        }
+        for len(mapped) > 0 {
+                n := min(len(mapped), 100)
+                fmt.Fprintf(&b, "%d beginbfchar\n", n)
+                for _, gid := range mapped[:n] {
+                        fmt.Fprintf(&b, "<%04X> <", gid)
+                        for _, u := range utf16.Encode([]rune{glyphs[gid]}) {
+                                fmt.Fprintf(&b, "%04X", u)
+                        }
+                        b.WriteString(">\n")
+                }
+                b.WriteString("endbfchar\n")
+                mapped = mapped[n:]
+        }
+        b.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend\n")
+        return b.Bytes()
+}
+
+// winAnsi returns the WinAnsiEncoding code of r, or '?'.
+func winAnsi(r rune) byte {
+        switch {
+        case r >= 0x20 && r < 0x7f, r >= 0xa0 && r <= 0xff:
+                return byte(r)
+        }
+        for c, w := range winAnsiHigh {
+                if w != 0 && w == r {
+                        return byte(0x80 + c)
+                }
+        }
+        return '?'
+}
+
+// winAnsiHigh is WinAnsiEncoding from 0x80 to 0x9f, where it differs from
+// Latin-1; zero marks unused codes.
+var winAnsiHigh = [32]rune{
+        '€', 0, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0, 'Ž', 0,
+        0, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0, 'ž', 'Ÿ',
+}
@@ -0,0 +1,101 @@
+package pdfdoc
+
+import (
+        "bytes"
+        "errors"
+        "fmt"
+        "image"
+        "image/color"
+        _ "image/gif"  // register the GIF decoder
+        _ "image/jpeg" // register the JPEG decoder
+        _ "image/png"  // register the PNG decoder
+)
+
+// ----------------------------------------------------------------------------------
+// Images
+// ----------------------------------------------------------------------------------
+
+// maxImagePixels bounds the images AddImage decodes, to keep a small but
+// huge-dimensioned PNG from taking gigabytes of memory.
+const maxImagePixels = 40_000_000
+
+// Image is an image added by an Update, for drawing on overlays.
+type Image struct {
+        ref Ref
+
+        // Width and Height are the size in pixels.
+        Width, Height int
+}
+
+// AddImage adds a JPEG, PNG or GIF image. JPEG data is embedded as it is, so
+// there is no loss of quality; other formats are stored losslessly, with
+// any transparency kept as a soft mask.
+func (u *Update) AddImage(data []byte) (*Image, error) {
+        cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+        if err != nil {
+                return nil, fmt.Errorf("pdfdoc: unsupported image: %w", err)
+        }
+        if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxImagePixels {
+                return nil, errors.New("pdfdoc: image dimensions out of range")
+        }
+        img := &Image{Width: cfg.Width, Height: cfg.Height}
+        dict := Dict{
+                "Type":             Name("XObject"),
+                "Subtype":          Name("Image"),
+                "Width":            cfg.Width,
+                "Height":           cfg.Height,
+                "BitsPerComponent": 8,
+        }
+
+        // Viewers decode JPEG themselves, except that CMYK JPEGs from Adobe
+        // applications are stored inverted; those are converted.
+        if format == "jpeg" && cfg.ColorModel != color.CMYKModel {
+                dict["ColorSpace"] = Name("DeviceRGB")
+                if cfg.ColorModel == color.GrayModel {
+                        dict["ColorSpace"] = Name("DeviceGray")
+                }
+                dict["Filter"] = Name("DCTDecode")
+                img.ref = u.Add(NewStream(dict, data))
+                return img, nil
+        }
+
+        decoded, _, err := image.Decode(bytes.NewReader(data))
+        if err != nil {
+                return nil, fmt.Errorf("pdfdoc: unsupported image: %w", err)
+        }
+        b := decoded.Bounds()
+        rgb := make([]byte, 0, 3*b.Dx()*b.Dy())
+        alpha := make([]byte, 0, b.Dx()*b.Dy())
+        opaque := true
+        for y := b.Min.Y; y < b.Max.Y; y++ {
+                for x := b.Min.X; x < b.Max.X; x++ {
+                        c := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+                        rgb = append(rgb, c.R, c.G, c.B)
+                        alpha = append(alpha, c.A)
+                        opaque = opaque && c.A == 0xff
+                }
+        }
+        if !opaque {
+                mask, err := deflate(alpha)
+                if err != nil {
+                        return nil, err
+                }
+                dict["SMask"] = u.Add(NewStream(Dict{
+                        "Type":             Name("XObject"),
+                        "Subtype":          Name("Image"),
+                        "Width":            cfg.Width,
+                        "Height":           cfg.Height,
+                        "BitsPerComponent": 8,
+                        "ColorSpace":       Name("DeviceGray"),
+                        "Filter":           Name("FlateDecode"),
+                }, mask))
+        }
+        pixels, err := deflate(rgb)
+        if err != nil {
+                return nil, err
+        }
+        dict["ColorSpace"] = Name("DeviceRGB")
+        dict["Filter"] = Name("FlateDecode")
+        img.ref = u.Add(NewStream(dict, pixels))
+        return img, nil
+}
@@ -0,0 +1,400 @@
+package pdfdoc
+
+import (
+        "bytes"
+        "errors"
+        "io"
+        "strconv"
+)
+
+// keyword is a bare token: a delimiter such as "[" or "<<", or a word such
+// as obj, stream, R or xref.
+type keyword string
+
+// maxNesting bounds how deeply arrays and dictionaries may nest.
+const maxNesting = 256
+
+var errNesting = errors.New("pdfdoc: objects nested too deeply")
+
+// lexer tokenizes PDF syntax read from an io.ReaderAt, starting at an
+// arbitrary offset.
+type lexer struct {
+        r      io.ReaderAt
+        buf    []byte
+        bufOff int64 // file offset of buf[0]
+        i      int   // next byte in buf
+        eof    bool
+        err    error // first structural error
+        back   []any // pushed-back tokens, last one first
+}
+
+const lexChunk = 16 << 10
+
+func newLexer(r io.ReaderAt, off int64) *lexer {
+        return &lexer{r: r, bufOff: off}
+}
+
+func newBytesLexer(b []byte) *lexer {
+        return &lexer{r: bytes.NewReader(b)}
+}
+
+// pos is the file offset of the next unread byte, ignoring pushed-back
+// tokens.
+func (l *lexer) pos() int64 { return l.bufOff + int64(l.i) }
+
+func (l *lexer) fill() bool {
+        if l.eof {
+                return false
+        }
+        l.bufOff += int64(len(l.buf))
+        if cap(l.buf) < lexChunk {
+                l.buf = make([]byte, lexChunk)
+        }
+        n, _ := l.r.ReadAt(l.buf[:lexChunk], l.bufOff)
+        l.buf, l.i = l.buf[:n], 0
+        if n == 0 {
+                l.eof = true
+                return false
+        }
+        return true
+}
+
+func (l *lexer) readByte() (byte, bool) {
+        if l.i >= len(l.buf) && !l.fill() {
+                return 0, false
+        }
+        c := l.buf[l.i]
+        l.i++
+        return c, true
+}
+
+// unreadByte steps back over the byte just read.
+func (l *lexer) unreadByte() { l.i-- }
+
+func isSpace(c byte) bool {
+        switch c {
+        case 0, '\t', '\n', '\f', '\r', ' ':
+                return true
+        }
+        return false
+}
+
+func isDelim(c byte) bool {
+        switch c {
+        case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+                return true
+        }
+        return false
+}
+
+func unhex(c byte) (byte, bool) {
+        switch {
+        case c >= '0' && c <= '9':
+                return c - '0', true
+        case c >= 'a' && c <= 'f':
+                return c - 'a' + 10, true
+        case c >= 'A' && c <= 'F':
+                return c - 'A' + 10, true
+        }
+        return 0, false
+}
+
+// skipSpace skips whitespace and comments and reports whether any input is
+// left.
+func (l *lexer) skipSpace() bool {
+        for {
+                c, ok := l.readByte()
+                if !ok {
+                        return false
+                }
+                if c == '%' {
+                        for ok && c != '\r' && c != '\n' {
+                                c, ok = l.readByte()
+                        }
+                        continue
+                }
+                if !isSpace(c) {
+                        l.unreadByte()
+                        return true
+                }
+        }
+}
+
+// pushBack returns a token to be read again by next.
+func (l *lexer) pushBack(tok any) { l.back = append(l.back, tok) }
+
+// next returns the next token: a keyword, Name, String, int64 or float64, or
+// nil at the end of the input.
+func (l *lexer) next() any {
+        if n := len(l.back); n > 0 {
+                tok := l.back[n-1]
+                l.back = l.back[:n-1]
+                return tok
+        }
+        if !l.skipSpace() {
+                return nil
+        }
+        c, _ := l.readByte()
+        switch c {
+        case '[', ']', '{', '}', ')':
+                return keyword(c)
+        case '<':
+                if c, ok := l.readByte(); ok && c == '<' {
+                        return keyword("<<")
+                } else if ok {
+                        l.unreadByte()
+                }
+                return l.readHexString()
+        case '>':
+                if c, ok := l.readByte(); ok && c == '>' {
+                        return keyword(">>")
+                } else if ok {
+                        l.unreadByte()
+                }
+                return keyword(">")
+        case '/':
+                return l.readName()
+        case '(':
+                return l.readLiteralString()
+        }
+        l.unreadByte()
+        word := l.readRegular()
+        if n, err := strconv.ParseInt(word, 10, 64); err == nil {
+                return n
+        }
+        if isNumeric(word) {
+                if f, err := strconv.ParseFloat(word, 64); err == nil {
+                        return f
+                }
+        }
+        return keyword(word)
+}
+
+func isNumeric(s string) bool {
+        if s == "" {
+                return false
+        }
+        for i := 0; i < len(s); i++ {
+                c := s[i]
+                if !(c >= '0' && c <= '9' || c == '.' || c == '-' || c == '+') {
+                        return false
+                }
+        }
+        return true
+}
+
+// readRegular reads a run of regular characters.
+func (l *lexer) readRegular() string {
+        var b []byte
+        for {
+                c, ok := l.readByte()
+                if !ok {
+                        break
+                }
+                if isSpace(c) || isDelim(c) {
+                        l.unreadByte()
+                        break
+                }
+                b = append(b, c)
+        }
+        return string(b)
+}
+
+func (l *lexer) readName() Name {
+        var b []byte
+        for {
+                c, ok := l.readByte()
+                if !ok {
+                        break
+                }
+                if isSpace(c) || isDelim(c) {
+                        l.unreadByte()
+                        break
+                }
+                if c == '#' {
+                        // #xx is an escape; anything else is kept as it is.
+                        h, ok := l.readByte()
+                        x, isHex := unhex(h)
+                        if !ok || !isHex {
+                                if ok {
+                                        l.unreadByte()
+                                }
+                                b = append(b, c)
+                                continue
+                        }
+                        lo, ok := l.readByte()
+                        y, isHex := unhex(lo)
+                        if !ok || !isHex {
+                                if ok {
+                                        l.unreadByte()
+                                }
+                                b = append(b, c, h)
+                                continue
+                        }
+                        c = x<<4 | y
+                }
+                b = append(b, c)
+        }
+        return Name(b)
+}
+
+func (l *lexer) readHexString() String {
+        var b []byte
+        var hi byte
+        half := false
+        for {
+                c, ok := l.readByte()
+                if !ok || c == '>' {
+                        break
+                }
+                v, ok := unhex(c)
+                if !ok {
+                        continue
+                }
+                if half {
+                        b = append(b, hi<<4|v)
+                } else {
+                        hi = v
+                }
+                half = !half
+        }
+        if half {
+                b = append(b, hi<<4)
+        }
+        return String(b)
+}
+
+func (l *lexer) readLiteralString() String {
+        var b []byte
+        depth := 1
+        for {
+                c, ok := l.readByte()
+                if !ok {
+                        return String(b)
+                }
+                switch c {
+                case '(':
+                        depth++
+                case ')':
+                        if depth--; depth == 0 {
+                                return String(b)
+                        }
+                case '\r':
+                        // An unescaped end of line is a single \n whatever its form.
+                        if c, ok := l.readByte(); ok && c != '\n' {
+                                l.unreadByte()
+                        }
+                        c = '\n'
+                case '\\':
+                        c, ok = l.readByte()
+                        if !ok {
+                                return String(b)
+                        }
+                        switch c {
+                        case 'n':
+                                c = '\n'
+                        case 'r':
+                                c = '\r'
+                        case 't':
+                                c = '\t'
+                        case 'b':
+                                c = '\b'
+                        case 'f':
+                                c = '\f'
+                        case '\r':
+                                if c, ok := l.readByte(); ok && c != '\n' {
+                                        l.unreadByte()
+                                }
+                                continue
+                        case '\n':
+                                continue
+                        case '0', '1', '2', '3', '4', '5', '6', '7':
+                                v := int(c - '0')
+                                for i := 0; i < 2; i++ {
+                                        d, ok := l.readByte()
+                                        if !ok {
+                                                break
+                                        }
+                                        if d < '0' || d > '7' {
+                                                l.unreadByte()
+                                                break
+                                        }
+                                        v = v*8 + int(d-'0')
+                                }
+                                c = byte(v)
+                        }
+                }
+                b = append(b, c)
+        }
+}
+
+// readObject parses one object. A keyword that doesn't start an object is
+// returned as is, so callers can recognize "]", ">>", endobj and the like.
+func (l *lexer) readObject() Object {
+        return l.readNested(0)
+}
+
+func (l *lexer) readNested(depth int) Object {
+        if depth > maxNesting {
+                if l.err == nil {
+                        l.err = errNesting
+                }
+                return nil
+        }
+        tok := l.next()
+        switch t := tok.(type) {
+        case keyword:
+                switch t {
+                case "null":
+                        return nil
+                case "true":
+                        return true
+                case "false":
+                        return false
+                case "[":
+                        var a Array
+                        for {
+                                tok := l.next()
+                                if tok == nil || tok == keyword("]") || l.err != nil {
+                                        return a
+                                }
+                                l.pushBack(tok)
+                                a = append(a, l.readNested(depth+1))
+                        }
+                case "<<":
+                        d := make(Dict)
+                        for {
+                                tok := l.next()
+                                if tok == nil || tok == keyword(">>") || l.err != nil {
+                                        return d
+                                }
+                                key, ok := tok.(Name)
+                                if !ok {
+                                        // Junk where a key belongs; skip it.
+                                        continue
+                                }
+                                val := l.next()
+                                if val == nil || val == keyword(">>") {
+                                        d[key] = nil
+                                        return d
+                                }
+                                l.pushBack(val)
+                                d[key] = l.readNested(depth + 1)
+                        }
+                }
+                return t
+        case int64:
+                // An integer may start a reference: num gen R.
+                gen := l.next()
+                if g, ok := gen.(int64); ok {
+                        r := l.next()
+                        if r == keyword("R") {
+                                return Ref{Num: int(t), Gen: int(g)}
+                        }
+                        l.pushBack(r)
+                }
+                l.pushBack(gen)
+                return t
+        }
+        return tok
+}
@@ -0,0 +1,85 @@
+package pdfdoc
+
+import "fmt"
+
+// Objects are represented by plain Go values:
+//
+//	null        nil
+//	boolean     bool
+//	integer     int64
+//	real        float64
+//	name        Name
+//	string      String
+//	array       Array
+//	dictionary  Dict
+//	stream      *Stream
+//	reference   Ref
+type Object any
+
+// Name is a PDF name without its leading slash.
+type Name string
+
+// String holds the bytes of a literal or hexadecimal string, decrypted. Use
+// Text for strings meant to be displayed.
+type String string
+
+type Array []Object
+
+type Dict map[Name]Object
+
+// Ref is an indirect reference.
+type Ref struct {
+        Num, Gen int
+}
+
+func (r Ref) String() string { return fmt.Sprintf("%d %d R", r.Num, r.Gen) }
+
+// Stream is a stream object. Its data is read, decrypted and decoded on
+// demand by Document.StreamData.
+type Stream struct {
+        Dict Dict
+
+        ref    Ref   // the object holding the stream, for decryption
+        off    int64 // offset of the raw data in the file
+        length int64 // length of the raw data
+
+        // mem is set for streams made by NewStream, whose (unencrypted) data
+        // is held in data rather than read from the file.
+        mem  bool
+        data []byte
+}
+
+// NewStream makes a stream to be written by an Update. data is encoded as
+// dict's /Filter says; /Length is set when the stream is written.
+func NewStream(dict Dict, data []byte) *Stream {
+        if dict == nil {
+                dict = make(Dict)
+        }
+        return &Stream{Dict: dict, mem: true, data: data}
+}
+
+// Type returns the dictionary's /Type, if any.
+func (d Dict) Type() Name {
+        n, _ := d["Type"].(Name)
+        return n
+}
+
+func asInt(o Object) (int64, bool) {
+        switch v := o.(type) {
+        case int64:
+                return v, true
+        case float64:
+                return int64(v), true
+        }
+        return 0, false
+}
+
+func asNumber(o Object) (float64, bool) {
+        switch v := o.(type) {
+        case int64:
+                return float64(v), true
+        case float64:
+                return v, true
+        }
+        return 0, false
+}
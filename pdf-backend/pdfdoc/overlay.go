@@ -0,0 +1,361 @@
+package pdfdoc
+
+import (
+        "bytes"
+        "fmt"
+        "image/color"
+        "strings"
+)
+
+// ----------------------------------------------------------------------------------
+// Overlays
+// ----------------------------------------------------------------------------------
+
+// Point is a position on an overlay.
+type Point struct {
+        X, Y float64
+}
+
+// Paint says how a closed shape is drawn.
+type Paint int
+
+const (
+        Stroke Paint = iota
+        Fill
+        FillStroke
+)
+
+// Overlay draws vector content on top of a page. Coordinates are in points
+// from the top-left corner of the page as displayed, its CropBox turned by
+// /Rotate, with y growing downwards: the way a rendering of the page shows
+// it. The drawing is appended to the page as a content stream of its own;
+// the page's existing content is left as it is.
+type Overlay struct {
+        canvas
+        u    *Update
+        page Page
+}
+
+// canvas is a drawing in the coordinates of overlays, with the resources it
+// uses: the content of an overlay or of an annotation's appearance.
+type canvas struct {
+        w, h    float64
+        content bytes.Buffer
+        // resources maps a resource category (Font, XObject, ExtGState) to the
+        // entries the drawing adds to it.
+        resources map[Name]Dict
+        // names are the resource names of the fonts, images and graphics
+        // states in use.
+        names map[any]Name
+        // taken returns the existing resources of a category, whose names
+        // must not be reused; nil if there are none.
+        taken func(category Name) Dict
+}
+
+func newCanvas(page Page) canvas {
+        c := canvas{
+                resources: make(map[Name]Dict),
+                names:     make(map[any]Name),
+        }
+        c.w, c.h = page.Size()
+        return c
+}
+
+// Overlay returns the overlay of page n (counting from 1), creating it on
+// first use.
+func (u *Update) Overlay(n int) (*Overlay, error) {
+        for _, o := range u.overlays {
+                if o.page.Number == n {
+                        return o, nil
+                }
+        }
+        if _, err := u.PageDict(n); err != nil {
+                return nil, err
+        }
+        page, _ := u.d.Page(n)
+        o := &Overlay{canvas: newCanvas(page), u: u, page: page}
+        o.taken = func(category Name) Dict { return u.d.getDict(page.Resources[category]) }
+        u.overlays = append(u.overlays, o)
+        return o, nil
+}
+
+// Size returns the width and height of the page as displayed.
+func (o *Overlay) Size() (w, h float64) { return o.w, o.h }
+
+// op writes an operator with its operands: numbers, names, or operators
+// given as strings.
+func (c *canvas) op(args ...any) {
+        for i, a := range args {
+                if i > 0 {
+                        c.content.WriteByte(' ')
+                }
+                switch a := a.(type) {
+                case float64:
+                        c.content.WriteString(formatNumber(a))
+                case Name:
+                        writeName(&c.content, a)
+                case string:
+                        c.content.WriteString(a)
+                }
+        }
+        c.content.WriteByte('\n')
+}
+
+// y converts a y coordinate from the top of the page to PDF's, upwards from
+// the bottom.
+func (c *canvas) y(y float64) float64 { return c.h - y }
+
+func colorComponents(c color.Color) (r, g, b float64) {
+        n := color.NRGBAModel.Convert(c).(color.NRGBA)
+        return float64(n.R) / 255, float64(n.G) / 255, float64(n.B) / 255
+}
+
+// SetFillColor sets the color of text and filled shapes. Its alpha is
+// ignored; see SetTransparency.
+func (c *canvas) SetFillColor(col color.Color) {
+        r, g, b := colorComponents(col)
+        c.op(r, g, b, "rg")
+}
+
+// SetStrokeColor sets the color of lines and outlines.
+func (c *canvas) SetStrokeColor(col color.Color) {
+        r, g, b := colorComponents(col)
+        c.op(r, g, b, "RG")
+}
+
+// SetLineWidth sets the width of lines, in points.
+func (c *canvas) SetLineWidth(w float64) {
+        c.op(w, "w")
+}
+
+// SetTransparency sets the opacity, 0 to 1, and the blend mode (Normal,
+// Multiply...) of everything drawn next. Multiply makes highlighter strokes
+// that darken, not cover, the text under them.
+func (c *canvas) SetTransparency(opacity float64, blend Name) {
+        type state struct {
+                opacity float64
+                blend   Name
+        }
+        key := state{min(max(opacity, 0), 1), blend}
+        name, ok := c.names[key]
+        if !ok {
+                name = c.addResource("ExtGState", "GS", Dict{
+                        "Type": Name("ExtGState"),
+                        "CA":   key.opacity,
+                        "ca":   key.opacity,
+                        "BM":   key.blend,
+                })
+                c.names[key] = name
+        }
+        c.op(name, "gs")
+}
+
+// addResource adds an entry to the page's resources under a name the page
+// doesn't use yet.
+func (c *canvas) addResource(category Name, prefix string, v Object) Name {
+        var existing Dict
+        if c.taken != nil {
+                existing = c.taken(category)
+        }
+        entries := c.resources[category]
+        if entries == nil {
+                entries = make(Dict)
+                c.resources[category] = entries
+        }
+        for i := len(entries) + 1; ; i++ {
+                name := Name(fmt.Sprintf("Ov%s%d", prefix, i))
+                _, taken := existing[name]
+                if _, ours := entries[name]; !taken && !ours {
+                        entries[name] = v
+                        return name
+                }
+        }
+}
+
+// Polyline strokes a line through the points.
+func (c *canvas) Polyline(pts []Point) {
+        if len(pts) < 2 {
+                return
+        }
+        c.path(pts)
+        c.op("S")
+}
+
+// Polygon draws the closed shape with the points as corners.
+func (c *canvas) Polygon(pts []Point, paint Paint) {
+        if len(pts) < 3 {
+                return
+        }
+        c.path(pts)
+        c.op("h")
+        c.paint(paint)
+}
+
+func (c *canvas) path(pts []Point) {
+        for i, p := range pts {
+                op := "l"
+                if i == 0 {
+                        op = "m"
+                }
+                c.op(p.X, c.y(p.Y), op)
+        }
+}
+
+// Rect draws the rectangle with top-left corner x, y.
+func (c *canvas) Rect(x, y, w, h float64, paint Paint) {
+        c.op(x, c.y(y+h), w, h, "re")
+        c.paint(paint)
+}
+
+// Ellipse draws the ellipse inscribed in the rectangle with top-left corner
+// x, y.
+func (c *canvas) Ellipse(x, y, w, h float64, paint Paint) {
+        // Four Bézier arcs; k places the control points.
+        const k = 0.5522847498
+        rx, ry := w/2, h/2
+        cx, cy := x+rx, c.y(y+ry)
+        c.op(cx+rx, cy, "m")
+        c.op(cx+rx, cy+k*ry, cx+k*rx, cy+ry, cx, cy+ry, "c")
+        c.op(cx-k*rx, cy+ry, cx-rx, cy+k*ry, cx-rx, cy, "c")
+        c.op(cx-rx, cy-k*ry, cx-k*rx, cy-ry, cx, cy-ry, "c")
+        c.op(cx+k*rx, cy-ry, cx+rx, cy-k*ry, cx+rx, cy, "c")
+        c.op("h")
+        c.paint(paint)
+}
+
+func (c *canvas) paint(p Paint) {
+        switch p {
+        case Fill:
+                c.op("f")
+        case FillStroke:
+                c.op("B")
+        default:
+                c.op("S")
+        }
+}
+
+// Text sets s in font f at size points, starting on the baseline at x, y,
+// in the fill color. Each line of a multi-line s goes 1.2 sizes below the
+// previous one.
+func (c *canvas) Text(f *Font, size, x, y float64, s string) {
+        name, ok := c.names[f]
+        if !ok {
+                name = c.addResource("Font", "F", f.ref)
+                c.names[f] = name
+        }
+        c.op("BT")
+        c.op(name, size, "Tf")
+        c.op(1.2*size, "TL")
+        c.op(x, c.y(y), "Td")
+        for i, line := range strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n") {
+                if i > 0 {
+                        c.op("T*")
+                }
+                writeString(&c.content, f.encode(line))
+                c.content.WriteString(" Tj\n")
+        }
+        c.op("ET")
+}
+
+// Image draws img scaled to the rectangle with top-left corner x, y.
+func (c *canvas) Image(img *Image, x, y, w, h float64) {
+        name, ok := c.names[img]
+        if !ok {
+                name = c.addResource("XObject", "Im", img.ref)
+                c.names[img] = name
+        }
+        c.op("q")
+        c.op(w, 0.0, 0.0, h, x, c.y(y+h), "cm")
+        c.op(name, "Do")
+        c.op("Q")
+}
+
+// displayMatrix is the matrix from the coordinates of overlays (with y
+// upwards) to the default user space of page p.
+func displayMatrix(p Page) [6]float64 {
+        c := p.CropBox
+        switch p.Rotate {
+        case 90:
+                return [6]float64{0, 1, -1, 0, c.URX, c.LLY}
+        case 180:
+                return [6]float64{-1, 0, 0, -1, c.URX, c.URY}
+        case 270:
+                return [6]float64{0, -1, 1, 0, c.LLX, c.URY}
+        }
+        return [6]float64{1, 0, 0, 1, c.LLX, c.LLY}
+}
+
+// attach adds the overlay's content stream and resources to its page. The
+// page's own content is bracketed with q/Q first, so whatever graphics state
+// it leaves behind doesn't affect the overlay.
+func (o *Overlay) attach() error {
+        if o.content.Len() == 0 {
+                return nil
+        }
+        u := o.u
+        page, err := u.PageDict(o.page.Number)
+        if err != nil {
+                return err
+        }
+
+        page["Resources"] = o.resourceDict(u.d, o.page.Resources)
+
+        var contents Array
+        switch c := page["Contents"].(type) {
+        case Ref:
+                if a, ok := u.d.get(c).(Array); ok {
+                        contents = a
+                } else {
+                        contents = Array{c}
+                }
+        case Array:
+                contents = c
+        }
+
+        data := append([]byte("Q\n"), o.contentStream(displayMatrix(o.page))...)
+        stream, err := deflate(data)
+        if err != nil {
+                return err
+        }
+        ref := u.Add(NewStream(Dict{"Filter": Name("FlateDecode")}, stream))
+
+        if u.saveState == (Ref{}) {
+                u.saveState = u.Add(NewStream(nil, []byte("q\n")))
+        }
+        page["Contents"] = append(append(Array{u.saveState}, contents...), ref)
+        return nil
+}
+
+// contentStream returns the drawing as a content stream, with m mapping its
+// coordinates to user space.
+func (c *canvas) contentStream(m [6]float64) []byte {
+        var b bytes.Buffer
+        b.WriteString("q\n")
+        for _, v := range m {
+                b.WriteString(formatNumber(v))
+                b.WriteByte(' ')
+        }
+        b.WriteString("cm\n1 J 1 j\n")
+        b.Write(c.content.Bytes())
+        b.WriteString("Q\n")
+        return b.Bytes()
+}
+
+// resourceDict returns the resources base with the drawing's added.
+func (c *canvas) resourceDict(d *Document, base Dict) Dict {
+        res := make(Dict, len(base)+len(c.resources))
+        for k, v := range base {
+                res[k] = v
+        }
+        for category, entries := range c.resources {
+                merged := make(Dict)
+                for k, v := range d.getDict(res[category]) {
+                        merged[k] = v
+                }
+                for k, v := range entries {
+                        merged[k] = v
+                }
+                res[category] = merged
+        }
+        return res
+}
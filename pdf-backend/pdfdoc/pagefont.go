@@ -0,0 +1,451 @@
+package pdfdoc
+
+import (
+        "strconv"
+        "strings"
+        "unicode/utf16"
+)
+
+// ----------------------------------------------------------------------------------
+// Fonts of pages
+// ----------------------------------------------------------------------------------
+
+// pageFont is what redaction needs to know of a font used by page content:
+// how its strings split into character codes, how wide each glyph is and
+// which text it stands for.
+type pageFont struct {
+        // ranges are the code space of a composite font; nil means one byte
+        // per code.
+        ranges []codespaceRange
+        // cids maps codes to CIDs, for composite fonts whose encoding isn't
+        // Identity.
+        cids map[uint32]uint32
+
+        // widths are the glyph widths, in text space units (1/1000 of them
+        // in the font's W or Widths array), by code for simple fonts and by
+        // CID for composite ones.
+        widths       map[uint32]float64
+        defaultWidth float64
+        // exact is set when the widths are the ones viewers use. Otherwise
+        // (standard fonts without metrics, unknown encodings) they are only
+        // estimated, and redaction errs on the side of removing more.
+        exact bool
+
+        ascent, descent float64 // in text space units
+        vertical        bool
+
+        toUnicode map[string]string
+        // names maps codes of a simple font to text, from its encoding.
+        names map[byte]string
+}
+
+type codespaceRange struct {
+        n      int // bytes
+        lo, hi uint32
+}
+
+// maxFontEntries bounds the entries read from W arrays and CMaps.
+const maxFontEntries = 1 << 20
+
+// estimatedWidth is the width assumed for glyphs whose metrics aren't
+// known, and maxGlyphWidth the most they are taken to be.
+const (
+        estimatedWidth = 0.5
+        maxGlyphWidth  = 1.2
+)
+
+// loadFont reads the font dictionary font.
+func (d *Document) loadFont(font Dict) *pageFont {
+        f := &pageFont{widths: make(map[uint32]float64), ascent: 1, descent: -0.3}
+        subtype, _ := d.get(font["Subtype"]).(Name)
+        descriptorOf := font
+        scale := 0.001
+
+        if subtype == "Type0" {
+                descendants, _ := d.get(font["DescendantFonts"]).(Array)
+                var cid Dict
+                if len(descendants) > 0 {
+                        cid = d.getDict(descendants[0])
+                }
+                descriptorOf = cid
+                f.defaultWidth = 1
+                if dw, ok := asNumber(d.get(cid["DW"])); ok {
+                        f.defaultWidth = dw * scale
+                }
+                f.readW(d, cid["W"])
+                f.exact = true
+                switch enc := d.get(font["Encoding"]).(type) {
+                case Name:
+                        switch enc {
+                        case "Identity-H", "Identity-V":
+                                f.ranges = []codespaceRange{{2, 0, 0xffff}}
+                                f.vertical = enc == "Identity-V"
+                        default:
+                                // A predefined CMap: its code lengths are unknown, so each
+                                // byte is taken as a code, which overestimates the extent
+                                // of strings.
+                                f.ranges = []codespaceRange{{1, 0, 0xff}}
+                                f.exact = false
+                                f.vertical = strings.HasSuffix(string(enc), "-V")
+                        }
+                case *Stream:
+                        data, err := d.StreamData(enc)
+                        if err == nil {
+                                f.ranges, f.cids = parseCMap(data)
+                        }
+                        if wmode, ok := asInt(d.get(enc.Dict["WMode"])); ok && wmode == 1 {
+                                f.vertical = true
+                        }
+                        if len(f.ranges) == 0 {
+                                f.ranges = []codespaceRange{{1, 0, 0xff}}
+                                f.exact = false
+                        }
+                default:
+                        f.ranges = []codespaceRange{{2, 0, 0xffff}}
+                }
+        } else {
+                if subtype == "Type3" {
+                        if m, ok := d.get(font["FontMatrix"]).(Array); ok && len(m) == 6 {
+                                scale, _ = asNumber(d.get(m[0]))
+                                if yScale, ok := asNumber(d.get(m[3])); ok {
+                                        if bbox := d.numbers(font["FontBBox"]); len(bbox) == 4 && bbox[3] > bbox[1] {
+                                                f.ascent, f.descent = max(bbox[1], bbox[3])*yScale, min(bbox[1], bbox[3])*yScale
+                                        }
+                                }
+                        }
+                }
+                first, _ := asInt(d.get(font["FirstChar"]))
+                widths := d.numbers(font["Widths"])
+                for i, w := range widths {
+                        if code := first + int64(i); code >= 0 && code < 256 {
+                                f.widths[uint32(code)] = w * scale
+                        }
+                }
+                f.exact = len(widths) > 0
+                if !f.exact {
+                        base, _ := d.get(font["BaseFont"]).(Name)
+                        if strings.HasPrefix(string(base), "Courier") {
+                                // The one standard font whose metrics are simple.
+                                f.defaultWidth, f.exact = 0.6, true
+                        }
+                }
+                f.names = d.encodingNames(font)
+        }
+
+        if fd := d.getDict(descriptorOf["FontDescriptor"]); fd != nil {
+                if mw, ok := asNumber(d.get(fd["MissingWidth"])); ok && len(f.widths) > 0 {
+                        f.defaultWidth = mw * scale
+                }
+                if subtype != "Type3" {
+                        if a, ok := asNumber(d.get(fd["Ascent"])); ok && a*0.001 > 0.5 && a*0.001 < 2 {
+                                f.ascent = a * 0.001
+                        }
+                        if de, ok := asNumber(d.get(fd["Descent"])); ok && de*0.001 < 0 && de*0.001 > -1 {
+                                f.descent = de * 0.001
+                        }
+                }
+        }
+
+        if s, ok := d.get(font["ToUnicode"]).(*Stream); ok {
+                if data, err := d.StreamData(s); err == nil {
+                        f.toUnicode = parseToUnicode(data)
+                }
+        }
+        return f
+}
+
+// readW reads the W array of a CIDFont: c [w1 w2 ...] or cfirst clast w.
+func (f *pageFont) readW(d *Document, o Object) {
+        w, _ := d.get(o).(Array)
+        for i := 0; i < len(w) && len(f.widths) < maxFontEntries; {
+                first, ok := asInt(d.get(w[i]))
+                if !ok || i+1 >= len(w) {
+                        return
+                }
+                if list, ok := d.get(w[i+1]).(Array); ok {
+                        for j, v := range list {
+                                if n, ok := asNumber(d.get(v)); ok {
+                                        f.widths[uint32(first)+uint32(j)] = n * 0.001
+                                }
+                        }
+                        i += 2
+                        continue
+                }
+                last, _ := asInt(d.get(w[i+1]))
+                if i+2 >= len(w) {
+                        return
+                }
+                n, _ := asNumber(d.get(w[i+2]))
+                for c := first; c <= last && c-first < maxFontEntries && len(f.widths) < maxFontEntries; c++ {
+                        f.widths[uint32(c)] = n * 0.001
+                }
+                i += 3
+        }
+}
+
+// codes splits a string into character codes.
+func (f *pageFont) codes(s []byte) []string {
+        codes := make([]string, 0, len(s))
+        for i := 0; i < len(s); {
+                n := f.codeLen(s[i:])
+                codes = append(codes, string(s[i:i+n]))
+                i += n
+        }
+        return codes
+}
+
+func (f *pageFont) codeLen(s []byte) int {
+        if f.ranges == nil {
+                return 1
+        }
+        shortest := 4
+        for _, r := range f.ranges {
+                shortest = min(shortest, r.n)
+                if r.n > len(s) {
+                        continue
+                }
+                if v := codeValue(string(s[:r.n])); v >= r.lo && v <= r.hi {
+                        return r.n
+                }
+        }
+        return min(shortest, len(s))
+}
+
+func codeValue(code string) uint32 {
+        var v uint32
+        for i := 0; i < len(code); i++ {
+                v = v<<8 | uint32(code[i])
+        }
+        return v
+}
+
+// width returns the width of the glyph for code, in text space units.
+func (f *pageFont) width(code string) float64 {
+        key := codeValue(code)
+        if f.ranges != nil {
+                if f.cids != nil {
+                        key = f.cids[key]
+                }
+        }
+        if w, ok := f.widths[key]; ok {
+                return w
+        }
+        if !f.exact {
+                return estimatedWidth
+        }
+        return f.defaultWidth
+}
+
+// text returns the text a code stands for, "" if unknown.
+func (f *pageFont) text(code string) string {
+        if s, ok := f.toUnicode[code]; ok {
+                return s
+        }
+        if f.ranges == nil && len(code) == 1 {
+                if s, ok := f.names[code[0]]; ok {
+                        return s
+                }
+        }
+        return ""
+}
+
+// parseCMap reads the code space and the code to CID mappings of an
+// embedded CMap.
+func parseCMap(data []byte) ([]codespaceRange, map[uint32]uint32) {
+        var ranges []codespaceRange
+        cids := make(map[uint32]uint32)
+        l := newBytesLexer(data)
+        for tok := l.next(); tok != nil; tok = l.next() {
+                switch tok {
+                case keyword("begincodespacerange"):
+                        for {
+                                lo, ok1 := l.next().(String)
+                                hi, ok2 := l.next().(String)
+                                if !ok1 || !ok2 || len(lo) != len(hi) || len(lo) == 0 || len(lo) > 4 {
+                                        break
+                                }
+                                ranges = append(ranges, codespaceRange{len(lo), codeValue(string(lo)), codeValue(string(hi))})
+                        }
+                case keyword("begincidrange"):
+                        for len(cids) < maxFontEntries {
+                                lo, ok1 := l.next().(String)
+                                hi, ok2 := l.next().(String)
+                                cid, ok3 := l.next().(int64)
+                                if !ok1 || !ok2 || !ok3 {
+                                        break
+                                }
+                                for c, n := codeValue(string(lo)), uint32(cid); c <= codeValue(string(hi)) && len(cids) < maxFontEntries; c, n = c+1, n+1 {
+                                        cids[c] = n
+                                }
+                        }
+                case keyword("begincidchar"):
+                        for len(cids) < maxFontEntries {
+                                code, ok1 := l.next().(String)
+                                cid, ok2 := l.next().(int64)
+                                if !ok1 || !ok2 {
+                                        break
+                                }
+                                cids[codeValue(string(code))] = uint32(cid)
+                        }
+                }
+        }
+        return ranges, cids
+}
+
+// parseToUnicode reads a ToUnicode CMap: the text of each code.
+func parseToUnicode(data []byte) map[string]string {
+        m := make(map[string]string)
+        utf16be := func(s String) string {
+                u := make([]uint16, 0, len(s)/2)
+                for i := 0; i+1 < len(s); i += 2 {
+                        u = append(u, uint16(s[i])<<8|uint16(s[i+1]))
+                }
+                return string(utf16.Decode(u))
+        }
+        l := newBytesLexer(data)
+        for tok := l.next(); tok != nil && len(m) < maxFontEntries; tok = l.next() {
+                switch tok {
+                case keyword("beginbfchar"):
+                        for len(m) < maxFontEntries {
+                                code, ok1 := l.next().(String)
+                                dst, ok2 := l.next().(String)
+                                if !ok1 || !ok2 {
+                                        break
+                                }
+                                m[string(code)] = utf16be(dst)
+                        }
+                case keyword("beginbfrange"):
+                        for len(m) < maxFontEntries {
+                                lo, ok1 := l.next().(String)
+                                hi, ok2 := l.next().(String)
+                                if !ok1 || !ok2 || len(lo) != len(hi) || len(lo) == 0 || len(lo) > 4 {
+                                        break
+                                }
+                                first, last := codeValue(string(lo)), codeValue(string(hi))
+                                code := func(v uint32) string {
+                                        b := make([]byte, len(lo))
+                                        for i := len(b) - 1; i >= 0; i-- {
+                                                b[i], v = byte(v), v>>8
+                                        }
+                                        return string(b)
+                                }
+                                switch dst := l.readObject().(type) {
+                                case String:
+                                        // Consecutive codes map to consecutive text: the last
+                                        // UTF-16 unit is incremented.
+                                        u := []byte(dst)
+                                        for c := first; c <= last && c-first < 1<<16 && len(u) >= 2; c++ {
+                                                m[code(c)] = utf16be(String(u))
+                                                u = append([]byte(nil), u...)
+                                                n := uint16(u[len(u)-2])<<8 | uint16(u[len(u)-1]) + 1
+                                                u[len(u)-2], u[len(u)-1] = byte(n>>8), byte(n)
+                                        }
+                                case Array:
+                                        for i, o := range dst {
+                                                if s, ok := o.(String); ok && first+uint32(i) <= last {
+                                                        m[code(first+uint32(i))] = utf16be(s)
+                                                }
+                                        }
+                                }
+                        }
+                }
+        }
+        return m
+}
+
+// encodingNames returns the text of the codes of a simple font, from its
+// Encoding: a base encoding and Differences naming glyphs. Codes whose
+// glyph names aren't understood are left out.
+func (d *Document) encodingNames(font Dict) map[byte]string {
+        m := make(map[byte]string)
+        base := Name("StandardEncoding")
+        var diffs Array
+        switch enc := d.get(font["Encoding"]).(type) {
+        case Name:
+                base = enc
+        case Dict:
+                if b, ok := d.get(enc["BaseEncoding"]).(Name); ok {
+                        base = b
+                }
+                diffs, _ = d.get(enc["Differences"]).(Array)
+        }
+        for c := 0x20; c < 0x7f; c++ {
+                m[byte(c)] = string(rune(c))
+        }
+        if base == "WinAnsiEncoding" {
+                for c := 0xa0; c <= 0xff; c++ {
+                        m[byte(c)] = string(rune(c))
+                }
+                for i, r := range winAnsiHigh {
+                        if r != 0 {
+                                m[byte(0x80+i)] = string(r)
+                        }
+                }
+        }
+        code := -1
+        for _, o := range diffs {
+                switch v := d.get(o).(type) {
+                case int64:
+                        code = int(v)
+                case Name:
+                        if code >= 0 && code < 256 {
+                                if s := glyphText(string(v)); s != "" {
+                                        m[byte(code)] = s
+                                } else {
+                                        delete(m, byte(code))
+                                }
+                        }
+                        code++
+                }
+        }
+        return m
+}
+
+// glyphText returns the text of a glyph name: names of one character, the
+// uniXXXX and uXXXX forms, and the common names of Latin text.
+func glyphText(name string) string {
+        name, _, _ = strings.Cut(name, ".")
+        if len(name) == 1 {
+                return name
+        }
+        if s, ok := glyphNames[name]; ok {
+                return s
+        }
+        if hex, ok := strings.CutPrefix(name, "uni"); ok && len(hex) >= 4 && len(hex)%4 == 0 {
+                // One or more UTF-16 units, for ligatures.
+                var u []uint16
+                for ; hex != ""; hex = hex[4:] {
+                        v, err := strconv.ParseUint(hex[:4], 16, 16)
+                        if err != nil {
+                                return ""
+                        }
+                        u = append(u, uint16(v))
+                }
+                return string(utf16.Decode(u))
+        }
+        if hex, ok := strings.CutPrefix(name, "u"); ok && len(hex) >= 4 && len(hex) <= 6 {
+                if v, err := strconv.ParseUint(hex, 16, 32); err == nil && v <= 0x10ffff {
+                        return string(rune(v))
+                }
+        }
+        return ""
+}
+
+var glyphNames = map[string]string{
+        "space": " ", "exclam": "!", "quotedbl": "\"", "numbersign": "#", "dollar": "$",
+        "percent": "%", "ampersand": "&", "quotesingle": "'", "quoteright": "’",
+        "parenleft": "(", "parenright": ")", "asterisk": "*", "plus": "+", "comma": ",",
+        "hyphen": "-", "period": ".", "slash": "/", "zero": "0", "one": "1", "two": "2",
+        "three": "3", "four": "4", "five": "5", "six": "6", "seven": "7", "eight": "8",
+        "nine": "9", "colon": ":", "semicolon": ";", "less": "<", "equal": "=",
+        "greater": ">", "question": "?", "at": "@", "bracketleft": "[", "backslash": "\\",
+        "bracketright": "]", "underscore": "_", "quoteleft": "‘", "grave": "`",
+        "braceleft": "{", "bar": "|", "braceright": "}", "asciitilde": "~",
+        "endash": "–", "emdash": "—", "bullet": "•", "quotedblleft": "“",
+        "quotedblright": "”", "ellipsis": "…", "fi": "fi", "fl": "fl", "ff": "ff",
+        "ffi": "ffi", "ffl": "ffl", "germandbls": "ß", "Euro": "€",
+        "adieresis": "ä", "odieresis": "ö", "udieresis": "ü", "Adieresis": "Ä",
+        "Odieresis": "Ö", "Udieresis": "Ü", "eacute": "é", "egrave": "è", "agrave": "à",
+        "ccedilla": "ç", "aacute": "á", "iacute": "í", "oacute": "ó", "uacute": "ú",
+        "ntilde": "ñ",
+}
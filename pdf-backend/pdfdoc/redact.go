@@ -0,0 +1,1361 @@
+package pdfdoc
+
+import (
+        "bytes"
+        "errors"
+        "fmt"
+        "image"
+        "image/color"
+        "image/draw"
+        "image/jpeg"
+        "math"
+        "regexp"
+        "sort"
+        "strings"
+        "unicode"
+        "unicode/utf8"
+)
+
+// ----------------------------------------------------------------------------------
+// Redaction
+// ----------------------------------------------------------------------------------
+
+// Redaction reports what Redact removed from a page.
+type Redaction struct {
+        Glyphs      int // characters of text
+        Paths       int // painted paths
+        Images      int // images blanked or removed
+        Annotations int
+        // Text is the text removed, in runs of adjacent characters. It lacks
+        // what was set in fonts that don't say which characters their glyphs
+        // are.
+        Text []string
+}
+
+const (
+        // maxFormDepth bounds the nesting of form XObjects redaction follows.
+        maxFormDepth = 12
+        // maxStateDepth bounds the graphics states saved by q.
+        maxStateDepth = 1000
+)
+
+// Redact removes the content of page n (counting from 1) under the areas,
+// given in the coordinates of overlays, and paints them with fill.
+//
+// Text is removed glyph by glyph, and the text around it stays in place.
+// Paths reaching into an area are removed, except that filled rectangles,
+// such as backgrounds and table cells, are cut around it. Images are
+// blanked under the areas, or removed when their encoding can't be
+// rewritten; inline images and annotations reaching into an area are
+// removed. Form XObjects are redacted like the page, in copies, so other
+// pages using them are unaffected.
+//
+// Redaction is only effective if the original content is gone from the
+// file: Redact makes the update a rewrite (see Rewrite), and drops the
+// page's thumbnail and private application data.
+func (u *Update) Redact(n int, areas []Box, fill color.Color) (*Redaction, error) {
+        page, ok := u.d.Page(n)
+        if !ok {
+                return nil, fmt.Errorf("pdfdoc: no page %d", n)
+        }
+        pageDict, err := u.PageDict(n)
+        if err != nil {
+                return nil, err
+        }
+        u.Rewrite()
+
+        s := newPageSpace(page)
+        r := &redactor{u: u, d: u.d, fonts: make(map[Ref]*pageFont), result: &Redaction{}}
+        for _, b := range areas {
+                if !b.empty() {
+                        r.areas = append(r.areas, s.rect(b))
+                }
+        }
+
+        var data []byte
+        switch c := u.d.get(pageDict["Contents"]).(type) {
+        case *Stream:
+                if data, err = u.d.StreamData(c); err != nil {
+                        return nil, err
+                }
+        case Array:
+                for _, o := range c {
+                        stm, ok := u.d.get(o).(*Stream)
+                        if !ok {
+                                continue
+                        }
+                        part, err := u.d.StreamData(stm)
+                        if err != nil {
+                                return nil, err
+                        }
+                        data = append(append(data, part...), '\n')
+                }
+        }
+
+        out, xobjects, open, err := r.content(data, page.Resources, identity, 0)
+        if err != nil {
+                return nil, err
+        }
+        if res := xobjects.resources(page.Resources); res != nil {
+                pageDict["Resources"] = res
+        }
+
+        // Close what the content leaves open, then paint the areas.
+        var b bytes.Buffer
+        b.Write(out)
+        b.WriteString(strings.Repeat("\nQ", open))
+        b.WriteByte('\n')
+        c := newCanvas(page)
+        c.SetFillColor(fill)
+        for _, a := range areas {
+                if !a.empty() {
+                        c.Rect(a.X, a.Y, a.Width, a.Height, Fill)
+                }
+        }
+        b.Write(c.contentStream(displayMatrix(page)))
+        packed, err := deflate(b.Bytes())
+        if err != nil {
+                return nil, err
+        }
+        pageDict["Contents"] = u.Add(NewStream(Dict{"Filter": Name("FlateDecode")}, packed))
+        delete(pageDict, "Thumb")
+        delete(pageDict, "PieceInfo")
+
+        r.redactAnnotations(pageDict)
+        r.flushText()
+        return r.result, nil
+}
+
+type redactor struct {
+        u      *Update
+        d      *Document
+        areas  []Rect // in default user space
+        fonts  map[Ref]*pageFont
+        result *Redaction
+
+        run   strings.Builder // the text being removed
+        names int             // for naming new XObjects
+}
+
+// hits reports whether b reaches into an area.
+func (r *redactor) hits(b Rect) bool {
+        for _, a := range r.areas {
+                if a.overlaps(b) {
+                        return true
+                }
+        }
+        return false
+}
+
+// breakText ends the run of removed text.
+func (r *redactor) breakText() {
+        if s := r.run.String(); s != "" && !strings.HasSuffix(s, "\n") {
+                r.run.WriteByte('\n')
+        }
+}
+
+func (r *redactor) flushText() {
+        for _, s := range strings.Split(r.run.String(), "\n") {
+                if s = strings.TrimSpace(s); s != "" {
+                        r.result.Text = append(r.result.Text, s)
+                }
+        }
+        r.run.Reset()
+}
+
+// font returns the font o refers to; nil if it isn't one.
+func (r *redactor) font(o Object) *pageFont {
+        ref, isRef := o.(Ref)
+        if f, ok := r.fonts[ref]; isRef && ok {
+                return f
+        }
+        dict := r.d.getDict(o)
+        if dict == nil {
+                return nil
+        }
+        f := r.d.loadFont(dict)
+        if isRef {
+                r.fonts[ref] = f
+        }
+        return f
+}
+
+// gstate is the part of the graphics state redaction follows.
+type gstate struct {
+        ctm       matrix
+        lineWidth float64
+
+        font                 *pageFont
+        fontSize             float64
+        charSpace, wordSpace float64
+        hScale               float64
+        leading, rise        float64
+}
+
+// textPos is the position in a text object. Where glyph widths are only
+// estimated, the true position lies from slackLo before to slackHi after
+// the one tracked, in text space units.
+type textPos struct {
+        tm, tlm          matrix
+        slackLo, slackHi float64
+}
+
+func (t *textPos) moveTo(m matrix) {
+        t.tm, t.tlm = m, m
+        t.slackLo, t.slackHi = 0, 0
+}
+
+// output collects the redacted content, one piece per operation, so that
+// marked content can be changed once what it encloses is known.
+type output struct {
+        pieces [][]byte
+        // marked are the open BDC operations, with their pieces.
+        marked []markedContent
+}
+
+type markedContent struct {
+        piece int
+        op    *operation
+}
+
+func (w *output) emit(o *operation, changed bool) {
+        var b bytes.Buffer
+        o.write(&b, changed)
+        w.pieces = append(w.pieces, b.Bytes())
+}
+
+// taint drops the ActualText, Alt and E entries of the open marked
+// content, which may repeat text removed within it.
+func (w *output) taint() {
+        for _, m := range w.marked {
+                if len(m.op.args) != 2 {
+                        continue
+                }
+                props, ok := m.op.args[1].(Dict)
+                if !ok || props["ActualText"] == nil && props["Alt"] == nil && props["E"] == nil {
+                        continue
+                }
+                clean := make(Dict, len(props))
+                for k, v := range props {
+                        if k != "ActualText" && k != "Alt" && k != "E" {
+                                clean[k] = v
+                        }
+                }
+                m.op.args = []Object{m.op.args[0], clean}
+                var b bytes.Buffer
+                m.op.write(&b, true)
+                w.pieces[m.piece] = b.Bytes()
+        }
+}
+
+// content redacts a content stream drawn with the resources res and the
+// transformation ctm to default user space. It returns the new content,
+// the XObjects it drew, and how many saved graphics states the content
+// leaves open.
+func (r *redactor) content(data []byte, res Dict, ctm matrix, depth int) ([]byte, *xobjectUse, int, error) {
+        ops, err := parseContent(data)
+        if err != nil {
+                return nil, nil, 0, err
+        }
+        d := r.d
+        fonts := d.getDict(res["Font"])
+        xobjects := &xobjectUse{
+                dict:     d.getDict(res["XObject"]),
+                added:    make(Dict),
+                kept:     make(map[Name]bool),
+                redacted: make(map[Name]bool),
+        }
+
+        gs := gstate{ctm: ctm, lineWidth: 1, hScale: 1}
+        var stack []gstate
+        var text textPos
+        w := &output{pieces: make([][]byte, 0, len(ops))}
+        var path pathState
+        path.reset()
+
+        for i := range ops {
+                o := &ops[i]
+                switch o.op {
+                case "q":
+                        if len(stack) < maxStateDepth {
+                                stack = append(stack, gs)
+                        }
+                case "Q":
+                        if len(stack) > 0 {
+                                gs = stack[len(stack)-1]
+                                stack = stack[:len(stack)-1]
+                        }
+                case "cm":
+                        gs.ctm = o.matrix().mul(gs.ctm)
+                case "w":
+                        gs.lineWidth = o.number(0)
+                case "gs":
+                        name, _ := o.arg(0).(Name)
+                        ext := d.getDict(d.getDict(res["ExtGState"])[name])
+                        if lw, ok := asNumber(d.get(ext["LW"])); ok {
+                                gs.lineWidth = lw
+                        }
+                        if f, ok := d.get(ext["Font"]).(Array); ok && len(f) == 2 {
+                                gs.font = r.font(f[0])
+                                gs.fontSize, _ = asNumber(d.get(f[1]))
+                        }
+
+                // Paths are painted, or not, once complete.
+                case "m", "l", "c", "v", "y", "h", "re", "W", "W*":
+                        path.add(o, gs.ctm)
+                        continue
+                case "S", "s", "f", "F", "f*", "B", "B*", "b", "b*", "n":
+                        r.paintPath(o, &gs, &path, w)
+                        path.reset()
+                        continue
+
+                // Text
+                case "BT":
+                        text.moveTo(identity)
+                case "ET":
+                        r.breakText()
+                case "Tf":
+                        name, _ := o.arg(0).(Name)
+                        gs.font = r.font(fonts[name])
+                        gs.fontSize = o.number(1)
+                case "Tc":
+                        gs.charSpace = o.number(0)
+                case "Tw":
+                        gs.wordSpace = o.number(0)
+                case "Tz":
+                        gs.hScale = o.number(0) / 100
+                case "TL":
+                        gs.leading = o.number(0)
+                case "Ts":
+                        gs.rise = o.number(0)
+                case "Td", "TD":
+                        if o.op == "TD" {
+                                gs.leading = -o.number(1)
+                        }
+                        text.moveTo(matrix{1, 0, 0, 1, o.number(0), o.number(1)}.mul(text.tlm))
+                        r.breakText()
+                case "Tm":
+                        text.moveTo(o.matrix())
+                        r.breakText()
+                case "T*":
+                        text.moveTo(matrix{1, 0, 0, 1, 0, -gs.leading}.mul(text.tlm))
+                        r.breakText()
+                case "Tj", "TJ", "'", "\"":
+                        if r.showText(o, &gs, &text, w) {
+                                w.taint()
+                        }
+                        continue
+
+                // Marked content
+                case "BDC", "BMC":
+                        w.marked = append(w.marked, markedContent{len(w.pieces), o})
+                case "EMC":
+                        if len(w.marked) > 0 {
+                                w.marked = w.marked[:len(w.marked)-1]
+                        }
+
+                // XObjects and inline images
+                case "Do":
+                        r.drawObject(o, &gs, res, xobjects, depth, w)
+                        continue
+                case "BI":
+                        if r.hits(gs.ctm.bounds(Rect{0, 0, 1, 1})) {
+                                r.result.Images++
+                                continue
+                        }
+                }
+                w.emit(o, false)
+        }
+        // A path left unpainted is kept as it was.
+        for _, o := range path.ops {
+                w.emit(o, false)
+        }
+
+        var b bytes.Buffer
+        for _, p := range w.pieces {
+                b.Write(p)
+        }
+        return b.Bytes(), xobjects, len(stack), nil
+}
+
+// ----------------------------------------------------------------------------------
+// Redacting paths
+// ----------------------------------------------------------------------------------
+
+// pathState is a path being built.
+type pathState struct {
+        ops []*operation
+        box Rect // bounds in default user space
+        // rects are the path's rectangles, if it is made of rectangles only,
+        // in default user space.
+        rects     []Rect
+        onlyRects bool
+        clip      bool
+        ctm       matrix
+}
+
+func (p *pathState) reset() {
+        *p = pathState{box: emptyBounds(), onlyRects: true}
+}
+
+func (p *pathState) add(o *operation, ctm matrix) {
+        p.ops = append(p.ops, o)
+        p.ctm = ctm
+        switch o.op {
+        case "W", "W*":
+                p.clip = true
+        case "re":
+                x, y, w, h := o.number(0), o.number(1), o.number(2), o.number(3)
+                rect := ctm.bounds(Rect{min(x, x+w), min(y, y+h), max(x, x+w), max(y, y+h)})
+                p.rects = append(p.rects, rect)
+                p.box.add(rect.LLX, rect.LLY)
+                p.box.add(rect.URX, rect.URY)
+        case "h":
+        default:
+                p.onlyRects = false
+                // Curves lie within their control points.
+                for j := 0; j+1 < len(o.args); j += 2 {
+                        p.box.add(ctm.apply(o.number(j), o.number(j+1)))
+                }
+        }
+}
+
+// paintPath writes the path and its painting operation o, unless the path
+// reaches into an area.
+func (r *redactor) paintPath(o *operation, gs *gstate, p *pathState, w *output) {
+        box := p.box
+        stroked := o.op != "f" && o.op != "F" && o.op != "f*" && o.op != "n"
+        if stroked {
+                // The line width, twice what strokes reach out, for miter
+                // joins; hairlines are one unit wide.
+                pad := max(gs.lineWidth, 1) * gs.ctm.scale()
+                box = Rect{box.LLX - pad, box.LLY - pad, box.URX + pad, box.URY + pad}
+        }
+        if o.op == "n" || !r.hits(box) {
+                for _, op := range p.ops {
+                        w.emit(op, false)
+                }
+                w.emit(o, false)
+                return
+        }
+        r.result.Paths++
+
+        if p.clip {
+                // Only clip: the clipping path isn't content.
+                for _, op := range p.ops {
+                        w.emit(op, false)
+                }
+                w.emit(&operation{op: "n"}, true)
+                return
+        }
+        // Filled rectangles are cut around the areas, where the pieces
+        // can be drawn alike: not turned by the CTM, nor overlapping under
+        // the even-odd rule.
+        inv, ok := p.ctm.invert()
+        aligned := p.ctm[1] == 0 && p.ctm[2] == 0 || p.ctm[0] == 0 && p.ctm[3] == 0
+        if stroked || !p.onlyRects || !ok || !aligned || o.op == "f*" && len(p.rects) > 1 {
+                return
+        }
+        cut := false
+        for _, rect := range p.rects {
+                for _, piece := range subtractRects(rect, r.areas) {
+                        piece = inv.bounds(piece)
+                        w.emit(&operation{op: "re", args: []Object{piece.LLX, piece.LLY, piece.Width(), piece.Height()}}, true)
+                        cut = true
+                }
+        }
+        if cut {
+                w.emit(&operation{op: o.op}, true)
+        }
+}
+
+// subtractRects returns rectangles that together cover r but none of
+// the areas.
+func subtractRects(r Rect, areas []Rect) []Rect {
+        pieces := []Rect{r}
+        for _, a := range areas {
+                var next []Rect
+                for _, p := range pieces {
+                        if !a.overlaps(p) {
+                                next = append(next, p)
+                                continue
+                        }
+                        // Up to four pieces: below, above, left and right of a.
+                        if a.LLY > p.LLY {
+                                next = append(next, Rect{p.LLX, p.LLY, p.URX, a.LLY})
+                        }
+                        if a.URY < p.URY {
+                                next = append(next, Rect{p.LLX, a.URY, p.URX, p.URY})
+                        }
+                        lo, hi := max(a.LLY, p.LLY), min(a.URY, p.URY)
+                        if a.LLX > p.LLX {
+                                next = append(next, Rect{p.LLX, lo, a.LLX, hi})
+                        }
+                        if a.URX < p.URX {
+                                next = append(next, Rect{a.URX, lo, p.URX, hi})
+                        }
+                }
+                pieces = next
+        }
+        return pieces
+}
+
+// ----------------------------------------------------------------------------------
+// Redacting text
+// ----------------------------------------------------------------------------------
+
+// glyph is a character shown by a text operation.
+type glyph struct {
+        code string
+        hit  bool
+        // advance is how far the glyph moves the position along the line, in
+        // text space.
+        advance float64
+}
+
+// missingFont stands for fonts that can't be read.
+var missingFont = &pageFont{ascent: 1, descent: -0.3}
+
+// showText writes the text operation o without the glyphs that reach into
+// an area. Each leaves a gap as wide as it was, so the rest of the line
+// stays in place. It reports whether any were removed.
+//
+// Where a font's widths are only estimated, the glyphs' positions are
+// uncertain: a string is then removed as a whole if any of it may reach
+// into an area.
+func (r *redactor) showText(o *operation, gs *gstate, t *textPos, w *output) bool {
+        var elems Array
+        switch o.op {
+        case "TJ":
+                elems, _ = o.arg(0).(Array)
+        case "Tj", "'":
+                elems = Array{o.arg(0)}
+        case "\"":
+                gs.wordSpace, gs.charSpace = o.number(0), o.number(1)
+                elems = Array{o.arg(2)}
+        }
+        if o.op == "'" || o.op == "\"" {
+                t.moveTo(matrix{1, 0, 0, 1, 0, -gs.leading}.mul(t.tlm))
+                r.breakText()
+        }
+        f := gs.font
+        if f == nil {
+                // Viewers show the text in a font of their own.
+                f = missingFont
+        }
+        fs, th := gs.fontSize, gs.hScale
+        exact := f.exact && !f.vertical
+
+        // Find the glyphs to remove, moving along the line as viewers do.
+        var strs [][]glyph
+        found := false
+        for _, e := range elems {
+                s, ok := e.(String)
+                if !ok {
+                        if n, ok := asNumber(e); ok {
+                                if f.vertical {
+                                        t.advance(true, -n/1000*fs)
+                                } else {
+                                        t.advance(false, -n/1000*fs*th)
+                                }
+                        }
+                        continue
+                }
+                var gl []glyph
+                hit := false
+                for _, code := range f.codes([]byte(s)) {
+                        spacing := gs.charSpace
+                        if code == " " {
+                                spacing += gs.wordSpace
+                        }
+                        width := f.width(code)
+                        g := glyph{code: code, hit: r.hits(glyphBox(f, gs, t, width))}
+                        if f.vertical {
+                                // Vertical metrics (W2) aren't read: glyphs are taken to be
+                                // one em high, with generous slack.
+                                g.advance = -fs + spacing
+                                t.slackLo += math.Abs(fs) * maxGlyphWidth
+                                t.slackHi += math.Abs(fs) * maxGlyphWidth
+                        } else {
+                                g.advance = (width*fs + spacing) * th
+                                if !f.exact {
+                                        t.slackLo += math.Abs(width * fs * th)
+                                        t.slackHi += math.Abs((maxGlyphWidth - width) * fs * th)
+                                }
+                        }
+                        t.advance(f.vertical, g.advance)
+                        hit = hit || g.hit
+                        gl = append(gl, g)
+                }
+                if hit && !exact {
+                        for i := range gl {
+                                gl[i].hit = true
+                        }
+                }
+                found = found || hit
+                strs = append(strs, gl)
+        }
+        if !found {
+                r.breakText()
+                w.emit(o, false)
+                return false
+        }
+
+        // Write the text as TJ, with adjustments in place of the glyphs removed.
+        var out Array
+        var kept []byte
+        flush := func() {
+                if kept != nil {
+                        out = append(out, String(kept))
+                        kept = nil
+                }
+        }
+        gap := func(n float64) {
+                flush()
+                if k := len(out); k > 0 {
+                        if prev, ok := out[k-1].(float64); ok {
+                                out[k-1] = prev + n
+                                return
+                        }
+                }
+                out = append(out, n)
+        }
+        k := 0
+        for _, e := range elems {
+                if _, ok := e.(String); !ok {
+                        if n, ok := asNumber(e); ok {
+                                if n < -250 {
+                                        r.run.WriteByte(' ')
+                                }
+                                gap(n)
+                        }
+                        continue
+                }
+                for _, g := range strs[k] {
+                        if !g.hit {
+                                r.breakText()
+                                kept = append(kept, g.code...)
+                                continue
+                        }
+                        r.result.Glyphs++
+                        r.run.WriteString(f.text(g.code))
+                        n := 0.0
+                        if f.vertical && fs != 0 {
+                                n = -g.advance * 1000 / fs
+                        } else if fs*th != 0 {
+                                n = -g.advance * 1000 / (fs * th)
+                        }
+                        gap(n)
+                }
+                flush()
+                k++
+        }
+
+        switch o.op {
+        case "\"":
+                w.emit(&operation{op: "Tw", args: []Object{o.arg(0)}}, true)
+                w.emit(&operation{op: "Tc", args: []Object{o.arg(1)}}, true)
+                w.emit(&operation{op: "T*"}, true)
+        case "'":
+                w.emit(&operation{op: "T*"}, true)
+        }
+        w.emit(&operation{op: "TJ", args: []Object{out}}, true)
+        return true
+}
+
+// advance moves the position d along the line: rightwards, or upwards for
+// vertical text.
+func (t *textPos) advance(vertical bool, d float64) {
+        if vertical {
+                t.tm = matrix{1, 0, 0, 1, 0, d}.mul(t.tm)
+        } else {
+                t.tm = matrix{1, 0, 0, 1, d, 0}.mul(t.tm)
+        }
+}
+
+// glyphBox returns the bounds in default user space of a glyph of the
+// given width at the current position.
+func glyphBox(f *pageFont, gs *gstate, t *textPos, width float64) Rect {
+        fs, th := gs.fontSize, gs.hScale
+        var b Rect
+        if f.vertical {
+                half, slack := 0.6*math.Abs(fs), t.slackLo+t.slackHi
+                b = Rect{-half, gs.rise - math.Abs(fs)*maxGlyphWidth - slack, half, gs.rise + slack}
+        } else {
+                if !f.exact {
+                        width = maxGlyphWidth
+                }
+                x1 := width * fs * th
+                y0, y1 := gs.rise+f.descent*fs, gs.rise+f.ascent*fs
+                b = Rect{min(0, x1) - t.slackLo, min(y0, y1), max(0, x1) + t.slackHi, max(y0, y1)}
+        }
+        return t.tm.mul(gs.ctm).bounds(b)
+}
+
+// ----------------------------------------------------------------------------------
+// Redacting XObjects
+// ----------------------------------------------------------------------------------
+
+// xobjectUse tracks the XObjects of a content stream's resources as they
+// are drawn, to rebuild the resources without those redacted.
+type xobjectUse struct {
+        dict     Dict          // the XObject resources
+        added    Dict          // redacted copies, by their new names
+        kept     map[Name]bool // drawn unchanged somewhere
+        redacted map[Name]bool // replaced or removed somewhere
+}
+
+// resources returns res with the XObjects updated; nil if unchanged. An
+// XObject that was redacted wherever it was drawn is dropped, so the file
+// no longer refers to it from here.
+func (x *xobjectUse) resources(res Dict) Dict {
+        if len(x.added) == 0 && len(x.redacted) == 0 {
+                return nil
+        }
+        xobjects := make(Dict, len(x.dict)+len(x.added))
+        for k, v := range x.dict {
+                if !x.redacted[k] || x.kept[k] {
+                        xobjects[k] = v
+                }
+        }
+        for k, v := range x.added {
+                xobjects[k] = v
+        }
+        out := make(Dict, len(res)+1)
+        for k, v := range res {
+                out[k] = v
+        }
+        out["XObject"] = xobjects
+        return out
+}
+
+// drawn returns res with only the XObjects drawn unchanged and the
+// redacted copies.
+func (x *xobjectUse) drawn(res Dict) Dict {
+        xobjects := make(Dict, len(x.kept)+len(x.added))
+        for k := range x.kept {
+                xobjects[k] = x.dict[k]
+        }
+        for k, v := range x.added {
+                xobjects[k] = v
+        }
+        out := make(Dict, len(res))
+        for k, v := range res {
+                out[k] = v
+        }
+        out["XObject"] = xobjects
+        return out
+}
+
+// add adds a redacted copy of an XObject under a new name.
+func (x *xobjectUse) add(r *redactor, ref Ref) Name {
+        for {
+                r.names++
+                name := Name(fmt.Sprintf("Rd%d", r.names))
+                _, taken := x.dict[name]
+                if _, ours := x.added[name]; !taken && !ours {
+                        x.added[name] = ref
+                        return name
+                }
+        }
+}
+
+// drawObject writes the Do operation o, drawing an XObject from the
+// resources res: as it is if it is clear of the areas, else as a redacted
+// copy, or not at all if it can't be redacted.
+func (r *redactor) drawObject(o *operation, gs *gstate, res Dict, x *xobjectUse, depth int, w *output) {
+        name, _ := o.arg(0).(Name)
+        stm, ok := r.d.get(x.dict[name]).(*Stream)
+        if !ok {
+                w.emit(o, false)
+                return
+        }
+        keep := func() {
+                x.kept[name] = true
+                w.emit(o, false)
+        }
+        // The copy replaces the original, or nothing does.
+        drop := func() { x.redacted[name] = true }
+        replace := func(ref Ref) {
+                drop()
+                w.emit(&operation{op: "Do", args: []Object{x.add(r, ref)}}, true)
+        }
+
+        switch r.d.get(stm.Dict["Subtype"]) {
+        case Name("Image"):
+                if !r.hits(gs.ctm.bounds(Rect{0, 0, 1, 1})) {
+                        keep()
+                        return
+                }
+                r.result.Images++
+                if ref, err := r.redactImage(stm, gs.ctm); err == nil {
+                        replace(ref)
+                } else {
+                        drop()
+                }
+
+        case Name("Form"):
+                ctm := gs.ctm
+                if m, ok := r.d.get(stm.Dict["Matrix"]).(Array); ok && len(m) == 6 {
+                        var fm matrix
+                        for i := range fm {
+                                fm[i], _ = asNumber(r.d.get(m[i]))
+                        }
+                        ctm = fm.mul(ctm)
+                }
+                bbox := r.d.rect(stm.Dict["BBox"], emptyBounds())
+                if !r.hits(ctm.bounds(bbox)) {
+                        keep()
+                        return
+                }
+                if depth >= maxFormDepth {
+                        r.result.Paths++
+                        drop()
+                        return
+                }
+                ref, changed, err := r.redactForm(stm, res, ctm, depth)
+                switch {
+                case err != nil:
+                        r.result.Paths++
+                        drop()
+                case changed:
+                        replace(ref)
+                default:
+                        keep()
+                }
+
+        default:
+                // PostScript XObjects are ignored by viewers.
+                keep()
+        }
+}
+
+// redactForm returns a redacted copy of the form XObject stm; changed is
+// false if nothing in it reaches into an area.
+func (r *redactor) redactForm(stm *Stream, res Dict, ctm matrix, depth int) (Ref, bool, error) {
+        data, err := r.d.StreamData(stm)
+        if err != nil {
+                return Ref{}, false, err
+        }
+        own := r.d.getDict(stm.Dict["Resources"])
+        if own != nil {
+                res = own
+        }
+        before := *r.result
+        out, xobjects, open, err := r.content(data, res, ctm, depth+1)
+        if err != nil {
+                return Ref{}, false, err
+        }
+        after := *r.result
+        if after.Glyphs == before.Glyphs && after.Paths == before.Paths && after.Images == before.Images {
+                return Ref{}, false, nil
+        }
+        out = append(out, strings.Repeat("\nQ", open)...)
+        packed, err := deflate(out)
+        if err != nil {
+                return Ref{}, false, err
+        }
+        dict := copyStreamDict(stm.Dict)
+        dict["Filter"] = Name("FlateDecode")
+        if own == nil {
+                // Resources inherited from the page are made the form's own,
+                // without the XObjects the page draws.
+                dict["Resources"] = xobjects.drawn(res)
+        } else if newRes := xobjects.resources(own); newRes != nil {
+                dict["Resources"] = newRes
+        }
+        return r.u.Add(NewStream(dict, packed)), true, nil
+}
+
+// copyStreamDict copies the dictionary of a stream whose data is to be
+// replaced, without the entries describing the old data.
+func copyStreamDict(d Dict) Dict {
+        out := make(Dict, len(d))
+        for k, v := range d {
+                switch k {
+                case "Filter", "DecodeParms", "Length", "DL", "F", "FFilter", "FDecodeParms":
+                        continue
+                }
+                out[k] = v
+        }
+        return out
+}
+
+// redactImage returns a copy of the image stm, drawn with the
+// transformation ctm, with the pixels under the areas zeroed. Images in
+// encodings this package can't decode are an error.
+func (r *redactor) redactImage(stm *Stream, ctm matrix) (Ref, error) {
+        inv, ok := ctm.invert()
+        if !ok {
+                return Ref{}, errors.New("pdfdoc: image drawn with a singular matrix")
+        }
+        // The areas in the image's unit square.
+        var areas []Rect
+        unit := Rect{0, 0, 1, 1}
+        for _, a := range r.areas {
+                if b := inv.bounds(a); b.overlaps(unit) {
+                        areas = append(areas, b.intersect(unit))
+                }
+        }
+        return r.blankImage(stm, areas, 0)
+}
+
+func (r *redactor) blankImage(stm *Stream, areas []Rect, depth int) (Ref, error) {
+        d := r.d
+        width, _ := asInt(d.get(stm.Dict["Width"]))
+        height, _ := asInt(d.get(stm.Dict["Height"]))
+        if width <= 0 || height <= 0 || width*height > maxImagePixels {
+                return Ref{}, errors.New("pdfdoc: image dimensions out of range")
+        }
+        w, h := int(width), int(height)
+        pixels := func(a Rect) image.Rectangle {
+                return image.Rect(
+                        int(math.Floor(a.LLX*float64(w))), int(math.Floor((1-a.URY)*float64(h))),
+                        int(math.Ceil(a.URX*float64(w))), int(math.Ceil((1-a.LLY)*float64(h))),
+                ).Intersect(image.Rect(0, 0, w, h))
+        }
+
+        dict := copyStreamDict(stm.Dict)
+        delete(dict, "Alternates")
+        delete(dict, "OPI")
+        var data []byte
+        filters, params := d.filtersOf(stm.Dict)
+        if n := len(filters); n > 0 && (filters[n-1] == "DCTDecode" || filters[n-1] == "DCT") {
+                raw, err := d.RawStreamData(stm)
+                if err != nil {
+                        return Ref{}, err
+                }
+                for i, f := range filters[:n-1] {
+                        if raw, err = decodeFilter(f, params[i], raw); err != nil {
+                                return Ref{}, err
+                        }
+                }
+                if data, err = blankJPEG(raw, areas, pixels); err != nil {
+                        return Ref{}, err
+                }
+                dict["Filter"] = Name("DCTDecode")
+        } else {
+                raw, err := d.StreamData(stm)
+                if err != nil {
+                        return Ref{}, err
+                }
+                comps, bpc := 1, int64(1)
+                if mask, _ := d.get(stm.Dict["ImageMask"]).(bool); !mask {
+                        comps = d.components(stm.Dict["ColorSpace"])
+                        bpc, _ = asInt(d.get(stm.Dict["BitsPerComponent"]))
+                }
+                if comps == 0 || bpc <= 0 || bpc > 16 {
+                        return Ref{}, errors.New("pdfdoc: unsupported image color space")
+                }
+                pixelBits := comps * int(bpc)
+                stride := (w*pixelBits + 7) / 8
+                if len(raw) < stride*h {
+                        return Ref{}, errors.New("pdfdoc: image data is truncated")
+                }
+                for _, a := range areas {
+                        p := pixels(a)
+                        for y := p.Min.Y; y < p.Max.Y; y++ {
+                                clearBits(raw[y*stride:(y+1)*stride], p.Min.X*pixelBits, p.Max.X*pixelBits)
+                        }
+                }
+                if data, err = deflate(raw); err != nil {
+                        return Ref{}, err
+                }
+                dict["Filter"] = Name("FlateDecode")
+        }
+
+        // Masks are blanked alike, or dropped.
+        for _, key := range []Name{"SMask", "Mask"} {
+                mask, ok := d.get(stm.Dict[key]).(*Stream)
+                if !ok {
+                        continue
+                }
+                delete(dict, key)
+                if depth == 0 {
+                        if ref, err := r.blankImage(mask, areas, depth+1); err == nil {
+                                dict[key] = ref
+                        }
+                }
+        }
+        return r.u.Add(NewStream(dict, data)), nil
+}
+
+// clearBits zeroes bits from up to to of row.
+func clearBits(row []byte, from, to int) {
+        for i := from; i < to; {
+                if i%8 == 0 && to-i >= 8 {
+                        row[i/8] = 0
+                        i += 8
+                        continue
+                }
+                row[i/8] &^= 0x80 >> (i % 8)
+                i++
+        }
+}
+
+// blankJPEG blacks out the areas of a JPEG image and encodes it again.
+func blankJPEG(data []byte, areas []Rect, pixels func(Rect) image.Rectangle) ([]byte, error) {
+        img, err := jpeg.Decode(bytes.NewReader(data))
+        if err != nil {
+                return nil, err
+        }
+        var dst draw.Image
+        switch img := img.(type) {
+        case *image.Gray:
+                dst = img
+        case *image.CMYK:
+                // Go writes CMYK as RGB, which the color space wouldn't match.
+                return nil, errors.New("pdfdoc: CMYK JPEG images are not supported")
+        default:
+                rgba := image.NewRGBA(img.Bounds())
+                draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+                dst = rgba
+        }
+        origin := dst.Bounds().Min
+        for _, a := range areas {
+                p := pixels(a).Add(origin)
+                draw.Draw(dst, p, image.NewUniform(color.Black), image.Point{}, draw.Src)
+        }
+        var b bytes.Buffer
+        if err := jpeg.Encode(&b, dst, &jpeg.Options{Quality: 90}); err != nil {
+                return nil, err
+        }
+        return b.Bytes(), nil
+}
+
+// components returns the number of color components of an image color
+// space; 0 if unknown.
+func (d *Document) components(cs Object) int {
+        switch cs := d.get(cs).(type) {
+        case Name:
+                switch cs {
+                case "DeviceGray", "G", "CalGray":
+                        return 1
+                case "DeviceRGB", "RGB", "CalRGB":
+                        return 3
+                case "DeviceCMYK", "CMYK":
+                        return 4
+                }
+        case Array:
+                if len(cs) == 0 {
+                        return 0
+                }
+                family, _ := d.get(cs[0]).(Name)
+                switch family {
+                case "Indexed", "I", "Separation", "CalGray":
+                        return 1
+                case "CalRGB", "Lab":
+                        return 3
+                case "ICCBased":
+                        if len(cs) > 1 {
+                                n, _ := asInt(d.get(d.getDict(cs[1])["N"]))
+                                return int(n)
+                        }
+                case "DeviceN":
+                        if len(cs) > 1 {
+                                names, _ := d.get(cs[1]).(Array)
+                                return len(names)
+                        }
+                default:
+                        return d.components(family)
+                }
+        }
+        return 0
+}
+
+// ----------------------------------------------------------------------------------
+// Redacting annotations
+// ----------------------------------------------------------------------------------
+
+// redactAnnotations removes the annotations of page reaching into an
+// area, with their pop-ups and replies, and the form fields they are
+// widgets of.
+func (r *redactor) redactAnnotations(page Dict) {
+        d := r.d
+        annots, ok := d.get(page["Annots"]).(Array)
+        if !ok {
+                return
+        }
+        removed := make(map[Ref]bool)
+        gone := func(a Object) bool {
+                ref, isRef := a.(Ref)
+                if isRef && removed[ref] {
+                        return true
+                }
+                dict := d.getDict(a)
+                if dict == nil {
+                        return false
+                }
+                for _, key := range []Name{"Parent", "IRT"} {
+                        if p, ok := dict[key].(Ref); ok && removed[p] {
+                                return true
+                        }
+                }
+                return r.hits(d.rect(dict["Rect"], emptyBounds()))
+        }
+        // Pop-ups and replies follow the annotations they belong to, which may
+        // come later in the array.
+        var kept Array
+        for pass := 0; pass < 2; pass++ {
+                kept = kept[:0]
+                for _, a := range annots {
+                        if !gone(a) {
+                                kept = append(kept, a)
+                                continue
+                        }
+                        if ref, ok := a.(Ref); ok {
+                                removed[ref] = true
+                        }
+                }
+        }
+        if len(kept) == len(annots) {
+                return
+        }
+        r.result.Annotations += len(annots) - len(kept)
+        page["Annots"] = kept
+        for ref := range removed {
+                r.u.Set(ref, nil)
+        }
+        r.pruneFields(removed)
+}
+
+// pruneFields removes the widgets removed from the form's fields, and the
+// fields left without widgets.
+func (r *redactor) pruneFields(removed map[Ref]bool) {
+        d := r.d
+        root, ok := d.trailer["Root"].(Ref)
+        if !ok {
+                return
+        }
+        form := d.getDict(d.catalog["AcroForm"])
+        fields, ok := d.get(form["Fields"]).(Array)
+        if !ok {
+                return
+        }
+        kept, changed := r.pruneKids(fields, removed, 0)
+        if !changed {
+                return
+        }
+        newForm := make(Dict, len(form))
+        for k, v := range form {
+                newForm[k] = v
+        }
+        newForm["Fields"] = kept
+        if ref, ok := d.catalog["AcroForm"].(Ref); ok {
+                r.u.Set(ref, newForm)
+                return
+        }
+        catalog := make(Dict, len(d.catalog))
+        for k, v := range d.catalog {
+                catalog[k] = v
+        }
+        catalog["AcroForm"] = newForm
+        r.u.Set(root, catalog)
+}
+
+func (r *redactor) pruneKids(kids Array, removed map[Ref]bool, depth int) (Array, bool) {
+        if depth > maxPageTreeDepth {
+                return kids, false
+        }
+        var kept Array
+        changed := false
+        for _, k := range kids {
+                ref, isRef := k.(Ref)
+                if isRef && removed[ref] {
+                        changed = true
+                        continue
+                }
+                field := r.d.getDict(k)
+                sub, ok := r.d.get(field["Kids"]).(Array)
+                if !ok || !isRef {
+                        kept = append(kept, k)
+                        continue
+                }
+                newSub, ch := r.pruneKids(sub, removed, depth+1)
+                if !ch {
+                        kept = append(kept, k)
+                        continue
+                }
+                changed = true
+                if len(newSub) == 0 {
+                        removed[ref] = true
+                        r.u.Set(ref, nil)
+                        continue
+                }
+                copied := make(Dict, len(field))
+                for key, v := range field {
+                        copied[key] = v
+                }
+                copied["Kids"] = newSub
+                r.u.Set(ref, copied)
+                kept = append(kept, k)
+        }
+        return kept, changed
+}
+
+// ----------------------------------------------------------------------------------
+// Scrubbing text
+// ----------------------------------------------------------------------------------
+
+// redactedText replaces scrubbed text.
+const redactedText = "[REDACTED]"
+
+// ScrubText replaces the terms, wherever they appear as whole words in any
+// case, with "[REDACTED]" in the document information, the XMP metadata,
+// the outline's titles and the text of annotations, so that text redacted
+// from pages doesn't live on there. It returns the number of replacements.
+func (u *Update) ScrubText(terms []string) (int, error) {
+        s := newScrubber(terms)
+        if s == nil {
+                return 0, nil
+        }
+        d := u.d
+        total := 0
+
+        // scrubDict replaces the text strings under keys of the object ref,
+        // writing a copy if any changed.
+        scrubDict := func(ref Ref, dict Dict, keys ...Name) (Dict, bool) {
+                var copied Dict
+                for _, k := range keys {
+                        str, ok := d.get(dict[k]).(String)
+                        if !ok {
+                                continue
+                        }
+                        text, n := s.scrub(Text(str))
+                        if n == 0 {
+                                continue
+                        }
+                        if copied == nil {
+                                copied = make(Dict, len(dict))
+                                for k, v := range dict {
+                                        copied[k] = v
+                                }
+                        }
+                        copied[k] = textString(text)
+                        total += n
+                }
+                if copied == nil {
+                        return dict, false
+                }
+                u.Set(ref, copied)
+                return copied, true
+        }
+
+        if ref, ok := d.trailer["Info"].(Ref); ok {
+                if info := d.getDict(ref); info != nil {
+                        keys := make([]Name, 0, len(info))
+                        for k := range info {
+                                keys = append(keys, k)
+                        }
+                        scrubDict(ref, info, keys...)
+                }
+        }
+
+        if ref, ok := d.catalog["Metadata"].(Ref); ok {
+                if stm, ok := d.get(ref).(*Stream); ok {
+                        data, err := d.StreamData(stm)
+                        if err != nil {
+                                return total, err
+                        }
+                        text, n := s.scrub(string(data))
+                        if n > 0 {
+                                total += n
+                                u.Set(ref, NewStream(Dict{"Type": Name("Metadata"), "Subtype": Name("XML")}, []byte(text)))
+                        }
+                }
+        }
+
+        // The outline, depth first.
+        visited := make(map[Ref]bool)
+        stack := []Object{d.getDict(d.catalog["Outlines"])["First"]}
+        for len(stack) > 0 && len(visited) < maxOutlineItems {
+                ref, ok := stack[len(stack)-1].(Ref)
+                stack = stack[:len(stack)-1]
+                if !ok || visited[ref] {
+                        continue
+                }
+                visited[ref] = true
+                item := d.getDict(ref)
+                if item == nil {
+                        continue
+                }
+                scrubDict(ref, item, "Title")
+                stack = append(stack, item["Next"], item["First"])
+        }
+
+        for n := 1; n <= d.NumPages(); n++ {
+                page, ok := u.pages[n]
+                if !ok {
+                        p, _ := d.Page(n)
+                        page = p.Dict
+                }
+                annots, _ := d.get(page["Annots"]).(Array)
+                for _, a := range annots {
+                        ref, ok := a.(Ref)
+                        if !ok {
+                                continue
+                        }
+                        if _, replaced := u.objects[ref.Num]; replaced {
+                                continue
+                        }
+                        dict := d.getDict(ref)
+                        if dict == nil {
+                                continue
+                        }
+                        changed, ok := scrubDict(ref, dict, "Contents", "T", "Subj", "RC")
+                        if ok && d.get(dict["Subtype"]) == Name("FreeText") {
+                                // Its appearance shows the old text; viewers draw a new one.
+                                delete(changed, "AP")
+                        }
+                }
+        }
+        return total, nil
+}
+
+// scrubber finds whole-word matches of terms.
+type scrubber struct {
+        re *regexp.Regexp
+}
+
+func newScrubber(terms []string) *scrubber {
+        terms = append([]string(nil), terms...)
+        // The longest term matches first, so a name goes before the part of
+        // it that is a term of its own.
+        sort.Slice(terms, func(i, j int) bool { return len(terms[i]) > len(terms[j]) })
+        var parts []string
+        for _, t := range terms {
+                if t = strings.TrimSpace(t); t != "" {
+                        parts = append(parts, regexp.QuoteMeta(t))
+                }
+        }
+        if len(parts) == 0 {
+                return nil
+        }
+        return &scrubber{re: regexp.MustCompile(`(?i)` + strings.Join(parts, "|"))}
+}
+
+// scrub returns s with the terms replaced, and the number replaced.
+func (s *scrubber) scrub(text string) (string, int) {
+        var b strings.Builder
+        n, last := 0, 0
+        for _, m := range s.re.FindAllStringIndex(text, -1) {
+                before, _ := utf8.DecodeLastRuneInString(text[:m[0]])
+                after, _ := utf8.DecodeRuneInString(text[m[1]:])
+                if isWordRune(before) || isWordRune(after) {
+                        continue
+                }
+                b.WriteString(text[last:m[0]])
+                b.WriteString(redactedText)
+                last = m[1]
+                n++
+        }
+        if n == 0 {
+                return text, 0
+        }
+        b.WriteString(text[last:])
+        return b.String(), n
+}
+
+func isWordRune(r rune) bool {
+        return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
@@ -0,0 +1,184 @@
+package pdfdoc
+
+import (
+        "bytes"
+        "image/color"
+        "strings"
+        "testing"
+)
+
+// redactObjects is a two-page document whose pages share a form XObject.
+// Page 1 has "Classified" set at 72 700 in 20 point Helvetica with widths of
+// 500, so each character is 10 points wide; "Classified" runs from x 122 to
+// 222. The form shows "Shared Form" at 300 400 in 10 point, "Form" running
+// from x 335 to 355. The document information, XMP metadata, outline and an
+// annotation on page 2 mention "Classified" too.
+func redactObjects() map[int]fixtureObject {
+        widths := strings.TrimSpace(strings.Repeat("500 ", 95))
+        resources := "<< /Font << /F1 7 0 R >> /XObject << /Fm1 8 0 R >> >>"
+        return map[int]fixtureObject{
+                1: {dict: "<< /Type /Catalog /Pages 2 0 R /Outlines 9 0 R /Metadata 12 0 R >>"},
+                2: {dict: "<< /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 /MediaBox [0 0 612 792] >>"},
+                3: {dict: "<< /Type /Page /Parent 2 0 R /Contents 5 0 R /Resources " + resources + " /Annots [13 0 R] >>"},
+                4: {dict: "<< /Type /Page /Parent 2 0 R /Contents 6 0 R /Resources " + resources + " /Annots [14 0 R] >>"},
+                5: {dict: "<< /Length LEN >>", stream: []byte("BT /F1 20 Tf 72 700 Td (Keep Classified here) Tj ET\n" +
+                        "BT /F1 12 Tf 72 500 Td (Untouched line) Tj ET\nq /Fm1 Do Q")},
+                6: {dict: "<< /Length LEN /Filter /FlateDecode >>",
+                        stream: zlibData([]byte("BT /F1 12 Tf 72 700 Td (Page two text) Tj ET\nq /Fm1 Do Q"))},
+                7: {dict: "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /FirstChar 32 /LastChar 126 /Widths [" + widths +
+                        "] /Encoding /WinAnsiEncoding >>"},
+                8: {dict: "<< /Type /XObject /Subtype /Form /BBox [0 0 612 792] /Resources << /Font << /F1 7 0 R >> >> /Length LEN >>",
+                        stream: []byte("BT /F1 10 Tf 300 400 Td (Shared Form) Tj ET")},
+                9:  {dict: "<< /Type /Outlines /First 10 0 R /Last 11 0 R /Count 2 >>"},
+                10: {dict: "<< /Title ((Classified chapter)) /Parent 9 0 R /Next 11 0 R /Dest [3 0 R /Fit] >>"},
+                11: {dict: "<< /Title ((Introduction)) /Parent 9 0 R /Prev 10 0 R /Dest [4 0 R /Fit] >>"},
+                12: {dict: "<< /Type /Metadata /Subtype /XML /Length LEN >>",
+                        stream: []byte("<x:xmpmeta><dc:title>Classified memo</dc:title></x:xmpmeta>")},
+                13: {dict: "<< /Type /Annot /Subtype /Text /Rect [130 700 150 720] /Contents ((Note on the word)) >>"},
+                14: {dict: "<< /Type /Annot /Subtype /Text /Rect [500 100 520 120] /Contents ((Classified mention)) >>"},
+                15: {dict: "<< /Title ((Classified report)) /Author ((Ann)) >>"},
+        }
+}
+
+// pageStreams returns the decoded contents of page n and of the one form
+// it draws, with the references of both.
+func pageStreams(t *testing.T, d *Document, n int) (contents []byte, contentsRef Ref, form []byte, formRef Ref) {
+        t.Helper()
+        p, _ := d.Page(n)
+        data := func(o Object) []byte {
+                stm, ok := d.get(o).(*Stream)
+                if !ok {
+                        t.Fatalf("page %d: %v is not a stream", n, o)
+                }
+                b, err := d.StreamData(stm)
+                if err != nil {
+                        t.Fatalf("page %d: %v", n, err)
+                }
+                return b
+        }
+        contentsRef, _ = p.Dict["Contents"].(Ref)
+        xobjects := d.getDict(p.Resources["XObject"])
+        if len(xobjects) != 1 {
+                t.Fatalf("page %d XObjects = %v, want one form", n, xobjects)
+        }
+        for _, o := range xobjects {
+                formRef, _ = o.(Ref)
+        }
+        return data(p.Dict["Contents"]), contentsRef, data(formRef), formRef
+}
+
+func TestRedact(t *testing.T) {
+        for _, tt := range []struct {
+                name  string
+                crypt *fixtureCrypt
+        }{
+                {"plain", nil},
+                {"encrypted", newFixtureCrypt("AESV2", "")},
+        } {
+                t.Run(tt.name, func(t *testing.T) {
+                        orig := openFixture(t, buildPDF(t, redactObjects(), "/Root 1 0 R /Info 15 0 R", fixtureOptions{crypt: tt.crypt}))
+                        _, page2Ref, _, formRef := pageStreams(t, orig, 2)
+                        p2, _ := orig.Page(2)
+                        page2Raw, err := orig.RawStreamData(orig.get(p2.Dict["Contents"]).(*Stream))
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+
+                        u, err := orig.NewUpdate()
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        // Boxes are in overlay coordinates, from the top of the page.
+                        res, err := u.Redact(1, []Box{
+                                {X: 124, Y: 792 - 718, Width: 96, Height: 23}, // "Classified"
+                                {X: 337, Y: 792 - 408, Width: 16, Height: 10}, // "Form"
+                        }, color.Black)
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        if strings.Join(res.Text, "|") != "Classified|Form" || res.Annotations != 1 {
+                                t.Errorf("Redact() = %+v", res)
+                        }
+                        if _, err := u.ScrubText(res.Text[:1]); err != nil {
+                                t.Fatal(err)
+                        }
+                        var out bytes.Buffer
+                        if _, err := u.WriteTo(&out); err != nil {
+                                t.Fatal(err)
+                        }
+                        d := openFixture(t, out.Bytes())
+
+                        // The redacted text is gone from the file and from every stream in
+                        // it, however encoded.
+                        if tt.crypt == nil && bytes.Contains(out.Bytes(), []byte("Classified")) {
+                                t.Error("the file still contains \"Classified\"")
+                        }
+                        for num, e := range d.xref {
+                                if e.kind == free {
+                                        continue
+                                }
+                                o, _ := d.Resolve(Ref{Num: num, Gen: e.gen})
+                                if stm, ok := o.(*Stream); ok {
+                                        b, err := d.StreamData(stm)
+                                        if err != nil {
+                                                t.Errorf("object %d: %v", num, err)
+                                        }
+                                        if bytes.Contains(b, []byte("Classified")) {
+                                                t.Errorf("object %d still contains \"Classified\": %q", num, b)
+                                        }
+                                }
+                        }
+
+                        // Text outside the areas stays, on page 1 and in its copy of the
+                        // form.
+                        page1, _, form1, form1Ref := pageStreams(t, d, 1)
+                        for _, s := range []string{"Keep", "here", "(Untouched line)"} {
+                                if !bytes.Contains(page1, []byte(s)) {
+                                        t.Errorf("page 1 lost %q: %q", s, page1)
+                                }
+                        }
+                        if !bytes.Contains(form1, []byte("Shared")) || bytes.Contains(form1, []byte("Form")) {
+                                t.Errorf("page 1 form = %q, want Shared without Form", form1)
+                        }
+                        if form1Ref == formRef {
+                                t.Error("page 1 still uses the shared form")
+                        }
+
+                        // Page 2 is untouched: same contents object, stored bytes and form.
+                        page2, ref, form2, form2Ref := pageStreams(t, d, 2)
+                        if ref != page2Ref || form2Ref != formRef {
+                                t.Errorf("page 2 uses %v and %v, want %v and %v", ref, form2Ref, page2Ref, formRef)
+                        }
+                        p2, _ = d.Page(2)
+                        if raw, err := d.RawStreamData(d.get(p2.Dict["Contents"]).(*Stream)); err != nil || !bytes.Equal(raw, page2Raw) {
+                                t.Errorf("page 2 contents changed: %v", err)
+                        }
+                        if string(page2) != "BT /F1 12 Tf 72 700 Td (Page two text) Tj ET\nq /Fm1 Do Q" {
+                                t.Errorf("page 2 contents = %q", page2)
+                        }
+                        if string(form2) != "BT /F1 10 Tf 300 400 Td (Shared Form) Tj ET" {
+                                t.Errorf("shared form = %q", form2)
+                        }
+
+                        // Information, metadata, outline and annotations are scrubbed; the
+                        // annotation in the area is removed.
+                        info, err := d.Info()
+                        if err != nil || info.Title != "[REDACTED] report" || info.Author != "Ann" {
+                                t.Errorf("Info() = %+v, %v", info, err)
+                        }
+                        if xmp, err := d.Metadata(); err != nil || !strings.Contains(string(xmp), "[REDACTED] memo") {
+                                t.Errorf("Metadata() = %q, %v", xmp, err)
+                        }
+                        outline, err := d.Outline()
+                        if err != nil || len(outline) != 2 || outline[0].Title != "[REDACTED] chapter" || outline[1].Title != "Introduction" {
+                                t.Errorf("Outline() = %+v, %v", outline, err)
+                        }
+                        if annots, err := d.Annotations(1); err != nil || len(annots) != 0 {
+                                t.Errorf("Annotations(1) = %+v, %v", annots, err)
+                        }
+                        if annots, err := d.Annotations(2); err != nil || len(annots) != 1 || annots[0].Contents != "[REDACTED] mention" {
+                                t.Errorf("Annotations(2) = %+v, %v", annots, err)
+                        }
+                })
+        }
+}
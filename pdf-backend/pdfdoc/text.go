@@ -0,0 +1,93 @@
+package pdfdoc
+
+import (
+        "strconv"
+        "strings"
+        "time"
+        "unicode/utf16"
+        "unicode/utf8"
+)
+
+// Text decodes a text string: UTF-16BE or UTF-8 with a byte order mark, or
+// PDFDocEncoding otherwise.
+func Text(s String) string {
+        b := []byte(s)
+        switch {
+        case len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff:
+                b = b[2:]
+                u := make([]uint16, 0, len(b)/2)
+                for i := 0; i+1 < len(b); i += 2 {
+                        u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+                }
+                return string(utf16.Decode(u))
+        case len(b) >= 3 && b[0] == 0xef && b[1] == 0xbb && b[2] == 0xbf && utf8.Valid(b[3:]):
+                return string(b[3:])
+        }
+        var sb strings.Builder
+        for _, c := range b {
+                if r, ok := pdfDocEncoding[c]; ok {
+                        sb.WriteRune(r)
+                } else {
+                        sb.WriteRune(rune(c))
+                }
+        }
+        return sb.String()
+}
+
+// pdfDocEncoding lists where PDFDocEncoding differs from Latin-1.
+var pdfDocEncoding = map[byte]rune{
+        0x18: '˘', 0x19: 'ˇ', 0x1a: 'ˆ', 0x1b: '˙', 0x1c: '˝', 0x1d: '˛', 0x1e: '˚', 0x1f: '˜',
+        0x80: '•', 0x81: '†', 0x82: '‡', 0x83: '…', 0x84: '—', 0x85: '–', 0x86: 'ƒ', 0x87: '⁄',
+        0x88: '‹', 0x89: '›', 0x8a: '−', 0x8b: '‰', 0x8c: '„', 0x8d: '“', 0x8e: '”', 0x8f: '‘',
+        0x90: '’', 0x91: '‚', 0x92: '™', 0x93: 'ﬁ', 0x94: 'ﬂ', 0x95: 'Ł', 0x96: 'Œ', 0x97: 'Š',
+        0x98: 'Ÿ', 0x99: 'Ž', 0x9a: 'ı', 0x9b: 'ł', 0x9c: 'œ', 0x9d: 'š', 0x9e: 'ž', 0xa0: '€',
+}
+
+// ParseDate parses a date string such as "D:20240131120000+01'00'". Missing
+// trailing fields take their lowest value; a missing zone means UTC.
+func ParseDate(s string) (time.Time, bool) {
+        s = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(s), "D:"))
+        num := func(n int, def int) int {
+                if len(s) < n {
+                        s = ""
+                        return def
+                }
+                v, err := strconv.Atoi(s[:n])
+                if err != nil {
+                        s = ""
+                        return def
+                }
+                s = s[n:]
+                return v
+        }
+        if len(s) < 4 {
+                return time.Time{}, false
+        }
+        year := num(4, 0)
+        if year == 0 {
+                return time.Time{}, false
+        }
+        month, day := num(2, 1), num(2, 1)
+        hour, minute, sec := num(2, 0), num(2, 0), num(2, 0)
+        loc := time.UTC
+        if s != "" {
+                sign := 0
+                switch s[0] {
+                case '+':
+                        sign = 1
+                case '-':
+                        sign = -1
+                }
+                if sign != 0 {
+                        s = s[1:]
+                        zh := num(2, 0)
+                        s = strings.TrimPrefix(s, "'")
+                        zm := num(2, 0)
+                        loc = time.FixedZone("", sign*(zh*3600+zm*60))
+                }
+        }
+        if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 || minute > 59 || sec > 60 {
+                return time.Time{}, false
+        }
+        return time.Date(year, time.Month(month), day, hour, minute, sec, 0, loc), true
+}
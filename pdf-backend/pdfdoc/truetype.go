@@ -0,0 +1,506 @@
+package pdfdoc
+
+import (
+        "encoding/binary"
+        "errors"
+        "fmt"
+        "sort"
+        "strings"
+        "unicode/utf16"
+)
+
+// ----------------------------------------------------------------------------------
+// TrueType
+// ----------------------------------------------------------------------------------
+//
+// Just enough of the TrueType format to embed a font: the metrics the font
+// descriptor needs, the character map, and a subset of the glyph outlines.
+// Subsets keep glyph IDs as they are, with the unused glyphs emptied, so text
+// can be encoded before the subset is made, and a cmap for the glyphs kept.
+
+var errBadFont = errors.New("pdfdoc: malformed TrueType font")
+
+type trueType struct {
+        tables map[string][]byte
+
+        name        string // PostScript name
+        unitsPerEm  int
+        numGlyphs   int
+        longLoca    bool
+        numHMetrics int
+        cmap        map[rune]uint16
+
+        bbox                       [4]int
+        ascent, descent, capHeight int
+        italicAngle                float64
+        fixedPitch                 bool
+        embeddable                 bool
+}
+
+// The readers return zero past the end of b, so malformed fonts produce
+// wrong values rather than panics.
+func be16(b []byte, off int) int {
+        if off < 0 || off+2 > len(b) {
+                return 0
+        }
+        return int(binary.BigEndian.Uint16(b[off:]))
+}
+
+func bes16(b []byte, off int) int { return int(int16(be16(b, off))) }
+
+func be32(b []byte, off int) uint32 {
+        if off < 0 || off+4 > len(b) {
+                return 0
+        }
+        return binary.BigEndian.Uint32(b[off:])
+}
+
+func parseTrueType(data []byte) (*trueType, error) {
+        if len(data) < 12 {
+                return nil, errBadFont
+        }
+        switch string(data[:4]) {
+        case "\x00\x01\x00\x00", "true":
+        case "OTTO":
+                return nil, errors.New("pdfdoc: OpenType fonts with CFF outlines are not supported")
+        case "ttcf":
+                return nil, errors.New("pdfdoc: font collections are not supported")
+        default:
+                return nil, errBadFont
+        }
+        tt := &trueType{tables: make(map[string][]byte)}
+        for i := 0; i < be16(data, 4); i++ {
+                rec := 12 + 16*i
+                if rec+16 > len(data) {
+                        return nil, errBadFont
+                }
+                off, length := int64(be32(data, rec+8)), int64(be32(data, rec+12))
+                if off > int64(len(data)) || length > int64(len(data))-off {
+                        return nil, errBadFont
+                }
+                tt.tables[string(data[rec:rec+4])] = data[off : off+length]
+        }
+        for _, tag := range []string{"head", "hhea", "maxp", "hmtx", "loca", "glyf", "cmap"} {
+                if tt.tables[tag] == nil {
+                        return nil, fmt.Errorf("pdfdoc: TrueType font has no %s table", tag)
+                }
+        }
+
+        head := tt.tables["head"]
+        tt.unitsPerEm = be16(head, 18)
+        if len(head) < 54 || tt.unitsPerEm == 0 {
+                return nil, errBadFont
+        }
+        tt.bbox = [4]int{bes16(head, 36), bes16(head, 38), bes16(head, 40), bes16(head, 42)}
+        tt.longLoca = bes16(head, 50) == 1
+
+        tt.numGlyphs = be16(tt.tables["maxp"], 4)
+        hhea := tt.tables["hhea"]
+        tt.ascent, tt.descent = bes16(hhea, 4), bes16(hhea, 6)
+        tt.numHMetrics = min(be16(hhea, 34), tt.numGlyphs)
+        locaSize := 2
+        if tt.longLoca {
+                locaSize = 4
+        }
+        if tt.numGlyphs == 0 || tt.numHMetrics == 0 ||
+                len(tt.tables["hmtx"]) < 4*tt.numHMetrics ||
+                len(tt.tables["loca"]) < locaSize*(tt.numGlyphs+1) {
+                return nil, errBadFont
+        }
+
+        tt.capHeight = tt.ascent
+        tt.embeddable = true
+        if os2 := tt.tables["OS/2"]; len(os2) >= 10 {
+                // fsType: bit 1 is the restricted license, unless bit 2 or 3
+                // allows embedding for viewing or editing; bit 9 allows bitmaps
+                // only.
+                fsType := be16(os2, 8)
+                if fsType&0x0002 != 0 && fsType&0x000c == 0 || fsType&0x0200 != 0 {
+                        tt.embeddable = false
+                }
+                if be16(os2, 0) >= 2 && len(os2) >= 90 {
+                        tt.capHeight = bes16(os2, 88)
+                }
+        }
+        if post := tt.tables["post"]; len(post) >= 16 {
+                tt.italicAngle = float64(int32(be32(post, 4))) / 65536
+                tt.fixedPitch = be32(post, 12) != 0
+        }
+        tt.name = postScriptName(tt.tables["name"])
+        tt.cmap = parseCmap(tt.tables["cmap"], tt.numGlyphs)
+        return tt, nil
+}
+
+// postScriptName returns name ID 6 of the name table, keeping only the
+// characters allowed in a PDF font name.
+func postScriptName(b []byte) string {
+        count, storage := be16(b, 2), be16(b, 4)
+        for i := 0; i < count; i++ {
+                rec := 6 + 12*i
+                platform, id := be16(b, rec), be16(b, rec+6)
+                length, off := be16(b, rec+8), storage+be16(b, rec+10)
+                if id != 6 || off+length > len(b) {
+                        continue
+                }
+                raw := b[off : off+length]
+                var s string
+                switch platform {
+                case 0, 3:
+                        u := make([]uint16, len(raw)/2)
+                        for j := range u {
+                                u[j] = uint16(be16(raw, 2*j))
+                        }
+                        s = string(utf16.Decode(u))
+                case 1:
+                        s = string(raw)
+                default:
+                        continue
+                }
+                s = strings.Map(func(r rune) rune {
+                        if r <= ' ' || r > '~' || strings.ContainsRune("()<>[]{}/%#", r) {
+                                return -1
+                        }
+                        return r
+                }, s)
+                if s != "" {
+                        return s
+                }
+        }
+        return "Font"
+}
+
+// parseCmap reads the best Unicode subtable of a cmap table: format 12 for
+// the full range, else format 4 for the Basic Multilingual Plane.
+func parseCmap(b []byte, numGlyphs int) map[rune]uint16 {
+        off, best := -1, 0
+        for i := 0; i < be16(b, 2); i++ {
+                rec := 4 + 8*i
+                platform, encoding := be16(b, rec), be16(b, rec+2)
+                sub := int(be32(b, rec+4))
+                score := 0
+                switch format := be16(b, sub); {
+                case format == 12 && (platform == 0 || platform == 3 && encoding == 10):
+                        score = 3
+                case format == 4 && (platform == 0 || platform == 3 && encoding == 1):
+                        score = 2
+                case format == 4 && platform == 3 && encoding == 0:
+                        score = 1
+                }
+                if score > best {
+                        off, best = sub, score
+                }
+        }
+        m := make(map[rune]uint16)
+        if off < 0 {
+                return m
+        }
+        add := func(c, gid int) {
+                if gid > 0 && gid < numGlyphs {
+                        m[rune(c)] = uint16(gid)
+                }
+        }
+        switch be16(b, off) {
+        case 4:
+                segX2 := be16(b, off+6)
+                ends := off + 14
+                starts := ends + segX2 + 2
+                deltas := starts + segX2
+                ranges := deltas + segX2
+                for s := 0; s < segX2/2; s++ {
+                        end, start := be16(b, ends+2*s), be16(b, starts+2*s)
+                        delta, rangeOff := be16(b, deltas+2*s), be16(b, ranges+2*s)
+                        for c := start; c <= end && c != 0xffff; c++ {
+                                if rangeOff == 0 {
+                                        add(c, (c+delta)&0xffff)
+                                } else if g := be16(b, ranges+2*s+rangeOff+2*(c-start)); g != 0 {
+                                        add(c, (g+delta)&0xffff)
+                                }
+                        }
+                }
+        case 12:
+                budget := 0x110000
+                for i := 0; i < int(be32(b, off+12)) && budget > 0; i++ {
+                        group := off + 16 + 12*i
+                        if group+12 > len(b) {
+                                break
+                        }
+                        start, end, gid := int64(be32(b, group)), int64(be32(b, group+4)), int64(be32(b, group+8))
+                        for c := start; c <= end && c <= 0x10ffff && budget > 0; c++ {
+                                if g := gid + c - start; g < int64(numGlyphs) {
+                                        add(int(c), int(g))
+                                }
+                                budget--
+                        }
+                }
+        }
+        return m
+}
+
+// glyph returns the glyph of r, or 0 (.notdef) if the font doesn't have one.
+func (tt *trueType) glyph(r rune) uint16 { return tt.cmap[r] }
+
+// advance returns the advance width of a glyph, in font units.
+func (tt *trueType) advance(gid uint16) int {
+        return be16(tt.tables["hmtx"], 4*min(int(gid), tt.numHMetrics-1))
+}
+
+// flags returns the font descriptor flags: symbolic, since glyphs are
+// addressed by ID, plus fixed-pitch and italic.
+func (tt *trueType) flags() int {
+        f := 4
+        if tt.fixedPitch {
+                f |= 1
+        }
+        if tt.italicAngle != 0 {
+                f |= 64
+        }
+        return f
+}
+
+func (tt *trueType) glyphData(gid int) []byte {
+        loca, glyf := tt.tables["loca"], tt.tables["glyf"]
+        var start, end int
+        if tt.longLoca {
+                start, end = int(be32(loca, 4*gid)), int(be32(loca, 4*gid+4))
+        } else {
+                start, end = 2*be16(loca, 2*gid), 2*be16(loca, 2*gid+2)
+        }
+        if start >= end || end > len(glyf) {
+                return nil
+        }
+        return glyf[start:end]
+}
+
+// components returns the glyphs a composite glyph is made of.
+func components(g []byte) []int {
+        if bes16(g, 0) >= 0 {
+                return nil
+        }
+        var ids []int
+        for off := 10; off+4 <= len(g); {
+                flags := be16(g, off)
+                ids = append(ids, be16(g, off+2))
+                off += 4
+                if flags&0x0001 != 0 { // ARG_1_AND_2_ARE_WORDS
+                        off += 4
+                } else {
+                        off += 2
+                }
+                switch {
+                case flags&0x0008 != 0: // WE_HAVE_A_SCALE
+                        off += 2
+                case flags&0x0040 != 0: // WE_HAVE_AN_X_AND_Y_SCALE
+                        off += 4
+                case flags&0x0080 != 0: // WE_HAVE_A_TWO_BY_TWO
+                        off += 8
+                }
+                if flags&0x0020 == 0 { // MORE_COMPONENTS
+                        break
+                }
+        }
+        return ids
+}
+
+// subset returns a font program with the outlines and metrics of the given
+// glyphs, those they are composed of, and .notdef, and a cmap for them. The
+// other glyphs are left empty.
+func (tt *trueType) subset(gids []uint16) ([]byte, error) {
+        keep := map[int]bool{0: true}
+        queue := []int{0}
+        for _, g := range gids {
+                queue = append(queue, int(g))
+        }
+        for len(queue) > 0 {
+                g := queue[len(queue)-1]
+                queue = queue[:len(queue)-1]
+                keep[g] = true
+                for _, c := range components(tt.glyphData(g)) {
+                        if c < tt.numGlyphs && !keep[c] {
+                                queue = append(queue, c)
+                        }
+                }
+        }
+
+        n := tt.numGlyphs
+        hmtx := tt.tables["hmtx"]
+        var glyf []byte
+        loca := make([]byte, 4*(n+1))
+        metrics := make([]byte, 4*n)
+        for g := 0; g < n; g++ {
+                binary.BigEndian.PutUint32(loca[4*g:], uint32(len(glyf)))
+                if !keep[g] {
+                        continue
+                }
+                glyf = append(glyf, tt.glyphData(g)...)
+                for len(glyf)%4 != 0 {
+                        glyf = append(glyf, 0)
+                }
+                // Every glyph gets a full metric, so the emptied ones can be
+                // zero and compress away.
+                var lsb int
+                if g < tt.numHMetrics {
+                        lsb = be16(hmtx, 4*g+2)
+                } else {
+                        lsb = be16(hmtx, 4*tt.numHMetrics+2*(g-tt.numHMetrics))
+                }
+                binary.BigEndian.PutUint16(metrics[4*g:], uint16(tt.advance(uint16(g))))
+                binary.BigEndian.PutUint16(metrics[4*g+2:], uint16(lsb))
+        }
+        binary.BigEndian.PutUint32(loca[4*n:], uint32(len(glyf)))
+
+        clone := func(tag string) []byte { return append([]byte(nil), tt.tables[tag]...) }
+        head := clone("head")
+        binary.BigEndian.PutUint32(head[8:], 0)  // checkSumAdjustment, set below
+        binary.BigEndian.PutUint16(head[50:], 1) // indexToLocFormat: long
+        hhea := clone("hhea")
+        if len(hhea) < 36 {
+                return nil, errBadFont
+        }
+        binary.BigEndian.PutUint16(hhea[34:], uint16(n))
+
+        tables := map[string][]byte{
+                "head": head,
+                "hhea": hhea,
+                "maxp": tt.tables["maxp"],
+                "hmtx": metrics,
+                "loca": loca,
+                "glyf": glyf,
+                "cmap": tt.subsetCmap(keep),
+        }
+        for _, tag := range []string{"OS/2", "cvt ", "fpgm", "prep"} {
+                if t := tt.tables[tag]; t != nil {
+                        tables[tag] = t
+                }
+        }
+        if post := tt.tables["post"]; len(post) >= 32 {
+                // Version 3 has no glyph names, which can be most of the table.
+                p := append([]byte(nil), post[:32]...)
+                binary.BigEndian.PutUint32(p, 0x00030000)
+                tables["post"] = p
+        }
+        return writeSfnt(tables), nil
+}
+
+// subsetCmap returns a cmap table for the characters of the kept glyphs:
+// format 4 for the Basic Multilingual Plane and format 12 for all of them.
+func (tt *trueType) subsetCmap(keep map[int]bool) []byte {
+        var chars []rune
+        for r, g := range tt.cmap {
+                if keep[int(g)] {
+                        chars = append(chars, r)
+                }
+        }
+        sort.Slice(chars, func(i, j int) bool { return chars[i] < chars[j] })
+        // Consecutive characters on consecutive glyphs share a segment.
+        type segment struct {
+                start, end rune
+                gid        uint16
+        }
+        var segs, bmp []segment
+        for _, r := range chars {
+                g := tt.cmap[r]
+                if n := len(segs); n > 0 && segs[n-1].end+1 == r && rune(segs[n-1].gid)+r-segs[n-1].start == rune(g) {
+                        segs[n-1].end = r
+                        continue
+                }
+                segs = append(segs, segment{r, r, g})
+        }
+        for _, s := range segs {
+                if s.end < 0xffff {
+                        bmp = append(bmp, s)
+                }
+        }
+        bmp = append(bmp, segment{0xffff, 0xffff, 0}) // required last segment
+
+        n := len(bmp)
+        selector := 0
+        for 1<<(selector+1) <= n {
+                selector++
+        }
+        searchRange := 2 << selector
+        f4 := make([]byte, 16+8*n)
+        binary.BigEndian.PutUint16(f4, 4)
+        binary.BigEndian.PutUint16(f4[2:], uint16(len(f4)))
+        binary.BigEndian.PutUint16(f4[6:], uint16(2*n))
+        binary.BigEndian.PutUint16(f4[8:], uint16(searchRange))
+        binary.BigEndian.PutUint16(f4[10:], uint16(selector))
+        binary.BigEndian.PutUint16(f4[12:], uint16(2*n-searchRange))
+        for i, s := range bmp {
+                binary.BigEndian.PutUint16(f4[14+2*i:], uint16(s.end))
+                binary.BigEndian.PutUint16(f4[16+2*n+2*i:], uint16(s.start))
+                binary.BigEndian.PutUint16(f4[16+4*n+2*i:], uint16(rune(s.gid)-s.start))
+        }
+
+        f12 := make([]byte, 16+12*len(segs))
+        binary.BigEndian.PutUint16(f12, 12)
+        binary.BigEndian.PutUint32(f12[4:], uint32(len(f12)))
+        binary.BigEndian.PutUint32(f12[12:], uint32(len(segs)))
+        for i, s := range segs {
+                binary.BigEndian.PutUint32(f12[16+12*i:], uint32(s.start))
+                binary.BigEndian.PutUint32(f12[20+12*i:], uint32(s.end))
+                binary.BigEndian.PutUint32(f12[24+12*i:], uint32(s.gid))
+        }
+
+        // Two Windows subtables: Unicode BMP (3, 1) and full Unicode (3, 10).
+        out := make([]byte, 20, 20+len(f4)+len(f12))
+        binary.BigEndian.PutUint16(out[2:], 2)
+        binary.BigEndian.PutUint16(out[4:], 3)
+        binary.BigEndian.PutUint16(out[6:], 1)
+        binary.BigEndian.PutUint32(out[8:], 20)
+        binary.BigEndian.PutUint16(out[12:], 3)
+        binary.BigEndian.PutUint16(out[14:], 10)
+        binary.BigEndian.PutUint32(out[16:], uint32(20+len(f4)))
+        out = append(out, f4...)
+        return append(out, f12...)
+}
+
+// writeSfnt assembles a TrueType file from its tables.
+func writeSfnt(tables map[string][]byte) []byte {
+        tags := make([]string, 0, len(tables))
+        for tag := range tables {
+                tags = append(tags, tag)
+        }
+        sort.Strings(tags)
+
+        num := len(tags)
+        selector := 0
+        for 1<<(selector+1) <= num {
+                selector++
+        }
+        searchRange := 16 << selector
+        out := make([]byte, 12+16*num)
+        binary.BigEndian.PutUint32(out, 0x00010000)
+        binary.BigEndian.PutUint16(out[4:], uint16(num))
+        binary.BigEndian.PutUint16(out[6:], uint16(searchRange))
+        binary.BigEndian.PutUint16(out[8:], uint16(selector))
+        binary.BigEndian.PutUint16(out[10:], uint16(16*num-searchRange))
+
+        headOff := 0
+        for i, tag := range tags {
+                t := tables[tag]
+                rec := out[12+16*i:]
+                copy(rec, tag)
+                binary.BigEndian.PutUint32(rec[4:], sfntChecksum(t))
+                binary.BigEndian.PutUint32(rec[8:], uint32(len(out)))
+                binary.BigEndian.PutUint32(rec[12:], uint32(len(t)))
+                if tag == "head" {
+                        headOff = len(out)
+                }
+                out = append(out, t...)
+                for len(out)%4 != 0 {
+                        out = append(out, 0)
+                }
+        }
+        binary.BigEndian.PutUint32(out[headOff+8:], 0xb1b0afba-sfntChecksum(out))
+        return out
+}
+
+func sfntChecksum(b []byte) uint32 {
+        var sum uint32
+        for i := 0; i < len(b); i += 4 {
+                var w [4]byte
+                copy(w[:], b[i:])
+                sum += binary.BigEndian.Uint32(w[:])
+        }
+        return sum
+}
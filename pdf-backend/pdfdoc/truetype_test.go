@@ -0,0 +1,228 @@
+package pdfdoc
+
+import (
+        "bytes"
+        "encoding/binary"
+        "math"
+        "reflect"
+        "testing"
+        "unicode/utf16"
+)
+
+// testFont is a TrueType font with six glyphs: .notdef, A, B, the composite
+// Ä made of A and a dieresis, the dieresis and C. The last two share the
+// last long metric, and the loca table is in the short format.
+func testFont(t *testing.T) []byte {
+        t.Helper()
+        u16 := func(b []byte, off, v int) { binary.BigEndian.PutUint16(b[off:], uint16(v)) }
+
+        head := make([]byte, 54)
+        binary.BigEndian.PutUint32(head, 0x00010000)
+        u16(head, 18, 1000) // unitsPerEm
+        u16(head, 36, -50)
+        u16(head, 38, -200)
+        u16(head, 40, 950)
+        u16(head, 42, 900)
+        hhea := make([]byte, 36)
+        u16(hhea, 4, 800)
+        u16(hhea, 6, -200)
+        u16(hhea, 34, 4) // numberOfHMetrics
+        maxp := make([]byte, 6)
+        binary.BigEndian.PutUint32(maxp, 0x00005000)
+        u16(maxp, 4, 6)
+
+        hmtx := make([]byte, 4*4+2*2)
+        for i, m := range [][2]int{{500, 0}, {600, 10}, {700, 20}, {650, 30}} {
+                u16(hmtx, 4*i, m[0])
+                u16(hmtx, 4*i+2, m[1])
+        }
+        u16(hmtx, 16, 40)
+        u16(hmtx, 18, 50)
+
+        simple := func(fill byte) []byte {
+                g := bytes.Repeat([]byte{fill}, 16)
+                u16(g, 0, 1) // one contour
+                return g
+        }
+        composite := make([]byte, 24)
+        u16(composite, 0, -1)
+        u16(composite, 10, 0x0021) // ARG_1_AND_2_ARE_WORDS, MORE_COMPONENTS
+        u16(composite, 12, 1)
+        u16(composite, 18, 0)
+        u16(composite, 20, 4)
+        glyphs := [][]byte{simple(0x10), simple(0x11), simple(0x12), composite, simple(0x14), simple(0x15)}
+        var glyf []byte
+        loca := make([]byte, 2*(len(glyphs)+1))
+        for i, g := range glyphs {
+                u16(loca, 2*i, len(glyf)/2)
+                glyf = append(glyf, g...)
+        }
+        u16(loca, 2*len(glyphs), len(glyf)/2)
+
+        // A format 12 subtable: A B -> 1 2, C -> 5, Ä -> 3 and U+1F600 -> 4.
+        groups := [][3]uint32{{'A', 'B', 1}, {'C', 'C', 5}, {'Ä', 'Ä', 3}, {0x1f600, 0x1f600, 4}}
+        cmap := make([]byte, 12+16+12*len(groups))
+        u16(cmap, 2, 1)
+        u16(cmap, 4, 3)
+        u16(cmap, 6, 10)
+        binary.BigEndian.PutUint32(cmap[8:], 12)
+        sub := cmap[12:]
+        u16(sub, 0, 12)
+        binary.BigEndian.PutUint32(sub[4:], uint32(len(sub)))
+        binary.BigEndian.PutUint32(sub[12:], uint32(len(groups)))
+        for i, g := range groups {
+                for j, v := range g {
+                        binary.BigEndian.PutUint32(sub[16+12*i+4*j:], v)
+                }
+        }
+
+        psName := utf16.Encode([]rune("Test (Regular)"))
+        name := make([]byte, 18+2*len(psName))
+        u16(name, 2, 1)
+        u16(name, 4, 18)
+        u16(name, 6, 3)
+        u16(name, 8, 1)
+        u16(name, 12, 6)
+        u16(name, 14, 2*len(psName))
+        for i, c := range psName {
+                u16(name, 18+2*i, int(c))
+        }
+        post := make([]byte, 32)
+        binary.BigEndian.PutUint32(post, 0x00020000)
+
+        return writeSfnt(map[string][]byte{
+                "head": head, "hhea": hhea, "maxp": maxp, "hmtx": hmtx,
+                "loca": loca, "glyf": glyf, "cmap": cmap, "name": name, "post": post,
+        })
+}
+
+func TestParseTrueType(t *testing.T) {
+        tt, err := parseTrueType(testFont(t))
+        if err != nil {
+                t.Fatal(err)
+        }
+        if tt.name != "TestRegular" || tt.unitsPerEm != 1000 || tt.numGlyphs != 6 || tt.longLoca ||
+                tt.bbox != [4]int{-50, -200, 950, 900} || tt.ascent != 800 || tt.descent != -200 || !tt.embeddable {
+                t.Errorf("parsed %+v", tt)
+        }
+        for r, want := range map[rune]uint16{'A': 1, 'B': 2, 'C': 5, 'Ä': 3, 0x1f600: 4, 'D': 0} {
+                if g := tt.glyph(r); g != want {
+                        t.Errorf("glyph(%q) = %d, want %d", r, g, want)
+                }
+        }
+        for g, want := range []int{500, 600, 700, 650, 650, 650} {
+                if w := tt.advance(uint16(g)); w != want {
+                        t.Errorf("advance(%d) = %d, want %d", g, w, want)
+                }
+        }
+}
+
+func TestTrueTypeSubset(t *testing.T) {
+        tt, err := parseTrueType(testFont(t))
+        if err != nil {
+                t.Fatal(err)
+        }
+        program, err := tt.subset([]uint16{tt.glyph('Ä')})
+        if err != nil {
+                t.Fatal(err)
+        }
+        if sum := sfntChecksum(program); sum != 0xb1b0afba {
+                t.Errorf("font checksum = %#x, want 0xb1b0afba", sum)
+        }
+        sub, err := parseTrueType(program)
+        if err != nil {
+                t.Fatalf("parsing the subset: %v", err)
+        }
+        if sub.numGlyphs != tt.numGlyphs || !sub.longLoca || sub.unitsPerEm != tt.unitsPerEm {
+                t.Errorf("subset %+v", sub)
+        }
+
+        // Ä keeps the glyphs it's made of; B and C are emptied.
+        kept := map[int]bool{0: true, 1: true, 3: true, 4: true}
+        for g := 0; g < tt.numGlyphs; g++ {
+                want, wantAdvance := tt.glyphData(g), tt.advance(uint16(g))
+                if !kept[g] {
+                        want, wantAdvance = nil, 0
+                }
+                if got := sub.glyphData(g); !bytes.Equal(got, want) {
+                        t.Errorf("glyph %d = %x, want %x", g, got, want)
+                }
+                if got := sub.advance(uint16(g)); got != wantAdvance {
+                        t.Errorf("advance(%d) = %d, want %d", g, got, wantAdvance)
+                }
+        }
+
+        wantCmap := map[rune]uint16{'A': 1, 'Ä': 3, 0x1f600: 4}
+        if !reflect.DeepEqual(sub.cmap, wantCmap) {
+                t.Errorf("subset cmap = %v, want %v", sub.cmap, wantCmap)
+        }
+        // The first subtable is the format 4 one, for the BMP only.
+        cmap := append([]byte(nil), sub.tables["cmap"]...)
+        binary.BigEndian.PutUint16(cmap[2:], 1)
+        delete(wantCmap, 0x1f600)
+        if got := parseCmap(cmap, sub.numGlyphs); !reflect.DeepEqual(got, wantCmap) {
+                t.Errorf("format 4 cmap = %v, want %v", got, wantCmap)
+        }
+}
+
+func TestEmbedFont(t *testing.T) {
+        d := openFixture(t, buildPDF(t, sampleObjects(), sampleTrailer, fixtureOptions{}))
+        u, err := d.NewUpdate()
+        if err != nil {
+                t.Fatal(err)
+        }
+        f, err := u.EmbedFont(testFont(t))
+        if err != nil {
+                t.Fatal(err)
+        }
+        o, err := u.Overlay(1)
+        if err != nil {
+                t.Fatal(err)
+        }
+        o.Text(f, 10, 20, 30, "AÄB")
+        var out bytes.Buffer
+        if _, err := u.WriteTo(&out); err != nil {
+                t.Fatal(err)
+        }
+
+        d = openFixture(t, out.Bytes())
+        p, _ := d.Page(1)
+        fonts := d.getDict(d.getDict(p.Dict["Resources"])["Font"])
+        if len(fonts) != 1 {
+                t.Fatalf("page fonts = %v", fonts)
+        }
+        for _, ref := range fonts {
+                font := d.getDict(ref)
+                pf := d.loadFont(font)
+                for code, want := range map[string]struct {
+                        width float64
+                        text  string
+                }{
+                        "\x00\x01": {0.6, "A"},
+                        "\x00\x02": {0.7, "B"},
+                        "\x00\x03": {0.65, "Ä"},
+                } {
+                        if w, s := pf.width(code), pf.text(code); math.Abs(w-want.width) > 1e-9 || s != want.text {
+                                t.Errorf("code %x: width %v text %q, want %v %q", code, w, s, want.width, want.text)
+                        }
+                }
+
+                cid := d.getDict(d.get(font["DescendantFonts"]).(Array)[0])
+                stm, _ := d.get(d.getDict(cid["FontDescriptor"])["FontFile2"]).(*Stream)
+                if stm == nil {
+                        t.Fatal("no FontFile2")
+                }
+                program, err := d.StreamData(stm)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                tt, err := parseTrueType(program)
+                if err != nil {
+                        t.Fatalf("parsing the embedded font: %v", err)
+                }
+                wantCmap := map[rune]uint16{'A': 1, 'B': 2, 'Ä': 3, 0x1f600: 4}
+                if !reflect.DeepEqual(tt.cmap, wantCmap) {
+                        t.Errorf("embedded cmap = %v, want %v", tt.cmap, wantCmap)
+                }
+        }
+}
@@ -0,0 +1,629 @@
+package pdfdoc
+
+import (
+        "bufio"
+        "bytes"
+        "compress/zlib"
+        "errors"
+        "fmt"
+        "io"
+        "math"
+        "os"
+        "sort"
+        "strconv"
+        "strings"
+)
+
+// ----------------------------------------------------------------------------------
+// Incremental updates
+// ----------------------------------------------------------------------------------
+
+// Update collects changes to a document and writes them as an incremental
+// update: the original bytes, unchanged, followed by the new and replaced
+// objects and a cross-reference section for them. Existing content is never
+// re-encoded, and signatures over the original bytes stay intact.
+type Update struct {
+        d       *Document
+        objects map[int]updated
+        nextNum int
+
+        pages    map[int]Dict // page dictionaries being changed, by page number
+        overlays []*Overlay
+        fonts    []*Font
+
+        // saveState is the shared "q" stream overlays put before the page's
+        // content.
+        saveState Ref
+
+        // rewrite is set when the document is written anew; see Rewrite.
+        rewrite bool
+}
+
+type updated struct {
+        gen int
+        obj Object
+}
+
+// NewUpdate starts an update of d. Encrypted documents can be updated only
+// when their file key is known (no user password); new objects are then
+// encrypted like the existing ones.
+func (d *Document) NewUpdate() (*Update, error) {
+        if d.needPassword() {
+                return nil, ErrPasswordRequired
+        }
+        next := 1
+        for num := range d.xref {
+                next = max(next, num+1)
+        }
+        if size, ok := asInt(d.trailer["Size"]); ok && size < maxXrefEntries {
+                next = max(next, int(size))
+        }
+        return &Update{
+                d:       d,
+                objects: make(map[int]updated),
+                nextNum: next,
+                pages:   make(map[int]Dict),
+        }, nil
+}
+
+// Document returns the document being updated.
+func (u *Update) Document() *Document { return u.d }
+
+// Add adds a new indirect object and returns its reference.
+func (u *Update) Add(o Object) Ref {
+        ref := u.alloc()
+        u.Set(ref, o)
+        return ref
+}
+
+func (u *Update) alloc() Ref {
+        ref := Ref{Num: u.nextNum}
+        u.nextNum++
+        return ref
+}
+
+// Set replaces object ref, or defines one reserved by Add.
+func (u *Update) Set(ref Ref, o Object) {
+        u.objects[ref.Num] = updated{gen: ref.Gen, obj: o}
+}
+
+// PageDict returns a copy of page n's dictionary that is written back with
+// the update, so changes to it replace the page. Inheritable attributes are
+// not merged in.
+func (u *Update) PageDict(n int) (Dict, error) {
+        if p, ok := u.pages[n]; ok {
+                return p, nil
+        }
+        page, ok := u.d.Page(n)
+        if !ok {
+                return nil, fmt.Errorf("pdfdoc: no page %d", n)
+        }
+        if page.Ref == (Ref{}) {
+                return nil, fmt.Errorf("pdfdoc: page %d is not an indirect object", n)
+        }
+        p := make(Dict, len(page.Dict)+2)
+        for k, v := range page.Dict {
+                p[k] = v
+        }
+        u.pages[n] = p
+        u.Set(page.Ref, p)
+        return p, nil
+}
+
+// WriteFile writes the updated document to path.
+func (u *Update) WriteFile(path string) error {
+        f, err := os.Create(path)
+        if err != nil {
+                return err
+        }
+        bw := bufio.NewWriterSize(f, 64<<10)
+        if _, err := u.WriteTo(bw); err != nil {
+                f.Close()
+                return err
+        }
+        if err := bw.Flush(); err != nil {
+                f.Close()
+                return err
+        }
+        return f.Close()
+}
+
+// Rewrite makes the update write the whole document anew rather than
+// append to it. Only the objects still in use are written, so what the
+// update replaced or removed is gone from the file, as redaction needs;
+// signatures over the original bytes no longer verify.
+func (u *Update) Rewrite() { u.rewrite = true }
+
+// WriteTo writes the original document followed by the update, or the
+// updated document as a whole after Rewrite.
+func (u *Update) WriteTo(w io.Writer) (int64, error) {
+        if err := u.finish(); err != nil {
+                return 0, err
+        }
+        if u.rewrite {
+                return u.writeFull(w)
+        }
+        cw := &countingWriter{w: w}
+        if _, err := io.Copy(cw, io.NewSectionReader(u.d.r, 0, u.d.size)); err != nil {
+                return cw.n, err
+        }
+        if last := u.d.readAt(u.d.size-1, 1); len(last) == 1 && last[0] != '\n' && last[0] != '\r' {
+                cw.Write([]byte("\n"))
+        }
+
+        offsets := make(map[int]xrefEntry, len(u.objects))
+        for _, num := range sortedNums(objectNums(u.objects)) {
+                obj := u.objects[num]
+                offsets[num] = xrefEntry{kind: inFile, off: cw.n, gen: obj.gen}
+                b, err := u.d.encodeIndirect(Ref{num, obj.gen}, obj.obj)
+                if err != nil {
+                        return cw.n, err
+                }
+                cw.Write(b)
+        }
+        if cw.err != nil {
+                return cw.n, cw.err
+        }
+        if err := u.writeXref(cw, offsets); err != nil {
+                return cw.n, err
+        }
+        return cw.n, cw.err
+}
+
+// finish turns the overlays and fonts into objects.
+func (u *Update) finish() error {
+        for _, o := range u.overlays {
+                if err := o.attach(); err != nil {
+                        return err
+                }
+        }
+        u.overlays = nil
+        for _, f := range u.fonts {
+                if err := f.finish(u); err != nil {
+                        return err
+                }
+        }
+        u.fonts = nil
+        return nil
+}
+
+// writeXref writes the cross-reference section and trailer. It normally
+// lists only the update's objects and links to the previous section; for a
+// document whose table had to be rebuilt it lists every object instead, so
+// readers never see the damaged one.
+func (u *Update) writeXref(cw *countingWriter, offsets map[int]xrefEntry) error {
+        d := u.d
+        trailer := make(Dict, len(d.trailer)+2)
+        for k, v := range d.trailer {
+                switch k {
+                case "Prev", "XRefStm", "Filter", "DecodeParms", "Length", "W", "Index", "Type", "DL":
+                        continue
+                }
+                trailer[k] = v
+        }
+        entries := offsets
+        if d.repaired {
+                entries = make(map[int]xrefEntry, len(d.xref)+len(offsets))
+                for num, e := range d.xref {
+                        if e.kind != free && num > 0 {
+                                entries[num] = e
+                        }
+                }
+                for num, e := range offsets {
+                        entries[num] = e
+                }
+        } else {
+                trailer["Prev"] = d.startxref
+        }
+
+        useStream := d.xrefStream
+        for _, e := range entries {
+                useStream = useStream || e.kind == inStream
+        }
+        size := u.nextNum
+        if useStream {
+                size++ // the stream itself
+        }
+        for num := range entries {
+                size = max(size, num+1)
+        }
+        trailer["Size"] = int64(size)
+
+        xrefOff := cw.n
+        if useStream {
+                ref := Ref{Num: size - 1}
+                entries[ref.Num] = xrefEntry{kind: inFile, off: xrefOff}
+                stm, err := xrefStream(trailer, entries, d.repaired)
+                if err != nil {
+                        return err
+                }
+                b, err := d.encodeIndirect(ref, stm)
+                if err != nil {
+                        return err
+                }
+                cw.Write(b)
+        } else {
+                var b bytes.Buffer
+                b.WriteString("xref\n")
+                nums := sortedNums(entries)
+                if d.repaired {
+                        nums = append([]int{0}, nums...)
+                }
+                for i := 0; i < len(nums); {
+                        j := i + 1
+                        for j < len(nums) && nums[j] == nums[j-1]+1 {
+                                j++
+                        }
+                        fmt.Fprintf(&b, "%d %d\n", nums[i], j-i)
+                        for _, num := range nums[i:j] {
+                                if e, ok := entries[num]; ok {
+                                        fmt.Fprintf(&b, "%010d %05d n \n", e.off, e.gen)
+                                } else {
+                                        b.WriteString("0000000000 65535 f \n")
+                                }
+                        }
+                        i = j
+                }
+                b.WriteString("trailer\n")
+                b.Write(encodeObject(trailer))
+                b.WriteString("\n")
+                cw.Write(b.Bytes())
+        }
+        fmt.Fprintf(cw, "startxref\n%d\n%%%%EOF\n", xrefOff)
+        return nil
+}
+
+// writeFull writes the updated document as a single revision holding the
+// objects reachable from the trailer, with their numbers unchanged: stream
+// data of the file is copied as stored, and its encryption stays valid.
+func (u *Update) writeFull(w io.Writer) (int64, error) {
+        d := u.d
+        trailer := make(Dict, 4)
+        for _, k := range []Name{"Root", "Info", "Encrypt", "ID"} {
+                if v, ok := d.trailer[k]; ok {
+                        trailer[k] = v
+                }
+        }
+
+        objects := make(map[int]updated)
+        var pending []Ref
+        var visit func(o Object)
+        visit = func(o Object) {
+                switch v := o.(type) {
+                case Ref:
+                        if _, seen := objects[v.Num]; !seen && v.Num > 0 {
+                                objects[v.Num] = updated{gen: v.Gen}
+                                pending = append(pending, v)
+                        }
+                case Array:
+                        for _, item := range v {
+                                visit(item)
+                        }
+                case Dict:
+                        for _, item := range v {
+                                visit(item)
+                        }
+                case *Stream:
+                        for k, item := range v.Dict {
+                                // Lengths are written directly.
+                                if k != "Length" {
+                                        visit(item)
+                                }
+                        }
+                }
+        }
+        visit(trailer)
+        for len(pending) > 0 {
+                ref := pending[len(pending)-1]
+                pending = pending[:len(pending)-1]
+                o, ok := u.objects[ref.Num]
+                if !ok {
+                        obj, err := d.object(ref)
+                        if err != nil {
+                                obj = nil
+                        }
+                        o = updated{gen: ref.Gen, obj: obj}
+                }
+                objects[ref.Num] = o
+                visit(o.obj)
+        }
+
+        cw := &countingWriter{w: w}
+        fmt.Fprintf(cw, "%%PDF-%s\n%%\xe2\xe3\xcf\xd3\n", d.version)
+        entries := make(map[int]xrefEntry, len(objects))
+        for _, num := range sortedNums(objectNums(objects)) {
+                o := objects[num]
+                entries[num] = xrefEntry{kind: inFile, off: cw.n, gen: o.gen}
+                b, err := d.encodeIndirect(Ref{num, o.gen}, o.obj)
+                if err != nil {
+                        return cw.n, err
+                }
+                cw.Write(b)
+        }
+
+        size := 1
+        for num := range entries {
+                size = max(size, num+1)
+        }
+        trailer["Size"] = int64(size)
+        xrefOff := cw.n
+        var b bytes.Buffer
+        fmt.Fprintf(&b, "xref\n0 %d\n", size)
+        for num := 0; num < size; num++ {
+                if e, ok := entries[num]; ok {
+                        fmt.Fprintf(&b, "%010d %05d n \n", e.off, e.gen)
+                } else {
+                        b.WriteString("0000000000 65535 f \n")
+                }
+        }
+        b.WriteString("trailer\n")
+        b.Write(encodeObject(trailer))
+        fmt.Fprintf(&b, "\nstartxref\n%d\n%%%%EOF\n", xrefOff)
+        cw.Write(b.Bytes())
+        return cw.n, cw.err
+}
+
+// objectNums returns the numbers of objects, as keys for sortedNums.
+func objectNums(objects map[int]updated) map[int]xrefEntry {
+        m := make(map[int]xrefEntry, len(objects))
+        for num := range objects {
+                m[num] = xrefEntry{}
+        }
+        return m
+}
+
+func xrefStream(trailer Dict, entries map[int]xrefEntry, full bool) (*Stream, error) {
+        maxOff := int64(0)
+        for _, e := range entries {
+                maxOff = max(maxOff, e.off)
+        }
+        offWidth := 1
+        for maxOff >= 1<<(8*offWidth) {
+                offWidth++
+        }
+        nums := sortedNums(entries)
+        if full {
+                nums = append([]int{0}, nums...)
+        }
+        var rows bytes.Buffer
+        var index Array
+        for i := 0; i < len(nums); {
+                j := i + 1
+                for j < len(nums) && nums[j] == nums[j-1]+1 {
+                        j++
+                }
+                index = append(index, int64(nums[i]), int64(j-i))
+                for _, num := range nums[i:j] {
+                        e, ok := entries[num]
+                        typ, f2, f3 := byte(0), int64(0), 65535
+                        if ok {
+                                typ, f2, f3 = 1, e.off, e.gen
+                                if e.kind == inStream {
+                                        typ = 2
+                                }
+                        }
+                        rows.WriteByte(typ)
+                        for k := offWidth - 1; k >= 0; k-- {
+                                rows.WriteByte(byte(f2 >> (8 * k)))
+                        }
+                        rows.Write([]byte{byte(f3 >> 8), byte(f3)})
+                }
+                i = j
+        }
+        dict := make(Dict, len(trailer)+5)
+        for k, v := range trailer {
+                dict[k] = v
+        }
+        dict["Type"] = Name("XRef")
+        dict["W"] = Array{int64(1), int64(offWidth), int64(2)}
+        dict["Index"] = index
+        dict["Filter"] = Name("FlateDecode")
+        data, err := deflate(rows.Bytes())
+        if err != nil {
+                return nil, err
+        }
+        return NewStream(dict, data), nil
+}
+
+type countingWriter struct {
+        w   io.Writer
+        n   int64
+        err error
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+        if c.err != nil {
+                return 0, c.err
+        }
+        n, err := c.w.Write(b)
+        c.n += int64(n)
+        c.err = err
+        return n, err
+}
+
+// deflate compresses data for FlateDecode.
+func deflate(data []byte) ([]byte, error) {
+        var b bytes.Buffer
+        zw, err := zlib.NewWriterLevel(&b, zlib.BestCompression)
+        if err != nil {
+                return nil, err
+        }
+        zw.Write(data)
+        if err := zw.Close(); err != nil {
+                return nil, err
+        }
+        return b.Bytes(), nil
+}
+
+// ----------------------------------------------------------------------------------
+// Serialization
+// ----------------------------------------------------------------------------------
+
+// encodeIndirect serializes object ref, encrypting its strings and stream
+// data when the document is encrypted.
+func (d *Document) encodeIndirect(ref Ref, o Object) ([]byte, error) {
+        e := &encoder{}
+        // Neither the encryption dictionary nor cross-reference streams are
+        // encrypted.
+        if s, ok := o.(*Stream); d.crypt != nil && ref != d.encryptRef && !(ok && s.Dict.Type() == "XRef") {
+                e.crypt, e.ref = d.crypt, ref
+        }
+        fmt.Fprintf(&e.b, "%d %d obj\n", ref.Num, ref.Gen)
+        if s, ok := o.(*Stream); ok {
+                data := s.data
+                if !s.mem {
+                        // Streams of the file are copied as stored: their encryption
+                        // depends only on the object number, which doesn't change.
+                        data = d.readAt(s.off, int(s.length))
+                } else if e.crypt != nil && e.crypt.encryptsStream(s) {
+                        var err error
+                        if data, err = e.crypt.encrypt(data, ref); err != nil {
+                                return nil, err
+                        }
+                }
+                dict := make(Dict, len(s.Dict))
+                for k, v := range s.Dict {
+                        dict[k] = v
+                }
+                dict["Length"] = int64(len(data))
+                e.encode(dict)
+                e.b.WriteString("\nstream\n")
+                e.b.Write(data)
+                e.b.WriteString("\nendstream")
+        } else {
+                e.encode(o)
+        }
+        e.b.WriteString("\nendobj\n")
+        return e.b.Bytes(), e.err
+}
+
+// encodeObject serializes a direct object without encryption.
+func encodeObject(o Object) []byte {
+        e := &encoder{}
+        e.encode(o)
+        return e.b.Bytes()
+}
+
+type encoder struct {
+        b     bytes.Buffer
+        crypt *decrypter
+        ref   Ref
+        err   error
+}
+
+func (e *encoder) encode(o Object) {
+        switch v := o.(type) {
+        case nil:
+                e.b.WriteString("null")
+        case bool:
+                e.b.WriteString(strconv.FormatBool(v))
+        case int:
+                e.b.WriteString(strconv.Itoa(v))
+        case int64:
+                e.b.WriteString(strconv.FormatInt(v, 10))
+        case float64:
+                e.b.WriteString(formatNumber(v))
+        case Name:
+                writeName(&e.b, v)
+        case String:
+                s := []byte(v)
+                if e.crypt != nil && !e.crypt.strNone {
+                        var err error
+                        if s, err = e.crypt.encrypt(s, e.ref); err != nil && e.err == nil {
+                                e.err = err
+                        }
+                }
+                writeString(&e.b, s)
+        case Ref:
+                fmt.Fprintf(&e.b, "%d %d R", v.Num, v.Gen)
+        case Array:
+                e.b.WriteByte('[')
+                for i, item := range v {
+                        if i > 0 {
+                                e.b.WriteByte(' ')
+                        }
+                        e.encode(item)
+                }
+                e.b.WriteByte(']')
+        case Dict:
+                keys := make([]string, 0, len(v))
+                for k := range v {
+                        keys = append(keys, string(k))
+                }
+                sort.Strings(keys)
+                e.b.WriteString("<<")
+                for _, k := range keys {
+                        writeName(&e.b, Name(k))
+                        e.b.WriteByte(' ')
+                        e.encode(v[Name(k)])
+                }
+                e.b.WriteString(">>")
+        case *Stream:
+                if e.err == nil {
+                        e.err = errors.New("pdfdoc: stream used as a direct object")
+                }
+        default:
+                if e.err == nil {
+                        e.err = fmt.Errorf("pdfdoc: can't encode %T", o)
+                }
+        }
+}
+
+// formatNumber writes a real with up to four decimals, which is finer than
+// any device resolution.
+func formatNumber(v float64) string {
+        if math.IsNaN(v) || math.IsInf(v, 0) {
+                return "0"
+        }
+        s := strings.TrimRight(strings.TrimRight(strconv.FormatFloat(v, 'f', 4, 64), "0"), ".")
+        if s == "-0" {
+                return "0"
+        }
+        return s
+}
+
+func writeName(b *bytes.Buffer, n Name) {
+        b.WriteByte('/')
+        for i := 0; i < len(n); i++ {
+                c := n[i]
+                if c < 0x21 || c > 0x7e || c == '#' || isDelim(c) {
+                        fmt.Fprintf(b, "#%02X", c)
+                } else {
+                        b.WriteByte(c)
+                }
+        }
+}
+
+// writeString writes s as a literal string, or in hex when it's mostly
+// binary.
+func writeString(b *bytes.Buffer, s []byte) {
+        binary := 0
+        for _, c := range s {
+                if c < 0x20 || c > 0x7e {
+                        binary++
+                }
+        }
+        if binary > len(s)/4 {
+                fmt.Fprintf(b, "<%X>", s)
+                return
+        }
+        b.WriteByte('(')
+        for _, c := range s {
+                switch c {
+                case '(', ')', '\\':
+                        b.WriteByte('\\')
+                        b.WriteByte(c)
+                case '\n':
+                        b.WriteString(`\n`)
+                case '\r':
+                        b.WriteString(`\r`)
+                default:
+                        if c < 0x20 || c > 0x7e {
+                                fmt.Fprintf(b, "\\%03o", c)
+                        } else {
+                                b.WriteByte(c)
+                        }
+                }
+        }
+        b.WriteByte(')')
+}
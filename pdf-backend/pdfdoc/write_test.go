@@ -0,0 +1,146 @@
+package pdfdoc
+
+import (
+        "bytes"
+        "testing"
+)
+
+// fixtureBases are the documents updates are tested on.
+var fixtureBases = []struct {
+        name     string
+        opt      func() fixtureOptions
+        repaired bool
+}{
+        {name: "classic table", opt: func() fixtureOptions { return fixtureOptions{} }},
+        {name: "object streams", opt: func() fixtureOptions {
+                return fixtureOptions{xrefStream: true, objStm: sampleObjStm}
+        }},
+        {name: "encrypted", opt: func() fixtureOptions {
+                return fixtureOptions{crypt: newFixtureCrypt("AESV2", "")}
+        }},
+        {name: "repaired", repaired: true, opt: func() fixtureOptions { return fixtureOptions{} }},
+}
+
+// fixtureBase builds objs, with a broken startxref if repaired is set.
+func fixtureBase(t *testing.T, objs map[int]fixtureObject, opt fixtureOptions, repaired bool) []byte {
+        b := buildPDF(t, objs, sampleTrailer, opt)
+        if repaired {
+                i := bytes.LastIndex(b, []byte("startxref"))
+                b = append(b[:i:i], "startxref\n999999\n%%EOF\n"...)
+        }
+        return b
+}
+
+func TestIncrementalUpdate(t *testing.T) {
+        for _, base := range fixtureBases {
+                t.Run(base.name, func(t *testing.T) {
+                        orig := fixtureBase(t, sampleObjects(), base.opt(), base.repaired)
+                        d := openFixture(t, orig)
+                        if d.Repaired() != base.repaired {
+                                t.Fatalf("Repaired() = %v, want %v", d.Repaired(), base.repaired)
+                        }
+                        u, err := d.NewUpdate()
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        note := u.Add(Dict{"Note": String("added")})
+                        data := u.Add(NewStream(nil, []byte("new stream data")))
+                        u.Set(Ref{Num: 14}, Dict{"Title": String("New title"), "Extra": Array{note, data}})
+                        var out bytes.Buffer
+                        if _, err := u.WriteTo(&out); err != nil {
+                                t.Fatal(err)
+                        }
+                        if !bytes.HasPrefix(out.Bytes(), orig) {
+                                t.Fatal("the original bytes were changed")
+                        }
+
+                        d = openFixture(t, out.Bytes())
+                        if d.Repaired() {
+                                t.Error("the updated document needed repairs")
+                        }
+                        for _, ref := range []Ref{note, data, {Num: 14}} {
+                                if e, ok := d.xref[ref.Num]; !ok || e.kind != inFile || e.off < int64(len(orig)) {
+                                        t.Errorf("object %v: xref entry %+v, want one in the update", ref, e)
+                                }
+                        }
+                        if o, _ := d.Resolve(note); o.(Dict)["Note"] != String("added") {
+                                t.Errorf("object %v = %v", note, o)
+                        }
+                        o, _ := d.Resolve(data)
+                        if b, err := d.StreamData(o.(*Stream)); err != nil || string(b) != "new stream data" {
+                                t.Errorf("object %v data = %q, %v", data, b, err)
+                        }
+                        if info, err := d.Info(); err != nil || info.Title != "New title" {
+                                t.Errorf("Info() = %+v, %v", info, err)
+                        }
+                        // Objects the update didn't touch are still read from the
+                        // original revision.
+                        if d.NumPages() != 3 {
+                                t.Errorf("NumPages() = %d, want 3", d.NumPages())
+                        }
+                        if outline, err := d.Outline(); err != nil || len(outline) != 2 {
+                                t.Errorf("Outline() = %+v, %v", outline, err)
+                        }
+                })
+        }
+}
+
+func TestRewriteDropsUnreachable(t *testing.T) {
+        for _, base := range fixtureBases {
+                t.Run(base.name, func(t *testing.T) {
+                        objs := sampleObjects()
+                        objs[15] = fixtureObject{dict: "<< /Length LEN >>", stream: []byte("orphaned data")}
+                        opt := base.opt()
+                        d := openFixture(t, fixtureBase(t, objs, opt, base.repaired))
+                        u, err := d.NewUpdate()
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        // Replacing the contents of page 1 leaves object 4 unused.
+                        page, err := u.PageDict(1)
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        page["Contents"] = u.Add(NewStream(nil, []byte("BT /F1 24 Tf 72 700 Td (Bye) Tj ET")))
+                        u.Rewrite()
+                        var out bytes.Buffer
+                        if _, err := u.WriteTo(&out); err != nil {
+                                t.Fatal(err)
+                        }
+                        if n := bytes.Count(out.Bytes(), []byte("startxref")); n != 1 {
+                                t.Errorf("%d revisions, want 1", n)
+                        }
+                        if opt.crypt == nil {
+                                for _, s := range []string{"orphaned data", "(Hello)"} {
+                                        if bytes.Contains(out.Bytes(), []byte(s)) {
+                                                t.Errorf("output still contains %q", s)
+                                        }
+                                }
+                        }
+
+                        d = openFixture(t, out.Bytes())
+                        for _, num := range []int{4, 15} {
+                                if e := d.xref[num]; e.kind != free {
+                                        t.Errorf("object %d: xref entry %+v, want free", num, e)
+                                }
+                        }
+                        p, _ := d.Page(1)
+                        o, _ := d.Resolve(p.Dict["Contents"])
+                        if b, err := d.StreamData(o.(*Stream)); err != nil || !bytes.Contains(b, []byte("(Bye)")) {
+                                t.Errorf("page 1 contents = %q, %v", b, err)
+                        }
+                        if d.NumPages() != 3 {
+                                t.Errorf("NumPages() = %d, want 3", d.NumPages())
+                        }
+                        if info, err := d.Info(); err != nil || info.Title != "Titítle" {
+                                t.Errorf("Info() = %+v, %v", info, err)
+                        }
+                        if outline, err := d.Outline(); err != nil || len(outline) != 2 || outline[0].Page != 1 {
+                                t.Errorf("Outline() = %+v, %v", outline, err)
+                        }
+                        if xmp, err := d.Metadata(); err != nil || string(xmp) != "<x:xmpmeta>hi</x:xmpmeta>" {
+                                t.Errorf("Metadata() = %q, %v", xmp, err)
+                        }
+                })
+        }
+}
@@ -0,0 +1,631 @@
+package pdfdoc
+
+import (
+        "bytes"
+        "errors"
+        "fmt"
+        "regexp"
+        "sort"
+        "strconv"
+)
+
+// xrefEntry locates an object: in the file (inFile, at off with generation
+// gen) or in an object stream (inStream, stream number off, index gen).
+type xrefEntry struct {
+        kind byte
+        off  int64
+        gen  int
+}
+
+const (
+        free byte = iota
+        inFile
+        inStream
+)
+
+const (
+        // maxXrefEntries bounds the entries one section may declare.
+        maxXrefEntries = 10_000_000
+        // maxRefChain bounds chains of references to references.
+        maxRefChain = 32
+)
+
+var errNoXref = errors.New("pdfdoc: cross-reference table not found")
+
+// readXref reads the newest cross-reference section and every older one it
+// links to, so entries of incremental updates shadow those they replace.
+func (d *Document) readXref() error {
+        off, err := d.findStartXref()
+        if err != nil {
+                return err
+        }
+        d.startxref = off
+        seen := make(map[int64]bool)
+        for off > 0 && !seen[off] {
+                seen[off] = true
+                trailer, err := d.readXrefSection(off)
+                if err != nil {
+                        return err
+                }
+                if off == d.startxref {
+                        d.xrefStream = trailer.Type() == "XRef"
+                }
+                // A hybrid file lists objects in compressed streams separately.
+                if stm, ok := asInt(trailer["XRefStm"]); ok && !seen[stm] {
+                        seen[stm] = true
+                        if _, err := d.readXrefSection(stm); err != nil {
+                                return err
+                        }
+                }
+                d.mergeTrailer(trailer)
+                prev, ok := asInt(trailer["Prev"])
+                if !ok {
+                        break
+                }
+                off = prev
+        }
+        if d.trailer == nil {
+                return errNoXref
+        }
+        return nil
+}
+
+// mergeTrailer adds the keys of an older trailer that newer ones lack.
+func (d *Document) mergeTrailer(t Dict) {
+        if d.trailer == nil {
+                d.trailer = make(Dict)
+        }
+        for k, v := range t {
+                switch k {
+                case "Prev", "XRefStm", "Filter", "DecodeParms", "Length", "W", "Index", "Type":
+                        continue
+                }
+                if _, ok := d.trailer[k]; !ok {
+                        d.trailer[k] = v
+                }
+        }
+}
+
+func (d *Document) findStartXref() (int64, error) {
+        n := int64(2048)
+        if n > d.size {
+                n = d.size
+        }
+        tail := d.readAt(d.size-n, int(n))
+        i := bytes.LastIndex(tail, []byte("startxref"))
+        if i < 0 {
+                return 0, errNoXref
+        }
+        l := newBytesLexer(tail[i+len("startxref"):])
+        off, ok := l.next().(int64)
+        if !ok || off <= 0 || off >= d.size {
+                return 0, errNoXref
+        }
+        return off, nil
+}
+
+// readXrefSection reads a table or stream at off and returns its trailer.
+func (d *Document) readXrefSection(off int64) (Dict, error) {
+        l := newLexer(d.r, off)
+        tok := l.next()
+        if tok == keyword("xref") {
+                return d.readXrefTable(l)
+        }
+        if _, ok := tok.(int64); !ok {
+                return nil, fmt.Errorf("pdfdoc: no cross-reference section at offset %d", off)
+        }
+        obj, err := d.parseIndirect(off, Ref{Num: -1})
+        if err != nil {
+                return nil, err
+        }
+        stm, ok := obj.(*Stream)
+        if !ok || stm.Dict.Type() != "XRef" {
+                return nil, fmt.Errorf("pdfdoc: no cross-reference stream at offset %d", off)
+        }
+        return stm.Dict, d.readXrefStream(stm)
+}
+
+func (d *Document) readXrefTable(l *lexer) (Dict, error) {
+        firstSection := true
+        for {
+                tok := l.next()
+                if tok == keyword("trailer") {
+                        t, ok := l.readObject().(Dict)
+                        if !ok {
+                                return nil, errors.New("pdfdoc: malformed trailer")
+                        }
+                        return t, nil
+                }
+                start, ok1 := tok.(int64)
+                count, ok2 := l.next().(int64)
+                if !ok1 || !ok2 || start < 0 || count < 0 || count > maxXrefEntries {
+                        return nil, errors.New("pdfdoc: malformed cross-reference table")
+                }
+                for i := int64(0); i < count; i++ {
+                        off, ok1 := l.next().(int64)
+                        gen, ok2 := l.next().(int64)
+                        typ, ok3 := l.next().(keyword)
+                        if !ok1 || !ok2 || !ok3 || (typ != "n" && typ != "f") {
+                                return nil, errors.New("pdfdoc: malformed cross-reference entry")
+                        }
+                        // Some writers number the first section from 1 although it
+                        // starts with the head of the free list, object 0.
+                        if firstSection && i == 0 && start == 1 && typ == "f" && gen == 65535 {
+                                start = 0
+                        }
+                        num := int(start + i)
+                        if typ == "n" && off > 0 {
+                                d.setXref(num, xrefEntry{kind: inFile, off: off, gen: int(gen)})
+                        } else {
+                                d.setXref(num, xrefEntry{kind: free})
+                        }
+                }
+                firstSection = false
+        }
+}
+
+func (d *Document) readXrefStream(stm *Stream) error {
+        data, err := d.StreamData(stm)
+        if err != nil {
+                return fmt.Errorf("pdfdoc: cross-reference stream: %w", err)
+        }
+        w, _ := stm.Dict["W"].(Array)
+        if len(w) < 3 {
+                return errors.New("pdfdoc: cross-reference stream without /W")
+        }
+        var widths [3]int
+        rowLen := 0
+        for i := range widths {
+                n, ok := asInt(w[i])
+                if !ok || n < 0 || n > 8 {
+                        return errors.New("pdfdoc: invalid /W in cross-reference stream")
+                }
+                widths[i] = int(n)
+                rowLen += int(n)
+        }
+        if rowLen == 0 {
+                return errors.New("pdfdoc: invalid /W in cross-reference stream")
+        }
+        index, _ := stm.Dict["Index"].(Array)
+        if len(index) == 0 {
+                size, _ := asInt(stm.Dict["Size"])
+                index = Array{int64(0), size}
+        }
+        field := func(b []byte) int64 {
+                var v int64
+                for _, c := range b {
+                        v = v<<8 | int64(c)
+                }
+                return v
+        }
+        for i := 0; i+1 < len(index); i += 2 {
+                start, ok1 := asInt(index[i])
+                count, ok2 := asInt(index[i+1])
+                if !ok1 || !ok2 || start < 0 || count < 0 || count > maxXrefEntries {
+                        return errors.New("pdfdoc: invalid /Index in cross-reference stream")
+                }
+                for j := int64(0); j < count; j++ {
+                        if len(data) < rowLen {
+                                return nil
+                        }
+                        row := data[:rowLen]
+                        data = data[rowLen:]
+                        typ := int64(1)
+                        if widths[0] > 0 {
+                                typ = field(row[:widths[0]])
+                        }
+                        f2 := field(row[widths[0] : widths[0]+widths[1]])
+                        f3 := field(row[widths[0]+widths[1]:])
+                        num := int(start + j)
+                        switch typ {
+                        case 0:
+                                d.setXref(num, xrefEntry{kind: free})
+                        case 1:
+                                d.setXref(num, xrefEntry{kind: inFile, off: f2, gen: int(f3)})
+                        case 2:
+                                d.setXref(num, xrefEntry{kind: inStream, off: f2, gen: int(f3)})
+                        }
+                }
+        }
+        return nil
+}
+
+// setXref records an entry unless a newer section already did.
+func (d *Document) setXref(num int, e xrefEntry) {
+        if _, ok := d.xref[num]; !ok {
+                d.xref[num] = e
+        }
+}
+
+// ----------------------------------------------------------------------------------
+// Objects
+// ----------------------------------------------------------------------------------
+
+// Resolve follows references until it reaches a direct object. References to
+// objects that don't exist resolve to null, as the format specifies.
+func (d *Document) Resolve(o Object) (Object, error) {
+        for i := 0; i < maxRefChain; i++ {
+                ref, ok := o.(Ref)
+                if !ok {
+                        return o, nil
+                }
+                var err error
+                if o, err = d.object(ref); err != nil {
+                        return nil, err
+                }
+        }
+        return nil, errors.New("pdfdoc: reference chain too long")
+}
+
+// get resolves o, treating unreadable objects as null. The error is kept
+// in d.lastErr so callers that come up empty can report it.
+func (d *Document) get(o Object) Object {
+        o, err := d.Resolve(o)
+        if err != nil {
+                d.lastErr = err
+                return nil
+        }
+        return o
+}
+
+// getDict resolves o to a dictionary, or to the dictionary of a stream.
+func (d *Document) getDict(o Object) Dict {
+        switch v := d.get(o).(type) {
+        case Dict:
+                return v
+        case *Stream:
+                return v.Dict
+        }
+        return nil
+}
+
+func (d *Document) object(ref Ref) (Object, error) {
+        if o, ok := d.cache[ref]; ok {
+                return o, nil
+        }
+        if d.resolving[ref] {
+                return nil, fmt.Errorf("pdfdoc: object %v refers to itself", ref)
+        }
+        d.resolving[ref] = true
+        defer delete(d.resolving, ref)
+
+        o, err := d.loadObject(ref)
+        if err != nil && !d.repaired {
+                // A damaged table is common; rebuild it from the objects themselves.
+                if rerr := d.repair(); rerr == nil {
+                        o, err = d.loadObject(ref)
+                }
+        }
+        if err != nil {
+                return nil, err
+        }
+        d.cache[ref] = o
+        return o, nil
+}
+
+func (d *Document) loadObject(ref Ref) (Object, error) {
+        e, ok := d.xref[ref.Num]
+        if !ok {
+                return nil, nil
+        }
+        switch e.kind {
+        case inFile:
+                if e.gen != ref.Gen {
+                        return nil, nil
+                }
+                o, err := d.parseIndirect(e.off, ref)
+                if err != nil {
+                        return nil, err
+                }
+                if d.crypt != nil && ref != d.encryptRef {
+                        o = d.crypt.decryptObject(o, ref)
+                }
+                return o, nil
+        case inStream:
+                if ref.Gen != 0 {
+                        return nil, nil
+                }
+                return d.objectInStream(int(e.off), e.gen, ref.Num)
+        }
+        return nil, nil
+}
+
+// parseIndirect parses the object "num gen obj ... endobj" at off. want.Num
+// is checked unless it is negative.
+func (d *Document) parseIndirect(off int64, want Ref) (Object, error) {
+        l := newLexer(d.r, off)
+        num, ok1 := l.next().(int64)
+        gen, ok2 := l.next().(int64)
+        kw := l.next()
+        if !ok1 || !ok2 || kw != keyword("obj") || (want.Num >= 0 && int(num) != want.Num) {
+                return nil, fmt.Errorf("pdfdoc: object %v not found at offset %d", want, off)
+        }
+        ref := Ref{Num: int(num), Gen: int(gen)}
+        obj := l.readObject()
+        if l.err != nil {
+                return nil, l.err
+        }
+        if k, ok := obj.(keyword); ok {
+                // endobj right away, or junk: a missing object is null.
+                if k == "endobj" {
+                        return nil, nil
+                }
+                return nil, fmt.Errorf("pdfdoc: object %v: unexpected %q", ref, string(k))
+        }
+        dict, isDict := obj.(Dict)
+        if !isDict || l.next() != keyword("stream") {
+                return obj, nil
+        }
+        // The keyword is followed by CRLF or LF (a lone CR is tolerated).
+        if c, ok := l.readByte(); ok {
+                if c == '\r' {
+                        if c, ok := l.readByte(); ok && c != '\n' {
+                                l.unreadByte()
+                        }
+                } else if c != '\n' {
+                        l.unreadByte()
+                }
+        }
+        s := &Stream{Dict: dict, ref: ref, off: l.pos(), length: -1}
+        if n, ok := asInt(d.lengthOf(dict["Length"])); ok && n >= 0 && s.off+n <= d.size {
+                s.length = n
+                if !d.endstreamAt(s.off + n) {
+                        s.length = -1
+                }
+        }
+        if s.length < 0 {
+                s.length = d.findEndstream(s.off)
+        }
+        return s, nil
+}
+
+// lengthOf resolves a stream's /Length, which may be an indirect object
+// that is itself being loaded.
+func (d *Document) lengthOf(o Object) Object {
+        if ref, ok := o.(Ref); ok && d.resolving[ref] {
+                return nil
+        }
+        return d.get(o)
+}
+
+func (d *Document) endstreamAt(off int64) bool {
+        b := bytes.TrimLeft(d.readAt(off, 32), "\x00\t\n\f\r ")
+        return bytes.HasPrefix(b, []byte("endstream"))
+}
+
+// findEndstream returns the length of stream data that starts at off, for
+// streams whose /Length is missing or wrong.
+func (d *Document) findEndstream(off int64) int64 {
+        const chunk = 64 << 10
+        marker := []byte("endstream")
+        for pos := off; pos < d.size; pos += chunk - int64(len(marker)) {
+                b := d.readAt(pos, chunk)
+                if i := bytes.Index(b, marker); i >= 0 {
+                        end := pos + int64(i)
+                        // Drop the end-of-line that precedes the keyword.
+                        tail := d.readAt(max(off, end-2), int(min(2, end-off)))
+                        if bytes.HasSuffix(tail, []byte("\r\n")) {
+                                end -= 2
+                        } else if len(tail) > 0 && (tail[len(tail)-1] == '\n' || tail[len(tail)-1] == '\r') {
+                                end--
+                        }
+                        return end - off
+                }
+                if len(b) < chunk {
+                        break
+                }
+        }
+        return d.size - off
+}
+
+func (d *Document) readAt(off int64, n int) []byte {
+        if off < 0 || n <= 0 {
+                return nil
+        }
+        if rest := d.size - off; int64(n) > rest {
+                if rest <= 0 {
+                        return nil
+                }
+                n = int(rest)
+        }
+        b := make([]byte, n)
+        m, _ := d.r.ReadAt(b, off)
+        return b[:m]
+}
+
+// ----------------------------------------------------------------------------------
+// Object streams
+// ----------------------------------------------------------------------------------
+
+type objStream struct {
+        data []byte
+        nums []int
+        offs []int
+}
+
+const maxObjStreamObjects = 1_000_000
+
+func (d *Document) objStream(num int) (*objStream, error) {
+        if s, ok := d.objStms[num]; ok {
+                return s, nil
+        }
+        o, err := d.Resolve(Ref{Num: num})
+        if err != nil {
+                return nil, err
+        }
+        stm, ok := o.(*Stream)
+        if !ok {
+                return nil, fmt.Errorf("pdfdoc: object stream %d not found", num)
+        }
+        data, err := d.StreamData(stm)
+        if err != nil {
+                return nil, fmt.Errorf("pdfdoc: object stream %d: %w", num, err)
+        }
+        n, _ := asInt(stm.Dict["N"])
+        first, _ := asInt(stm.Dict["First"])
+        if n < 0 || n > maxObjStreamObjects || first < 0 || first > int64(len(data)) {
+                return nil, fmt.Errorf("pdfdoc: object stream %d is malformed", num)
+        }
+        s := &objStream{data: data[first:]}
+        l := newBytesLexer(data[:first])
+        for i := int64(0); i < n; i++ {
+                objNum, ok1 := l.next().(int64)
+                off, ok2 := l.next().(int64)
+                if !ok1 || !ok2 || off < 0 || off > int64(len(s.data)) {
+                        break
+                }
+                s.nums = append(s.nums, int(objNum))
+                s.offs = append(s.offs, int(off))
+        }
+        d.objStms[num] = s
+        return s, nil
+}
+
+func (d *Document) objectInStream(stmNum, index, num int) (Object, error) {
+        s, err := d.objStream(stmNum)
+        if err != nil {
+                return nil, err
+        }
+        if index < 0 || index >= len(s.nums) || s.nums[index] != num {
+                // Trust the stream's own header over a wrong index.
+                index = -1
+                for i, n := range s.nums {
+                        if n == num {
+                                index = i
+                                break
+                        }
+                }
+                if index < 0 {
+                        return nil, nil
+                }
+        }
+        l := newBytesLexer(s.data[s.offs[index]:])
+        o := l.readObject()
+        if l.err != nil {
+                return nil, l.err
+        }
+        if _, ok := o.(keyword); ok {
+                return nil, nil
+        }
+        return o, nil
+}
+
+// ----------------------------------------------------------------------------------
+// Repair
+// ----------------------------------------------------------------------------------
+
+var objHeader = regexp.MustCompile(`(?:^|[\x00\t\n\f\r ])(\d{1,10})[\x00\t\n\f\r ]+(\d{1,5})[\x00\t\n\f\r ]+obj\b`)
+
+// repair rebuilds the cross-reference table by scanning the file for
+// objects and trailers, the way viewers open damaged files. Later
+// definitions of an object win, as they would in an incremental update.
+func (d *Document) repair() error {
+        if d.repaired {
+                return nil
+        }
+        d.repaired = true
+        objs := make(map[int]xrefEntry)
+        var trailers []int64
+
+        const chunk = 1 << 20
+        const overlap = 64
+        trailerKw := []byte("trailer")
+        for pos := int64(0); pos < d.size; pos += chunk {
+                b := d.readAt(pos, chunk+overlap)
+                for _, m := range objHeader.FindAllSubmatchIndex(b, -1) {
+                        if m[2] >= chunk && pos+int64(len(b)) < d.size {
+                                continue // seen again in the next chunk
+                        }
+                        num, _ := strconv.Atoi(string(b[m[2]:m[3]]))
+                        gen, _ := strconv.Atoi(string(b[m[4]:m[5]]))
+                        objs[num] = xrefEntry{kind: inFile, off: pos + int64(m[2]), gen: gen}
+                }
+                for i := 0; ; {
+                        j := bytes.Index(b[i:], trailerKw)
+                        if j < 0 {
+                                break
+                        }
+                        if i+j < chunk || pos+int64(len(b)) >= d.size {
+                                trailers = append(trailers, pos+int64(i+j))
+                        }
+                        i += j + len(trailerKw)
+                }
+        }
+        if len(objs) == 0 {
+                return errors.New("pdfdoc: no objects found; not a PDF file")
+        }
+
+        d.xref = objs
+        d.cache = make(map[Ref]Object)
+        d.objStms = make(map[int]*objStream)
+        trailer := make(Dict)
+        for _, off := range trailers {
+                l := newLexer(d.r, off)
+                l.next()
+                if t, ok := l.readObject().(Dict); ok {
+                        for k, v := range t {
+                                trailer[k] = v
+                        }
+                }
+        }
+        var catalog *Ref
+        var streams []int
+        for _, num := range sortedNums(objs) {
+                e := objs[num]
+                o, err := d.parseIndirect(e.off, Ref{Num: num, Gen: e.gen})
+                if err != nil {
+                        continue
+                }
+                var dict Dict
+                switch v := o.(type) {
+                case Dict:
+                        dict = v
+                case *Stream:
+                        dict = v.Dict
+                }
+                switch dict.Type() {
+                case "XRef":
+                        for _, k := range []Name{"Root", "Info", "Encrypt", "ID"} {
+                                if v, ok := dict[k]; ok {
+                                        trailer[k] = v
+                                }
+                        }
+                case "ObjStm":
+                        streams = append(streams, num)
+                case "Catalog":
+                        catalog = &Ref{Num: num, Gen: e.gen}
+                }
+        }
+        if _, ok := trailer["Root"]; !ok && catalog != nil {
+                trailer["Root"] = *catalog
+        }
+        if _, ok := trailer["Root"]; !ok {
+                return errors.New("pdfdoc: document catalog not found")
+        }
+        d.trailer = trailer
+        if err := d.setupEncryption(); err != nil {
+                return err
+        }
+        // Objects in object streams, unless also stored directly.
+        for _, num := range streams {
+                s, err := d.objStream(num)
+                if err != nil {
+                        continue
+                }
+                for i, n := range s.nums {
+                        if _, ok := d.xref[n]; !ok {
+                                d.xref[n] = xrefEntry{kind: inStream, off: int64(num), gen: i}
+                        }
+                }
+        }
+        return nil
+}
+
+func sortedNums(m map[int]xrefEntry) []int {
+        nums := make([]int, 0, len(m))
+        for n := range m {
+                nums = append(nums, n)
+        }
+        sort.Ints(nums)
+        return nums
+}
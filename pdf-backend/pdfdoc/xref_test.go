@@ -0,0 +1,139 @@
+package pdfdoc
+
+import (
+        "bytes"
+        "fmt"
+        "reflect"
+        "strconv"
+        "testing"
+        "time"
+)
+
+// appendUpdate appends an incremental update holding obj as object num to a
+// document with a classic cross-reference table.
+func appendUpdate(t *testing.T, base []byte, num int, obj, trailer string) []byte {
+        t.Helper()
+        i := bytes.LastIndex(base, []byte("startxref"))
+        prev, err := strconv.Atoi(string(bytes.Fields(base[i+len("startxref"):])[0]))
+        if err != nil {
+                t.Fatalf("startxref: %v", err)
+        }
+        out := bytes.NewBuffer(append([]byte{}, base...))
+        off := out.Len()
+        fmt.Fprintf(out, "%d 0 obj\n%s\nendobj\n", num, obj)
+        xref := out.Len()
+        fmt.Fprintf(out, "xref\n%d 1\n%010d 00000 n \ntrailer\n<< /Size %d %s /Prev %d >>\nstartxref\n%d\n%%%%EOF\n",
+                num, off, num+1, trailer, prev, xref)
+        return out.Bytes()
+}
+
+func TestOpenStructures(t *testing.T) {
+        classic := func(t *testing.T) []byte { return buildPDF(t, sampleObjects(), sampleTrailer, fixtureOptions{}) }
+        tests := []struct {
+                name     string
+                build    func(t *testing.T) []byte
+                repaired bool
+                title    string
+        }{
+                {name: "classic table", build: classic, title: "Titítle"},
+                {name: "xref stream", build: func(t *testing.T) []byte {
+                        return buildPDF(t, sampleObjects(), sampleTrailer, fixtureOptions{xrefStream: true})
+                }, title: "Titítle"},
+                {name: "object streams", build: func(t *testing.T) []byte {
+                        return buildPDF(t, sampleObjects(), sampleTrailer, fixtureOptions{xrefStream: true, objStm: sampleObjStm})
+                }, title: "Titítle"},
+                {name: "incremental update", build: func(t *testing.T) []byte {
+                        return appendUpdate(t, classic(t), 15, "<< /Title (Updated) >>", "/Root 1 0 R /Info 15 0 R")
+                }, title: "Updated"},
+                {name: "bad startxref", build: func(t *testing.T) []byte {
+                        b := classic(t)
+                        // Shift every object so the table is wrong too.
+                        b = bytes.Replace(b, []byte("\n1 0 obj"), []byte("\n\n\n1 0 obj"), 1)
+                        i := bytes.LastIndex(b, []byte("startxref"))
+                        return append(b[:i:i], "startxref\n999999\n%%EOF\n"...)
+                }, repaired: true, title: "Titítle"},
+                {name: "missing xref table", build: func(t *testing.T) []byte {
+                        b := classic(t)
+                        // The trailer goes too, so there is no Info to recover.
+                        return b[:bytes.LastIndex(b, []byte("xref\n0 "))]
+                }, repaired: true},
+        }
+        wantPages := []struct {
+                media, crop Rect
+                rotate      int
+        }{
+                {Rect{0, 0, 595, 842}, Rect{10, 10, 585, 832}, 90},
+                {Rect{0, 0, 300, 400}, Rect{0, 0, 300, 400}, 270},
+                {Rect{0, 0, 612, 792}, Rect{0, 0, 100, 100}, 180},
+        }
+        wantOutline := []OutlineItem{
+                {Title: "Chapter 1", Page: 1, Children: []OutlineItem{{Title: "Sub", Page: 2}}},
+                {Title: "Äb", Page: 3},
+        }
+
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        d := openFixture(t, tt.build(t))
+                        if d.Repaired() != tt.repaired {
+                                t.Errorf("Repaired() = %v, want %v", d.Repaired(), tt.repaired)
+                        }
+                        if d.Version() != "1.7" {
+                                t.Errorf("Version() = %q, want 1.7", d.Version())
+                        }
+                        if d.NumPages() != len(wantPages) {
+                                t.Fatalf("NumPages() = %d, want %d", d.NumPages(), len(wantPages))
+                        }
+                        for i, want := range wantPages {
+                                p, _ := d.Page(i + 1)
+                                if p.MediaBox != want.media || p.CropBox != want.crop || p.Rotate != want.rotate {
+                                        t.Errorf("page %d: MediaBox %v CropBox %v Rotate %d, want %v %v %d",
+                                                i+1, p.MediaBox, p.CropBox, p.Rotate, want.media, want.crop, want.rotate)
+                                }
+                                if d.PageNumber(p.Ref) != i+1 {
+                                        t.Errorf("PageNumber(%v) = %d, want %d", p.Ref, d.PageNumber(p.Ref), i+1)
+                                }
+                        }
+
+                        info, err := d.Info()
+                        if err != nil {
+                                t.Fatalf("Info: %v", err)
+                        }
+                        if info.Title != tt.title {
+                                t.Errorf("Title = %q, want %q", info.Title, tt.title)
+                        }
+                        if tt.title == "Titítle" {
+                                created := time.Date(2024, 1, 31, 12, 0, 0, 0, time.FixedZone("", 3600))
+                                if info.Author != "Ann — Bo" || info.Trapped != "False" || info.Custom["Custom1"] != "v" ||
+                                        !info.CreationDate.Equal(created) {
+                                        t.Errorf("Info = %+v", info)
+                                }
+                        }
+
+                        outline, err := d.Outline()
+                        if err != nil {
+                                t.Fatalf("Outline: %v", err)
+                        }
+                        if !reflect.DeepEqual(outline, wantOutline) {
+                                t.Errorf("Outline() = %+v, want %+v", outline, wantOutline)
+                        }
+                        xmp, err := d.Metadata()
+                        if err != nil || string(xmp) != "<x:xmpmeta>hi</x:xmpmeta>" {
+                                t.Errorf("Metadata() = %q, %v", xmp, err)
+                        }
+                })
+        }
+}
+
+func TestOpenRejects(t *testing.T) {
+        for name, b := range map[string][]byte{
+                "empty":      nil,
+                "not a pdf":  []byte("hello world"),
+                "no objects": []byte("%PDF-1.4\ntrailer\n<< >>\n%%EOF\n"),
+        } {
+                t.Run(name, func(t *testing.T) {
+                        if _, err := New(bytes.NewReader(b), int64(len(b))); err == nil {
+                                t.Error("New succeeded")
+                        }
+                })
+        }
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "io/fs"
+        "net/http"
+        "path/filepath"
+
+        "go.opentelemetry.io/otel/attribute"
+
+        "pdf-backend/pdfdoc"
+)
+
+// ==================================================================================
+// PDF structure
+// ==================================================================================
+//
+// Page counts, page boxes and document metadata are read in process by the
+// pdfdoc package rather than scraped from the human-readable output of
+// pdfinfo and pdfcpu info, whose wording and number formatting change with
+// the locale and the tool version. Parsing costs a few milliseconds and
+// doesn't take a tool slot.
+
+// openPDF parses the structure of the PDF at path. The caller must Close it.
+func openPDF(ctx context.Context, path string) (doc *pdfdoc.Document, err error) {
+        _, span := startSpan(ctx, "parse pdf", attribute.String("file.name", filepath.Base(path)))
+        defer func() { endSpan(span, err) }()
+        doc, err = pdfdoc.Open(path)
+        if err != nil {
+                return nil, err
+        }
+        span.SetAttributes(
+                attribute.Int("pdf.pages", doc.NumPages()),
+                attribute.Bool("pdf.encrypted", doc.Encrypted()),
+                attribute.Bool("pdf.repaired", doc.Repaired()),
+        )
+        return doc, nil
+}
+
+// countPages returns the number of pages of a PDF.
+func countPages(ctx context.Context, path string) (int, error) {
+        doc, err := openPDF(ctx, path)
+        if err != nil {
+                return 0, err
+        }
+        defer doc.Close()
+        return doc.NumPages(), nil
+}
+
+// firstPageSize returns the width and height of the first page's CropBox, in
+// points.
+func firstPageSize(ctx context.Context, path string) (w, h float64, err error) {
+        doc, err := openPDF(ctx, path)
+        if err != nil {
+                return 0, 0, err
+        }
+        defer doc.Close()
+        p, _ := doc.Page(1)
+        return p.CropBox.Width(), p.CropBox.Height(), nil
+}
+
+// pdfReadError is the error returned to the client when a PDF can't be
+// parsed.
+func pdfReadError(err error) error {
+        switch {
+        case errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission):
+                return opFail(http.StatusInternalServerError, "failed to open PDF")
+        case errors.Is(err, pdfdoc.ErrPasswordRequired):
+                return &opError{status: http.StatusUnprocessableEntity, code: codeEncryptedPDF,
+                        msg: "the PDF is password-protected; unlock it first", debug: err.Error()}
+        }
+        return &opError{status: http.StatusUnprocessableEntity, code: codeCorruptPDF,
+                msg: "the PDF is damaged or not a valid PDF", debug: err.Error()}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "fmt"
+        "net/http"
+        "os"
+        "path/filepath"
+        "strings"
+        "time"
+)
+
+// ==================================================================================
+// Pipeline: chain several tools in one request
+// ==================================================================================
+//
+// POST /api/pdf/pipeline
+//
+//	files (or file): one or more uploads; several are only allowed when the
+//	                 first step is "merge"
+//	steps:           JSON list, e.g.
+//	                 [{"op":"merge"},
+//	                  {"op":"rotate","params":{"degrees":90}},
+//	                  {"op":"page-numbers","params":{"position":"bc"}},
+//	                  {"op":"watermark","params":{"text":"DRAFT"}},
+//	                  {"op":"compress","params":{"level":"medium"}}]
+//
+// Every step runs a registered operation against the previous step's output.
+// Steps live in step-N subdirectories of a single job directory and the final
+// result is moved to the job root. Only the last step may produce something
+// other than a PDF (e.g. pdf-to-jpg) or a JSON result (e.g. metadata read).
+
+const maxPipelineSteps = 20
+
+type pipelineStep struct {
+        Op     string                     `json:"op"`
+        Params map[string]json.RawMessage `json:"params,omitempty"`
+}
+
+type pipelineStepReport struct {
+        Step       int    `json:"step"`
+        Op         string `json:"op"`
+        DurationMs int64  `json:"durationMs"`
+        SizeBefore int64  `json:"sizeBefore"`
+        SizeAfter  int64  `json:"sizeAfter,omitempty"`
+        Error      string `json:"error,omitempty"`
+        Code       string `json:"code,omitempty"`
+}
+
+type pipelineResponse struct {
+        DownloadURL string               `json:"downloadUrl,omitempty"`
+        FileID      string               `json:"fileId,omitempty"`
+        Result      any                  `json:"result,omitempty"`
+        Error       string               `json:"error,omitempty"`
+        Code        string               `json:"code,omitempty"`
+        Param       string               `json:"param,omitempty"`
+        Debug       string               `json:"debug,omitempty"`
+        Steps       []pipelineStepReport `json:"steps"`
+}
+
+// paramString turns a JSON param value into the form value an operation
+// expects. Strings are used verbatim; numbers, booleans, arrays and objects
+// keep their JSON encoding (sign/edit/redact take JSON form fields).
+func paramString(raw json.RawMessage) string {
+        var s string
+        if err := json.Unmarshal(raw, &s); err == nil {
+                return s
+        }
+        return string(raw)
+}
+
+func handlePipeline(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
+                return
+        }
+
+        jobID, dir, err := newJobDir(r.Context())
+        if err != nil {
+                errorJSON(w, http.StatusInternalServerError, "failed to create job")
+                return
+        }
+        defer markJobActive(jobID)()
+        r = r.WithContext(withLogAttrs(r.Context(), "job_id", jobID, "operation", "pipeline"))
+
+        steps, ops, inputs, err := receivePipelineInput(w, r, jobID, dir)
+        if err != nil {
+                discardJob(r.Context(), jobID)
+                writeRequestError(w, r, err)
+                return
+        }
+
+        reports := make([]pipelineStepReport, 0, len(steps))
+        var result *OpResult
+        for i, st := range steps {
+                setJobProgress(r.Context(), float64(i)/float64(len(steps)))
+
+                report := pipelineStepReport{Step: i + 1, Op: st.Op}
+                for _, f := range inputs {
+                        if fi, err := os.Stat(f.Path); err == nil {
+                                report.SizeBefore += fi.Size()
+                        }
+                }
+
+                stepDir := filepath.Join(dir, fmt.Sprintf("step-%d", i+1))
+                params := make(map[string]string, len(st.Params))
+                for k, v := range st.Params {
+                        params[k] = paramString(v)
+                }
+
+                start := time.Now()
+                ctx := withToolFailures(r.Context())
+                res, err := runPipelineStep(ctx, ops[i], jobID, stepDir, inputs, params)
+                report.DurationMs = time.Since(start).Milliseconds()
+                if err == nil && i < len(steps)-1 && (res.File == "" || !strings.EqualFold(filepath.Ext(res.File), ".pdf")) {
+                        err = opFail(http.StatusBadRequest, fmt.Sprintf("%s does not produce a PDF and must be the last step", st.Op))
+                }
+                if err != nil {
+                        status, resp := opErrorResponse(ctx, ops[i], err)
+                        logger(ctx).Warn("pipeline step failed", "step", i+1, "step_op", st.Op, "status", status, "code", resp.Code, "error", err.Error())
+                        report.Error, report.Code = resp.Error, resp.Code
+                        reports = append(reports, report)
+                        if !debugErrors {
+                                resp.Debug = ""
+                        }
+                        writeJSON(w, status, pipelineResponse{
+                                Error: fmt.Sprintf("step %d (%s) failed: %s", i+1, st.Op, resp.Error),
+                                Code:  resp.Code,
+                                Param: resp.Param,
+                                Debug: resp.Debug,
+                                Steps: reports,
+                        })
+                        return
+                }
+
+                result = res
+                if res.File != "" {
+                        out := filepath.Join(stepDir, res.File)
+                        if fi, err := os.Stat(out); err == nil {
+                                report.SizeAfter = fi.Size()
+                        }
+                        // Keep the client's name so each step names its output
+                        // after the original document, not after the previous step.
+                        inputs = []OpFile{{Path: out, Name: inputs[0].Name, Field: "file"}}
+                }
+                reports = append(reports, report)
+        }
+
+        if result.File == "" {
+                writeJSON(w, http.StatusOK, pipelineResponse{Result: result.Data, Steps: reports})
+                return
+        }
+
+        outName := result.File
+        if err := os.Rename(inputs[0].Path, filepath.Join(dir, outName)); err != nil {
+                logger(r.Context()).Error("move result failed", "error", err.Error())
+                errorJSON(w, http.StatusInternalServerError, "failed to store pipeline result")
+                return
+        }
+        if err := persistFile(r.Context(), filepath.Join(dir, outName)); err != nil {
+                logger(r.Context()).Error("store result failed", "component", "storage", "error", err.Error())
+                errorJSON(w, http.StatusInternalServerError, "failed to store pipeline result")
+                return
+        }
+
+        writeJSON(w, http.StatusOK, pipelineResponse{
+                DownloadURL: buildDownloadURL(r, jobID, outName),
+                FileID:      newFileID(jobID, outName, outName),
+                Steps:       reports,
+        })
+}
+
+// runPipelineStep runs op in its own step directory against inputs.
+func runPipelineStep(ctx context.Context, op *Operation, jobID, stepDir string, inputs []OpFile, params map[string]string) (*OpResult, error) {
+        in, err := stageOperationInput(op, jobID, stepDir, inputs, params)
+        if err != nil {
+                return nil, err
+        }
+        // Detach the step from any async job so that the step's own progress
+        // reports don't overwrite the pipeline's.
+        return runOperation(withJob(ctx, nil), op, in)
+}
+
+// receivePipelineInput streams the uploads into dir, parses and checks the
+// steps and prepares the uploads for the first step.
+func receivePipelineInput(w http.ResponseWriter, r *http.Request, jobID, dir string) ([]pipelineStep, []*Operation, []OpFile, error) {
+        received, err := readUploads(w, r, dir, uploadSpec{fields: []string{"files", "file"}, multi: true})
+        if err != nil {
+                return nil, nil, nil, err
+        }
+
+        var steps []pipelineStep
+        if err := json.Unmarshal([]byte(r.FormValue("steps")), &steps); err != nil {
+                return nil, nil, nil, opParamFail("steps", "steps must be a JSON list of {op, params}")
+        }
+        if len(steps) == 0 {
+                return nil, nil, nil, opParamFail("steps", "at least one step is required")
+        }
+        if len(steps) > maxPipelineSteps {
+                return nil, nil, nil, opParamFail("steps", fmt.Sprintf("at most %d steps are allowed", maxPipelineSteps))
+        }
+        ops := make([]*Operation, len(steps))
+        for i, st := range steps {
+                op, ok := lookupOperation(st.Op)
+                if ok && op.Name == "merge" && i == 0 {
+                        ops[i] = op
+                        continue
+                }
+                if !ok || !acceptsSinglePDF(op) {
+                        return nil, nil, nil, opParamFail("steps", fmt.Sprintf("step %d: unsupported operation %q", i+1, st.Op))
+                }
+                ops[i] = op
+        }
+
+        files := filesInField(received, "files")
+        if len(files) == 0 {
+                files = filesInField(received, "file")
+        }
+        if len(files) == 0 {
+                if files, err = referencedInputs(r, "file", true, true, dir); err != nil {
+                        return nil, nil, nil, err
+                }
+        }
+        if len(files) == 0 {
+                return nil, nil, nil, opParamFail("file", "file is required")
+        }
+        if len(files) > 1 && steps[0].Op != "merge" {
+                return nil, nil, nil, opFail(http.StatusBadRequest, "multiple files require merge as the first step")
+        }
+        ret, err := parseRetention(r)
+        if err != nil {
+                return nil, nil, nil, opParamFail("retention", err.Error())
+        }
+        if err := writeJobRetention(dir, ret); err != nil {
+                return nil, nil, nil, err
+        }
+
+        for i := range files {
+                inPath := filepath.Join(dir, fmt.Sprintf("upload_%d.pdf", i))
+                if err := os.Rename(files[i].Path, inPath); err != nil {
+                        return nil, nil, nil, err
+                }
+                files[i].Path = inPath
+                if err := persistFile(r.Context(), inPath); err != nil {
+                        return nil, nil, nil, err
+                }
+        }
+        uploads := &OpInput{JobID: jobID, Dir: dir, Files: files, Params: formParams(r.MultipartForm)}
+        ctx := withRequestLimits(withToolFailures(r.Context()), r)
+        if _, err := prepareInputs(ctx, ops[0], uploads); err != nil {
+                return nil, nil, nil, err
+        }
+        return steps, ops, uploads.Files, nil
+}
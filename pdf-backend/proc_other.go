@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+        "context"
+        "os/exec"
+        "time"
+)
+
+// commandContext is exec.CommandContext. Process groups are only used on unix;
+// elsewhere cancellation kills the direct child only.
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+        cmd := exec.CommandContext(ctx, name, args...)
+        cmd.WaitDelay = 5 * time.Second
+        return cmd
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+        "context"
+        "os/exec"
+        "syscall"
+        "time"
+)
+
+// commandContext is exec.CommandContext, except that the process is started
+// in its own process group and cancellation kills the whole group. Tools such
+// as libreoffice, chromium and ocrmypdf fork helpers that would otherwise keep
+// running after the parent is killed.
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+        cmd := exec.CommandContext(ctx, name, args...)
+        cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+        cmd.Cancel = func() error {
+                return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+        }
+        // Don't let a grandchild holding stdout/stderr open block Wait forever.
+        cmd.WaitDelay = 5 * time.Second
+        return cmd
+}
@@ -0,0 +1,81 @@
+package main
+
+// ==================================================================================
+// Operation registry
+// ==================================================================================
+//
+// Each entry is served at /api/pdf/<name> and /pdf/<name> and is available to
+// batch and pipeline requests. Requires must list every tool the operation
+// runs so that /health/ready can report it as degraded when one is missing.
+
+func init() {
+        for _, op := range []*Operation{
+                // Organize
+                {Name: "merge", Inputs: []string{"files"}, Multi: true, Requires: []string{"pdfcpu"}, Run: opMerge},
+                {Name: "split", Params: []string{"mode", "ranges", "merge", "pages"}, Requires: []string{"pdfcpu", "qpdf"}, Run: opSplit},
+                {Name: "remove-pages", Params: []string{"pages"}, Requires: []string{"pdfcpu"}, Run: opRemovePages},
+                {Name: "extract-pages", Params: []string{"mode", "ranges"}, Requires: []string{"pdfcpu"}, Run: opExtractPages},
+                {Name: "organize", Params: []string{"order", "rotations"}, Requires: []string{"pdfcpu"}, Run: opOrganize},
+
+                // Edit
+                {Name: "rotate", Params: []string{"degrees"}, Requires: []string{"pdfcpu"}, Run: opRotate},
+                {Name: "crop", Params: []string{"description", "unit", "marginLeft", "marginRight", "marginTop", "marginBottom"}, Requires: []string{"pdfcpu"}, Run: opCrop},
+                {Name: "page-numbers", Params: []string{"position", "fontSize", "opacity", "startAt", "margin"}, Requires: []string{"pdfcpu"}, Run: opPageNumbers},
+                {Name: "watermark", Params: []string{"text", "rotation", "opacity", "layer", "fromPage", "toPage", "color"}, Requires: []string{"pdfcpu"}, Run: opWatermark},
+                {Name: "add-header-footer", Params: []string{"headerText", "footerText", "headerAlign", "footerAlign", "fontSize", "margin", "fromPage", "toPage"}, Requires: []string{"pdfcpu"}, Run: opHeaderFooter},
+                {Name: "sign", Params: []string{"signatures"}, Run: opSignPDF},
+                {Name: "digital-signature", Params: []string{"signature", "page", "x", "y"}, Requires: []string{"pdfcpu", "qpdf"}, Run: opDigitalSignature},
+                {Name: "add-text", Params: []string{"text", "page", "x", "y", "fontSize", "color"}, Run: opAddTextAnnotation},
+                {Name: "edit", Params: []string{"annotations", "mode", "author"}, Run: opEditPDF},
+                {Name: "annotations", Run: opListAnnotations},
+                {Name: "metadata", Params: []string{"action", "title", "author", "subject", "keywords"}, Requires: []string{"pdfcpu"}, Run: opMetadataEditor},
+                {Name: "bookmarks", Params: []string{"bookmarks"}, Requires: []string{"python:pypdf"}, Run: opBookmarksEditor},
+                {Name: "form-fill", Params: []string{"action", "fields"}, Requires: []string{"pdfcpu", "pdftk"}, Run: opFormFill},
+
+                // Optimize
+                {Name: "compress", Params: []string{"level", "targetSize"}, Cacheable: true, Requires: []string{"gs"}, Run: opCompress},
+                {Name: "repair", AllowDamaged: true, Cacheable: true, Requires: []string{"pdfcpu"}, Run: opRepair},
+                {Name: "ocr", Params: []string{"lang"}, Cacheable: true, Requires: []string{"ocrmypdf"}, Run: opOCR},
+                {Name: "convert-to-pdfa", Cacheable: true, Requires: []string{"gs"}, Run: opConvertToPDFA},
+                {Name: "validate-pdfa", Requires: []string{"qpdf", "pdfinfo"}, Run: opValidatePDFA},
+                {Name: "compare", Inputs: []string{"file1", "file2"}, Requires: []string{"pdftotext", "diff"}, Run: opComparePDFs},
+
+                // Security
+                {Name: "protect", Params: []string{"password"}, Requires: []string{"qpdf"}, Run: opProtectPDF},
+                {Name: "unlock", AllowEncrypted: true, Params: []string{"password"}, Requires: []string{"qpdf"}, Run: opUnlockPDF},
+                {Name: "encrypt-pdf", Params: []string{"password", "permissions"}, Requires: []string{"qpdf"}, Run: opEncryptPDF},
+                {Name: "redact", Params: []string{"redactions", "color"}, Run: opRedactPDF},
+                {Name: "flatten", Cacheable: true, Requires: []string{"qpdf"}, Run: opFlattenPDF},
+
+                // Convert from PDF
+                {Name: "pdf-to-word", Cacheable: true, Requires: []string{"pdftotext", "python:docx"}, Run: opPDFToWord},
+                {Name: "pdf-to-excel", Cacheable: true, Requires: []string{"pdftotext", "python:openpyxl"}, Run: opPDFToExcel},
+                {Name: "pdf-to-powerpoint", Cacheable: true, Requires: []string{"pdftoppm", "python:pdf2image", "python:pptx"}, Run: opPDFToPowerPoint},
+                {Name: "pdf-to-jpg", Params: []string{"dpi", "page", "all"}, Cacheable: true, Requires: []string{"pdftoppm"}, Run: opPDFToJPG},
+                {Name: "pdf-to-png", Params: []string{"dpi"}, Cacheable: true, Requires: []string{"pdftoppm"}, Run: opPDFToPNG},
+                {Name: "pdf-to-tiff", Params: []string{"dpi"}, Cacheable: true, Requires: []string{"gs"}, Run: opPDFToTIFF},
+                {Name: "pdf-to-html", Cacheable: true, Requires: []string{"pdftohtml"}, Run: opPDFToHTML},
+                {Name: "extract-text", Cacheable: true, Requires: []string{"pdftotext"}, Run: opExtractText},
+                {Name: "extract-images", Cacheable: true, Requires: []string{"pdfimages"}, Run: opExtractImages},
+
+                // Convert to PDF
+                {Name: "image-to-pdf", Inputs: []string{"files"}, Multi: true, KeepExt: true, InputExt: ".jpg", Params: []string{"layout", "pageSize", "margin", "outputFilename"}, Requires: []string{"convert"}, Run: opImageToPDF},
+                {Name: "png-to-pdf", Inputs: []string{"files"}, Multi: true, InputExt: ".png", Requires: []string{"convert"}, Run: opPNGToPDF},
+                {Name: "bmp-to-pdf", Inputs: []string{"files"}, Multi: true, InputExt: ".bmp", Requires: []string{"convert"}, Run: opBMPToPDF},
+                {Name: "word-to-pdf", KeepExt: true, InputExt: ".docx", Cacheable: true, Requires: []string{"libreoffice"}, Run: opWordToPDF},
+                {Name: "excel-to-pdf", KeepExt: true, InputExt: ".xlsx", Cacheable: true, Requires: []string{"libreoffice"}, Run: opExcelToPDF},
+                {Name: "powerpoint-to-pdf", KeepExt: true, InputExt: ".pptx", Cacheable: true, Requires: []string{"libreoffice"}, Run: opPowerPointToPDF},
+                {Name: "html-to-pdf", InputOptional: true, InputExt: ".html", Params: []string{"url", "html"}, Requires: []string{"chromium"}, Run: opHTMLToPDF},
+                {Name: "markdown-to-pdf", InputOptional: true, InputExt: ".md", Params: []string{"markdown"}, Requires: []string{"chromium"}, Run: opMarkdownToPDF},
+                {Name: "url-to-pdf", InputOptional: true, ChecksInputs: true, Params: []string{"url"}, Requires: []string{"chromium"}, Run: opURLToPDF},
+
+                // Batch: run any single-PDF operation over many files
+                {Name: "batch", Inputs: []string{"files"}, Multi: true, ChecksInputs: true, Params: []string{"operation", "autoConvert"}, Requires: []string{"pdfcpu"}, Run: opBatch},
+
+                // Document scanner
+                {Name: "document-crop", Inputs: []string{"image"}, KeepExt: true, InputExt: ".jpg", Run: opDocumentCrop},
+                {Name: "document-detect", Inputs: []string{"image"}, KeepExt: true, InputExt: ".jpg", Run: opDocumentDetect},
+        } {
+                registerOperation(op)
+        }
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+        "context"
+        "crypto/hmac"
+        "encoding/base64"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "net/http"
+        "os"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+
+        "github.com/google/uuid"
+)
+
+// ==================================================================================
+// Resumable uploads
+// ==================================================================================
+//
+// Large files can be uploaded in chunks with a subset of the tus 1.0 protocol
+// (https://tus.io/protocols/resumable-upload), so an interrupted upload
+// continues where it stopped instead of starting over:
+//
+//	POST    /api/pdf/uploads       create; Upload-Length: <bytes>,
+//	                               Upload-Metadata: filename <base64 name>
+//	HEAD    /api/pdf/uploads/{id}  Upload-Offset: bytes received so far
+//	PATCH   /api/pdf/uploads/{id}  append the body at Upload-Offset
+//	                               (Content-Type: application/offset+octet-stream)
+//	GET     /api/pdf/uploads/{id}  JSON status
+//	DELETE  /api/pdf/uploads/{id}  discard the upload
+//	OPTIONS /api/pdf/uploads       protocol discovery
+//
+// Each upload is assembled in a job directory of its own, so retention and
+// eviction (retention.go) apply to it; a retention parameter may be given in
+// the creation request's query string. Once complete, the upload can be used
+// by any tool in place of a multipart file: uploadId=<id> fills the tool's
+// first file field and <field>UploadId (e.g. file2UploadId) a specific one.
+// The same upload can be used by several requests.
+//
+// An upload ID is the upload's job ID followed by a signature over it
+// (signing.go), so only the client that created an upload can resume, inspect,
+// delete or use it; job IDs seen elsewhere can't be turned into upload IDs.
+//
+// The chunks of one upload must reach the same replica; the completed file is
+// persisted in the storage backend, so other replicas can use it.
+
+const (
+        tusVersion = "1.0.0"
+
+        uploadStateFile = "upload.json"
+        uploadDataFile  = "upload.data"
+
+        uploadChunkContentType = "application/offset+octet-stream"
+
+        urlKindUpload = "upload"
+)
+
+// resumableUpload is the persisted state of an upload. The offset is the size
+// of the data file.
+type resumableUpload struct {
+        ID        string    `json:"id"`
+        Filename  string    `json:"filename"`
+        Length    int64     `json:"length"`
+        SHA256    string    `json:"sha256,omitempty"` // set once complete
+        CreatedAt time.Time `json:"createdAt"`
+}
+
+type uploadStatusResponse struct {
+        ID        string    `json:"id"`
+        UploadURL string    `json:"uploadUrl"`
+        Filename  string    `json:"filename"`
+        Length    int64     `json:"length"`
+        Offset    int64     `json:"offset"`
+        Complete  bool      `json:"complete"`
+        SHA256    string    `json:"sha256,omitempty"`
+        CreatedAt time.Time `json:"createdAt"`
+}
+
+// uploadLocks marks uploads with a PATCH in progress; tus clients must not
+// send chunks of one upload concurrently.
+var uploadLocks = struct {
+        sync.Mutex
+        busy map[string]bool
+}{busy: make(map[string]bool)}
+
+func lockUpload(id string) bool {
+        uploadLocks.Lock()
+        defer uploadLocks.Unlock()
+        if uploadLocks.busy[id] {
+                return false
+        }
+        uploadLocks.busy[id] = true
+        return true
+}
+
+func unlockUpload(id string) {
+        uploadLocks.Lock()
+        delete(uploadLocks.busy, id)
+        uploadLocks.Unlock()
+}
+
+// newUploadID returns the client-facing ID of the upload in job jobID.
+func newUploadID(jobID string) string {
+        return jobID + "." + signer.mac(urlKindUpload, jobID, 0, "")
+}
+
+// parseUploadID verifies a client-facing upload ID and returns the job ID of
+// the upload.
+func parseUploadID(id string) (string, bool) {
+        jobID, sig, _ := strings.Cut(id, ".")
+        if _, ok := uploadDir(jobID); !ok {
+                return "", false
+        }
+        if !hmac.Equal([]byte(sig), []byte(signer.mac(urlKindUpload, jobID, 0, ""))) {
+                return "", false
+        }
+        return jobID, true
+}
+
+func uploadDir(id string) (string, bool) {
+        if _, err := uuid.Parse(id); err != nil {
+                return "", false
+        }
+        return filepath.Join(baseWorkDir, id), true
+}
+
+// readUpload loads the upload id and its current offset.
+func readUpload(id string) (*resumableUpload, int64, error) {
+        dir, ok := uploadDir(id)
+        if !ok {
+                return nil, 0, os.ErrNotExist
+        }
+        b, err := os.ReadFile(filepath.Join(dir, uploadStateFile))
+        if err != nil {
+                return nil, 0, err
+        }
+        var up resumableUpload
+        if err := json.Unmarshal(b, &up); err != nil {
+                return nil, 0, err
+        }
+        offset := int64(0)
+        if fi, err := os.Stat(filepath.Join(dir, uploadDataFile)); err == nil {
+                offset = fi.Size()
+        } else if up.SHA256 != "" {
+                // Complete, but the data lives in the storage backend only.
+                offset = up.Length
+        }
+        return &up, offset, nil
+}
+
+func writeUpload(dir string, up *resumableUpload) error {
+        b, err := json.Marshal(up)
+        if err != nil {
+                return err
+        }
+        tmp := filepath.Join(dir, uploadStateFile+".tmp")
+        if err := os.WriteFile(tmp, b, 0o644); err != nil {
+                return err
+        }
+        return os.Rename(tmp, filepath.Join(dir, uploadStateFile))
+}
+
+// parseUploadMetadata decodes the Upload-Metadata header: comma-separated
+// "key base64value" pairs.
+func parseUploadMetadata(h string) map[string]string {
+        meta := make(map[string]string)
+        for _, pair := range strings.Split(h, ",") {
+                key, val, _ := strings.Cut(strings.TrimSpace(pair), " ")
+                if key == "" {
+                        continue
+                }
+                dec, err := base64.StdEncoding.DecodeString(strings.TrimSpace(val))
+                if err != nil {
+                        continue
+                }
+                meta[key] = string(dec)
+        }
+        return meta
+}
+
+func handleUploads(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Tus-Resumable", tusVersion)
+        if r.Method != http.MethodOptions {
+                if v := r.Header.Get("Tus-Resumable"); v != "" && v != tusVersion {
+                        w.Header().Set("Tus-Version", tusVersion)
+                        errorJSON(w, http.StatusPreconditionFailed, "unsupported tus version "+v)
+                        return
+                }
+        }
+
+        base, id := r.URL.Path, ""
+        if i := strings.Index(r.URL.Path, "/uploads/"); i >= 0 {
+                base, id = r.URL.Path[:i+len("/uploads")], strings.Trim(r.URL.Path[i+len("/uploads/"):], "/")
+        }
+        if id != "" && r.Method != http.MethodOptions {
+                jobID, ok := parseUploadID(id)
+                if !ok {
+                        errorJSON(w, http.StatusNotFound, "upload not found")
+                        return
+                }
+                id = jobID
+        }
+
+        switch {
+        case r.Method == http.MethodOptions:
+                w.Header().Set("Tus-Version", tusVersion)
+                w.Header().Set("Tus-Extension", "creation,termination")
+                if maxSize := getMaxFileSizeBytes(r); maxSize > 0 {
+                        w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+                }
+                w.WriteHeader(http.StatusNoContent)
+        case id == "" && r.Method == http.MethodPost:
+                createUpload(w, r, base)
+        case id == "":
+                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
+        case r.Method == http.MethodHead, r.Method == http.MethodGet:
+                uploadStatus(w, r, base, id)
+        case r.Method == http.MethodPatch:
+                appendUploadChunk(w, r, id)
+        case r.Method == http.MethodDelete:
+                if _, _, err := readUpload(id); err != nil {
+                        errorJSON(w, http.StatusNotFound, "upload not found")
+                        return
+                }
+                removeJob(id)
+                w.WriteHeader(http.StatusNoContent)
+        default:
+                errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
+        }
+}
+
+func createUpload(w http.ResponseWriter, r *http.Request, base string) {
+        length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+        if err != nil || length <= 0 {
+                writeAPIError(w, http.StatusBadRequest, apiError{Error: "Upload-Length must be a positive byte count",
+                        Code: codeInvalidParam, Param: "Upload-Length"})
+                return
+        }
+        name := filepath.Base(parseUploadMetadata(r.Header.Get("Upload-Metadata"))["filename"])
+        if name == "." || name == "/" {
+                name = "upload"
+        }
+        if maxSize := getMaxFileSizeBytes(r); maxSize > 0 && length > maxSize {
+                writeRequestError(w, r, fileSizeError(r, name, maxSize))
+                return
+        }
+        ret, err := parseRetention(r)
+        if err != nil {
+                paramErrorJSON(w, "retention", err.Error())
+                return
+        }
+
+        jobID, dir, err := newJobDir(context.Background())
+        if err != nil {
+                errorJSON(w, http.StatusInternalServerError, "failed to create upload")
+                return
+        }
+        up := &resumableUpload{ID: jobID, Filename: name, Length: length, CreatedAt: time.Now().UTC()}
+        err = writeJobRetention(dir, ret)
+        if err == nil {
+                err = writeUpload(dir, up)
+        }
+        if err == nil {
+                err = os.WriteFile(filepath.Join(dir, uploadDataFile), nil, 0o644)
+        }
+        if err != nil {
+                logger(r.Context()).Error("create upload failed", "component", "uploads", "job_id", jobID, "error", err.Error())
+                removeJob(jobID)
+                errorJSON(w, http.StatusInternalServerError, "failed to create upload")
+                return
+        }
+
+        uploadID := newUploadID(jobID)
+        w.Header().Set("Location", base+"/"+uploadID)
+        w.Header().Set("Upload-Offset", "0")
+        writeJSON(w, http.StatusCreated, uploadStatusResponse{
+                ID: uploadID, UploadURL: base + "/" + uploadID, Filename: name, Length: length, CreatedAt: up.CreatedAt,
+        })
+}
+
+func uploadStatus(w http.ResponseWriter, r *http.Request, base, id string) {
+        up, offset, err := readUpload(id)
+        if err != nil {
+                errorJSON(w, http.StatusNotFound, "upload not found")
+                return
+        }
+        w.Header().Set("Cache-Control", "no-store")
+        w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+        w.Header().Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+        if r.Method == http.MethodHead {
+                w.WriteHeader(http.StatusOK)
+                return
+        }
+        uploadID := newUploadID(up.ID)
+        writeJSON(w, http.StatusOK, uploadStatusResponse{
+                ID: uploadID, UploadURL: base + "/" + uploadID, Filename: up.Filename, Length: up.Length,
+                Offset: offset, Complete: offset == up.Length, SHA256: up.SHA256, CreatedAt: up.CreatedAt,
+        })
+}
+
+func appendUploadChunk(w http.ResponseWriter, r *http.Request, id string) {
+        if ct := r.Header.Get("Content-Type"); ct != uploadChunkContentType {
+                errorJSON(w, http.StatusUnsupportedMediaType, "Content-Type must be "+uploadChunkContentType)
+                return
+        }
+        if !lockUpload(id) {
+                errorJSON(w, http.StatusConflict, "another chunk of this upload is in progress")
+                return
+        }
+        defer unlockUpload(id)
+        defer markJobActive(id)()
+
+        up, offset, err := readUpload(id)
+        if err != nil {
+                errorJSON(w, http.StatusNotFound, "upload not found")
+                return
+        }
+        dir, _ := uploadDir(id)
+        clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+        if err != nil || clientOffset != offset {
+                w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+                writeAPIError(w, http.StatusConflict, apiError{Error: fmt.Sprintf("Upload-Offset must be %d", offset),
+                        Code: codeInvalidParam, Param: "Upload-Offset"})
+                return
+        }
+        if offset == up.Length {
+                errorJSON(w, http.StatusForbidden, "upload is already complete")
+                return
+        }
+
+        f, err := os.OpenFile(filepath.Join(dir, uploadDataFile), os.O_WRONLY|os.O_APPEND, 0o644)
+        if err != nil {
+                logger(r.Context()).Error("open upload failed", "component", "uploads", "upload_id", id, "error", err.Error())
+                errorJSON(w, http.StatusInternalServerError, "failed to store chunk")
+                return
+        }
+        // Bytes received before a connection drops are kept; the client resumes
+        // from the offset HEAD reports.
+        src := &partReader{r: r.Body}
+        n, err := io.Copy(f, io.LimitReader(src, up.Length-offset))
+        if cerr := f.Close(); err == nil {
+                err = cerr
+        }
+        offset += n
+        now := time.Now()
+        _ = os.Chtimes(dir, now, now) // restart the retention clock while uploading
+        w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+        if src.err != nil {
+                writeRequestError(w, r, uploadReadError(src.err))
+                return
+        }
+        if err != nil {
+                logger(r.Context()).Error("write chunk failed", "component", "uploads", "upload_id", id, "error", err.Error())
+                errorJSON(w, http.StatusInternalServerError, "failed to store chunk")
+                return
+        }
+        // A chunk running past Upload-Length is rejected, but the bytes up to
+        // the length are kept like any others, so the upload still completes.
+        extra, _ := r.Body.Read(make([]byte, 1))
+        if offset == up.Length {
+                if err := completeUpload(r.Context(), dir, up); err != nil {
+                        logger(r.Context()).Error("complete upload failed", "component", "uploads", "upload_id", id, "error", err.Error())
+                        errorJSON(w, http.StatusInternalServerError, "failed to store upload")
+                        return
+                }
+        }
+        if extra > 0 {
+                writeAPIError(w, http.StatusRequestEntityTooLarge, apiError{Error: "chunk extends past Upload-Length",
+                        Code: codeLimitExceeded})
+                return
+        }
+        w.WriteHeader(http.StatusNoContent)
+}
+
+// completeUpload hashes the assembled file and persists it.
+func completeUpload(ctx context.Context, dir string, up *resumableUpload) error {
+        path := filepath.Join(dir, uploadDataFile)
+        sum, err := hashFile(path)
+        if err != nil {
+                return err
+        }
+        if err := persistFile(ctx, path); err != nil {
+                return err
+        }
+        up.SHA256 = sum
+        logger(ctx).Info("upload complete", "component", "uploads", "job_id", up.ID, "bytes", up.Length)
+        return writeUpload(dir, up)
+}
+
+// ----------------------------------------------------------------------------------
+// Using uploads in tool requests
+// ----------------------------------------------------------------------------------
+
+// referencedUploads returns the completed uploads r names for field in place
+// of file parts, linked into dir. first marks the operation's first file
+// field, which plain uploadId values fill.
+func referencedUploads(r *http.Request, field string, first, multi bool, dir string) ([]OpFile, error) {
+        var ids []string
+        if first {
+                ids = append(ids, r.Form["uploadId"]...)
+        }
+        ids = append(ids, r.Form[field+"UploadId"]...)
+        if !multi && len(ids) > 1 {
+                ids = ids[:1]
+        }
+        var files []OpFile
+        for k, id := range ids {
+                f, err := claimUpload(r, strings.TrimSpace(id), field, filepath.Join(dir, fmt.Sprintf("upload-%s-%d", field, k)))
+                if err != nil {
+                        for _, f := range files {
+                                os.Remove(f.Path)
+                        }
+                        return nil, err
+                }
+                files = append(files, f)
+        }
+        return files, nil
+}
+
+// claimUpload links the completed upload id to dst.
+func claimUpload(r *http.Request, id, field, dst string) (OpFile, error) {
+        param := "uploadId"
+        if _, ok := r.Form[field+"UploadId"]; ok {
+                param = field + "UploadId"
+        }
+        jobID, ok := parseUploadID(id)
+        if !ok {
+                return OpFile{}, &opError{status: http.StatusNotFound, code: codeNotFound, param: param,
+                        msg: fmt.Sprintf("upload %q not found or expired", id)}
+        }
+        up, offset, err := readUpload(jobID)
+        if err != nil {
+                return OpFile{}, &opError{status: http.StatusNotFound, code: codeNotFound, param: param,
+                        msg: fmt.Sprintf("upload %q not found or expired", id)}
+        }
+        if offset != up.Length || up.SHA256 == "" {
+                return OpFile{}, &opError{status: http.StatusConflict, code: codeInvalidParam, param: param,
+                        msg: fmt.Sprintf("upload %q is incomplete (%d of %d bytes)", id, offset, up.Length)}
+        }
+        if maxSize := getMaxFileSizeBytes(r); maxSize > 0 && up.Length > maxSize {
+                return OpFile{}, fileSizeError(r, up.Filename, maxSize)
+        }
+
+        dir, _ := uploadDir(jobID)
+        src := filepath.Join(dir, uploadDataFile)
+        if err := fetchFile(r.Context(), src); err != nil {
+                if errors.Is(err, errStorageNotFound) {
+                        return OpFile{}, &opError{status: http.StatusNotFound, code: codeNotFound, param: param,
+                                msg: fmt.Sprintf("upload %q not found or expired", id)}
+                }
+                return OpFile{}, err
+        }
+        if err := os.Link(src, dst); err != nil {
+                if err := copyFileEdit(src, dst); err != nil {
+                        return OpFile{}, err
+                }
+        }
+        now := time.Now()
+        _ = os.Chtimes(dir, now, now) // keep a reused upload alive
+        return OpFile{Path: dst, Name: up.Filename, Size: up.Length, Field: field, SHA256: up.SHA256}, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+        "encoding/base64"
+        "encoding/json"
+        "errors"
+        "net/http"
+        "net/http/httptest"
+        "net/url"
+        "os"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "testing"
+        "time"
+)
+
+// tusRequest sends one request of the upload protocol to handleUploads.
+func tusRequest(method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest(method, target, strings.NewReader(body))
+        r.Header.Set("Tus-Resumable", tusVersion)
+        for k, v := range header {
+                r.Header.Set(k, v)
+        }
+        rec := httptest.NewRecorder()
+        handleUploads(rec, r)
+        return rec
+}
+
+// createTestUpload starts an upload of length bytes named name and returns
+// its URL.
+func createTestUpload(t *testing.T, name string, length int) string {
+        t.Helper()
+        rec := tusRequest(http.MethodPost, "/api/pdf/uploads", "", map[string]string{
+                "Upload-Length":   strconv.Itoa(length),
+                "Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(name)),
+        })
+        if rec.Code != http.StatusCreated {
+                t.Fatalf("create: %d: %s", rec.Code, rec.Body)
+        }
+        loc := rec.Header().Get("Location")
+        if !strings.HasPrefix(loc, "/api/pdf/uploads/") || rec.Header().Get("Upload-Offset") != "0" {
+                t.Fatalf("create: Location %q, Upload-Offset %q", loc, rec.Header().Get("Upload-Offset"))
+        }
+        return loc
+}
+
+// patchChunk appends data at offset.
+func patchChunk(loc string, offset int, data string) *httptest.ResponseRecorder {
+        return tusRequest(http.MethodPatch, loc, data, map[string]string{
+                "Content-Type":  uploadChunkContentType,
+                "Upload-Offset": strconv.Itoa(offset),
+        })
+}
+
+func TestResumableUpload(t *testing.T) {
+        useWorkDir(t)
+        const content = "%PDF-1.7 resumable"
+        loc := createTestUpload(t, "big report.pdf", len(content))
+
+        steps := []struct {
+                name   string
+                rec    func() *httptest.ResponseRecorder
+                status int
+                offset string
+        }{
+                {name: "wrong content type", rec: func() *httptest.ResponseRecorder {
+                        return tusRequest(http.MethodPatch, loc, "x", map[string]string{"Content-Type": "application/pdf", "Upload-Offset": "0"})
+                }, status: http.StatusUnsupportedMediaType},
+                {name: "first chunk", rec: func() *httptest.ResponseRecorder { return patchChunk(loc, 0, content[:5]) },
+                        status: http.StatusNoContent, offset: "5"},
+                {name: "stale offset", rec: func() *httptest.ResponseRecorder { return patchChunk(loc, 0, content[:5]) },
+                        status: http.StatusConflict, offset: "5"},
+                {name: "resume", rec: func() *httptest.ResponseRecorder {
+                        return tusRequest(http.MethodHead, loc, "", nil)
+                }, status: http.StatusOK, offset: "5"},
+                {name: "too long", rec: func() *httptest.ResponseRecorder { return patchChunk(loc, 5, content[5:]+"extra") },
+                        status: http.StatusRequestEntityTooLarge},
+        }
+        for _, s := range steps {
+                rec := s.rec()
+                if rec.Code != s.status || (s.offset != "" && rec.Header().Get("Upload-Offset") != s.offset) {
+                        t.Fatalf("%s: %d, Upload-Offset %q; want %d, %q: %s",
+                                s.name, rec.Code, rec.Header().Get("Upload-Offset"), s.status, s.offset, rec.Body)
+                }
+        }
+        // The oversized chunk filled the upload; bytes past the length were dropped.
+        rec := tusRequest(http.MethodGet, loc, "", nil)
+        var st uploadStatusResponse
+        if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+                t.Fatal(err)
+        }
+        if !st.Complete || st.Offset != int64(len(content)) || st.Filename != "big report.pdf" || st.SHA256 != sha256Hex(content) {
+                t.Fatalf("status %+v", st)
+        }
+        if rec := patchChunk(loc, len(content), "x"); rec.Code != http.StatusForbidden {
+                t.Errorf("patch after completion: %d", rec.Code)
+        }
+
+        // A completed upload can be used by several requests.
+        id := strings.TrimPrefix(loc, "/api/pdf/uploads/")
+        for i := 0; i < 2; i++ {
+                r := httptest.NewRequest(http.MethodPost, "/api/pdf/compress", nil)
+                r.Form = url.Values{"uploadId": {id}}
+                files, err := referencedUploads(r, "file", true, false, t.TempDir())
+                if err != nil || len(files) != 1 {
+                        t.Fatalf("use %d: %v, %v", i+1, files, err)
+                }
+                b, _ := os.ReadFile(files[0].Path)
+                if string(b) != content || files[0].Name != "big report.pdf" || files[0].SHA256 != sha256Hex(content) {
+                        t.Errorf("use %d: %+v with %q", i+1, files[0], b)
+                }
+        }
+
+        if rec := tusRequest(http.MethodDelete, loc, "", nil); rec.Code != http.StatusNoContent {
+                t.Fatalf("delete: %d", rec.Code)
+        }
+        if rec := tusRequest(http.MethodHead, loc, "", nil); rec.Code != http.StatusNotFound {
+                t.Errorf("head after delete: %d", rec.Code)
+        }
+}
+
+func TestUploadIDs(t *testing.T) {
+        useWorkDir(t)
+        useRetention(t, retentionConfig{defaultTTL: time.Hour, maxTTL: 24 * time.Hour})
+        loc := createTestUpload(t, "a.pdf", 4)
+        id := strings.TrimPrefix(loc, "/api/pdf/uploads/")
+        jobID, _, _ := strings.Cut(id, ".")
+
+        // Only the signed ID reaches the upload.
+        for _, bad := range []string{jobID, jobID + ".forged", "../" + id} {
+                if rec := tusRequest(http.MethodHead, "/api/pdf/uploads/"+bad, "", nil); rec.Code != http.StatusNotFound {
+                        t.Errorf("HEAD with %q: %d, want 404", bad, rec.Code)
+                }
+        }
+
+        tests := []struct {
+                name   string
+                form   url.Values
+                field  string
+                status int
+                param  string
+        }{
+                {name: "incomplete", form: url.Values{"uploadId": {id}}, field: "file", status: http.StatusConflict, param: "uploadId"},
+                {name: "forged", form: url.Values{"file2UploadId": {jobID + ".x"}}, field: "file2", status: http.StatusNotFound, param: "file2UploadId"},
+        }
+        for _, tt := range tests {
+                r := httptest.NewRequest(http.MethodPost, "/api/pdf/compare", nil)
+                r.Form = tt.form
+                _, err := referencedUploads(r, tt.field, true, false, t.TempDir())
+                var oe *opError
+                if !errors.As(err, &oe) || oe.status != tt.status || oe.param != tt.param {
+                        t.Errorf("%s: error %v, want %d on %s", tt.name, err, tt.status, tt.param)
+                }
+        }
+
+        // Uploads expire with their job directory.
+        old := time.Now().Add(-3 * time.Hour)
+        os.Chtimes(filepath.Join(baseWorkDir, jobID), old, old)
+        sweepJobs()
+        if rec := tusRequest(http.MethodHead, loc, "", nil); rec.Code != http.StatusNotFound {
+                t.Errorf("HEAD after expiry: %d", rec.Code)
+        }
+}
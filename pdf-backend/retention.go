@@ -0,0 +1,332 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "fmt"
+        "io/fs"
+        "log/slog"
+        "net/http"
+        "os"
+        "path/filepath"
+        "sort"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+
+        "github.com/google/uuid"
+)
+
+// ==================================================================================
+// Job retention and eviction
+// ==================================================================================
+//
+// Job directories are removed by a periodic sweep when their retention runs
+// out. By default a job is kept for PDF_RETENTION_DEFAULT (2h) after its
+// directory was last modified. A request can choose its own policy with the
+// retention parameter (form field or query string):
+//
+//	retention=10m                    keep for 10 minutes (any Go duration or
+//	                                 plain seconds, capped at PDF_RETENTION_MAX)
+//	retention=delete-after-download  delete as soon as the result has been
+//	                                 downloaded once (or after the default
+//	                                 retention if it never is)
+//
+// DELETE on an async job's statusUrl (jobs.go) purges the job immediately,
+// cancelling it first if it is still running.
+//
+// PDF_WORK_DIR_MAX_BYTES (e.g. "20G") bounds the work directory: whenever it
+// is exceeded, the least recently modified idle jobs are evicted until usage
+// is back under 90% of the limit. The check runs on every sweep
+// (PDF_CLEANUP_INTERVAL, default 1m) and whenever a new job is created.
+
+const (
+        jobRetentionFile = "retention.json"
+
+        defaultRetention       = 2 * time.Hour
+        defaultMaxRetention    = 24 * time.Hour
+        defaultCleanupInterval = time.Minute
+
+        retentionDeleteAfterDownload = "delete-after-download"
+)
+
+// jobRetention is the per-job policy chosen with the retention parameter.
+type jobRetention struct {
+        ExpiresAt           time.Time `json:"expiresAt"`
+        DeleteAfterDownload bool      `json:"deleteAfterDownload,omitempty"`
+}
+
+type retentionConfig struct {
+        defaultTTL time.Duration
+        maxTTL     time.Duration
+        interval   time.Duration
+        maxBytes   int64
+}
+
+var retention = loadRetentionConfig()
+
+func loadRetentionConfig() retentionConfig {
+        return retentionConfig{
+                defaultTTL: time.Duration(config.Retention.Default),
+                maxTTL:     time.Duration(config.Retention.Max),
+                interval:   time.Duration(config.Retention.CleanupInterval),
+                maxBytes:   int64(config.Retention.WorkDirMaxBytes),
+        }
+}
+
+// parseByteSize accepts a plain byte count or one with a K/M/G/T suffix
+// (binary multiples, optional trailing "B" or "iB").
+func parseByteSize(s string) (int64, error) {
+        s = strings.ToUpper(strings.TrimSpace(s))
+        s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+        mult := int64(1)
+        if n := len(s); n > 0 {
+                switch s[n-1] {
+                case 'K':
+                        mult = 1 << 10
+                case 'M':
+                        mult = 1 << 20
+                case 'G':
+                        mult = 1 << 30
+                case 'T':
+                        mult = 1 << 40
+                }
+                if mult > 1 {
+                        s = s[:n-1]
+                }
+        }
+        n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+        if err != nil {
+                return 0, err
+        }
+        return n * mult, nil
+}
+
+// parseRetention reads the retention parameter of r. It returns nil when the
+// request didn't set one, so the default policy applies.
+func parseRetention(r *http.Request) (*jobRetention, error) {
+        v := strings.TrimSpace(r.FormValue("retention"))
+        if v == "" {
+                return nil, nil
+        }
+        now := time.Now().UTC()
+        switch strings.ToLower(v) {
+        case retentionDeleteAfterDownload, "delete-after-first-download":
+                return &jobRetention{ExpiresAt: now.Add(retention.defaultTTL), DeleteAfterDownload: true}, nil
+        }
+        d, err := time.ParseDuration(v)
+        if err != nil {
+                n, convErr := strconv.Atoi(v)
+                if convErr != nil {
+                        return nil, fmt.Errorf("invalid retention %q: use a duration such as 10m or %s", v, retentionDeleteAfterDownload)
+                }
+                d = time.Duration(n) * time.Second
+        }
+        if d <= 0 {
+                return nil, fmt.Errorf("retention must be positive")
+        }
+        if d > retention.maxTTL {
+                return nil, fmt.Errorf("retention may not exceed %s", retention.maxTTL)
+        }
+        return &jobRetention{ExpiresAt: now.Add(d)}, nil
+}
+
+func writeJobRetention(dir string, ret *jobRetention) error {
+        if ret == nil {
+                return nil
+        }
+        b, err := json.Marshal(ret)
+        if err != nil {
+                return err
+        }
+        return os.WriteFile(filepath.Join(dir, jobRetentionFile), b, 0o644)
+}
+
+func readJobRetention(dir string) *jobRetention {
+        b, err := os.ReadFile(filepath.Join(dir, jobRetentionFile))
+        if err != nil {
+                return nil
+        }
+        var ret jobRetention
+        if json.Unmarshal(b, &ret) != nil {
+                return nil
+        }
+        return &ret
+}
+
+// deleteAfterDownload reports whether the job is to be purged once its result
+// has been downloaded.
+func deleteAfterDownload(jobID string) bool {
+        ret := readJobRetention(filepath.Join(baseWorkDir, jobID))
+        return ret != nil && ret.DeleteAfterDownload
+}
+
+// activeJobs counts requests currently working in each job directory, so that
+// the sweep and eviction never pull a directory out from under a running tool.
+var activeJobs = struct {
+        sync.Mutex
+        n map[string]int
+}{n: make(map[string]int)}
+
+// markJobActive marks jobID as in use until the returned function is called.
+func markJobActive(jobID string) func() {
+        activeJobs.Lock()
+        activeJobs.n[jobID]++
+        activeJobs.Unlock()
+        return func() {
+                activeJobs.Lock()
+                defer activeJobs.Unlock()
+                activeJobs.n[jobID]--
+                if activeJobs.n[jobID] <= 0 {
+                        delete(activeJobs.n, jobID)
+                }
+        }
+}
+
+func jobIsActive(jobID string) bool {
+        activeJobs.Lock()
+        defer activeJobs.Unlock()
+        return activeJobs.n[jobID] > 0
+}
+
+// removeJob purges a job: a running async job is cancelled and waited for,
+// then its directory and stored objects are deleted. It reports whether the
+// job existed locally.
+func removeJob(jobID string) bool {
+        existed := false
+        jobRegistry.Lock()
+        job := jobRegistry.jobs[jobID]
+        delete(jobRegistry.jobs, jobID)
+        jobRegistry.Unlock()
+        if job != nil {
+                existed = true
+                job.stop()
+        }
+
+        dir := filepath.Join(baseWorkDir, jobID)
+        if _, err := os.Stat(dir); err == nil {
+                existed = true
+        }
+        if err := os.RemoveAll(dir); err != nil {
+                slog.Error("remove job failed", "component", "retention", "job_id", jobID, "error", err.Error())
+        }
+        if err := store.Delete(context.Background(), jobID); err != nil {
+                slog.Error("delete stored files failed", "component", "retention", "job_id", jobID, "error", err.Error())
+        }
+        return existed
+}
+
+// discardJob removes the job a request created when the request fails before
+// anything ran (a rejected upload). An async job is kept: its record reports
+// the failure to the client polling it.
+func discardJob(ctx context.Context, jobID string) {
+        if jobFromContext(ctx) != nil {
+                return
+        }
+        removeJob(jobID)
+}
+
+type jobDirUsage struct {
+        id      string
+        modTime time.Time
+        size    int64
+}
+
+// sweepJobs removes expired jobs and, if the work directory is over its size
+// limit, evicts the least recently modified idle jobs. Directories that aren't
+// named by a job ID (the result cache, scratch directories of requests that
+// don't create a job) are left alone.
+func sweepJobs() {
+        entries, err := os.ReadDir(baseWorkDir)
+        if err != nil {
+                return
+        }
+        now := time.Now()
+        var jobs []jobDirUsage
+        var total int64
+        defer func() { workDirBytes.Set(float64(total)) }()
+        for _, e := range entries {
+                if _, err := uuid.Parse(e.Name()); err != nil || !e.IsDir() {
+                        continue
+                }
+                id := e.Name()
+                dir := filepath.Join(baseWorkDir, id)
+                info, err := os.Stat(dir)
+                if err != nil {
+                        continue
+                }
+                busy := jobIsActive(id)
+                expires := info.ModTime().Add(retention.defaultTTL)
+                if ret := readJobRetention(dir); ret != nil {
+                        expires = ret.ExpiresAt
+                }
+                if !busy && now.After(expires) {
+                        removeJob(id)
+                        jobsRemoved.WithLabelValues("expired").Inc()
+                        continue
+                }
+                size := dirSize(dir)
+                total += size
+                if !busy {
+                        jobs = append(jobs, jobDirUsage{id: id, modTime: info.ModTime(), size: size})
+                }
+        }
+
+        if retention.maxBytes <= 0 || total <= retention.maxBytes {
+                return
+        }
+        target := retention.maxBytes / 10 * 9
+        sort.Slice(jobs, func(i, j int) bool { return jobs[i].modTime.Before(jobs[j].modTime) })
+        for _, j := range jobs {
+                if total <= target {
+                        break
+                }
+                slog.Info("work dir over its limit, evicting job", "component", "retention", "bytes", total, "max_bytes", retention.maxBytes, "job_id", j.id, "job_bytes", j.size)
+                removeJob(j.id)
+                jobsRemoved.WithLabelValues("disk_limit").Inc()
+                total -= j.size
+        }
+}
+
+func dirSize(dir string) int64 {
+        var size int64
+        _ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+                if err == nil && !d.IsDir() {
+                        if info, err := d.Info(); err == nil {
+                                size += info.Size()
+                        }
+                }
+                return nil
+        })
+        return size
+}
+
+// sweepNow asks the janitor for an early sweep, e.g. after a new job was
+// created while a disk limit is configured.
+var sweepNow = make(chan struct{}, 1)
+
+func requestSweep() {
+        if retention.maxBytes <= 0 {
+                return
+        }
+        select {
+        case sweepNow <- struct{}{}:
+        default:
+        }
+}
+
+// runJanitor sweeps the work directory every cleanup interval and on demand.
+func runJanitor() {
+        slog.Info("retention", "component", "retention", "default_ttl", retention.defaultTTL.String(), "max_ttl", retention.maxTTL.String(),
+                "interval", retention.interval.String(), "max_bytes", retention.maxBytes)
+        ticker := time.NewTicker(retention.interval)
+        defer ticker.Stop()
+        for {
+                select {
+                case <-ticker.C:
+                case <-sweepNow:
+                }
+                sweepJobs()
+        }
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+        "net/http"
+        "net/http/httptest"
+        "os"
+        "path/filepath"
+        "strings"
+        "testing"
+        "time"
+
+        "github.com/google/uuid"
+)
+
+// useRetention replaces the retention settings for the rest of the test.
+func useRetention(t *testing.T, r retentionConfig) {
+        t.Helper()
+        old := retention
+        retention = r
+        t.Cleanup(func() { retention = old })
+}
+
+func TestParseByteSize(t *testing.T) {
+        tests := []struct {
+                in   string
+                want int64
+                err  bool
+        }{
+                {in: "0", want: 0},
+                {in: "1234", want: 1234},
+                {in: "10K", want: 10 << 10},
+                {in: "10kb", want: 10 << 10},
+                {in: " 20 G ", want: 20 << 30},
+                {in: "3MiB", want: 3 << 20},
+                {in: "1T", want: 1 << 40},
+                {in: "", err: true},
+                {in: "G", err: true},
+                {in: "12X", err: true},
+        }
+        for _, tt := range tests {
+                got, err := parseByteSize(tt.in)
+                if (err != nil) != tt.err || got != tt.want {
+                        t.Errorf("parseByteSize(%q) = %d, %v; want %d, error %v", tt.in, got, err, tt.want, tt.err)
+                }
+        }
+}
+
+func TestParseRetention(t *testing.T) {
+        useRetention(t, retentionConfig{defaultTTL: 2 * time.Hour, maxTTL: 24 * time.Hour})
+        tests := []struct {
+                query   string
+                ttl     time.Duration // 0 when no policy is returned
+                once    bool
+                errText string
+        }{
+                {query: ""},
+                {query: "retention=10m", ttl: 10 * time.Minute},
+                {query: "retention=90", ttl: 90 * time.Second},
+                {query: "retention=24h", ttl: 24 * time.Hour},
+                {query: "retention=delete-after-download", ttl: 2 * time.Hour, once: true},
+                {query: "retention=Delete-After-First-Download", ttl: 2 * time.Hour, once: true},
+                {query: "retention=25h", errText: "may not exceed"},
+                {query: "retention=0", errText: "must be positive"},
+                {query: "retention=-5m", errText: "must be positive"},
+                {query: "retention=soon", errText: "invalid retention"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.query, func(t *testing.T) {
+                        before := time.Now()
+                        ret, err := parseRetention(httptest.NewRequest("POST", "/api/pdf/compress?"+tt.query, nil))
+                        if tt.errText != "" {
+                                if err == nil || !strings.Contains(err.Error(), tt.errText) {
+                                        t.Fatalf("error = %v, want %q", err, tt.errText)
+                                }
+                                return
+                        }
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        if tt.ttl == 0 {
+                                if ret != nil {
+                                        t.Errorf("policy = %+v, want none", ret)
+                                }
+                                return
+                        }
+                        if ret == nil {
+                                t.Fatal("no policy")
+                        }
+                        if ret.ExpiresAt.Before(before.Add(tt.ttl).Add(-time.Second)) || ret.ExpiresAt.After(time.Now().Add(tt.ttl)) {
+                                t.Errorf("expires at %v, want about %v from now", ret.ExpiresAt, tt.ttl)
+                        }
+                        if ret.DeleteAfterDownload != tt.once {
+                                t.Errorf("DeleteAfterDownload = %v, want %v", ret.DeleteAfterDownload, tt.once)
+                        }
+                })
+        }
+}
+
+// makeJobDir creates a directory of size bytes in the work directory, last
+// modified age ago.
+func makeJobDir(t *testing.T, name string, size int, age time.Duration) string {
+        t.Helper()
+        dir := filepath.Join(baseWorkDir, name)
+        if err := os.MkdirAll(dir, 0o755); err != nil {
+                t.Fatal(err)
+        }
+        if err := os.WriteFile(filepath.Join(dir, "data"), make([]byte, size), 0o644); err != nil {
+                t.Fatal(err)
+        }
+        mtime := time.Now().Add(-age)
+        if err := os.Chtimes(dir, mtime, mtime); err != nil {
+                t.Fatal(err)
+        }
+        return dir
+}
+
+func TestSweepJobsExpiry(t *testing.T) {
+        useWorkDir(t)
+        useRetention(t, retentionConfig{defaultTTL: time.Hour, maxTTL: 24 * time.Hour})
+
+        expired := uuid.NewString()
+        fresh := uuid.NewString()
+        kept := uuid.NewString()
+        due := uuid.NewString()
+        busy := uuid.NewString()
+        makeJobDir(t, expired, 10, 2*time.Hour)
+        makeJobDir(t, fresh, 10, time.Minute)
+        writeJobRetention(makeJobDir(t, kept, 10, 2*time.Hour), &jobRetention{ExpiresAt: time.Now().Add(time.Hour)})
+        writeJobRetention(makeJobDir(t, due, 10, time.Minute), &jobRetention{ExpiresAt: time.Now().Add(-time.Second)})
+        makeJobDir(t, busy, 10, 2*time.Hour)
+        done := markJobActive(busy)
+        defer done()
+        for _, name := range []string{".warp-123", resultCacheDir, "notes"} {
+                makeJobDir(t, name, 10, 48*time.Hour)
+        }
+
+        sweepJobs()
+        for name, want := range map[string]bool{
+                expired: false, fresh: true, kept: true, due: false, busy: true,
+                ".warp-123": true, resultCacheDir: true, "notes": true,
+        } {
+                _, err := os.Stat(filepath.Join(baseWorkDir, name))
+                if exists := err == nil; exists != want {
+                        t.Errorf("%s: exists = %v, want %v", name, exists, want)
+                }
+        }
+}
+
+func TestSweepJobsEviction(t *testing.T) {
+        useWorkDir(t)
+        useRetention(t, retentionConfig{defaultTTL: time.Hour, maxTTL: 24 * time.Hour, maxBytes: 1000})
+
+        // 1200 bytes in jobs; eviction stops once at most 900 remain.
+        oldest := uuid.NewString()
+        older := uuid.NewString()
+        newer := uuid.NewString()
+        busy := uuid.NewString()
+        makeJobDir(t, oldest, 200, 40*time.Minute)
+        makeJobDir(t, older, 200, 30*time.Minute)
+        makeJobDir(t, newer, 400, 20*time.Minute)
+        makeJobDir(t, busy, 400, 50*time.Minute)
+        done := markJobActive(busy)
+        defer done()
+        // Scratch space isn't evicted and doesn't count.
+        makeJobDir(t, ".warp-1", 5000, 50*time.Minute)
+
+        sweepJobs()
+        for name, want := range map[string]bool{oldest: false, older: false, newer: true, busy: true, ".warp-1": true} {
+                _, err := os.Stat(filepath.Join(baseWorkDir, name))
+                if exists := err == nil; exists != want {
+                        t.Errorf("%s: exists = %v, want %v", name, exists, want)
+                }
+        }
+}
+
+func TestDeleteRunningJob(t *testing.T) {
+        useWorkDir(t)
+        started := make(chan struct{})
+        cancelled := make(chan struct{})
+        mux := http.NewServeMux()
+        mux.HandleFunc("/api/pdf/ocr", func(w http.ResponseWriter, r *http.Request) {
+                close(started)
+                <-r.Context().Done()
+                close(cancelled)
+        })
+
+        sub := submitAsync(t, mux, "/api/pdf/ocr", "")
+        <-started
+        if rec := jobStatus(http.MethodDelete, sub.StatusURL); rec.Code != http.StatusOK {
+                t.Fatalf("delete: %d: %s", rec.Code, rec.Body)
+        }
+        select {
+        case <-cancelled:
+        default:
+                t.Error("delete returned before the job was cancelled")
+        }
+        if _, err := os.Stat(filepath.Join(baseWorkDir, sub.JobID)); !os.IsNotExist(err) {
+                t.Errorf("job directory kept: %v", err)
+        }
+        for _, method := range []string{http.MethodGet, http.MethodDelete} {
+                if rec := jobStatus(method, sub.StatusURL); rec.Code != http.StatusNotFound {
+                        t.Errorf("%s after delete: %d, want 404", method, rec.Code)
+                }
+        }
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+        "container/list"
+        "context"
+        "encoding/json"
+        "net/http"
+        "path/filepath"
+        "strconv"
+        "sync"
+        "time"
+)
+
+// ==================================================================================
+// External tool scheduler
+// ==================================================================================
+//
+// Every external process (gs, libreoffice, chromium, ocrmypdf, ...) is started
+// through runCommand/runCommandOutput/runChromiumPDF, which take a slot from
+// the pool belonging to that binary before exec'ing it. Each pool admits at
+// most `limit` processes at a time; additional callers wait in FIFO order.
+//
+// Limits are configured with PDF_TOOL_CONCURRENCY, e.g.
+//
+//	PDF_TOOL_CONCURRENCY="libreoffice=2,gs=4,chromium=1"
+//
+// Binaries without an explicit limit share PDF_TOOL_DEFAULT_CONCURRENCY
+// (default: number of CPUs) per binary. New requests are rejected with 503 and
+// a Retry-After header while the total number of waiting callers is at or
+// above PDF_QUEUE_MAX_DEPTH.
+//
+// Once started, a tool runs for at most PDF_TOOL_TIMEOUT (default 120s,
+// chromium 60s); per-binary overrides use PDF_TOOL_TIMEOUT_<BINARY>, e.g.
+// PDF_TOOL_TIMEOUT_OCRMYPDF=10m. Values are Go durations or plain seconds.
+// All of these can also be set in the config file's tools section (config.go).
+
+// toolTimeout returns how long a single invocation of the named binary may run.
+func toolTimeout(name string) time.Duration {
+        if d, ok := config.Tools.Timeouts[toolKey(name)]; ok {
+                return time.Duration(d)
+        }
+        return time.Duration(config.Tools.Timeout)
+}
+
+type toolPool struct {
+        name    string
+        limit   int
+        running int
+        waiters *list.List // of chan struct{}
+}
+
+type toolScheduler struct {
+        mu           sync.Mutex
+        pools        map[string]*toolPool
+        limits       map[string]int
+        defaultLimit int
+        maxDepth     int
+        retryAfter   int
+        waiting      int
+}
+
+var scheduler = newToolScheduler()
+
+func newToolScheduler() *toolScheduler {
+        return &toolScheduler{
+                pools:        make(map[string]*toolPool),
+                limits:       config.Tools.Concurrency,
+                defaultLimit: config.Tools.DefaultConcurrency,
+                maxDepth:     config.Tools.QueueMaxDepth,
+                retryAfter:   int((time.Duration(config.Tools.QueueRetryAfter) + time.Second - 1) / time.Second),
+        }
+}
+
+// pool returns the pool for a binary, creating it on first use. Callers must
+// hold s.mu.
+func (s *toolScheduler) pool(name string) *toolPool {
+        key := filepath.Base(name)
+        p, ok := s.pools[key]
+        if !ok {
+                limit, ok := s.limits[toolKey(name)]
+                if !ok {
+                        limit = s.defaultLimit
+                }
+                p = &toolPool{name: key, limit: limit, waiters: list.New()}
+                s.pools[key] = p
+        }
+        return p
+}
+
+// acquire blocks until a slot for the named binary is free and returns the
+// function that releases it. Waiters are served in arrival order; a waiter
+// whose ctx is cancelled leaves the queue and gets ctx.Err().
+func (s *toolScheduler) acquire(ctx context.Context, name string) (func(), error) {
+        s.mu.Lock()
+        p := s.pool(name)
+        if p.running < p.limit && p.waiters.Len() == 0 {
+                p.running++
+                s.mu.Unlock()
+                return func() { s.release(p) }, nil
+        }
+        ready := make(chan struct{})
+        elem := p.waiters.PushBack(ready)
+        s.waiting++
+        s.mu.Unlock()
+
+        select {
+        case <-ready:
+                return func() { s.release(p) }, nil
+        case <-ctx.Done():
+                s.mu.Lock()
+                select {
+                case <-ready:
+                        // Granted concurrently with the cancellation; pass it on.
+                        s.mu.Unlock()
+                        s.release(p)
+                default:
+                        p.waiters.Remove(elem)
+                        s.waiting--
+                        s.mu.Unlock()
+                }
+                return nil, ctx.Err()
+        }
+}
+
+// release hands the slot directly to the oldest waiter, if any, so that a
+// newly arriving caller can never overtake the queue.
+func (s *toolScheduler) release(p *toolPool) {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        if front := p.waiters.Front(); front != nil {
+                p.waiters.Remove(front)
+                s.waiting--
+                close(front.Value.(chan struct{}))
+                return
+        }
+        p.running--
+}
+
+// full reports whether the queue has reached its maximum depth.
+func (s *toolScheduler) full() bool {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        return s.waiting >= s.maxDepth
+}
+
+type toolQueueStats struct {
+        Limit   int `json:"limit"`
+        Running int `json:"running"`
+        Waiting int `json:"waiting"`
+}
+
+type queueStats struct {
+        Depth    int                       `json:"depth"`
+        MaxDepth int                       `json:"maxDepth"`
+        Tools    map[string]toolQueueStats `json:"tools"`
+}
+
+func (s *toolScheduler) stats() queueStats {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        st := queueStats{
+                Depth:    s.waiting,
+                MaxDepth: s.maxDepth,
+                Tools:    make(map[string]toolQueueStats, len(s.pools)),
+        }
+        for name, p := range s.pools {
+                st.Tools[name] = toolQueueStats{Limit: p.limit, Running: p.running, Waiting: p.waiters.Len()}
+        }
+        return st
+}
+
+// withAdmission rejects new tool requests with 503 while the tool queue is
+// full. Status endpoints, downloads and previews are always let through so
+// that clients can keep polling and fetching results under load.
+func withAdmission(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if r.Method == http.MethodPost && scheduler.full() {
+                        logger(r.Context()).Warn("queue full, rejecting request", "component", "scheduler", "path", r.URL.Path)
+                        w.Header().Set("Retry-After", strconv.Itoa(scheduler.retryAfter))
+                        errorJSON(w, http.StatusServiceUnavailable, "server is busy, please retry later")
+                        return
+                }
+                next.ServeHTTP(w, r)
+        })
+}
+
+type healthResponse struct {
+        Status string           `json:"status"`
+        Queue  queueStats       `json:"queue"`
+        Cache  resultCacheStats `json:"cache"`
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(healthResponse{Status: "ok", Queue: scheduler.stats(), Cache: resultCache.stats()})
+}
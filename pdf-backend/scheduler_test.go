@@ -0,0 +1,178 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "net/http"
+        "net/http/httptest"
+        "testing"
+        "time"
+)
+
+func testScheduler(limits map[string]int, defaultLimit, maxDepth int) *toolScheduler {
+        return &toolScheduler{
+                pools:        make(map[string]*toolPool),
+                limits:       limits,
+                defaultLimit: defaultLimit,
+                maxDepth:     maxDepth,
+                retryAfter:   7,
+        }
+}
+
+// waitQueued waits until n callers are queued in s.
+func waitQueued(t *testing.T, s *toolScheduler, n int) {
+        t.Helper()
+        deadline := time.Now().Add(5 * time.Second)
+        for s.stats().Depth != n {
+                if time.Now().After(deadline) {
+                        t.Fatalf("queue depth %d, want %d", s.stats().Depth, n)
+                }
+                time.Sleep(time.Millisecond)
+        }
+}
+
+func TestToolPoolLimits(t *testing.T) {
+        s := testScheduler(map[string]int{"gs": 3, "libreoffice": 2}, 5, 10)
+        tests := []struct {
+                name string
+                pool string
+                want int
+        }{
+                {name: "gs", pool: "gs", want: 3},
+                {name: "/usr/bin/gs", pool: "gs", want: 3},
+                {name: "libreoffice", pool: "libreoffice", want: 2},
+                {name: "qpdf", pool: "qpdf", want: 5},
+        }
+        for _, tt := range tests {
+                s.mu.Lock()
+                p := s.pool(tt.name)
+                s.mu.Unlock()
+                if p.name != tt.pool || p.limit != tt.want {
+                        t.Errorf("pool(%q) = %s with limit %d, want %s with %d", tt.name, p.name, p.limit, tt.pool, tt.want)
+                }
+        }
+}
+
+func TestSchedulerFIFO(t *testing.T) {
+        s := testScheduler(map[string]int{"gs": 2}, 1, 10)
+        ctx := context.Background()
+        var held []func()
+        for i := 0; i < 2; i++ {
+                release, err := s.acquire(ctx, "gs")
+                if err != nil {
+                        t.Fatal(err)
+                }
+                held = append(held, release)
+        }
+        // Other tools have pools of their own.
+        release, err := s.acquire(ctx, "qpdf")
+        if err != nil {
+                t.Fatal(err)
+        }
+        release()
+
+        order := make(chan int, 5)
+        for i := 0; i < 5; i++ {
+                go func(i int) {
+                        release, err := s.acquire(ctx, "gs")
+                        if err != nil {
+                                t.Error(err)
+                                return
+                        }
+                        order <- i
+                        release()
+                }(i)
+                waitQueued(t, s, i+1)
+        }
+        if st := s.stats().Tools["gs"]; st.Running != 2 || st.Waiting != 5 {
+                t.Fatalf("gs stats %+v", st)
+        }
+
+        held[0]()
+        for want := 0; want < 5; want++ {
+                if got := <-order; got != want {
+                        t.Fatalf("waiter %d ran in position %d", got, want)
+                }
+        }
+        held[1]()
+        if st := s.stats().Tools["gs"]; st.Running != 0 || st.Waiting != 0 {
+                t.Errorf("gs stats after release %+v", st)
+        }
+}
+
+func TestSchedulerCancelledWaiter(t *testing.T) {
+        s := testScheduler(nil, 1, 10)
+        release, err := s.acquire(context.Background(), "gs")
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        ctx, cancel := context.WithCancel(context.Background())
+        errc := make(chan error, 1)
+        go func() {
+                _, err := s.acquire(ctx, "gs")
+                errc <- err
+        }()
+        waitQueued(t, s, 1)
+        cancel()
+        if err := <-errc; !errors.Is(err, context.Canceled) {
+                t.Fatalf("cancelled waiter got %v", err)
+        }
+        waitQueued(t, s, 0)
+
+        // The slot goes to the next caller, not the one that gave up.
+        release()
+        release, err = s.acquire(context.Background(), "gs")
+        if err != nil {
+                t.Fatal(err)
+        }
+        release()
+        if st := s.stats().Tools["gs"]; st.Running != 0 {
+                t.Errorf("gs stats %+v", st)
+        }
+}
+
+func TestAdmission(t *testing.T) {
+        old := scheduler
+        scheduler = testScheduler(nil, 1, 1)
+        defer func() { scheduler = old }()
+
+        h := withAdmission(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                w.WriteHeader(http.StatusNoContent)
+        }))
+        serve := func(method string) *httptest.ResponseRecorder {
+                rec := httptest.NewRecorder()
+                h.ServeHTTP(rec, httptest.NewRequest(method, "/api/pdf/compress", nil))
+                return rec
+        }
+
+        if rec := serve(http.MethodPost); rec.Code != http.StatusNoContent {
+                t.Fatalf("idle: %d", rec.Code)
+        }
+        release, err := scheduler.acquire(context.Background(), "gs")
+        if err != nil {
+                t.Fatal(err)
+        }
+        done := make(chan struct{})
+        go func() {
+                defer close(done)
+                if release, err := scheduler.acquire(context.Background(), "gs"); err == nil {
+                        release()
+                }
+        }()
+        waitQueued(t, scheduler, 1)
+
+        rec := serve(http.MethodPost)
+        if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "7" {
+                t.Errorf("full queue: %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+        }
+        if rec := serve(http.MethodGet); rec.Code != http.StatusNoContent {
+                t.Errorf("GET with full queue: %d", rec.Code)
+        }
+
+        release()
+        <-done
+        if rec := serve(http.MethodPost); rec.Code != http.StatusNoContent {
+                t.Errorf("drained: %d", rec.Code)
+        }
+}
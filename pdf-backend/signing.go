@@ -0,0 +1,192 @@
+package main
+
+import (
+        "crypto/hmac"
+        "crypto/rand"
+        "crypto/sha256"
+        "encoding/base64"
+        "encoding/hex"
+        "errors"
+        "log/slog"
+        "net/http"
+        "net/url"
+        "os"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// ==================================================================================
+// Signed download and preview URLs
+// ==================================================================================
+//
+// Download and preview links carry an expiry and an HMAC over the file they
+// point at, so knowing a job ID is not enough to fetch its files:
+//
+//	/downloads/<jobId>/<file>?exp=<unix>&sig=<mac>[&once=<nonce>]
+//
+// A signature only covers one path and one kind of link, so a preview link
+// can't be turned into a link to the job's input or to another file.
+//
+// Configuration:
+//
+//	PDF_URL_SIGNING_KEY  HMAC key; must be shared by all replicas. When unset
+//	                     a random key is generated and links stop working
+//	                     after a restart.
+//	PDF_URL_TTL          link lifetime (default 2h, the job retention)
+//	PDF_URL_SINGLE_USE   "true" makes every download link single-use; a
+//	                     request can also ask for it with singleUse=true
+//
+// Single-use links record their nonce in the job directory on first GET and
+// answer 410 afterwards. Preview links are never single-use since browsers
+// refetch thumbnails freely.
+
+const (
+        urlKindDownload = "download"
+        urlKindPreview  = "preview"
+
+        defaultURLTTL = 2 * time.Hour
+
+        usedNoncesDir = ".used-links"
+)
+
+var (
+        errURLInvalid = errors.New("invalid or missing signature")
+        errURLExpired = errors.New("link expired")
+        errURLUsed    = errors.New("link already used")
+)
+
+type urlSigner struct {
+        key       []byte
+        ttl       time.Duration
+        singleUse bool
+}
+
+var signer = newURLSigner()
+
+func newURLSigner() *urlSigner {
+        s := &urlSigner{
+                key:       []byte(config.Links.SigningKey),
+                ttl:       time.Duration(config.Links.TTL),
+                singleUse: config.Links.SingleUse,
+        }
+        if len(s.key) == 0 {
+                s.key = make([]byte, 32)
+                if _, err := rand.Read(s.key); err != nil {
+                        fatal("failed to generate URL signing key", err)
+                }
+                slog.Warn("PDF_URL_SIGNING_KEY not set, using a random key; links will not survive a restart", "component", "signing")
+        }
+        return s
+}
+
+func (s *urlSigner) mac(kind, rel string, exp int64, nonce string) string {
+        m := hmac.New(sha256.New, s.key)
+        m.Write([]byte(kind + "\n" + rel + "\n" + strconv.FormatInt(exp, 10) + "\n" + nonce))
+        return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// sign returns the query string authorising access to rel ("<jobId>/<file>")
+// until the configured TTL elapses. A non-empty nonce makes the link
+// single-use.
+func (s *urlSigner) sign(kind, rel, nonce string) string {
+        exp := time.Now().Add(s.ttl).Unix()
+        q := url.Values{}
+        q.Set("exp", strconv.FormatInt(exp, 10))
+        if nonce != "" {
+                q.Set("once", nonce)
+        }
+        q.Set("sig", s.mac(kind, rel, exp, nonce))
+        return q.Encode()
+}
+
+// verify checks the signature and expiry of a request for rel and, for
+// single-use links, consumes the nonce.
+func (s *urlSigner) verify(r *http.Request, kind, rel string) error {
+        q := r.URL.Query()
+        exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+        if err != nil {
+                return errURLInvalid
+        }
+        nonce := q.Get("once")
+        if !hmac.Equal([]byte(q.Get("sig")), []byte(s.mac(kind, rel, exp, nonce))) {
+                return errURLInvalid
+        }
+        if time.Now().Unix() > exp {
+                return errURLExpired
+        }
+        if nonce != "" && r.Method != http.MethodHead {
+                return consumeNonce(rel, nonce)
+        }
+        return nil
+}
+
+func newNonce() string {
+        b := make([]byte, 16)
+        if _, err := rand.Read(b); err != nil {
+                fatal("failed to generate link nonce", err)
+        }
+        return hex.EncodeToString(b)
+}
+
+// consumeNonce marks a single-use link as used by creating a marker file in
+// the job directory; O_EXCL makes concurrent first requests race safely.
+func consumeNonce(rel, nonce string) error {
+        if _, err := hex.DecodeString(nonce); err != nil {
+                return errURLInvalid
+        }
+        jobID, _, _ := strings.Cut(rel, "/")
+        dir := filepath.Join(baseWorkDir, jobID, usedNoncesDir)
+        if err := os.MkdirAll(dir, 0o755); err != nil {
+                return err
+        }
+        f, err := os.OpenFile(filepath.Join(dir, nonce), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+        if err != nil {
+                if errors.Is(err, os.ErrExist) {
+                        return errURLUsed
+                }
+                return err
+        }
+        return f.Close()
+}
+
+// writeURLError answers a request whose link failed verification.
+func writeURLError(w http.ResponseWriter, r *http.Request, err error) {
+        switch {
+        case errors.Is(err, errURLExpired), errors.Is(err, errURLUsed):
+                writeAPIError(w, http.StatusGone, apiError{Error: err.Error(), Code: codeLinkExpired})
+        case errors.Is(err, errURLInvalid):
+                errorJSON(w, http.StatusForbidden, err.Error())
+        default:
+                logger(r.Context()).Error("verify link failed", "component", "signing", "error", err.Error())
+                errorJSON(w, http.StatusInternalServerError, "internal error")
+        }
+}
+
+// wantsSingleUse reports whether download links for r should be single-use.
+func wantsSingleUse(r *http.Request) bool {
+        if signer.singleUse {
+                return true
+        }
+        v := r.URL.Query().Get("singleUse")
+        if v == "" && r.MultipartForm != nil {
+                if vs := r.MultipartForm.Value["singleUse"]; len(vs) > 0 {
+                        v = vs[0]
+                }
+        }
+        return v == "true" || v == "1"
+}
+
+// downloadURLExpired reports whether a stored /downloads/ link (the
+// downloadUrl of an async job) is past its expiry. Presigned object-store
+// URLs carry their own expiry and are never reported expired here.
+func downloadURLExpired(u string) bool {
+        path, rawQuery, _ := strings.Cut(u, "?")
+        if !strings.HasPrefix(path, "/downloads/") {
+                return false
+        }
+        q, _ := url.ParseQuery(rawQuery)
+        exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+        return err == nil && time.Now().Unix() > exp
+}
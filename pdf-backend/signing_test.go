@@ -0,0 +1,169 @@
+package main
+
+import (
+        "errors"
+        "net/http"
+        "net/http/httptest"
+        "net/url"
+        "os"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "testing"
+        "time"
+)
+
+// useSigner replaces the URL signer for the rest of the test.
+func useSigner(t *testing.T, ttl time.Duration, singleUse bool) {
+        t.Helper()
+        old := signer
+        signer = &urlSigner{key: []byte("test key"), ttl: ttl, singleUse: singleUse}
+        t.Cleanup(func() { signer = old })
+}
+
+func TestURLSignatures(t *testing.T) {
+        useWorkDir(t)
+        useSigner(t, time.Hour, false)
+        const rel = "0b7c4cd4-6ed2-4c1b-9f0e-6f1d2c3b4a59/out.pdf"
+
+        valid := signer.sign(urlKindDownload, rel, "")
+        q, _ := url.ParseQuery(valid)
+        expired := url.Values{"exp": {strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)}}
+        expired.Set("sig", signer.mac(urlKindDownload, rel, time.Now().Add(-time.Minute).Unix(), ""))
+        later := url.Values{"exp": {strconv.FormatInt(time.Now().Add(2*time.Hour).Unix(), 10)}, "sig": q["sig"]}
+
+        tests := []struct {
+                name  string
+                kind  string
+                rel   string
+                query string
+                want  error
+        }{
+                {name: "valid", kind: urlKindDownload, rel: rel, query: valid},
+                {name: "other kind", kind: urlKindPreview, rel: rel, query: valid, want: errURLInvalid},
+                {name: "other file", kind: urlKindDownload, rel: strings.Replace(rel, "out", "input", 1), query: valid, want: errURLInvalid},
+                {name: "no query", kind: urlKindDownload, rel: rel, want: errURLInvalid},
+                {name: "no signature", kind: urlKindDownload, rel: rel, query: "exp=" + q.Get("exp"), want: errURLInvalid},
+                {name: "extended expiry", kind: urlKindDownload, rel: rel, query: later.Encode(), want: errURLInvalid},
+                {name: "expired", kind: urlKindDownload, rel: rel, query: expired.Encode(), want: errURLExpired},
+                {name: "other key", kind: urlKindDownload, rel: rel, query: (&urlSigner{key: []byte("other"), ttl: time.Hour}).sign(urlKindDownload, rel, ""), want: errURLInvalid},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        r := httptest.NewRequest(http.MethodGet, "/downloads/"+tt.rel+"?"+tt.query, nil)
+                        if err := signer.verify(r, tt.kind, tt.rel); !errors.Is(err, tt.want) {
+                                t.Errorf("verify = %v, want %v", err, tt.want)
+                        }
+                })
+        }
+}
+
+func TestSingleUseURL(t *testing.T) {
+        useWorkDir(t)
+        useSigner(t, time.Hour, false)
+        const rel = "0b7c4cd4-6ed2-4c1b-9f0e-6f1d2c3b4a59/out.pdf"
+        query := signer.sign(urlKindDownload, rel, newNonce())
+        verify := func(method string) error {
+                return signer.verify(httptest.NewRequest(method, "/downloads/"+rel+"?"+query, nil), urlKindDownload, rel)
+        }
+        for i, tt := range []struct {
+                method string
+                want   error
+        }{
+                {http.MethodHead, nil},
+                {http.MethodGet, nil},
+                {http.MethodGet, errURLUsed},
+                {http.MethodHead, nil},
+        } {
+                if err := verify(tt.method); !errors.Is(err, tt.want) {
+                        t.Errorf("request %d (%s) = %v, want %v", i+1, tt.method, err, tt.want)
+                }
+        }
+
+        r := httptest.NewRequest(http.MethodGet, "/downloads/"+rel+"?"+signer.sign(urlKindDownload, rel, "not-hex"), nil)
+        if err := signer.verify(r, urlKindDownload, rel); !errors.Is(err, errURLInvalid) {
+                t.Errorf("non-hex nonce = %v, want %v", err, errURLInvalid)
+        }
+}
+
+func TestServeSignedDownload(t *testing.T) {
+        useWorkDir(t)
+        const jobID = "0b7c4cd4-6ed2-4c1b-9f0e-6f1d2c3b4a59"
+        if err := os.MkdirAll(filepath.Join(baseWorkDir, jobID), 0o755); err != nil {
+                t.Fatal(err)
+        }
+        if err := os.WriteFile(filepath.Join(baseWorkDir, jobID, "out.pdf"), []byte("%PDF-result"), 0o644); err != nil {
+                t.Fatal(err)
+        }
+        get := func(u string) *httptest.ResponseRecorder {
+                rec := httptest.NewRecorder()
+                serveDownload(rec, httptest.NewRequest(http.MethodGet, u, nil))
+                return rec
+        }
+
+        tests := []struct {
+                name      string
+                ttl       time.Duration
+                singleUse bool
+                query     string // of the request the link is built for
+                want      []int  // statuses of successive downloads
+        }{
+                {name: "reusable", ttl: time.Hour, want: []int{200, 200}},
+                {name: "expired", ttl: -time.Second, want: []int{410}},
+                {name: "single use by request", ttl: time.Hour, query: "?singleUse=true", want: []int{200, 410}},
+                {name: "single use by config", ttl: time.Hour, singleUse: true, want: []int{200, 410}},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        useSigner(t, tt.ttl, tt.singleUse)
+                        u := buildDownloadURL(httptest.NewRequest(http.MethodPost, "/api/pdf/compress"+tt.query, nil), jobID, "out.pdf")
+                        if !strings.HasPrefix(u, "/downloads/"+jobID+"/out.pdf?") {
+                                t.Fatalf("download URL %q", u)
+                        }
+                        if got := downloadURLExpired(u); got != (tt.ttl < 0) {
+                                t.Errorf("downloadURLExpired(%q) = %v", u, got)
+                        }
+                        for i, want := range tt.want {
+                                rec := get(u)
+                                if rec.Code != want {
+                                        t.Fatalf("download %d: %d, want %d", i+1, rec.Code, want)
+                                }
+                                if want == 200 && rec.Body.String() != "%PDF-result" {
+                                        t.Errorf("download %d: body %q", i+1, rec.Body)
+                                }
+                        }
+                })
+        }
+
+        useSigner(t, time.Hour, false)
+        for _, u := range []string{
+                "/downloads/" + jobID + "/out.pdf",
+                "/downloads/" + jobID + "/out.pdf?" + signer.sign(urlKindPreview, jobID+"/out.pdf", ""),
+                "/downloads/" + jobID + "/input.pdf?" + signer.sign(urlKindDownload, jobID+"/out.pdf", ""),
+        } {
+                if rec := get(u); rec.Code != http.StatusForbidden {
+                        t.Errorf("GET %s: %d, want 403", u, rec.Code)
+                }
+        }
+}
+
+func TestJobStatusURLSigned(t *testing.T) {
+        useWorkDir(t)
+        useSigner(t, time.Hour, false)
+        const jobID = "0b7c4cd4-6ed2-4c1b-9f0e-6f1d2c3b4a59"
+        for _, tt := range []struct {
+                query string
+                want  int
+        }{
+                {query: "", want: http.StatusForbidden},
+                {query: signer.sign(urlKindDownload, jobID, ""), want: http.StatusForbidden},
+                {query: signer.sign(urlKindJob, "5d0e1f4c-3b2a-4c1d-8e9f-0a1b2c3d4e5f", ""), want: http.StatusForbidden},
+                {query: signer.sign(urlKindJob, jobID, ""), want: http.StatusNotFound},
+        } {
+                rec := httptest.NewRecorder()
+                handleJobStatus(rec, httptest.NewRequest(http.MethodGet, "/api/pdf/jobs/"+jobID+"?"+tt.query, nil))
+                if rec.Code != tt.want {
+                        t.Errorf("status with %q: %d, want %d", tt.query, rec.Code, tt.want)
+                }
+        }
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "io"
+        "log/slog"
+        "mime"
+        "net/url"
+        "os"
+        "path"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "time"
+
+        "github.com/minio/minio-go/v7"
+        "github.com/minio/minio-go/v7/pkg/credentials"
+        "go.opentelemetry.io/otel/attribute"
+)
+
+// ==================================================================================
+// Storage backends for job inputs and outputs
+// ==================================================================================
+//
+// Tools always run against a local scratch directory (baseWorkDir/<jobId>),
+// since the external binaries need real files. The Storage backend is where
+// uploads and results are persisted so that downloads can be served from it.
+// Keys mirror the scratch layout: "<jobId>/<name>".
+//
+// PDF_STORAGE selects the backend:
+//
+//	local (default)  files stay in baseWorkDir; downloads go through /downloads/
+//	s3               any S3-compatible object store (AWS S3, MinIO, R2, ...)
+//
+// The s3 backend is configured with
+//
+//	PDF_S3_ENDPOINT         host[:port] of the API, e.g. "localhost:9000"
+//	PDF_S3_PUBLIC_ENDPOINT  host[:port] used in presigned URLs, if clients
+//	                        reach the store under a different name
+//	PDF_S3_BUCKET           bucket name (created on startup if missing)
+//	PDF_S3_ACCESS_KEY       access key ID
+//	PDF_S3_SECRET_KEY       secret access key
+//	PDF_S3_REGION           region (default "us-east-1")
+//	PDF_S3_USE_SSL          "false" for plain HTTP (default true)
+//	PDF_S3_PREFIX           optional key prefix, e.g. "pdf-jobs/"
+//	PDF_S3_PRESIGN          "false" to proxy downloads instead of returning
+//	                        presigned URLs (default true)
+//	PDF_S3_PRESIGN_TTL      lifetime of presigned URLs (default 1h)
+//
+// Objects are deleted together with the scratch directory by the periodic
+// cleanup; a bucket lifecycle rule is still recommended when several
+// instances share a bucket.
+
+// errStorageNotFound is returned by Storage.Open for keys that don't exist.
+var errStorageNotFound = errors.New("storage: object not found")
+
+// Storage persists job files under slash-separated keys.
+type Storage interface {
+        // Put stores the local file at src under key.
+        Put(ctx context.Context, key, src string) error
+        // Open returns the object stored under key with its size and
+        // modification time.
+        Open(ctx context.Context, key string) (io.ReadSeekCloser, storageInfo, error)
+        // Delete removes every object whose key starts with prefix + "/".
+        Delete(ctx context.Context, prefix string) error
+        // PresignURL returns a time-limited URL clients can download key from
+        // directly, or "" when downloads must go through serveDownload.
+        PresignURL(ctx context.Context, key, filename string) (string, error)
+}
+
+type storageInfo struct {
+        Size    int64
+        ModTime time.Time
+}
+
+// store is the configured backend; main replaces it according to PDF_STORAGE.
+var store Storage = &localStorage{root: baseWorkDir}
+
+func newStorageFromEnv(workDir string) (Storage, error) {
+        switch backend := config.Storage.Backend; backend {
+        case "", "local":
+                return &localStorage{root: workDir}, nil
+        case "s3":
+                return newS3Storage()
+        default:
+                return nil, fmt.Errorf("unknown PDF_STORAGE %q (want local or s3)", backend)
+        }
+}
+
+// storageKey maps a path inside baseWorkDir to its storage key.
+func storageKey(p string) (string, bool) {
+        rel, err := filepath.Rel(baseWorkDir, p)
+        if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+                return "", false
+        }
+        return filepath.ToSlash(rel), true
+}
+
+// persistFile stores a file from a job directory in the storage backend.
+func persistFile(ctx context.Context, p string) (err error) {
+        ctx, span := startSpan(ctx, "persist", attribute.String("file.name", filepath.Base(p)))
+        defer func() { endSpan(span, err) }()
+        key, ok := storageKey(p)
+        if !ok {
+                return fmt.Errorf("%s is outside the work directory", p)
+        }
+        return store.Put(ctx, key, p)
+}
+
+// fetchFile makes sure the file for path p exists in the scratch directory,
+// downloading it from the storage backend if this instance doesn't have it
+// (e.g. the job ran on another replica, or the scratch copy was cleaned up).
+func fetchFile(ctx context.Context, p string) error {
+        if _, err := os.Stat(p); err == nil {
+                return nil
+        }
+        key, ok := storageKey(p)
+        if !ok {
+                return errStorageNotFound
+        }
+        obj, _, err := store.Open(ctx, key)
+        if err != nil {
+                return err
+        }
+        defer obj.Close()
+        if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+                return err
+        }
+        tmp := p + ".part"
+        out, err := os.Create(tmp)
+        if err != nil {
+                return err
+        }
+        if _, err := io.Copy(out, obj); err != nil {
+                out.Close()
+                os.Remove(tmp)
+                return err
+        }
+        if err := out.Close(); err != nil {
+                os.Remove(tmp)
+                return err
+        }
+        return os.Rename(tmp, p)
+}
+
+// ----------------------------------------------------------------------------------
+// Local filesystem
+// ----------------------------------------------------------------------------------
+
+// localStorage keeps objects in the work directory itself, so files produced
+// in a job directory are already stored and Put is usually a no-op.
+type localStorage struct {
+        root string
+}
+
+func (s *localStorage) path(key string) (string, error) {
+        clean := path.Clean("/" + key)
+        if clean == "/" {
+                return "", fmt.Errorf("invalid storage key %q", key)
+        }
+        return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+func (s *localStorage) Put(ctx context.Context, key, src string) error {
+        dst, err := s.path(key)
+        if err != nil {
+                return err
+        }
+        if filepath.Clean(src) == dst {
+                return nil
+        }
+        if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+                return err
+        }
+        return copyFileEdit(src, dst)
+}
+
+func (s *localStorage) Open(ctx context.Context, key string) (io.ReadSeekCloser, storageInfo, error) {
+        p, err := s.path(key)
+        if err != nil {
+                return nil, storageInfo{}, err
+        }
+        f, err := os.Open(p)
+        if err != nil {
+                if errors.Is(err, os.ErrNotExist) {
+                        err = errStorageNotFound
+                }
+                return nil, storageInfo{}, err
+        }
+        fi, err := f.Stat()
+        if err != nil || fi.IsDir() {
+                f.Close()
+                return nil, storageInfo{}, errStorageNotFound
+        }
+        return f, storageInfo{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *localStorage) Delete(ctx context.Context, prefix string) error {
+        p, err := s.path(prefix)
+        if err != nil {
+                return err
+        }
+        return os.RemoveAll(p)
+}
+
+func (s *localStorage) PresignURL(ctx context.Context, key, filename string) (string, error) {
+        return "", nil
+}
+
+// ----------------------------------------------------------------------------------
+// S3-compatible object store
+// ----------------------------------------------------------------------------------
+
+type s3Storage struct {
+        client     *minio.Client
+        presigner  *minio.Client // client configured with the public endpoint
+        bucket     string
+        prefix     string
+        presign    bool
+        presignTTL time.Duration
+}
+
+const defaultPresignTTL = time.Hour
+
+func newS3Storage() (*s3Storage, error) {
+        cfg := config.Storage.S3
+        if cfg.Endpoint == "" || cfg.Bucket == "" {
+                return nil, errors.New("PDF_S3_ENDPOINT and PDF_S3_BUCKET are required for PDF_STORAGE=s3")
+        }
+        bucket, region, useSSL := cfg.Bucket, cfg.Region, cfg.UseSSL
+        creds := credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, "")
+
+        client, err := minio.New(cfg.Endpoint, &minio.Options{Creds: creds, Secure: useSSL, Region: region})
+        if err != nil {
+                return nil, fmt.Errorf("s3 client: %w", err)
+        }
+        s := &s3Storage{
+                client:     client,
+                presigner:  client,
+                bucket:     bucket,
+                prefix:     cfg.Prefix,
+                presign:    cfg.Presign,
+                presignTTL: time.Duration(cfg.PresignTTL),
+        }
+        if public := cfg.PublicEndpoint; public != "" {
+                // Presigning is offline, but the signature covers the host, so the
+                // URL has to be signed for the name clients will use.
+                s.presigner, err = minio.New(public, &minio.Options{Creds: creds, Secure: useSSL, Region: region})
+                if err != nil {
+                        return nil, fmt.Errorf("s3 public client: %w", err)
+                }
+        }
+
+        ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+        defer cancel()
+        exists, err := client.BucketExists(ctx, bucket)
+        if err != nil {
+                return nil, fmt.Errorf("s3 bucket %s: %w", bucket, err)
+        }
+        if !exists {
+                if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: region}); err != nil {
+                        return nil, fmt.Errorf("create s3 bucket %s: %w", bucket, err)
+                }
+                slog.Info("created bucket", "component", "storage", "bucket", bucket)
+        }
+        return s, nil
+}
+
+func (s *s3Storage) objectName(key string) string {
+        return s.prefix + key
+}
+
+// Put uploads src unless an object of the same size is already stored under
+// key; results are published both by the tool (zipDirectory) and by the
+// request adapter, and re-uploading them would be wasted work.
+func (s *s3Storage) Put(ctx context.Context, key, src string) error {
+        fi, err := os.Stat(src)
+        if err != nil {
+                return err
+        }
+        if st, err := s.client.StatObject(ctx, s.bucket, s.objectName(key), minio.StatObjectOptions{}); err == nil && st.Size == fi.Size() {
+                return nil
+        }
+        _, err = s.client.FPutObject(ctx, s.bucket, s.objectName(key), src, minio.PutObjectOptions{
+                ContentType: contentTypeForName(key),
+        })
+        return err
+}
+
+func (s *s3Storage) Open(ctx context.Context, key string) (io.ReadSeekCloser, storageInfo, error) {
+        obj, err := s.client.GetObject(ctx, s.bucket, s.objectName(key), minio.GetObjectOptions{})
+        if err != nil {
+                return nil, storageInfo{}, err
+        }
+        st, err := obj.Stat()
+        if err != nil {
+                obj.Close()
+                if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+                        err = errStorageNotFound
+                }
+                return nil, storageInfo{}, err
+        }
+        return obj, storageInfo{Size: st.Size, ModTime: st.LastModified}, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, prefix string) error {
+        objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+                Prefix:    s.objectName(strings.TrimSuffix(prefix, "/") + "/"),
+                Recursive: true,
+        })
+        for res := range s.client.RemoveObjects(ctx, s.bucket, objects, minio.RemoveObjectsOptions{}) {
+                if res.Err != nil {
+                        return fmt.Errorf("remove %s: %w", res.ObjectName, res.Err)
+                }
+        }
+        return nil
+}
+
+func (s *s3Storage) PresignURL(ctx context.Context, key, filename string) (string, error) {
+        if !s.presign {
+                return "", nil
+        }
+        params := url.Values{}
+        params.Set("response-content-disposition", "attachment; filename="+strconv.Quote(filename))
+        u, err := s.presigner.PresignedGetObject(ctx, s.bucket, s.objectName(key), s.presignTTL, params)
+        if err != nil {
+                return "", err
+        }
+        return u.String(), nil
+}
+
+// contentTypeForName guesses the Content-Type stored with an object, so that
+// presigned downloads are served with a sensible type.
+func contentTypeForName(name string) string {
+        if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+                return ct
+        }
+        return "application/octet-stream"
+}
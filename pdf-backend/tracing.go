@@ -0,0 +1,175 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "log/slog"
+        "net/http"
+        "os"
+        "os/exec"
+        "path/filepath"
+        "strings"
+
+        "go.opentelemetry.io/otel"
+        "go.opentelemetry.io/otel/attribute"
+        "go.opentelemetry.io/otel/codes"
+        "go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+        "go.opentelemetry.io/otel/propagation"
+        "go.opentelemetry.io/otel/sdk/resource"
+        sdktrace "go.opentelemetry.io/otel/sdk/trace"
+        semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+        "go.opentelemetry.io/otel/trace"
+)
+
+// ==================================================================================
+// Tracing
+// ==================================================================================
+//
+// With an OTLP endpoint configured, spans are exported over OTLP/HTTP using
+// the standard OpenTelemetry environment variables:
+//
+//	OTEL_EXPORTER_OTLP_ENDPOINT          e.g. http://localhost:4318; tracing
+//	(or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT) is off when neither is set
+//	OTEL_SERVICE_NAME                    default "pdf-backend"
+//	OTEL_TRACES_SAMPLER[_ARG]            default parentbased_always_on
+//
+// Spans:
+//
+//	HTTP <method> <route>   every request (withTracing), continuing the trace
+//	                        of an incoming traceparent header (the Node proxy
+//	                        forwards the browser's or its own)
+//	operation <name>        an operation run, with cache hits marked
+//	exec <tool>             every runCommand/runChromiumPDF invocation, with
+//	                        the binary, a redacted summary of its arguments,
+//	                        the time spent waiting for a slot and the exit code
+//	save upload, persist,   file saves: uploads, copies to the storage backend
+//	zip                     and ZIP archives
+//	async job <operation>   the background replay of an async request, in the
+//	                        trace of the request that submitted it
+//
+// Log lines of a traced request carry its trace_id.
+
+const tracerName = "pdf-backend"
+
+var tracer = otel.Tracer(tracerName)
+
+// setupTracing installs the propagator and, when an endpoint is configured,
+// the OTLP exporter.
+func setupTracing(ctx context.Context) {
+        otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+                propagation.TraceContext{}, propagation.Baggage{}))
+
+        if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+                return
+        }
+        exp, err := otlptracehttp.New(ctx)
+        if err != nil {
+                slog.Error("tracing disabled", "component", "tracing", "error", err.Error())
+                return
+        }
+        name := os.Getenv("OTEL_SERVICE_NAME")
+        if name == "" {
+                name = "pdf-backend"
+        }
+        res, err := resource.Merge(resource.Default(),
+                resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(name)))
+        if err != nil {
+                res = resource.Default()
+        }
+        otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+                slog.Error("tracing error", "component", "tracing", "error", err.Error())
+        }))
+        tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+        otel.SetTracerProvider(tp)
+        slog.Info("exporting spans over OTLP", "component", "tracing", "service", name)
+}
+
+// withTracing starts a server span for every request, continuing the caller's
+// trace.
+func withTracing(mux *http.ServeMux, next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                _, route := mux.Handler(r)
+                if route == "" {
+                        route = "other"
+                }
+                ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+                ctx, span := tracer.Start(ctx, "HTTP "+r.Method+" "+route,
+                        trace.WithSpanKind(trace.SpanKindServer),
+                        trace.WithAttributes(
+                                semconv.HTTPMethod(r.Method),
+                                semconv.HTTPRoute(route),
+                                attribute.String("http.target", r.URL.Path),
+                                attribute.Int64("http.request_content_length", max(r.ContentLength, 0)),
+                        ))
+                defer span.End()
+
+                rw := &metricsWriter{ResponseWriter: w}
+                next.ServeHTTP(rw, r.WithContext(ctx))
+                if rw.status == 0 {
+                        rw.status = http.StatusOK
+                }
+                span.SetAttributes(semconv.HTTPStatusCode(rw.status), attribute.Int64("http.response_content_length", rw.bytes))
+                if rw.status >= http.StatusInternalServerError {
+                        span.SetStatus(codes.Error, http.StatusText(rw.status))
+                }
+        })
+}
+
+// startSpan starts an internal span; end it with endSpan.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+        return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, and ends span.
+func endSpan(span trace.Span, err error) {
+        if err != nil {
+                span.RecordError(err)
+                span.SetStatus(codes.Error, err.Error())
+        }
+        span.End()
+}
+
+// startToolSpan starts the span of an external tool invocation.
+func startToolSpan(ctx context.Context, name string, args []string) (context.Context, trace.Span) {
+        tool := filepath.Base(name)
+        return startSpan(ctx, "exec "+tool,
+                attribute.String("process.executable.name", tool),
+                attribute.String("process.command_args", argsSummary(args)),
+        )
+}
+
+// endToolSpan records how a tool invocation ended.
+func endToolSpan(span trace.Span, err error) {
+        code := 0
+        var exitErr *exec.ExitError
+        switch {
+        case errors.As(err, &exitErr):
+                code = exitErr.ExitCode()
+        case err != nil:
+                code = -1
+        }
+        span.SetAttributes(attribute.Int("process.exit_code", code))
+        endSpan(span, err)
+}
+
+// argsSummary is a short, redacted rendering of tool arguments with job
+// directory paths shortened to their file names.
+func argsSummary(args []string) string {
+        args = redactArgs(args)
+        for i, a := range args {
+                if k, v, ok := strings.Cut(a, "="); ok && strings.HasPrefix(v, baseWorkDir) {
+                        args[i] = k + "=" + filepath.Base(v)
+                } else if strings.HasPrefix(a, baseWorkDir) {
+                        args[i] = filepath.Base(a)
+                }
+        }
+        return truncateForLog(strings.Join(args, " "), 512)
+}
+
+// traceIDOf returns the trace ID of the span in ctx, or "".
+func traceIDOf(ctx context.Context) string {
+        if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+                return sc.TraceID().String()
+        }
+        return ""
+}
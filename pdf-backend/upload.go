@@ -0,0 +1,240 @@
+package main
+
+import (
+        "crypto/sha256"
+        "encoding/hex"
+        "errors"
+        "fmt"
+        "io"
+        "mime/multipart"
+        "net/http"
+        "net/url"
+        "os"
+        "path/filepath"
+
+        "go.opentelemetry.io/otel/attribute"
+)
+
+// ==================================================================================
+// Streaming uploads
+// ==================================================================================
+//
+// Handlers read multipart bodies with readUploads instead of
+// ParseMultipartForm, so uploads are never buffered in memory or in temporary
+// files: each file part is written straight into the job directory while its
+// size is checked against the plan's per-file limit (aborting the upload as
+// soon as it is exceeded) and its SHA-256 is computed.
+//
+// Text fields are collected into r.Form, r.PostForm and r.MultipartForm as
+// ParseMultipartForm would have done, so r.FormValue keeps working.
+//
+// PDF_MAX_UPLOAD_BYTES caps the whole request body for every plan
+// (default: no cap beyond the per-file limits).
+
+const (
+        // maxFormValueBytes bounds the text fields of one request in total;
+        // html, markdown and annotation JSON can be sizeable.
+        maxFormValueBytes = 32 << 20
+        // maxUploadParts bounds the number of parts of one request.
+        maxUploadParts = 1000
+)
+
+var maxUploadBytes = int64(config.MaxUploadBytes)
+
+// uploadSpec names the file fields a handler uses. File parts in other fields
+// are read and discarded.
+type uploadSpec struct {
+        fields []string
+        // multi keeps every file of a field instead of only the first.
+        multi bool
+}
+
+func (s uploadSpec) wants(field string) bool {
+        for _, f := range s.fields {
+                if f == field {
+                        return true
+                }
+        }
+        return false
+}
+
+// readUploads streams the multipart body of r. Wanted file parts are saved in
+// dir as upload-<n> (callers rename them into place) and returned in the
+// order they arrived. On error, the files written so far are removed.
+func readUploads(w http.ResponseWriter, r *http.Request, dir string, spec uploadSpec) (files []OpFile, err error) {
+        defer func() {
+                if err != nil {
+                        for _, f := range files {
+                                os.Remove(f.Path)
+                        }
+                        files = nil
+                }
+        }()
+
+        if maxUploadBytes > 0 {
+                r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+        }
+        mr, err := r.MultipartReader()
+        if err != nil {
+                return nil, opFail(http.StatusBadRequest, "invalid multipart form")
+        }
+
+        values := url.Values{}
+        valueBytes := int64(0)
+        perField := map[string]int{}
+        maxFileSize := getMaxFileSizeBytes(r)
+        for parts := 0; ; parts++ {
+                part, err := mr.NextPart()
+                if err == io.EOF {
+                        break
+                }
+                if err != nil {
+                        return files, uploadReadError(err)
+                }
+                if parts >= maxUploadParts {
+                        part.Close()
+                        return files, opFailCode(http.StatusRequestEntityTooLarge, codeLimitExceeded, "too many form parts")
+                }
+                field := part.FormName()
+                if part.FileName() == "" {
+                        b, err := io.ReadAll(io.LimitReader(part, maxFormValueBytes-valueBytes+1))
+                        part.Close()
+                        if err != nil {
+                                return files, uploadReadError(err)
+                        }
+                        valueBytes += int64(len(b))
+                        if valueBytes > maxFormValueBytes {
+                                return files, opFailCode(http.StatusRequestEntityTooLarge, codeLimitExceeded, "form fields are too large")
+                        }
+                        values.Add(field, string(b))
+                        continue
+                }
+
+                if !spec.wants(field) || (!spec.multi && perField[field] > 0) {
+                        _, err := io.Copy(io.Discard, part)
+                        part.Close()
+                        if err != nil {
+                                return files, uploadReadError(err)
+                        }
+                        continue
+                }
+                perField[field]++
+                f, err := saveUploadPart(r, part, filepath.Join(dir, fmt.Sprintf("upload-%d", len(files))), maxFileSize)
+                part.Close()
+                if f.Path != "" {
+                        files = append(files, f)
+                }
+                if err != nil {
+                        return files, err
+                }
+        }
+
+        for k, vs := range r.URL.Query() {
+                values[k] = append(values[k], vs...)
+        }
+        r.Form = values
+        r.PostForm = values
+        r.MultipartForm = &multipart.Form{Value: values, File: map[string][]*multipart.FileHeader{}}
+        return files, nil
+}
+
+// saveUploadPart writes one file part to dst, hashing it on the way and
+// stopping as soon as it exceeds maxSize (0 for no limit).
+func saveUploadPart(r *http.Request, part *multipart.Part, dst string, maxSize int64) (_ OpFile, err error) {
+        _, span := startSpan(r.Context(), "save upload", attribute.String("upload.field", part.FormName()))
+        defer func() { endSpan(span, err) }()
+        f := OpFile{Name: part.FileName(), Field: part.FormName()}
+        out, err := os.Create(dst)
+        if err != nil {
+                return OpFile{}, err
+        }
+        f.Path = dst
+
+        src := &partReader{r: part}
+        var lr io.Reader = src
+        if maxSize > 0 {
+                lr = io.LimitReader(src, maxSize+1)
+        }
+        h := sha256.New()
+        n, err := io.Copy(io.MultiWriter(out, h), lr)
+        if cerr := out.Close(); err == nil {
+                err = cerr
+        }
+        f.Size = n
+        if src.err != nil {
+                return f, uploadReadError(src.err)
+        }
+        if err != nil {
+                return f, err
+        }
+        if maxSize > 0 && n > maxSize {
+                return f, fileSizeError(r, f.Name, maxSize)
+        }
+        f.SHA256 = hex.EncodeToString(h.Sum(nil))
+        span.SetAttributes(attribute.Int64("upload.size", n))
+        return f, nil
+}
+
+// partReader remembers read errors, to tell a broken upload from a failure to
+// write it.
+type partReader struct {
+        r   io.Reader
+        err error
+}
+
+func (p *partReader) Read(b []byte) (int, error) {
+        n, err := p.r.Read(b)
+        if err != nil && err != io.EOF {
+                p.err = err
+        }
+        return n, err
+}
+
+// uploadReadError reports a body that couldn't be read: one exceeding
+// PDF_MAX_UPLOAD_BYTES, or a malformed or interrupted upload.
+func uploadReadError(err error) error {
+        var maxErr *http.MaxBytesError
+        if errors.As(err, &maxErr) {
+                return opFailCode(http.StatusRequestEntityTooLarge, codeLimitExceeded,
+                        fmt.Sprintf("request exceeds the %.0fMB upload limit", float64(maxErr.Limit)/1024/1024))
+        }
+        return &opError{status: http.StatusBadRequest, code: codeBadRequest, msg: "invalid multipart form", debug: err.Error()}
+}
+
+// fileSizeError reports an upload that exceeds the plan's per-file limit.
+func fileSizeError(r *http.Request, name string, maxSize int64) error {
+        limitMB := float64(maxSize) / 1024 / 1024
+        if requestPlan(r) == planAnonymous {
+                freeMB := float64(planLimits["free"].maxFileSizeBytes()) / 1024 / 1024
+                return opFail(http.StatusUnauthorized, fmt.Sprintf(
+                        "File \"%s\" is larger than %.0fMB. Please log in to upload files up to %.0fMB.",
+                        name, limitMB, freeMB))
+        }
+        return opFail(http.StatusRequestEntityTooLarge, fmt.Sprintf(
+                "File \"%s\" exceeds the %.0fMB per-file limit. Upgrade to Pro for unlimited file sizes.",
+                name, limitMB))
+}
+
+// writeRequestError answers a request that failed before an operation ran
+// (upload, limits): opErrors keep their status and code, anything else is a
+// server error.
+func writeRequestError(w http.ResponseWriter, r *http.Request, err error) {
+        var oe *opError
+        if errors.As(err, &oe) {
+                writeAPIError(w, oe.status, apiError{Error: oe.msg, Code: oe.code, Param: oe.param, Debug: oe.debug})
+                return
+        }
+        logger(r.Context()).Error("save upload failed", "component", "upload", "error", err.Error())
+        errorJSON(w, http.StatusInternalServerError, "failed to save file")
+}
+
+// filesInField returns the files uploaded in field.
+func filesInField(files []OpFile, field string) []OpFile {
+        var out []OpFile
+        for _, f := range files {
+                if f.Field == field {
+                        out = append(out, f)
+                }
+        }
+        return out
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+        "bytes"
+        "crypto/sha256"
+        "encoding/hex"
+        "errors"
+        "mime/multipart"
+        "net/http"
+        "net/http/httptest"
+        "os"
+        "strings"
+        "testing"
+)
+
+type testPart struct {
+        field, name string // name is empty for a text field
+        data        string
+}
+
+// multipartRequest builds a POST to target whose body holds parts in order.
+func multipartRequest(t *testing.T, target string, parts ...testPart) *http.Request {
+        t.Helper()
+        var body bytes.Buffer
+        mw := multipart.NewWriter(&body)
+        for _, p := range parts {
+                if p.name == "" {
+                        mw.WriteField(p.field, p.data)
+                        continue
+                }
+                fw, err := mw.CreateFormFile(p.field, p.name)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                fw.Write([]byte(p.data))
+        }
+        mw.Close()
+        r := httptest.NewRequest(http.MethodPost, target, &body)
+        r.Header.Set("Content-Type", mw.FormDataContentType())
+        return r
+}
+
+func sha256Hex(s string) string {
+        sum := sha256.Sum256([]byte(s))
+        return hex.EncodeToString(sum[:])
+}
+
+func TestReadUploads(t *testing.T) {
+        parts := []testPart{
+                {field: "level", data: "high"},
+                {field: "file", name: "a.pdf", data: "first file"},
+                {field: "other", name: "x.bin", data: "not wanted"},
+                {field: "file", name: "b.pdf", data: "second file"},
+                {field: "file2", name: "c.pdf", data: "third"},
+        }
+        tests := []struct {
+                name string
+                spec uploadSpec
+                want []OpFile
+        }{
+                {name: "first of each field", spec: uploadSpec{fields: []string{"file", "file2"}}, want: []OpFile{
+                        {Name: "a.pdf", Field: "file", Size: 10},
+                        {Name: "c.pdf", Field: "file2", Size: 5},
+                }},
+                {name: "multi", spec: uploadSpec{fields: []string{"file"}, multi: true}, want: []OpFile{
+                        {Name: "a.pdf", Field: "file", Size: 10},
+                        {Name: "b.pdf", Field: "file", Size: 11},
+                }},
+                {name: "no files wanted", spec: uploadSpec{}},
+        }
+        contents := map[string]string{"a.pdf": "first file", "b.pdf": "second file", "c.pdf": "third"}
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        dir := t.TempDir()
+                        r := multipartRequest(t, "/api/pdf/compress?retention=10m", parts...)
+                        files, err := readUploads(httptest.NewRecorder(), r, dir, tt.spec)
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        if len(files) != len(tt.want) {
+                                t.Fatalf("got %d files, want %d", len(files), len(tt.want))
+                        }
+                        for i, f := range files {
+                                want := tt.want[i]
+                                if f.Name != want.Name || f.Field != want.Field || f.Size != want.Size {
+                                        t.Errorf("file %d = %+v, want %+v", i, f, want)
+                                }
+                                b, err := os.ReadFile(f.Path)
+                                if err != nil || string(b) != contents[f.Name] || f.SHA256 != sha256Hex(contents[f.Name]) {
+                                        t.Errorf("file %d: content %q, sha256 %s, err %v", i, b, f.SHA256, err)
+                                }
+                        }
+                        if r.FormValue("level") != "high" || r.FormValue("retention") != "10m" {
+                                t.Errorf("form values %v", r.Form)
+                        }
+                        if r.MultipartForm == nil || r.MultipartForm.Value["level"][0] != "high" {
+                                t.Errorf("MultipartForm %+v", r.MultipartForm)
+                        }
+                })
+        }
+}
+
+func TestReadUploadsLimits(t *testing.T) {
+        limit := func(mb float64) planLimit { return planLimit{MaxFileSizeMB: &mb} }
+        oldLimits, oldMax := planLimits, maxUploadBytes
+        planLimits = map[string]planLimit{
+                planAnonymous: limit(1.0 / 1024), // 1KB
+                "free":        limit(2.0 / 1024),
+                "pro":         {},
+        }
+        defer func() { planLimits, maxUploadBytes = oldLimits, oldMax }()
+
+        small := strings.Repeat("x", 1000)
+        large := strings.Repeat("x", 1500)
+        tests := []struct {
+                name     string
+                plan     string
+                maxBody  int64
+                parts    []testPart
+                status   int
+                code     string
+                contains string
+        }{
+                {name: "anonymous within limit", parts: []testPart{{field: "file", name: "a.pdf", data: small}}},
+                {name: "anonymous over limit", parts: []testPart{{field: "file", name: "a.pdf", data: large}},
+                        status: http.StatusUnauthorized, contains: `"a.pdf" is larger than`},
+                {name: "free over limit", plan: "free", parts: []testPart{
+                        {field: "file", name: "a.pdf", data: small},
+                        {field: "file2", name: "b.pdf", data: large + large},
+                }, status: http.StatusRequestEntityTooLarge, contains: `"b.pdf" exceeds`},
+                {name: "pro unlimited", plan: "pro", parts: []testPart{{field: "file", name: "a.pdf", data: large + large}}},
+                {name: "unwanted file isn't limited", parts: []testPart{{field: "other", name: "a.pdf", data: large}}},
+                {name: "body cap", plan: "pro", maxBody: 2000, parts: []testPart{{field: "file", name: "a.pdf", data: large + large}},
+                        status: http.StatusRequestEntityTooLarge, code: codeLimitExceeded, contains: "upload limit"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        maxUploadBytes = tt.maxBody
+                        dir := t.TempDir()
+                        r := multipartRequest(t, "/api/pdf/compress", tt.parts...)
+                        if tt.plan != "" {
+                                r.Header.Set("X-PDF-User-Plan", tt.plan)
+                        }
+                        files, err := readUploads(httptest.NewRecorder(), r, dir, uploadSpec{fields: []string{"file", "file2"}})
+                        if tt.status == 0 {
+                                if err != nil {
+                                        t.Fatalf("readUploads: %v", err)
+                                }
+                                return
+                        }
+                        var oe *opError
+                        if !errors.As(err, &oe) || oe.status != tt.status || (tt.code != "" && oe.code != tt.code) ||
+                                !strings.Contains(oe.msg, tt.contains) {
+                                t.Fatalf("error = %#v, want status %d, code %q, message containing %q", err, tt.status, tt.code, tt.contains)
+                        }
+                        if files != nil {
+                                t.Errorf("files returned with error: %+v", files)
+                        }
+                        if left, _ := os.ReadDir(dir); len(left) != 0 {
+                                t.Errorf("partial uploads left behind: %v", left)
+                        }
+                })
+        }
+}
+
+func TestReadUploadsRejectsNonMultipart(t *testing.T) {
+        r := httptest.NewRequest(http.MethodPost, "/api/pdf/compress", strings.NewReader("level=high"))
+        r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        _, err := readUploads(httptest.NewRecorder(), r, t.TempDir(), uploadSpec{fields: []string{"file"}})
+        var oe *opError
+        if !errors.As(err, &oe) || oe.status != http.StatusBadRequest {
+                t.Errorf("error = %v, want 400", err)
+        }
+}
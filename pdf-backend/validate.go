@@ -0,0 +1,437 @@
+package main
+
+import (
+        "archive/zip"
+        "bytes"
+        "context"
+        "errors"
+        "fmt"
+        "io"
+        "io/fs"
+        "net/http"
+        "os"
+        "path/filepath"
+        "strings"
+        "unicode/utf8"
+
+        "pdf-backend/pdfdoc"
+)
+
+// ==================================================================================
+// Input validation
+// ==================================================================================
+//
+// Uploads are sniffed from their magic bytes before an operation runs, so a
+// JPEG sent to /pdf/compress is rejected with UNSUPPORTED_FORMAT instead of
+// failing somewhere inside pdfcpu. PDFs are additionally checked for
+// encryption (ENCRYPTED_PDF, unless the only password is an owner password)
+// and for a cross-reference table that can't be parsed or rebuilt
+// (CORRUPT_PDF).
+//
+// With autoConvert=true (or PDF_AUTO_CONVERT=true), wrong-type uploads are
+// routed instead: an image, Office document, HTML or text file sent to a PDF
+// tool is converted to PDF first, and a file sent to the wrong converter
+// (a JPEG to /pdf/word-to-pdf) is handed to the right one.
+
+type fileKind string
+
+const (
+        kindPDF     fileKind = "pdf"
+        kindJPEG    fileKind = "jpeg"
+        kindPNG     fileKind = "png"
+        kindGIF     fileKind = "gif"
+        kindBMP     fileKind = "bmp"
+        kindTIFF    fileKind = "tiff"
+        kindWEBP    fileKind = "webp"
+        kindDOCX    fileKind = "docx"
+        kindXLSX    fileKind = "xlsx"
+        kindPPTX    fileKind = "pptx"
+        kindODT     fileKind = "odt"
+        kindODS     fileKind = "ods"
+        kindODP     fileKind = "odp"
+        kindOLE     fileKind = "ole" // legacy .doc/.xls/.ppt
+        kindRTF     fileKind = "rtf"
+        kindZIP     fileKind = "zip"
+        kindHTML    fileKind = "html"
+        kindText    fileKind = "text"
+        kindUnknown fileKind = "unknown"
+)
+
+var fileKindInfo = map[fileKind]struct {
+        desc string
+        ext  string
+}{
+        kindPDF:     {"a PDF", ".pdf"},
+        kindJPEG:    {"a JPEG image", ".jpg"},
+        kindPNG:     {"a PNG image", ".png"},
+        kindGIF:     {"a GIF image", ".gif"},
+        kindBMP:     {"a BMP image", ".bmp"},
+        kindTIFF:    {"a TIFF image", ".tiff"},
+        kindWEBP:    {"a WebP image", ".webp"},
+        kindDOCX:    {"a Word document", ".docx"},
+        kindXLSX:    {"an Excel workbook", ".xlsx"},
+        kindPPTX:    {"a PowerPoint presentation", ".pptx"},
+        kindODT:     {"an OpenDocument text", ".odt"},
+        kindODS:     {"an OpenDocument spreadsheet", ".ods"},
+        kindODP:     {"an OpenDocument presentation", ".odp"},
+        kindOLE:     {"a legacy Office document", ".doc"},
+        kindRTF:     {"an RTF document", ".rtf"},
+        kindZIP:     {"a ZIP archive", ".zip"},
+        kindHTML:    {"an HTML page", ".html"},
+        kindText:    {"a text file", ".txt"},
+        kindUnknown: {"an unrecognised file", ""},
+}
+
+var imageKinds = []fileKind{kindJPEG, kindPNG, kindGIF, kindBMP, kindTIFF, kindWEBP}
+
+// acceptedKinds lists the kinds op's uploads may be, derived from its
+// InputExt.
+func acceptedKinds(op *Operation) []fileKind {
+        switch op.InputExt {
+        case "", ".pdf":
+                return []fileKind{kindPDF}
+        case ".jpg", ".png", ".bmp":
+                return imageKinds
+        case ".docx":
+                return []fileKind{kindDOCX, kindODT, kindOLE, kindRTF, kindText, kindUnknown}
+        case ".xlsx":
+                return []fileKind{kindXLSX, kindODS, kindOLE, kindText, kindUnknown}
+        case ".pptx":
+                return []fileKind{kindPPTX, kindODP, kindOLE, kindUnknown}
+        case ".html":
+                return []fileKind{kindHTML, kindText}
+        case ".md":
+                return []fileKind{kindText, kindHTML}
+        }
+        return nil
+}
+
+func acceptsKind(op *Operation, k fileKind) bool {
+        accepted := acceptedKinds(op)
+        if accepted == nil {
+                return true
+        }
+        for _, a := range accepted {
+                if a == k {
+                        return true
+                }
+        }
+        return false
+}
+
+// converterFor names the operation that turns a file of kind k into a PDF.
+func converterFor(k fileKind) string {
+        switch k {
+        case kindJPEG, kindPNG, kindGIF, kindBMP, kindTIFF, kindWEBP:
+                return "image-to-pdf"
+        case kindDOCX, kindODT, kindOLE, kindRTF:
+                return "word-to-pdf"
+        case kindXLSX, kindODS:
+                return "excel-to-pdf"
+        case kindPPTX, kindODP:
+                return "powerpoint-to-pdf"
+        case kindHTML:
+                return "html-to-pdf"
+        case kindText:
+                return "markdown-to-pdf"
+        }
+        return ""
+}
+
+// ----------------------------------------------------------------------------------
+// Sniffing
+// ----------------------------------------------------------------------------------
+
+const sniffLen = 8 << 10
+
+// sniffFile identifies a file from its content.
+func sniffFile(path string) (fileKind, error) {
+        f, err := os.Open(path)
+        if err != nil {
+                return kindUnknown, err
+        }
+        defer f.Close()
+        head := make([]byte, sniffLen)
+        n, err := io.ReadFull(f, head)
+        if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+                return kindUnknown, err
+        }
+        head = head[:n]
+
+        switch {
+        case bytes.Contains(head[:min(len(head), 1024)], []byte("%PDF-")):
+                return kindPDF, nil
+        case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+                return kindJPEG, nil
+        case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+                return kindPNG, nil
+        case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+                return kindGIF, nil
+        case bytes.HasPrefix(head, []byte("BM")) && len(head) >= 26:
+                return kindBMP, nil
+        case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+                return kindTIFF, nil
+        case len(head) >= 12 && bytes.Equal(head[:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WEBP")):
+                return kindWEBP, nil
+        case bytes.HasPrefix(head, []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}):
+                return kindOLE, nil
+        case bytes.HasPrefix(head, []byte("{\\rtf")):
+                return kindRTF, nil
+        case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+                return sniffZip(path), nil
+        }
+
+        if bytes.IndexByte(head, 0) >= 0 || !utf8.Valid(trimPartialRune(head)) {
+                return kindUnknown, nil
+        }
+        text := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(string(head), "\ufeff")))
+        if strings.HasPrefix(text, "<!doctype html") || strings.HasPrefix(text, "<html") ||
+                (strings.HasPrefix(text, "<") && (strings.Contains(text, "<body") || strings.Contains(text, "<head"))) {
+                return kindHTML, nil
+        }
+        return kindText, nil
+}
+
+// trimPartialRune drops a UTF-8 sequence cut off by the sniff buffer.
+func trimPartialRune(b []byte) []byte {
+        for i := 0; i < utf8.UTFMax && i < len(b); i++ {
+                if utf8.RuneStart(b[len(b)-1-i]) {
+                        if !utf8.FullRune(b[len(b)-1-i:]) {
+                                return b[:len(b)-1-i]
+                        }
+                        break
+                }
+        }
+        return b
+}
+
+// sniffZip tells OOXML and OpenDocument files apart from plain archives.
+func sniffZip(path string) fileKind {
+        zr, err := zip.OpenReader(path)
+        if err != nil {
+                return kindUnknown
+        }
+        defer zr.Close()
+        for _, f := range zr.File {
+                switch {
+                case strings.HasPrefix(f.Name, "word/"):
+                        return kindDOCX
+                case strings.HasPrefix(f.Name, "xl/"):
+                        return kindXLSX
+                case strings.HasPrefix(f.Name, "ppt/"):
+                        return kindPPTX
+                case f.Name == "mimetype":
+                        rc, err := f.Open()
+                        if err != nil {
+                                continue
+                        }
+                        b, _ := io.ReadAll(io.LimitReader(rc, 128))
+                        rc.Close()
+                        switch mt := string(b); {
+                        case strings.HasSuffix(mt, "opendocument.text"):
+                                return kindODT
+                        case strings.HasSuffix(mt, "opendocument.spreadsheet"):
+                                return kindODS
+                        case strings.HasSuffix(mt, "opendocument.presentation"):
+                                return kindODP
+                        }
+                }
+        }
+        return kindZIP
+}
+
+// ----------------------------------------------------------------------------------
+// PDF checks
+// ----------------------------------------------------------------------------------
+
+// checkPDF reports an encrypted PDF (unless op handles encryption) or one
+// whose structure can't be parsed, even by rebuilding its cross-reference
+// table, as the error to return to the client. Files protected only by an
+// owner password (permissions) open without one, so the tools handle them and
+// they are let through.
+func checkPDF(ctx context.Context, op *Operation, f OpFile) error {
+        doc, err := openPDF(ctx, f.Path)
+        if err == nil {
+                defer doc.Close()
+        }
+        switch {
+        case errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission):
+                return err
+        case errors.Is(err, pdfdoc.ErrPasswordRequired),
+                err == nil && doc.Encryption() != nil && doc.Encryption().PasswordRequired:
+                if !op.AllowEncrypted {
+                        return &opError{status: http.StatusUnprocessableEntity, code: codeEncryptedPDF, param: f.Field,
+                                msg: fmt.Sprintf("%q is password-protected; unlock it first", f.Name)}
+                }
+        case err != nil:
+                if !op.AllowDamaged {
+                        return &opError{status: http.StatusUnprocessableEntity, code: codeCorruptPDF, param: f.Field,
+                                msg: fmt.Sprintf("%q is damaged or not a valid PDF; try the repair tool", f.Name), debug: err.Error()}
+                }
+        }
+        return nil
+}
+
+// ----------------------------------------------------------------------------------
+// Validation and routing
+// ----------------------------------------------------------------------------------
+
+var autoConvertDefault = config.AutoConvert
+
+func wantsAutoConvert(in *OpInput) bool {
+        if v := in.Param("autoConvert"); v != "" {
+                return v == "true" || v == "1"
+        }
+        return autoConvertDefault
+}
+
+// expectedInput describes what op wants uploaded, for error messages.
+func expectedInput(op *Operation) string {
+        switch op.InputExt {
+        case "", ".pdf":
+                return "a PDF"
+        case ".jpg", ".png", ".bmp":
+                return "an image"
+        case ".docx":
+                return "a Word document"
+        case ".xlsx":
+                return "a spreadsheet"
+        case ".pptx":
+                return "a presentation"
+        case ".html":
+                return "an HTML page"
+        case ".md":
+                return "a Markdown or text file"
+        }
+        return "a supported file"
+}
+
+// prepareInputs sniffs and validates the uploads in in.Files before op runs.
+// With auto-conversion, wrong-type uploads to a PDF tool are converted to PDF
+// in place, and a converter sent another convertible kind is swapped for the
+// right one. PDF inputs are then held to the request's page limit (see
+// limits.go). The operation to run is returned, op itself on error.
+func prepareInputs(ctx context.Context, op *Operation, in *OpInput) (*Operation, error) {
+        if op.ChecksInputs || len(in.Files) == 0 {
+                return op, nil
+        }
+        kinds := make([]fileKind, len(in.Files))
+        for i, f := range in.Files {
+                k, err := sniffFile(f.Path)
+                if err != nil {
+                        return op, err
+                }
+                kinds[i] = k
+        }
+        auto := wantsAutoConvert(in)
+
+        if auto && !acceptsKind(op, kinds[0]) && strings.HasSuffix(op.Name, "-to-pdf") {
+                if target, ok := lookupOperation(converterFor(kinds[0])); ok {
+                        if err := rerouteInputs(op, target, in, kinds); err != nil {
+                                return op, err
+                        }
+                        logger(ctx).Info("upload routed to converter", "component", "validate", "kind", string(kinds[0]), "from", op.Name, "to", target.Name)
+                        op = target
+                }
+        }
+
+        for i, f := range in.Files {
+                k := kinds[i]
+                if !acceptsKind(op, k) {
+                        conv := converterFor(k)
+                        if !auto || conv == "" || !acceptsKind(op, kindPDF) {
+                                return op, mismatchError(op, f, k)
+                        }
+                        converted, err := convertInput(ctx, op, conv, in, i, k)
+                        if err != nil {
+                                return op, err
+                        }
+                        in.Files[i] = converted
+                        continue
+                }
+                if k == kindPDF {
+                        if err := checkPDF(ctx, op, f); err != nil {
+                                return op, err
+                        }
+                }
+        }
+        if acceptsKind(op, kindPDF) {
+                if err := checkPageLimit(ctx, in.Files); err != nil {
+                        return op, err
+                }
+        }
+        return op, nil
+}
+
+func mismatchError(op *Operation, f OpFile, k fileKind) error {
+        msg := fmt.Sprintf("%q is %s, but %s expects %s", f.Name, fileKindInfo[k].desc, op.Name, expectedInput(op))
+        if conv := converterFor(k); conv != "" && acceptsKind(op, kindPDF) {
+                msg += fmt.Sprintf("; convert it with %s first or set autoConvert=true", conv)
+        }
+        return &opError{status: http.StatusUnsupportedMediaType, code: codeUnsupportedFormat, msg: msg, param: f.Field}
+}
+
+// sniffedName gives a client file name the extension of its actual kind, so
+// converters that go by the extension (LibreOffice) see the right one.
+func sniffedName(name string, k fileKind) string {
+        ext := fileKindInfo[k].ext
+        if ext == "" || strings.EqualFold(filepath.Ext(name), ext) {
+                return name
+        }
+        return strings.TrimSuffix(name, filepath.Ext(name)) + ext
+}
+
+// rerouteInputs renames the uploads in in.Dir to the names target expects.
+// Only target's first input field is fed, as for an ordinary request.
+func rerouteInputs(op, target *Operation, in *OpInput, kinds []fileKind) error {
+        files := in.Files
+        if !target.Multi {
+                files, kinds = files[:1], kinds[:1]
+        }
+        for i, f := range files {
+                dst := filepath.Join(in.Dir, operationInputName(target, sniffedName(f.Name, kinds[i]), i, len(files)))
+                if err := os.Rename(f.Path, dst); err != nil {
+                        return err
+                }
+                files[i].Path = dst
+                files[i].Field = target.Inputs[0]
+        }
+        in.Files = files
+        return nil
+}
+
+// convertInput runs the converter conv on the i-th upload in a subdirectory
+// of the job and returns the resulting PDF in place of the upload. op is the
+// operation the upload was sent to, named in the error when conv isn't
+// registered.
+func convertInput(ctx context.Context, op *Operation, conv string, in *OpInput, i int, k fileKind) (OpFile, error) {
+        f := in.Files[i]
+        convOp, ok := lookupOperation(conv)
+        if !ok {
+                return OpFile{}, mismatchError(op, f, k)
+        }
+        staged := f
+        staged.Name = sniffedName(f.Name, k)
+        convDir := filepath.Join(in.Dir, fmt.Sprintf("convert-%d", i))
+        convIn, err := stageOperationInput(convOp, in.JobID, convDir, []OpFile{staged}, map[string]string{})
+        if err != nil {
+                return OpFile{}, err
+        }
+        res, err := convOp.Run(ctx, convIn)
+        if err == nil && res.File == "" {
+                err = fmt.Errorf("%s returned no file", conv)
+        }
+        if err != nil {
+                status, resp := opErrorResponse(ctx, convOp, err)
+                resp.Error = fmt.Sprintf("converting %q to PDF failed: %s", f.Name, resp.Error)
+                resp.Param = f.Field
+                return OpFile{}, resp.asOpError(status)
+        }
+        logger(ctx).Info("converted upload", "component", "validate", "kind", string(k), "file", f.Name, "converter", conv)
+
+        out := OpFile{Path: filepath.Join(convDir, res.File), Name: f.Name, Field: f.Field}
+        if fi, err := os.Stat(out.Path); err == nil {
+                out.Size = fi.Size()
+        }
+        return out, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "errors"
+        "net/http"
+        "os"
+        "path/filepath"
+        "testing"
+)
+
+func TestWrongTypeUpload(t *testing.T) {
+        tests := []struct {
+                name string
+                data []byte
+        }{
+                {"photo.jpg", []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")},
+                {"image.pdf", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")},
+                {"notes.txt", []byte("just some text\n")},
+        }
+        h := serveOperation(operations["compress"])
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        rec := postFiles(t, h, "/api/pdf/compress", map[string][]byte{tt.name: tt.data}, nil)
+                        var resp apiError
+                        if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+                                t.Fatalf("response %q: %v", rec.Body, err)
+                        }
+                        if rec.Code != http.StatusUnsupportedMediaType || resp.Code != codeUnsupportedFormat || resp.Param != "file" {
+                                t.Errorf("got %d %+v, want 415 %s for file", rec.Code, resp, codeUnsupportedFormat)
+                        }
+                })
+        }
+}
+
+func TestConvertInputWithoutConverter(t *testing.T) {
+        dir := t.TempDir()
+        path := filepath.Join(dir, "photo.jpg")
+        if err := os.WriteFile(path, []byte("\xff\xd8\xff\xe0"), 0o644); err != nil {
+                t.Fatal(err)
+        }
+        in := &OpInput{Dir: dir, Files: []OpFile{{Path: path, Name: "photo.jpg", Field: "file"}}}
+        _, err := convertInput(context.Background(), operations["compress"], "no-such-converter", in, 0, kindJPEG)
+        var oe *opError
+        if !errors.As(err, &oe) || oe.status != http.StatusUnsupportedMediaType || oe.code != codeUnsupportedFormat {
+                t.Errorf("convertInput() error = %v, want UNSUPPORTED_FORMAT", err)
+        }
+}
@@ -208,12 +208,18 @@ export async function getSystemHealth(req: AdminRequest, res: Response) {
       dbStatus = "error";
     }
 
+    // /health/ready also checks the backend's external tools: it answers 503
+    // when a critical one is missing and lists endpoints that can't work.
     let goBackendStatus = "healthy";
+    let degradedEndpoints: { endpoint: string; missing: string[] }[] = [];
     try {
-      const response = await fetch("http://localhost:8080/health", { 
+      const response = await fetch("http://localhost:8080/health/ready", { 
         signal: AbortSignal.timeout(3000) 
       });
+      const ready = await response.json().catch(() => null);
+      degradedEndpoints = ready?.degraded || [];
       if (!response.ok) goBackendStatus = "error";
+      else if (ready?.status === "degraded") goBackendStatus = "degraded";
     } catch {
       goBackendStatus = "error";
     }
@@ -225,6 +231,7 @@ export async function getSystemHealth(req: AdminRequest, res: Response) {
         pdfBackend: goBackendStatus,
         server: "healthy",
       },
+      degradedEndpoints,
       timestamp: new Date().toISOString(),
     });
   } catch (error) {
@@ -3,6 +3,7 @@ import { db } from "./db";
 import { pdfUsage, users, pdfOperations } from "@shared/schema";
 import { eq, and, sql, desc, gte, count } from "drizzle-orm";
 import { verifyToken } from "./auth";
+import planLimits from "@shared/planLimits.json";
 
 async function checkUserActive(userId: string): Promise<{ isActive: boolean; plan: string; effectivePlan: string } | null> {
   const [user] = await db.select({ 
@@ -21,23 +22,21 @@ async function checkUserActive(userId: string): Promise<{ isActive: boolean; pla
   return { isActive: user.isActive, plan: user.plan, effectivePlan };
 }
 
-const LIMITS = {
-  anonymous: {
-    maxOpsPerDay: 10,
-    maxFileSizeMB: 7,
-    maxPages: 25,
-  },
-  free: {
-    maxOpsPerDay: 25,
-    maxFileSizeMB: 11,
-    maxPages: 40,
-  },
-  pro: {
-    maxOpsPerDay: Infinity,
-    maxFileSizeMB: Infinity,
-    maxPages: Infinity,
-  },
-};
+type PlanName = keyof typeof planLimits;
+type PlanLimits = { maxOpsPerDay: number; maxFileSizeMB: number; maxPages: number };
+
+// Plan limits are shared with the Go backend (shared/planLimits.json), where
+// null means unlimited.
+const LIMITS = Object.fromEntries(
+  Object.entries(planLimits).map(([plan, limits]) => [
+    plan,
+    {
+      maxOpsPerDay: limits.maxOpsPerDay ?? Infinity,
+      maxFileSizeMB: limits.maxFileSizeMB ?? Infinity,
+      maxPages: limits.maxPages ?? Infinity,
+    },
+  ]),
+) as Record<PlanName, PlanLimits>;
 
 interface PdfLimitsRequest extends Request {
   pdfUser?: {
@@ -129,6 +128,12 @@ export async function incrementUsage(userId: string | null, ipAddress: string):
 }
 
 export async function checkPdfLimits(req: PdfLimitsRequest, res: Response, next: NextFunction) {
+  // Polling or deleting an async job (/api/pdf/jobs/{id}) is not a new
+  // operation; the job was checked and counted when it was submitted.
+  if (req.path.startsWith("/jobs/")) {
+    return next();
+  }
+  
   try {
     const clientIp = getClientIp(req);
     req.clientIp = clientIp;
@@ -2,6 +2,7 @@ import type { Express, Request, Response, NextFunction } from "express";
 import { type Server } from "http";
 import { createProxyMiddleware } from "http-proxy-middleware";
 import { spawn, ChildProcess } from "child_process";
+import { randomUUID } from "crypto";
 import path from "path";
 import { register, login, getMe, changePassword, authMiddleware, getMyOperations, deleteAccount, forgotPassword, resetPassword } from "./auth";
 import { checkPdfLimits, incrementUsage, getPdfLimitsData, logOperation, getUserLimits } from "./pdfLimits";
@@ -31,17 +32,35 @@ export function setupPdfProxy(app: Express) {
       on: {
         proxyReq: (proxyReq, req) => {
           proxyReq.path = (req as any).originalUrl || req.url;
+          // Correlates the backend's logs for this request (see
+          // pdf-backend/logging.go); an ID from the client is kept.
+          const requestId = req.headers["x-request-id"];
+          proxyReq.setHeader("X-Request-ID", typeof requestId === "string" && requestId ? requestId : randomUUID());
+          // traceparent/tracestate pass through unchanged, so the backend's
+          // spans join the caller's trace (pdf-backend/tracing.go).
           const limitsData = getPdfLimitsData(req as Request);
           if (limitsData) {
-            proxyReq.setHeader("X-PDF-Max-Pages", String(limitsData.maxPages));
+            // Unlimited plans send no page limit; the backend applies the
+            // plan's limit from shared/planLimits.json.
+            if (Number.isFinite(limitsData.maxPages)) {
+              proxyReq.setHeader("X-PDF-Max-Pages", String(limitsData.maxPages));
+            }
             proxyReq.setHeader("X-PDF-User-Plan", limitsData.userPlan);
+          } else if ((req as any).userPlan === "pro") {
+            // Pro requests skip the limits path (no usage lookup, counting or
+            // logging), but the backend still needs the plan, or it would apply
+            // the anonymous limits from shared/planLimits.json.
+            proxyReq.setHeader("X-PDF-User-Plan", "pro");
           }
         },
         proxyRes: async (proxyRes, req) => {
           if (proxyRes.statusCode && proxyRes.statusCode >= 200 && proxyRes.statusCode < 300) {
             const limitsData = getPdfLimitsData(req as Request);
-            if (limitsData) {
-              const operation = ((req as any).originalUrl || req.url).replace("/api/pdf/", "").split("?")[0];
+            const operation = ((req as any).originalUrl || req.url).replace("/api/pdf/", "").split("?")[0];
+            // Resumable upload requests only transfer data, and job status
+            // polls and deletes follow a request that was already counted; the
+            // tool request is what counts as an operation.
+            if (limitsData && !operation.startsWith("uploads") && !operation.startsWith("jobs/")) {
               const contentLength = parseInt(req.headers["content-length"] || "0", 10);
               const pdfUser = (req as any).pdfUser;
               